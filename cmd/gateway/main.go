@@ -25,46 +25,48 @@ func main() {
 	}
 	defer func() { _ = shutdownTracer(ctx) }()
 
+	shutdownMeter, err := telemetry.InitMeterProvider(ctx, "gateway", "0.1.0")
+	if err != nil {
+		logger.Error("failed to initialize meter", "error", err)
+		os.Exit(1)
+	}
+	defer func() { _ = shutdownMeter(ctx) }()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	ordersServiceURL := os.Getenv("ORDERS_SERVICE_URL")
-	if ordersServiceURL == "" {
-		logger.Error("ORDERS_SERVICE_URL is required")
-		os.Exit(1)
-	}
-
-	inventoryServiceURL := os.Getenv("INVENTORY_SERVICE_URL")
-	if inventoryServiceURL == "" {
-		logger.Error("INVENTORY_SERVICE_URL is required")
-		os.Exit(1)
+	configPath := os.Getenv("GATEWAY_CONFIG")
+	if configPath == "" {
+		configPath = "config/gateway.yaml"
 	}
 
+	// Each route sets its own upstream timeout.
 	httpClient := &http.Client{
-		Timeout:   10 * time.Second,
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		Transport: gateway.NewTransport(http.DefaultTransport),
 	}
 
-	ordersProxy := gateway.NewServiceProxy(ordersServiceURL, httpClient)
-	inventoryProxy := gateway.NewServiceProxy(inventoryServiceURL, httpClient)
-	handler := gateway.NewHandler(ordersProxy, inventoryProxy, logger)
+	router := gateway.NewRouter(configPath, httpClient, logger)
+	if err := router.Load(); err != nil {
+		logger.Error("failed to load routes", "error", err)
+		os.Exit(1)
+	}
+	defer router.Close()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /orders", telemetry.WithHTTPRoute(handler.HandleOrders))
-	mux.HandleFunc("GET /orders-nplus1", telemetry.WithHTTPRoute(handler.HandleOrders))
-	mux.HandleFunc("POST /orders", telemetry.WithHTTPRoute(handler.HandleOrders))
-	mux.HandleFunc("GET /orders/{id}", telemetry.WithHTTPRoute(handler.HandleOrders))
-	mux.HandleFunc("PATCH /orders/{id}/status", telemetry.WithHTTPRoute(handler.HandleOrders))
-	mux.HandleFunc("GET /inventory/stock", telemetry.WithHTTPRoute(handler.HandleInventory))
-	mux.HandleFunc("GET /inventory/stock/{itemId}", telemetry.WithHTTPRoute(handler.HandleInventory))
-	mux.HandleFunc("POST /inventory/stock/{itemId}/reserve", telemetry.WithHTTPRoute(handler.HandleInventory))
-	mux.HandleFunc("POST /inventory/stock/{itemId}/release", telemetry.WithHTTPRoute(handler.HandleInventory))
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := router.Load(); err != nil {
+				logger.Error("failed to reload routes, keeping current routes", "error", err)
+			}
+		}
+	}()
 
 	server := &http.Server{
 		Addr: ":" + port,
-		Handler: otelhttp.NewHandler(mux, "gateway",
+		Handler: otelhttp.NewHandler(router, "gateway",
 			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
 				if r.Pattern != "" {
 					return r.Pattern
@@ -6,13 +6,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/inventory"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/telemetry"
 )
 
@@ -50,14 +54,84 @@ func main() {
 		os.Exit(1)
 	}
 
-	repo := inventory.NewInventoryRepository(db)
+	reservationTTL, err := durationEnv("RESERVATION_TTL", 15*time.Minute)
+	if err != nil {
+		logger.Error("invalid RESERVATION_TTL", "error", err)
+		os.Exit(1)
+	}
+
+	sweepInterval, err := durationEnv("RESERVATION_SWEEP_INTERVAL", 30*time.Second)
+	if err != nil || sweepInterval <= 0 {
+		logger.Error("invalid RESERVATION_SWEEP_INTERVAL", "error", err, "value", sweepInterval)
+		os.Exit(1)
+	}
+
+	sweepBatchSize := 100
+	if v := os.Getenv("RESERVATION_SWEEP_BATCH_SIZE"); v != "" {
+		sweepBatchSize, err = strconv.Atoi(v)
+		if err != nil || sweepBatchSize <= 0 {
+			logger.Error("invalid RESERVATION_SWEEP_BATCH_SIZE", "value", v)
+			os.Exit(1)
+		}
+	}
+
+	outboxInterval, err := durationEnv("OUTBOX_RELAY_INTERVAL", time.Second)
+	if err != nil || outboxInterval <= 0 {
+		logger.Error("invalid OUTBOX_RELAY_INTERVAL", "error", err, "value", outboxInterval)
+		os.Exit(1)
+	}
+
+	var producer *messaging.Producer
+	kafkaBrokers := os.Getenv("KAFKA_BROKERS")
+	if kafkaBrokers != "" {
+		brokers := strings.Split(kafkaBrokers, ",")
+		producer = messaging.NewProducer(brokers, domain.TopicStockReservationExpired)
+		defer func() { _ = producer.Close() }()
+	}
+
+	repoOpts := []inventory.RepositoryOption{inventory.WithReservationTTL(reservationTTL)}
+	if defaultLocation := os.Getenv("DEFAULT_LOCATION"); defaultLocation != "" {
+		repoOpts = append(repoOpts, inventory.WithDefaultLocation(defaultLocation))
+	}
+
+	repo := inventory.NewInventoryRepository(db, repoOpts...)
 	handler := inventory.NewHandler(repo, logger)
 
+	backgroundCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	sweeper := inventory.NewSweeper(repo, sweepInterval, sweepBatchSize, logger)
+	go sweeper.Run(backgroundCtx)
+
+	if producer != nil {
+		relay := messaging.NewOutboxRelay(db, producer, outboxInterval, outboxRelayBatchSize, logger)
+		go relay.Run(backgroundCtx)
+	} else {
+		logger.Warn("KAFKA_BROKERS not set, outbox events will not be published")
+	}
+
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", handler.HandleHealth)
 	mux.HandleFunc("GET /stock", telemetry.WithHTTPRoute(handler.HandleListStock))
 	mux.HandleFunc("GET /stock/{itemId}", telemetry.WithHTTPRoute(handler.HandleGetStock))
 	mux.HandleFunc("POST /stock/{itemId}/reserve", telemetry.WithHTTPRoute(handler.HandleReserve))
 	mux.HandleFunc("POST /stock/{itemId}/release", telemetry.WithHTTPRoute(handler.HandleRelease))
+	mux.HandleFunc("POST /stock/{itemId}/restock", telemetry.WithHTTPRoute(handler.HandleRestock))
+	mux.HandleFunc("POST /stock/{itemId}/adjust", telemetry.WithHTTPRoute(handler.HandleAdjust))
+	mux.HandleFunc("GET /stock/{itemId}/locations", telemetry.WithHTTPRoute(handler.HandleListItemLocations))
+	mux.HandleFunc("GET /stock/{itemId}/movements", telemetry.WithHTTPRoute(handler.HandleListMovements))
+	mux.HandleFunc("GET /stock/reconciliation", telemetry.WithHTTPRoute(handler.HandleReconcile))
+	mux.HandleFunc("POST /items", telemetry.WithHTTPRoute(handler.HandleCreateItem))
+	mux.HandleFunc("PATCH /items/{itemId}", telemetry.WithHTTPRoute(handler.HandleUpdateItem))
+	mux.HandleFunc("GET /locations", telemetry.WithHTTPRoute(handler.HandleListLocations))
+	mux.HandleFunc("GET /locations/{locationId}/stock", telemetry.WithHTTPRoute(handler.HandleListLocationStock))
+	mux.HandleFunc("GET /backorders", telemetry.WithHTTPRoute(handler.HandleListBackorders))
+	mux.HandleFunc("POST /backorders", telemetry.WithHTTPRoute(handler.HandleCreateBackorder))
+	mux.HandleFunc("POST /backorders/{orderId}/cancel", telemetry.WithHTTPRoute(handler.HandleCancelBackorder))
+	mux.HandleFunc("POST /returns", telemetry.WithHTTPRoute(handler.HandleReceiveReturn))
+	mux.HandleFunc("GET /reservations", telemetry.WithHTTPRoute(handler.HandleListReservations))
+	mux.HandleFunc("POST /reservations", telemetry.WithHTTPRoute(handler.HandleCreateReservation))
+	mux.HandleFunc("POST /reservations/{orderId}/confirm", telemetry.WithHTTPRoute(handler.HandleConfirmReservations))
+	mux.HandleFunc("POST /reservations/{orderId}/commit", telemetry.WithHTTPRoute(handler.HandleCommitReservations))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -67,6 +141,7 @@ func main() {
 	server := &http.Server{
 		Addr: ":" + port,
 		Handler: otelhttp.NewHandler(mux, "inventory",
+			otelhttp.WithFilter(telemetry.NotHealthCheck),
 			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
 				if r.Pattern != "" {
 					return r.Pattern
@@ -91,6 +166,7 @@ func main() {
 	<-stop
 
 	logger.Info("shutting down")
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -99,3 +175,13 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+const outboxRelayBatchSize = 100
+
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(v)
+}
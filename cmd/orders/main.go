@@ -13,6 +13,7 @@ import (
 	_ "github.com/lib/pq"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/orders"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/telemetry"
@@ -52,23 +53,64 @@ func main() {
 		os.Exit(1)
 	}
 
+	outboxInterval, err := durationEnv("OUTBOX_RELAY_INTERVAL", time.Second)
+	if err != nil || outboxInterval <= 0 {
+		logger.Error("invalid OUTBOX_RELAY_INTERVAL", "error", err, "value", outboxInterval)
+		os.Exit(1)
+	}
+
 	var producer *messaging.Producer
 	kafkaBrokers := os.Getenv("KAFKA_BROKERS")
 	if kafkaBrokers != "" {
 		brokers := strings.Split(kafkaBrokers, ",")
-		producer = messaging.NewProducer(brokers, "order.created")
+		producer = messaging.NewProducer(brokers, domain.TopicOrderCreated)
 		defer func() { _ = producer.Close() }()
 	}
 
 	repo := orders.NewOrderRepository(db)
 	handler := orders.NewHandler(repo, producer, logger)
 
+	notifier, err := orders.NewStatusNotifier(postgresURL, logger)
+	if err != nil {
+		logger.Error("failed to listen for status changes", "error", err)
+		os.Exit(1)
+	}
+	defer func() { _ = notifier.Close() }()
+
+	backgroundCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	go notifier.Run(backgroundCtx)
+	handler.SetStatusNotifier(notifier)
+
+	if producer != nil {
+		relay := messaging.NewOutboxRelay(db, producer, outboxInterval, outboxRelayBatchSize, logger)
+		go relay.Run(backgroundCtx)
+	} else {
+		logger.Warn("KAFKA_BROKERS not set, outbox events will not be published")
+	}
+
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", handler.HandleHealth)
 	mux.HandleFunc("GET /orders", telemetry.WithHTTPRoute(handler.HandleList))
 	mux.HandleFunc("GET /orders-nplus1", telemetry.WithHTTPRoute(handler.HandleListNPlus1))
 	mux.HandleFunc("POST /orders", telemetry.WithHTTPRoute(handler.HandleCreate))
 	mux.HandleFunc("GET /orders/{id}", telemetry.WithHTTPRoute(handler.HandleGet))
 	mux.HandleFunc("PATCH /orders/{id}/status", telemetry.WithHTTPRoute(handler.HandleUpdateStatus))
+	mux.HandleFunc("POST /orders/{id}/cancel", telemetry.WithHTTPRoute(handler.HandleCancel))
+	mux.HandleFunc("GET /orders/{id}/history", telemetry.WithHTTPRoute(handler.HandleHistory))
+	mux.HandleFunc("GET /orders/{id}/events", telemetry.WithHTTPRoute(handler.HandleEvents))
+	mux.HandleFunc("GET /orders/{id}/shipments", telemetry.WithHTTPRoute(handler.HandleListShipments))
+	mux.HandleFunc("POST /orders/{id}/shipments", telemetry.WithHTTPRoute(handler.HandleCreateShipment))
+	mux.HandleFunc("GET /orders/{id}/returns", telemetry.WithHTTPRoute(handler.HandleListReturns))
+	mux.HandleFunc("POST /orders/{id}/returns", telemetry.WithHTTPRoute(handler.HandleCreateReturn))
+	mux.HandleFunc("POST /orders/{id}/returns/{returnId}/receive", telemetry.WithHTTPRoute(handler.HandleReceiveReturn))
+	mux.HandleFunc("POST /orders/{id}/returns/{returnId}/refund", telemetry.WithHTTPRoute(handler.HandleRefundReturn))
+	mux.HandleFunc("GET /customers/{customerId}/orders", telemetry.WithHTTPRoute(handler.HandleListByCustomer))
+	mux.HandleFunc("GET /customers/{customerId}/summary", telemetry.WithHTTPRoute(handler.HandleCustomerSummary))
+	mux.HandleFunc("POST /promo-codes", telemetry.WithHTTPRoute(handler.HandleCreatePromoCode))
+	mux.HandleFunc("GET /promo-codes/{code}", telemetry.WithHTTPRoute(handler.HandleGetPromoCode))
+	mux.HandleFunc("GET /pricing/regions", telemetry.WithHTTPRoute(handler.HandleListPricingRegions))
+	mux.HandleFunc("PUT /pricing/regions/{region}", telemetry.WithHTTPRoute(handler.HandleSavePricingRegion))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -78,6 +120,7 @@ func main() {
 	server := &http.Server{
 		Addr: ":" + port,
 		Handler: otelhttp.NewHandler(mux, "orders",
+			otelhttp.WithFilter(telemetry.NotHealthCheck),
 			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
 				if r.Pattern != "" {
 					return r.Pattern
@@ -102,6 +145,7 @@ func main() {
 	<-stop
 
 	logger.Info("shutting down")
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -110,3 +154,13 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+const outboxRelayBatchSize = 100
+
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(v)
+}
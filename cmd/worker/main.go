@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/telemetry"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/worker"
@@ -53,15 +56,33 @@ func main() {
 	}
 
 	brokers := strings.Split(kafkaBrokers, ",")
-	consumer := messaging.NewConsumer(brokers, "order.created", "notification-worker")
-	defer func() { _ = consumer.Close() }()
 
 	httpClient := &http.Client{
 		Timeout:   10 * time.Second,
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
 	}
 
-	notificationHandler := worker.NewNotificationHandler(emailServiceURL, ordersServiceURL, inventoryServiceURL, httpClient, logger)
+	var handlerOpts []worker.NotificationOption
+	if alertEmail := os.Getenv("ALERT_EMAIL"); alertEmail != "" {
+		handlerOpts = append(handlerOpts, worker.WithAlertRecipient(alertEmail))
+	}
+
+	notificationHandler := worker.NewNotificationHandler(emailServiceURL, ordersServiceURL, inventoryServiceURL, httpClient, logger, handlerOpts...)
+
+	subscriptions := []struct {
+		topic   string
+		handler func(ctx context.Context, payload []byte) error
+	}{
+		{domain.TopicOrderCreated, notificationHandler.Handle},
+		{domain.TopicOrderCancelled, notificationHandler.HandleOrderCancelled},
+		{domain.TopicOrderShipped, notificationHandler.HandleOrderShipped},
+		{domain.TopicOrderReturnRequested, notificationHandler.HandleReturnRequested},
+		{domain.TopicOrderReturnReceived, notificationHandler.HandleReturnReceived},
+		{domain.TopicOrderReturnRefunded, notificationHandler.HandleReturnRefunded},
+		{domain.TopicStockLow, notificationHandler.HandleStockLow},
+		{domain.TopicStockBackorderFilled, notificationHandler.HandleBackorderFilled},
+		{domain.TopicStockReturnRestocked, notificationHandler.HandleReturnRestocked},
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -76,12 +97,27 @@ func main() {
 
 	logger.Info("starting notification worker", "brokers", brokers)
 
-	if err := consumer.Consume(ctx, notificationHandler.Handle); err != nil {
-		if ctx.Err() == context.Canceled {
-			logger.Info("consumer stopped")
-			return
-		}
+	errs := make(chan error, len(subscriptions))
+	var wg sync.WaitGroup
+	for _, sub := range subscriptions {
+		consumer := messaging.NewConsumer(brokers, sub.topic, "notification-worker")
+		defer func() { _ = consumer.Close() }()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := consumer.Consume(ctx, sub.handler); err != nil && ctx.Err() == nil {
+				errs <- fmt.Errorf("consume %s: %w", sub.topic, err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
 		logger.Error("consumer error", "error", err)
 		os.Exit(1)
 	}
+	logger.Info("consumer stopped")
 }
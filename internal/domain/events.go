@@ -1,10 +1,132 @@
 package domain
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	TopicOrderCreated            = "order.created"
+	TopicOrderCancelled          = "order.cancelled"
+	TopicOrderShipped            = "order.shipped"
+	TopicOrderReturnRequested    = "order.return_requested"
+	TopicOrderReturnReceived     = "order.return_received"
+	TopicOrderReturnRefunded     = "order.return_refunded"
+	TopicStockReservationExpired = "stock.reservation_expired"
+	TopicStockLow                = "stock.low"
+	TopicStockBackorderFilled    = "stock.backorder_filled"
+	TopicStockReturnRestocked    = "stock.return_restocked"
+)
 
 type OrderCreatedEvent struct {
-	OrderID    string      `json:"order_id"`
-	CustomerID string      `json:"customer_id"`
-	Items      []OrderItem `json:"items"`
-	Timestamp  time.Time   `json:"timestamp"`
+	OrderID        string      `json:"order_id"`
+	CustomerID     string      `json:"customer_id"`
+	Items          []OrderItem `json:"items"`
+	AllowBackorder bool        `json:"allow_backorder,omitempty"`
+	Timestamp      time.Time   `json:"timestamp"`
+}
+
+type OrderCancelledEvent struct {
+	OrderID        string      `json:"order_id"`
+	CustomerID     string      `json:"customer_id"`
+	Items          []OrderItem `json:"items"`
+	PreviousStatus OrderStatus `json:"previous_status"`
+	Reason         string      `json:"reason,omitempty"`
+	Timestamp      time.Time   `json:"timestamp"`
+}
+
+// OrderShippedEvent is published when the last line of an order ships. It
+// lists every shipment the order went out in.
+type OrderShippedEvent struct {
+	OrderID    string     `json:"order_id"`
+	CustomerID string     `json:"customer_id"`
+	Shipments  []Shipment `json:"shipments"`
+	Timestamp  time.Time  `json:"timestamp"`
+}
+
+// ReturnEvent is published by the orders service at each step of a return.
+// Status tells which step was reached.
+type ReturnEvent struct {
+	ReturnID     string       `json:"return_id"`
+	OrderID      string       `json:"order_id"`
+	CustomerID   string       `json:"customer_id"`
+	Status       ReturnStatus `json:"status"`
+	Items        []ReturnItem `json:"items"`
+	RefundAmount Money        `json:"refund_amount"`
+	Timestamp    time.Time    `json:"timestamp"`
+}
+
+// returnEventFields has the fields of ReturnEvent without its JSON methods.
+type returnEventFields ReturnEvent
+
+// MarshalJSON keeps refund_amount the bare number consumers read before
+// currencies existed, and leaves it out until the return is refunded.
+func (e ReturnEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		returnEventFields
+		RefundAmount int64  `json:"refund_amount,omitempty"`
+		Currency     string `json:"currency,omitempty"`
+	}{
+		returnEventFields: returnEventFields(e),
+		RefundAmount:      e.RefundAmount.Amount,
+		Currency:          e.RefundAmount.Currency,
+	})
+}
+
+// UnmarshalJSON reads events without a currency as refunded in
+// DefaultCurrency.
+func (e *ReturnEvent) UnmarshalJSON(data []byte) error {
+	v := struct {
+		*returnEventFields
+		RefundAmount int64  `json:"refund_amount"`
+		Currency     string `json:"currency"`
+	}{returnEventFields: (*returnEventFields)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Currency == "" {
+		v.Currency = DefaultCurrency
+	}
+	e.RefundAmount = NewMoney(v.RefundAmount, v.Currency)
+	return nil
+}
+
+type ReservationExpiredEvent struct {
+	OrderID    string    `json:"order_id"`
+	ItemID     string    `json:"item_id"`
+	LocationID string    `json:"location_id"`
+	Quantity   int       `json:"quantity"`
+	ReservedAt time.Time `json:"reserved_at"`
+	ExpiredAt  time.Time `json:"expired_at"`
+}
+
+// StockLowEvent is published when an item's available stock drops below its
+// reorder threshold.
+type StockLowEvent struct {
+	ItemID           string    `json:"item_id"`
+	Name             string    `json:"name"`
+	Available        int       `json:"available"`
+	ReorderThreshold int       `json:"reorder_threshold"`
+	Reason           string    `json:"reason"`
+	OrderID          string    `json:"order_id,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+// BackorderFilledEvent is published when restocked inventory reserves every
+// item of a backordered order.
+type BackorderFilledEvent struct {
+	OrderID    string            `json:"order_id"`
+	CustomerID string            `json:"customer_id"`
+	Items      []ReservationItem `json:"items"`
+	FilledAt   time.Time         `json:"filled_at"`
+}
+
+// ReturnRestockedEvent is published when the items of a received return are
+// back in stock.
+type ReturnRestockedEvent struct {
+	ReturnID   string       `json:"return_id"`
+	OrderID    string       `json:"order_id"`
+	LocationID string       `json:"location_id"`
+	Items      []ReturnItem `json:"items"`
+	Timestamp  time.Time    `json:"timestamp"`
 }
@@ -1,7 +1,81 @@
 package domain
 
+import "time"
+
+type Item struct {
+	ItemID           string `json:"item_id"`
+	Name             string `json:"name"`
+	ReorderThreshold int    `json:"reorder_threshold"`
+}
+
 type StockLevel struct {
 	ItemID    string `json:"item_id"`
 	Available int    `json:"available"`
 	Reserved  int    `json:"reserved"`
 }
+
+type Location struct {
+	LocationID string `json:"location_id"`
+	Name       string `json:"name"`
+	Priority   int    `json:"priority"`
+}
+
+type LocationStockLevel struct {
+	ItemID     string `json:"item_id"`
+	LocationID string `json:"location_id"`
+	Available  int    `json:"available"`
+	Reserved   int    `json:"reserved"`
+}
+
+type Reservation struct {
+	OrderID    string     `json:"order_id"`
+	ItemID     string     `json:"item_id"`
+	LocationID string     `json:"location_id"`
+	Quantity   int        `json:"quantity"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+type ReservationItem struct {
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+type Backorder struct {
+	OrderID    string            `json:"order_id"`
+	CustomerID string            `json:"customer_id"`
+	Items      []ReservationItem `json:"items"`
+	Status     string            `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FilledAt   *time.Time        `json:"filled_at,omitempty"`
+}
+
+type StockShortfall struct {
+	ItemID    string `json:"item_id"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+type StockMovement struct {
+	ID             int64     `json:"id"`
+	ItemID         string    `json:"item_id"`
+	LocationID     string    `json:"location_id"`
+	AvailableDelta int       `json:"available_delta"`
+	ReservedDelta  int       `json:"reserved_delta"`
+	Reason         string    `json:"reason"`
+	OrderID        string    `json:"order_id,omitempty"`
+	Actor          string    `json:"actor"`
+	TraceID        string    `json:"trace_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// StockDiscrepancy reports counters that disagree with the ledger. LocationID
+// is empty when the item's aggregate counters are off.
+type StockDiscrepancy struct {
+	ItemID          string `json:"item_id"`
+	LocationID      string `json:"location_id,omitempty"`
+	Available       int    `json:"available"`
+	Reserved        int    `json:"reserved"`
+	LedgerAvailable int    `json:"ledger_available"`
+	LedgerReserved  int    `json:"ledger_reserved"`
+}
@@ -0,0 +1,133 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// DefaultCurrency is assumed for amounts sent without a currency, which is
+// how every client priced orders before currencies were tracked.
+const DefaultCurrency = "USD"
+
+var (
+	ErrMoneyOverflow    = errors.New("money amount overflows")
+	ErrCurrencyMismatch = errors.New("currencies do not match")
+	ErrInvalidCurrency  = errors.New("invalid currency code")
+	ErrMixedCurrencies  = errors.New("order items use more than one currency")
+	ErrNegativeQuantity = errors.New("quantity must not be negative")
+)
+
+// Money is an amount in the minor unit of its currency, e.g. cents for USD.
+// Currency is an ISO 4217 code.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// ValidateCurrency reports whether code looks like an ISO 4217 code: three
+// upper-case letters.
+func ValidateCurrency(code string) error {
+	if len(code) != 3 {
+		return fmt.Errorf("%w: %q", ErrInvalidCurrency, code)
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("%w: %q", ErrInvalidCurrency, code)
+		}
+	}
+	return nil
+}
+
+// Add returns m + other. Both must share a currency.
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	if (other.Amount > 0 && m.Amount > math.MaxInt64-other.Amount) ||
+		(other.Amount < 0 && m.Amount < math.MinInt64-other.Amount) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m - other. Both must share a currency.
+func (m Money) Sub(other Money) (Money, error) {
+	if other.Amount == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Percent returns basisPoints hundredths of a percent of m, rounded half away
+// from zero to the minor unit. 2500 basis points are a quarter of m.
+func (m Money) Percent(basisPoints int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(basisPoints))
+	quotient, remainder := new(big.Int).QuoRem(product, big.NewInt(10000), new(big.Int))
+	if new(big.Int).Abs(remainder).Cmp(big.NewInt(5000)) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(product.Sign())))
+	}
+	if !quotient.IsInt64() {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: quotient.Int64(), Currency: m.Currency}, nil
+}
+
+// Mul returns m multiplied by quantity, which must not be negative.
+func (m Money) Mul(quantity int) (Money, error) {
+	if quantity < 0 {
+		return Money{}, ErrNegativeQuantity
+	}
+	q := int64(quantity)
+	if q != 0 && (m.Amount > math.MaxInt64/q || m.Amount < math.MinInt64/q) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: m.Amount * q, Currency: m.Currency}, nil
+}
+
+// String formats m with two decimal places, which fits the currencies this
+// demo deals in.
+func (m Money) String() string {
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+	}
+	units, cents := amount/100, amount%100
+	if units < 0 {
+		units = -units
+	}
+	if cents < 0 {
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, units, cents, m.Currency)
+}
+
+// OrderTotal prices items, which must all share one currency, and returns
+// their total. An order without items costs nothing in DefaultCurrency.
+func OrderTotal(items []OrderItem) (Money, error) {
+	if len(items) == 0 {
+		return NewMoney(0, DefaultCurrency), nil
+	}
+
+	total := NewMoney(0, items[0].Price.Currency)
+	for _, item := range items {
+		if item.Price.Currency != total.Currency {
+			return Money{}, ErrMixedCurrencies
+		}
+		line, err := item.Price.Mul(item.Quantity)
+		if err != nil {
+			return Money{}, fmt.Errorf("item %s: %w", item.ItemID, err)
+		}
+		total, err = total.Add(line)
+		if err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,328 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMoney_Add(t *testing.T) {
+	t.Run("adds amounts in the same currency", func(t *testing.T) {
+		sum, err := NewMoney(150, "USD").Add(NewMoney(250, "USD"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if sum != NewMoney(400, "USD") {
+			t.Errorf("expected 400 USD, got %s", sum)
+		}
+	})
+
+	t.Run("rejects different currencies", func(t *testing.T) {
+		_, err := NewMoney(150, "USD").Add(NewMoney(250, "EUR"))
+		if !errors.Is(err, ErrCurrencyMismatch) {
+			t.Errorf("expected ErrCurrencyMismatch, got %v", err)
+		}
+	})
+
+	t.Run("detects overflow", func(t *testing.T) {
+		_, err := NewMoney(math.MaxInt64, "USD").Add(NewMoney(1, "USD"))
+		if !errors.Is(err, ErrMoneyOverflow) {
+			t.Errorf("expected ErrMoneyOverflow, got %v", err)
+		}
+	})
+
+	t.Run("detects underflow", func(t *testing.T) {
+		_, err := NewMoney(math.MinInt64, "USD").Add(NewMoney(-1, "USD"))
+		if !errors.Is(err, ErrMoneyOverflow) {
+			t.Errorf("expected ErrMoneyOverflow, got %v", err)
+		}
+	})
+}
+
+func TestMoney_Mul(t *testing.T) {
+	t.Run("multiplies by a quantity", func(t *testing.T) {
+		product, err := NewMoney(2999, "USD").Mul(3)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if product != NewMoney(8997, "USD") {
+			t.Errorf("expected 8997 USD, got %s", product)
+		}
+	})
+
+	t.Run("detects overflow", func(t *testing.T) {
+		_, err := NewMoney(math.MaxInt64/2+1, "USD").Mul(2)
+		if !errors.Is(err, ErrMoneyOverflow) {
+			t.Errorf("expected ErrMoneyOverflow, got %v", err)
+		}
+	})
+
+	t.Run("rejects negative quantities", func(t *testing.T) {
+		_, err := NewMoney(100, "USD").Mul(-1)
+		if !errors.Is(err, ErrNegativeQuantity) {
+			t.Errorf("expected ErrNegativeQuantity, got %v", err)
+		}
+	})
+}
+
+func TestMoney_Sub(t *testing.T) {
+	t.Run("subtracts amounts in the same currency", func(t *testing.T) {
+		diff, err := NewMoney(1000, "USD").Sub(NewMoney(250, "USD"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff != NewMoney(750, "USD") {
+			t.Errorf("expected 750 USD, got %s", diff)
+		}
+	})
+
+	t.Run("detects overflow", func(t *testing.T) {
+		_, err := NewMoney(0, "USD").Sub(NewMoney(math.MinInt64, "USD"))
+		if !errors.Is(err, ErrMoneyOverflow) {
+			t.Errorf("expected ErrMoneyOverflow, got %v", err)
+		}
+	})
+}
+
+func TestMoney_Percent(t *testing.T) {
+	tests := []struct {
+		money       Money
+		basisPoints int64
+		want        Money
+	}{
+		{NewMoney(10000, "USD"), 725, NewMoney(725, "USD")},
+		{NewMoney(999, "USD"), 1000, NewMoney(100, "USD")},
+		{NewMoney(994, "USD"), 1000, NewMoney(99, "USD")},
+		{NewMoney(-995, "USD"), 1000, NewMoney(-100, "USD")},
+	}
+	for _, tt := range tests {
+		got, err := tt.money.Percent(tt.basisPoints)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("%d basis points of %s: expected %s, got %s", tt.basisPoints, tt.money, tt.want, got)
+		}
+	}
+
+	if _, err := NewMoney(math.MaxInt64, "USD").Percent(20000); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("expected ErrMoneyOverflow, got %v", err)
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := map[Money]string{
+		NewMoney(2999, "USD"):  "29.99 USD",
+		NewMoney(5, "EUR"):     "0.05 EUR",
+		NewMoney(-1050, "GBP"): "-10.50 GBP",
+	}
+	for money, want := range tests {
+		if got := money.String(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestValidateCurrency(t *testing.T) {
+	for _, code := range []string{"USD", "EUR", "JPY"} {
+		if err := ValidateCurrency(code); err != nil {
+			t.Errorf("expected %s to be valid, got %v", code, err)
+		}
+	}
+	for _, code := range []string{"", "usd", "US", "EURO", "U$D"} {
+		if err := ValidateCurrency(code); !errors.Is(err, ErrInvalidCurrency) {
+			t.Errorf("expected %q to be rejected, got %v", code, err)
+		}
+	}
+}
+
+func TestOrderTotal(t *testing.T) {
+	t.Run("sums line totals", func(t *testing.T) {
+		total, err := OrderTotal([]OrderItem{
+			{ItemID: "A", Quantity: 2, Price: NewMoney(1000, "EUR")},
+			{ItemID: "B", Quantity: 1, Price: NewMoney(499, "EUR")},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total != NewMoney(2499, "EUR") {
+			t.Errorf("expected 2499 EUR, got %s", total)
+		}
+	})
+
+	t.Run("rejects mixed currencies", func(t *testing.T) {
+		_, err := OrderTotal([]OrderItem{
+			{ItemID: "A", Quantity: 1, Price: NewMoney(1000, "EUR")},
+			{ItemID: "B", Quantity: 1, Price: NewMoney(1000, "USD")},
+		})
+		if !errors.Is(err, ErrMixedCurrencies) {
+			t.Errorf("expected ErrMixedCurrencies, got %v", err)
+		}
+	})
+
+	t.Run("detects overflow across lines", func(t *testing.T) {
+		_, err := OrderTotal([]OrderItem{
+			{ItemID: "A", Quantity: 1, Price: NewMoney(math.MaxInt64, "USD")},
+			{ItemID: "B", Quantity: 1, Price: NewMoney(1, "USD")},
+		})
+		if !errors.Is(err, ErrMoneyOverflow) {
+			t.Errorf("expected ErrMoneyOverflow, got %v", err)
+		}
+	})
+}
+
+func TestOrderJSON(t *testing.T) {
+	t.Run("reads orders written before currencies", func(t *testing.T) {
+		var order Order
+		err := json.Unmarshal([]byte(`{"id":"1","total":2000,"items":[{"item_id":"A","quantity":2,"price":1000}]}`), &order)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if order.Total != NewMoney(2000, DefaultCurrency) {
+			t.Errorf("expected total 2000 %s, got %s", DefaultCurrency, order.Total)
+		}
+		if order.Items[0].Price != NewMoney(1000, DefaultCurrency) {
+			t.Errorf("expected price 1000 %s, got %s", DefaultCurrency, order.Items[0].Price)
+		}
+	})
+
+	t.Run("writes amounts as plain numbers next to the currency", func(t *testing.T) {
+		data, err := json.Marshal(Order{
+			ID:            "1",
+			Items:         []OrderItem{{ItemID: "A", Quantity: 1, Price: NewMoney(1000, "EUR")}},
+			Total:         NewMoney(1000, "EUR"),
+			RefundedTotal: NewMoney(250, "EUR"),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var raw struct {
+			Total         json.Number `json:"total"`
+			RefundedTotal json.Number `json:"refunded_total"`
+			Currency      string      `json:"currency"`
+			Items         []struct {
+				Price    json.Number `json:"price"`
+				Currency string      `json:"currency"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if raw.Total != "1000" || raw.RefundedTotal != "250" || raw.Currency != "EUR" {
+			t.Errorf("unexpected totals: %s", data)
+		}
+		if len(raw.Items) != 1 || raw.Items[0].Price != "1000" || raw.Items[0].Currency != "EUR" {
+			t.Errorf("unexpected items: %s", data)
+		}
+	})
+}
+
+func TestCustomerSummaryJSON(t *testing.T) {
+	data, err := json.Marshal(CustomerSummary{
+		CustomerID:    "c1",
+		LifetimeValue: []Money{NewMoney(500, "EUR"), NewMoney(1400, DefaultCurrency)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var raw struct {
+		LifetimeValue  json.Number `json:"lifetime_value"`
+		LifetimeValues []Money     `json:"lifetime_values"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if raw.LifetimeValue != "1400" {
+		t.Errorf("expected lifetime_value to stay the %s amount, got %s", DefaultCurrency, data)
+	}
+	if len(raw.LifetimeValues) != 2 {
+		t.Errorf("expected one lifetime value per currency, got %s", data)
+	}
+
+	var summary CustomerSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(summary.LifetimeValue) != 2 || summary.LifetimeValue[1] != NewMoney(1400, DefaultCurrency) {
+		t.Errorf("expected the summary to round-trip, got %+v", summary.LifetimeValue)
+	}
+}
+
+func TestReturnJSON(t *testing.T) {
+	t.Run("reads refunds written before currencies", func(t *testing.T) {
+		var ret Return
+		if err := json.Unmarshal([]byte(`{"id":"r1","status":"refunded","refund_amount":3861}`), &ret); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ret.RefundAmount == nil || *ret.RefundAmount != NewMoney(3861, DefaultCurrency) {
+			t.Errorf("expected refund 3861 %s, got %v", DefaultCurrency, ret.RefundAmount)
+		}
+	})
+
+	t.Run("writes the refund as a plain number next to the currency", func(t *testing.T) {
+		refund := NewMoney(1250, "EUR")
+		data, err := json.Marshal(Return{ID: "r1", RefundAmount: &refund})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var raw struct {
+			RefundAmount json.Number `json:"refund_amount"`
+			Currency     string      `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if raw.RefundAmount != "1250" || raw.Currency != "EUR" {
+			t.Errorf("unexpected refund: %s", data)
+		}
+
+		var ret Return
+		if err := json.Unmarshal(data, &ret); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ret.RefundAmount == nil || *ret.RefundAmount != refund {
+			t.Errorf("expected the refund to round-trip, got %v", ret.RefundAmount)
+		}
+	})
+
+	t.Run("leaves the refund out until the return is refunded", func(t *testing.T) {
+		data, err := json.Marshal(Return{ID: "r1", Status: ReturnStatusRequested})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Contains(string(data), "refund_amount") || strings.Contains(string(data), "currency") {
+			t.Errorf("expected no refund fields, got %s", data)
+		}
+	})
+}
+
+func TestReturnEventJSON(t *testing.T) {
+	data, err := json.Marshal(ReturnEvent{ReturnID: "r1", RefundAmount: NewMoney(2000, "GBP")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var raw struct {
+		RefundAmount json.Number `json:"refund_amount"`
+		Currency     string      `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if raw.RefundAmount != "2000" || raw.Currency != "GBP" {
+		t.Errorf("unexpected refund: %s", data)
+	}
+
+	var event ReturnEvent
+	if err := json.Unmarshal([]byte(`{"return_id":"r1","refund_amount":2000}`), &event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.RefundAmount != NewMoney(2000, DefaultCurrency) {
+		t.Errorf("expected refund 2000 %s, got %s", DefaultCurrency, event.RefundAmount)
+	}
+}
@@ -1,27 +1,316 @@
 package domain
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type OrderStatus string
 
 const (
-	OrderStatusPending   OrderStatus = "pending"
-	OrderStatusConfirmed OrderStatus = "confirmed"
-	OrderStatusShipped   OrderStatus = "shipped"
-	OrderStatusCancelled OrderStatus = "cancelled"
+	OrderStatusPending     OrderStatus = "pending"
+	OrderStatusBackordered OrderStatus = "backordered"
+	OrderStatusConfirmed   OrderStatus = "confirmed"
+	OrderStatusShipped     OrderStatus = "shipped"
+	OrderStatusCancelled   OrderStatus = "cancelled"
 )
 
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:     {OrderStatusConfirmed, OrderStatusBackordered, OrderStatusCancelled},
+	OrderStatusBackordered: {OrderStatusConfirmed, OrderStatusCancelled},
+	OrderStatusConfirmed:   {OrderStatusShipped, OrderStatusCancelled},
+}
+
+// CanTransitionTo reports whether an order in status s may move to next.
+// Shipped and cancelled orders are terminal.
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid reports whether s is one of the known order statuses.
+func (s OrderStatus) IsValid() bool {
+	switch s {
+	case OrderStatusPending, OrderStatusBackordered, OrderStatusConfirmed, OrderStatusShipped, OrderStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// StatusChange is an entry in an order's audit trail. FromStatus is empty for
+// the entry recorded when the order was created.
+type StatusChange struct {
+	ID         int64       `json:"id"`
+	OrderID    string      `json:"order_id"`
+	FromStatus OrderStatus `json:"from_status,omitempty"`
+	ToStatus   OrderStatus `json:"to_status"`
+	Actor      string      `json:"actor"`
+	Reason     string      `json:"reason,omitempty"`
+	TraceID    string      `json:"trace_id,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// Allocation is the part of an order line fulfilled from one stock location.
+type Allocation struct {
+	LocationID string `json:"location_id"`
+	Quantity   int    `json:"quantity"`
+}
+
+type ItemAllocation struct {
+	ItemID     string `json:"item_id"`
+	LocationID string `json:"location_id"`
+	Quantity   int    `json:"quantity"`
+}
+
 type OrderItem struct {
+	ItemID      string       `json:"item_id"`
+	Quantity    int          `json:"quantity"`
+	Price       Money        `json:"price"`
+	Discount    Money        `json:"discount"`
+	Allocations []Allocation `json:"allocations,omitempty"`
+}
+
+// orderItemJSON keeps price a bare number, as clients sent and read it before
+// currencies existed, and carries the currency next to it.
+type orderItemJSON struct {
+	ItemID      string       `json:"item_id"`
+	Quantity    int          `json:"quantity"`
+	Price       int64        `json:"price"`
+	Currency    string       `json:"currency,omitempty"`
+	Discount    int64        `json:"discount,omitempty"`
+	Allocations []Allocation `json:"allocations,omitempty"`
+}
+
+func (i OrderItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(orderItemJSON{
+		ItemID:      i.ItemID,
+		Quantity:    i.Quantity,
+		Price:       i.Price.Amount,
+		Currency:    i.Price.Currency,
+		Discount:    i.Discount.Amount,
+		Allocations: i.Allocations,
+	})
+}
+
+// UnmarshalJSON leaves the currency of items sent without one empty so that
+// they can take the currency of their order.
+func (i *OrderItem) UnmarshalJSON(data []byte) error {
+	var v orderItemJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*i = OrderItem{
+		ItemID:      v.ItemID,
+		Quantity:    v.Quantity,
+		Price:       NewMoney(v.Price, v.Currency),
+		Discount:    NewMoney(v.Discount, v.Currency),
+		Allocations: v.Allocations,
+	}
+	return nil
+}
+
+// Order is priced as Subtotal - Discount + Tax + Shipping = Total. Discount
+// covers both line and order discounts.
+type Order struct {
+	ID             string      `json:"id"`
+	CustomerID     string      `json:"customer_id"`
+	Items          []OrderItem `json:"items"`
+	PromoCode      string      `json:"promo_code,omitempty"`
+	Region         string      `json:"region,omitempty"`
+	Subtotal       Money       `json:"subtotal"`
+	Discount       Money       `json:"discount"`
+	Tax            Money       `json:"tax"`
+	Shipping       Money       `json:"shipping"`
+	Total          Money       `json:"total"`
+	Status         OrderStatus `json:"status"`
+	AllowBackorder bool        `json:"allow_backorder"`
+	RefundedTotal  Money       `json:"refunded_total"`
+	Version        int         `json:"version"`
+	CreatedAt      time.Time   `json:"created_at"`
+}
+
+// orderFields has the fields of Order without its JSON methods.
+type orderFields Order
+
+// MarshalJSON keeps amounts bare numbers, as clients read them before
+// currencies existed, and adds the order's currency.
+func (o Order) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		orderFields
+		Subtotal      int64  `json:"subtotal"`
+		Discount      int64  `json:"discount"`
+		Tax           int64  `json:"tax"`
+		Shipping      int64  `json:"shipping"`
+		Total         int64  `json:"total"`
+		RefundedTotal int64  `json:"refunded_total"`
+		Currency      string `json:"currency"`
+	}{
+		orderFields:   orderFields(o),
+		Subtotal:      o.Subtotal.Amount,
+		Discount:      o.Discount.Amount,
+		Tax:           o.Tax.Amount,
+		Shipping:      o.Shipping.Amount,
+		Total:         o.Total.Amount,
+		RefundedTotal: o.RefundedTotal.Amount,
+		Currency:      o.Total.Currency,
+	})
+}
+
+// UnmarshalJSON reads orders without a currency as priced in DefaultCurrency.
+// Items without a currency take the order's.
+func (o *Order) UnmarshalJSON(data []byte) error {
+	v := struct {
+		*orderFields
+		Subtotal      int64  `json:"subtotal"`
+		Discount      int64  `json:"discount"`
+		Tax           int64  `json:"tax"`
+		Shipping      int64  `json:"shipping"`
+		Total         int64  `json:"total"`
+		RefundedTotal int64  `json:"refunded_total"`
+		Currency      string `json:"currency"`
+	}{orderFields: (*orderFields)(o)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Currency == "" {
+		v.Currency = DefaultCurrency
+	}
+	o.Subtotal = NewMoney(v.Subtotal, v.Currency)
+	o.Discount = NewMoney(v.Discount, v.Currency)
+	o.Tax = NewMoney(v.Tax, v.Currency)
+	o.Shipping = NewMoney(v.Shipping, v.Currency)
+	o.Total = NewMoney(v.Total, v.Currency)
+	o.RefundedTotal = NewMoney(v.RefundedTotal, v.Currency)
+	for i := range o.Items {
+		if o.Items[i].Price.Currency == "" {
+			o.Items[i].Price.Currency = v.Currency
+			o.Items[i].Discount.Currency = v.Currency
+		}
+	}
+	return nil
+}
+
+// CustomerSummary aggregates a customer's orders. LifetimeValue is what the
+// customer has spent on orders that were not cancelled, net of refunds, with
+// one entry per currency. LastOrderAt is nil when the customer has no orders.
+type CustomerSummary struct {
+	CustomerID    string     `json:"customer_id"`
+	OrderCount    int        `json:"order_count"`
+	LifetimeValue []Money    `json:"lifetime_values"`
+	LastOrderAt   *time.Time `json:"last_order_at"`
+}
+
+// summaryFields has the fields of CustomerSummary without its JSON methods.
+type summaryFields CustomerSummary
+
+// MarshalJSON keeps lifetime_value the bare DefaultCurrency amount clients
+// read before currencies existed; lifetime_values lists every currency.
+func (s CustomerSummary) MarshalJSON() ([]byte, error) {
+	v := struct {
+		summaryFields
+		LifetimeValue int64 `json:"lifetime_value"`
+	}{summaryFields: summaryFields(s)}
+	for _, value := range s.LifetimeValue {
+		if value.Currency == DefaultCurrency {
+			v.LifetimeValue = value.Amount
+		}
+	}
+	return json.Marshal(v)
+}
+
+type ShipmentItem struct {
 	ItemID   string `json:"item_id"`
 	Quantity int    `json:"quantity"`
-	Price    int64  `json:"price"`
 }
 
-type Order struct {
-	ID         string      `json:"id"`
-	CustomerID string      `json:"customer_id"`
-	Items      []OrderItem `json:"items"`
-	Total      int64       `json:"total"`
-	Status     OrderStatus `json:"status"`
-	CreatedAt  time.Time   `json:"created_at"`
+// Shipment is a parcel handed to a carrier. An order may ship in several
+// shipments and moves to shipped once every line has been sent.
+type Shipment struct {
+	ID             string         `json:"id"`
+	OrderID        string         `json:"order_id"`
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"tracking_number"`
+	Items          []ShipmentItem `json:"items"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+type ReturnStatus string
+
+const (
+	ReturnStatusRequested ReturnStatus = "requested"
+	ReturnStatusReceived  ReturnStatus = "received"
+	ReturnStatusRefunded  ReturnStatus = "refunded"
+)
+
+var returnTransitions = map[ReturnStatus]ReturnStatus{
+	ReturnStatusRequested: ReturnStatusReceived,
+	ReturnStatusReceived:  ReturnStatusRefunded,
+}
+
+// CanTransitionTo reports whether a return in status s may move to next.
+// Returns only move forward, one step at a time.
+func (s ReturnStatus) CanTransitionTo(next ReturnStatus) bool {
+	return returnTransitions[s] == next
+}
+
+type ReturnItem struct {
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+// Return tracks line items a customer sends back after an order shipped.
+// RefundAmount is set once the return is refunded, in the order's currency.
+type Return struct {
+	ID           string       `json:"id"`
+	OrderID      string       `json:"order_id"`
+	Status       ReturnStatus `json:"status"`
+	Reason       string       `json:"reason,omitempty"`
+	Items        []ReturnItem `json:"items"`
+	RefundAmount *Money       `json:"refund_amount,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	ReceivedAt   *time.Time   `json:"received_at,omitempty"`
+	RefundedAt   *time.Time   `json:"refunded_at,omitempty"`
+}
+
+// returnFields has the fields of Return without its JSON methods.
+type returnFields Return
+
+// MarshalJSON keeps refund_amount a bare number, as clients read it before
+// currencies existed, and adds its currency next to it.
+func (r Return) MarshalJSON() ([]byte, error) {
+	v := struct {
+		returnFields
+		RefundAmount *int64 `json:"refund_amount,omitempty"`
+		Currency     string `json:"currency,omitempty"`
+	}{returnFields: returnFields(r)}
+	if r.RefundAmount != nil {
+		v.RefundAmount = &r.RefundAmount.Amount
+		v.Currency = r.RefundAmount.Currency
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON reads refunds without a currency as paid in DefaultCurrency.
+func (r *Return) UnmarshalJSON(data []byte) error {
+	v := struct {
+		*returnFields
+		RefundAmount *int64 `json:"refund_amount"`
+		Currency     string `json:"currency"`
+	}{returnFields: (*returnFields)(r)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	r.RefundAmount = nil
+	if v.RefundAmount != nil {
+		if v.Currency == "" {
+			v.Currency = DefaultCurrency
+		}
+		amount := NewMoney(*v.RefundAmount, v.Currency)
+		r.RefundAmount = &amount
+	}
+	return nil
 }
@@ -0,0 +1,52 @@
+package domain
+
+import "time"
+
+type PromoScope string
+
+const (
+	PromoScopeOrder PromoScope = "order"
+	PromoScopeLine  PromoScope = "line"
+)
+
+// PromoCode is a discount customers redeem by code. A line promo discounts
+// the lines of ItemID, an order promo the order after line discounts. It takes
+// either PercentOff of the amount or AmountOff, which for line promos is per
+// unit. ValidFrom, ValidUntil and MaxUses are optional.
+type PromoCode struct {
+	Code        string     `json:"code"`
+	Description string     `json:"description,omitempty"`
+	Scope       PromoScope `json:"scope"`
+	ItemID      string     `json:"item_id,omitempty"`
+	PercentOff  int        `json:"percent_off,omitempty"`
+	AmountOff   *Money     `json:"amount_off,omitempty"`
+	ValidFrom   *time.Time `json:"valid_from,omitempty"`
+	ValidUntil  *time.Time `json:"valid_until,omitempty"`
+	MaxUses     *int       `json:"max_uses,omitempty"`
+	Uses        int        `json:"uses"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// ActiveAt reports whether the code can be redeemed at t, ignoring how often
+// it has been used.
+func (p PromoCode) ActiveAt(t time.Time) bool {
+	if p.ValidFrom != nil && t.Before(*p.ValidFrom) {
+		return false
+	}
+	if p.ValidUntil != nil && !t.Before(*p.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// PricingRegion holds the tax rate and shipping fee of orders shipped to a
+// region. Amounts are in the minor unit of Currency, the only currency the
+// region prices orders in. Orders whose discounted subtotal reaches
+// FreeShippingOver ship for free.
+type PricingRegion struct {
+	Region           string `json:"region"`
+	Currency         string `json:"currency"`
+	TaxRateBps       int    `json:"tax_rate_bps"`
+	ShippingFee      int64  `json:"shipping_fee"`
+	FreeShippingOver *int64 `json:"free_shipping_over,omitempty"`
+}
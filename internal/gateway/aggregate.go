@@ -0,0 +1,261 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultAggregateConcurrency = 8
+	defaultStockTimeout         = 2 * time.Second
+)
+
+// AggregateFactory builds the handler of an aggregate route from the
+// gateway's upstream proxies and the route's options. Aggregate routes answer
+// from several upstream calls instead of proxying one.
+type AggregateFactory func(proxies map[string]*ServiceProxy, options map[string]any, logger *slog.Logger) (http.Handler, error)
+
+// AggregateConfig names a registered aggregate and its options.
+type AggregateConfig struct {
+	Name    string         `json:"name" yaml:"name"`
+	Options map[string]any `json:"options" yaml:"options"`
+}
+
+// OrderDetails is the response of the order_details aggregate: the order as
+// the orders service returned it, and the stock of each of its items. Items
+// whose stock could not be fetched are listed in Errors instead, and Partial
+// is set.
+type OrderDetails struct {
+	Order   json.RawMessage            `json:"order"`
+	Stock   map[string]json.RawMessage `json:"stock"`
+	Errors  map[string]string          `json:"errors,omitempty"`
+	Partial bool                       `json:"partial"`
+}
+
+type orderDetailsHandler struct {
+	orders       *ServiceProxy
+	inventory    *ServiceProxy
+	concurrency  int
+	stockTimeout time.Duration
+	logger       *slog.Logger
+}
+
+// orderDetailsAggregate serves an order with the current stock of its items.
+// The route's pattern must have an {id} wildcard. Stock is fetched from the
+// inventory upstream concurrently, at most concurrency requests at a time,
+// each bounded by stock_timeout. A failed stock lookup leaves the item out
+// rather than failing the request; a failed order lookup fails it.
+func orderDetailsAggregate(proxies map[string]*ServiceProxy, options map[string]any, logger *slog.Logger) (http.Handler, error) {
+	opts := struct {
+		Orders       string   `json:"orders"`
+		Inventory    string   `json:"inventory"`
+		Concurrency  int      `json:"concurrency"`
+		StockTimeout Duration `json:"stock_timeout"`
+	}{
+		Orders:       "orders",
+		Inventory:    "inventory",
+		Concurrency:  defaultAggregateConcurrency,
+		StockTimeout: Duration(defaultStockTimeout),
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Concurrency <= 0 {
+		return nil, fmt.Errorf("concurrency must be positive")
+	}
+
+	h := &orderDetailsHandler{
+		concurrency:  opts.Concurrency,
+		stockTimeout: time.Duration(opts.StockTimeout),
+		logger:       logger,
+	}
+	var ok bool
+	if h.orders, ok = proxies[opts.Orders]; !ok {
+		return nil, fmt.Errorf("unknown upstream %q", opts.Orders)
+	}
+	if h.inventory, ok = proxies[opts.Inventory]; !ok {
+		return nil, fmt.Errorf("unknown upstream %q", opts.Inventory)
+	}
+	return h, nil
+}
+
+func (h *orderDetailsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	path := "/orders/" + url.PathEscape(r.PathValue("id"))
+
+	resp, err := h.orders.ForwardRequest(ctx, subrequest(ctx, r), path)
+	if err != nil {
+		h.logger.Error("failed to get order", "error", err, "path", path)
+		status, message := forwardErrorStatus(err)
+		writeMiddlewareError(w, status, message)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		// Not found and the like mean the same here as on GET /orders/{id}.
+		CopyResponseHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			h.logger.Error("failed to copy response body", "error", err)
+		}
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.logger.Error("failed to read order", "error", err, "path", path)
+		writeMiddlewareError(w, http.StatusBadGateway, "service unavailable")
+		return
+	}
+	var order struct {
+		Items []struct {
+			ItemID string `json:"item_id"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &order); err != nil {
+		h.logger.Error("failed to decode order", "error", err, "path", path)
+		writeMiddlewareError(w, http.StatusBadGateway, "service unavailable")
+		return
+	}
+
+	var itemIDs []string
+	seen := make(map[string]bool)
+	for _, item := range order.Items {
+		if !seen[item.ItemID] {
+			seen[item.ItemID] = true
+			itemIDs = append(itemIDs, item.ItemID)
+		}
+	}
+
+	details := OrderDetails{
+		Order: body,
+		Stock: make(map[string]json.RawMessage, len(itemIDs)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, h.concurrency)
+	for _, itemID := range itemIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			stock, err := h.stock(ctx, r, itemID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if details.Errors == nil {
+					details.Errors = make(map[string]string)
+				}
+				details.Errors[itemID] = err.Error()
+				details.Partial = true
+				return
+			}
+			details.Stock[itemID] = stock
+		}()
+	}
+	wg.Wait()
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("gateway.aggregate.calls", len(itemIDs)+1),
+		attribute.Bool("gateway.aggregate.partial", details.Partial),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(details); err != nil {
+		h.logger.Error("failed to encode order details", "error", err)
+	}
+}
+
+// stock fetches the stock of one item in a span of its own, so the fan-out
+// shows up as parallel spans under the request. Errors are worded for the
+// client.
+func (h *orderDetailsHandler) stock(ctx context.Context, r *http.Request, itemID string) (json.RawMessage, error) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer("gateway/aggregate")
+	ctx, span := tracer.Start(ctx, "fetch stock", trace.WithAttributes(
+		attribute.String("inventory.item_id", itemID),
+	))
+	defer span.End()
+
+	if h.stockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.stockTimeout)
+		defer cancel()
+	}
+
+	fail := func(err error, message string) (json.RawMessage, error) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, message)
+		h.logger.Warn("failed to get stock", "error", err, "item_id", itemID)
+		return nil, errors.New(message)
+	}
+
+	resp, err := h.inventory.ForwardRequest(ctx, subrequest(ctx, r), "/stock/"+url.PathEscape(itemID))
+	if err != nil {
+		_, message := forwardErrorStatus(err)
+		return fail(err, "inventory "+message)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fail(err, "inventory service unavailable")
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fail(errors.New(resp.Status), "item not found")
+	case resp.StatusCode != http.StatusOK:
+		return fail(errors.New(resp.Status), "inventory service unavailable")
+	case !json.Valid(body):
+		return fail(errors.New("invalid JSON"), "inventory service unavailable")
+	}
+	return body, nil
+}
+
+// conditionalHeaders refer to the aggregate response, not to the upstream
+// resources it is built from, so subrequests never carry them.
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+	"Range",
+}
+
+// subrequest returns a bodiless GET with r's headers for an aggregate's
+// upstream calls. The query string and conditional headers stay behind; they
+// belong to the aggregate route.
+func subrequest(ctx context.Context, r *http.Request) *http.Request {
+	sub := r.Clone(ctx)
+	sub.Method = http.MethodGet
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	sub.URL.RawQuery = ""
+	// The transport only decompresses responses when it asked for
+	// compression itself.
+	sub.Header.Del("Accept-Encoding")
+	sub.Header.Del("Content-Type")
+	sub.Header.Del("Content-Length")
+	for _, name := range conditionalHeaders {
+		sub.Header.Del(name)
+	}
+	return sub
+}
@@ -0,0 +1,286 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRouter_OrderDetails(t *testing.T) {
+	orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/orders/order-1" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"order not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"order-1","items":[{"item_id":"item-1","quantity":1},{"item_id":"item-2","quantity":2},{"item_id":"item-1","quantity":3}]}`))
+	}))
+	defer orders.Close()
+
+	newInventory := func(handler http.HandlerFunc) *httptest.Server {
+		t.Helper()
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		return server
+	}
+	stock := func(w http.ResponseWriter, r *http.Request) {
+		itemID := strings.TrimPrefix(r.URL.Path, "/stock/")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"item_id":"` + itemID + `","available":5,"reserved":1}`))
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newRouter := func(inventoryURL, options string) *Router {
+		t.Helper()
+		path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    url: `+orders.URL+`
+  inventory:
+    url: `+inventoryURL+`
+routes:
+  - method: GET
+    pattern: /orders/{id}/details
+    aggregate:
+      name: order_details
+      options: {`+options+`}
+`)
+		router := NewRouter(path, http.DefaultClient, logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return router
+	}
+	get := func(router *Router, path string) (*httptest.ResponseRecorder, OrderDetails) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var details OrderDetails
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return rec, details
+	}
+
+	t.Run("merges the order with the stock of each item", func(t *testing.T) {
+		router := newRouter(newInventory(stock).URL, "")
+
+		rec, details := get(router, "/orders/order-1/details")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		if !strings.Contains(string(details.Order), `"id":"order-1"`) {
+			t.Errorf("expected the order in the response, got %s", details.Order)
+		}
+		if len(details.Stock) != 2 || details.Partial || len(details.Errors) != 0 {
+			t.Fatalf("expected the stock of 2 items and no errors, got %+v", details)
+		}
+		if !strings.Contains(string(details.Stock["item-2"]), `"available":5`) {
+			t.Errorf("expected item-2 stock, got %s", details.Stock["item-2"])
+		}
+	})
+
+	t.Run("does not pass conditional headers to the upstreams", func(t *testing.T) {
+		var mu sync.Mutex
+		var forwarded []string
+		router := newRouter(newInventory(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"} {
+				if r.Header.Get(name) != "" {
+					forwarded = append(forwarded, name)
+				}
+			}
+			mu.Unlock()
+			stock(w, r)
+		}).URL, "")
+
+		req := httptest.NewRequest(http.MethodGet, "/orders/order-1/details", nil)
+		req.Header.Set("If-None-Match", `"abc"`)
+		req.Header.Set("If-Modified-Since", "Mon, 12 Oct 2026 10:00:00 GMT")
+		req.Header.Set("If-Match", `"abc"`)
+		req.Header.Set("If-Unmodified-Since", "Mon, 12 Oct 2026 10:00:00 GMT")
+		req.Header.Set("If-Range", `"abc"`)
+		req.Header.Set("Range", "bytes=0-10")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		var details OrderDetails
+		if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(details.Stock) != 2 || details.Partial {
+			t.Fatalf("expected full stock for both items, got %+v", details)
+		}
+		if len(forwarded) != 0 {
+			t.Errorf("expected no conditional headers upstream, got %v", forwarded)
+		}
+	})
+
+	t.Run("fetches stock in parallel spans", func(t *testing.T) {
+		var arrived sync.WaitGroup
+		arrived.Add(2)
+		router := newRouter(newInventory(func(w http.ResponseWriter, r *http.Request) {
+			arrived.Done()
+			// Answers only once both lookups are in flight.
+			done := make(chan struct{})
+			go func() { arrived.Wait(); close(done) }()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+			stock(w, r)
+		}).URL, "")
+
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		ctx, span := tp.Tracer("test").Start(context.Background(), "gateway")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/orders/order-1/details", nil).WithContext(ctx))
+		span.End()
+
+		var details OrderDetails
+		if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil || details.Partial {
+			t.Fatalf("expected both lookups to succeed together, got %s", rec.Body.String())
+		}
+
+		var fetches []sdktrace.ReadOnlySpan
+		for _, s := range recorder.Ended() {
+			if s.Name() == "fetch stock" {
+				fetches = append(fetches, s)
+			}
+		}
+		if len(fetches) != 2 {
+			t.Fatalf("expected 2 fetch stock spans, got %d", len(fetches))
+		}
+		for _, fetch := range fetches {
+			if fetch.Parent().SpanID() != span.SpanContext().SpanID() {
+				t.Error("expected fetch stock spans to be children of the request span")
+			}
+		}
+		if !fetches[0].StartTime().Before(fetches[1].EndTime()) || !fetches[1].StartTime().Before(fetches[0].EndTime()) {
+			t.Error("expected the fetch stock spans to overlap")
+		}
+	})
+
+	t.Run("degrades when stock lookups fail", func(t *testing.T) {
+		router := newRouter(newInventory(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/stock/item-1":
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}).URL, "")
+
+		rec, details := get(router, "/orders/order-1/details")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		if !details.Partial || len(details.Stock) != 0 {
+			t.Fatalf("expected a partial response without stock, got %+v", details)
+		}
+		if details.Errors["item-1"] != "item not found" || details.Errors["item-2"] != "inventory service unavailable" {
+			t.Errorf("unexpected errors: %v", details.Errors)
+		}
+	})
+
+	t.Run("bounds each stock lookup", func(t *testing.T) {
+		router := newRouter(newInventory(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/stock/item-2" {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}
+			stock(w, r)
+		}).URL, "stock_timeout: 50ms")
+
+		rec, details := get(router, "/orders/order-1/details")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		if _, ok := details.Stock["item-1"]; !ok || details.Errors["item-2"] != "inventory upstream timed out" {
+			t.Errorf("expected item-1 stock and an item-2 timeout, got %+v", details)
+		}
+	})
+
+	t.Run("passes order errors through", func(t *testing.T) {
+		router := newRouter(newInventory(stock).URL, "")
+
+		rec, _ := get(router, "/orders/missing/details")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "order not found") {
+			t.Errorf("expected the orders service's error, got %s", rec.Body.String())
+		}
+	})
+
+	t.Run("fails when orders is unreachable", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    url: `+down.URL+`
+  inventory:
+    url: `+down.URL+`
+routes:
+  - method: GET
+    pattern: /orders/{id}/details
+    aggregate:
+      name: order_details
+`)
+		router := NewRouter(path, http.DefaultClient, logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if rec, _ := get(router, "/orders/order-1/details"); rec.Code != http.StatusBadGateway {
+			t.Errorf("expected status 502, got %d", rec.Code)
+		}
+	})
+
+	t.Run("rejects invalid routes", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			route string
+		}{
+			{"upstream and aggregate", "upstream: orders\n    aggregate:\n      name: order_details"},
+			{"unknown aggregate", "aggregate:\n      name: order_summary"},
+			{"unknown upstream option", "aggregate:\n      name: order_details\n      options:\n        inventory: stock"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    url: `+orders.URL+`
+routes:
+  - method: GET
+    pattern: /orders/{id}/details
+    `+tt.route+`
+`)
+				if err := NewRouter(path, http.DefaultClient, logger).Load(); err == nil {
+					t.Error("expected an error")
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,380 @@
+package gateway
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers the gateway sets on authenticated requests. Clients cannot send
+// them; the router removes them from every incoming request. HeaderActor is
+// the verified subject again, under the name services record in their audit
+// trails.
+const (
+	HeaderAuthSubject = "X-Auth-Subject"
+	HeaderAuthScopes  = "X-Auth-Scopes"
+	HeaderAuthMethod  = "X-Auth-Method"
+	HeaderActor       = "X-Actor"
+)
+
+var identityHeaders = []string{HeaderAuthSubject, HeaderAuthScopes, HeaderAuthMethod, HeaderActor}
+
+// clockSkew is how far token expiry and not-before times may be off.
+const clockSkew = 30 * time.Second
+
+var (
+	errMissingCredentials = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// AuthConfig lists the credentials the auth middleware accepts. API keys
+// with an empty key are ignored, so keys read from unset environment
+// variables are disabled. The same goes for an empty HS256 secret or JWKS
+// file.
+type AuthConfig struct {
+	APIKeys []APIKeyConfig `json:"api_keys" yaml:"api_keys"`
+	JWT     JWTConfig      `json:"jwt" yaml:"jwt"`
+}
+
+type APIKeyConfig struct {
+	Key     string   `json:"key" yaml:"key"`
+	Subject string   `json:"subject" yaml:"subject"`
+	Scopes  []string `json:"scopes" yaml:"scopes"`
+}
+
+// JWTConfig verifies bearer tokens signed with HS256 using HS256Secret or
+// with RS256 using the keys in JWKSFile. Issuer and Audience, when set, must
+// match the token's iss and aud claims.
+type JWTConfig struct {
+	Issuer      string `json:"issuer" yaml:"issuer"`
+	Audience    string `json:"audience" yaml:"audience"`
+	HS256Secret string `json:"hs256_secret" yaml:"hs256_secret"`
+	JWKSFile    string `json:"jwks_file" yaml:"jwks_file"`
+}
+
+// Identity is the verified caller of a request.
+type Identity struct {
+	Subject string
+	Scopes  []string
+	Method  string
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the caller the auth middleware verified for the
+// request, if any.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// HasScopes reports whether the identity was granted every required scope.
+func (id Identity) HasScopes(required []string) bool {
+	for _, scope := range required {
+		if !slices.Contains(id.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticator checks the API key or bearer token of requests.
+type Authenticator struct {
+	apiKeys    map[[sha256.Size]byte]Identity
+	issuer     string
+	audience   string
+	hmacSecret []byte
+	rsaKeys    map[string]*rsa.PublicKey
+	now        func() time.Time
+}
+
+func NewAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeys:    make(map[[sha256.Size]byte]Identity),
+		issuer:     cfg.JWT.Issuer,
+		audience:   cfg.JWT.Audience,
+		hmacSecret: []byte(cfg.JWT.HS256Secret),
+		now:        time.Now,
+	}
+
+	for _, key := range cfg.APIKeys {
+		if key.Key == "" {
+			continue
+		}
+		if key.Subject == "" {
+			return nil, fmt.Errorf("api key needs a subject")
+		}
+		// Keys are looked up by hash so the lookup time does not depend on
+		// how much of a guessed key is right.
+		a.apiKeys[sha256.Sum256([]byte(key.Key))] = Identity{
+			Subject: key.Subject,
+			Scopes:  key.Scopes,
+			Method:  "api_key",
+		}
+	}
+
+	if cfg.JWT.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWT.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("load jwks: %w", err)
+		}
+		a.rsaKeys = keys
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the identity behind the request's X-API-Key header or
+// bearer token.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		identity, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+		if !ok {
+			return Identity{}, errInvalidCredentials
+		}
+		return identity, nil
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return Identity{}, errMissingCredentials
+	}
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return Identity{}, errInvalidCredentials
+	}
+	return a.verifyJWT(strings.TrimSpace(token))
+}
+
+// authMiddleware rejects requests without valid credentials or without all
+// of the scopes option, and passes the caller's identity on to the upstream.
+func (a *Authenticator) authMiddleware(options map[string]any) (Middleware, error) {
+	var opts struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := trace.SpanFromContext(r.Context())
+
+			identity, err := a.Authenticate(r)
+			if err != nil {
+				span.SetAttributes(attribute.String("gateway.auth.error", err.Error()))
+				w.Header().Set("WWW-Authenticate", `Bearer realm="orderflow"`)
+				if errors.Is(err, errMissingCredentials) {
+					writeMiddlewareError(w, http.StatusUnauthorized, "authentication required")
+					return
+				}
+				writeMiddlewareError(w, http.StatusUnauthorized, "invalid credentials")
+				return
+			}
+
+			span.SetAttributes(
+				semconv.EnduserID(identity.Subject),
+				semconv.EnduserScope(strings.Join(identity.Scopes, " ")),
+				attribute.String("gateway.auth.method", identity.Method),
+			)
+
+			if !identity.HasScopes(opts.Scopes) {
+				writeMiddlewareError(w, http.StatusForbidden, "insufficient scope")
+				return
+			}
+
+			r.Header.Del("X-API-Key")
+			r.Header.Set(HeaderAuthSubject, identity.Subject)
+			r.Header.Set(HeaderAuthScopes, strings.Join(identity.Scopes, " "))
+			r.Header.Set(HeaderAuthMethod, identity.Method)
+			r.Header.Set(HeaderActor, identity.Subject)
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+		})
+	}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	Scope     string      `json:"scope"`
+	Scopes    []string    `json:"scp"`
+}
+
+// jwtAudience reads the aud claim, which is either a string or a list.
+type jwtAudience []string
+
+func (aud *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*aud = list
+	return nil
+}
+
+// verifyJWT checks the signature and claims of a compact JWS token. The
+// algorithm must match the kind of key configured for it, so an RS256 public
+// key can never be used as an HS256 secret.
+func (a *Authenticator) verifyJWT(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errInvalidCredentials
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Identity{}, errInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errInvalidCredentials
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if len(a.hmacSecret) == 0 {
+			return Identity{}, errInvalidCredentials
+		}
+		mac := hmac.New(sha256.New, a.hmacSecret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return Identity{}, errInvalidCredentials
+		}
+	case "RS256":
+		key := a.rsaKey(header.Kid)
+		if key == nil {
+			return Identity{}, errInvalidCredentials
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return Identity{}, errInvalidCredentials
+		}
+	default:
+		return Identity{}, errInvalidCredentials
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Identity{}, errInvalidCredentials
+	}
+
+	now := a.now()
+	if claims.Subject == "" || claims.ExpiresAt == nil {
+		return Identity{}, errInvalidCredentials
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(*claims.ExpiresAt), 0)) {
+		return Identity{}, errInvalidCredentials
+	}
+	if claims.NotBefore != nil && now.Add(clockSkew).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return Identity{}, errInvalidCredentials
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return Identity{}, errInvalidCredentials
+	}
+	if a.audience != "" && !slices.Contains(claims.Audience, a.audience) {
+		return Identity{}, errInvalidCredentials
+	}
+
+	scopes := claims.Scopes
+	if claims.Scope != "" {
+		scopes = strings.Fields(claims.Scope)
+	}
+
+	return Identity{Subject: claims.Subject, Scopes: scopes, Method: "jwt"}, nil
+}
+
+// rsaKey returns the JWKS key with the given id. Tokens without a kid may
+// only be used when the JWKS holds a single key.
+func (a *Authenticator) rsaKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(a.rsaKeys) == 1 {
+		for _, key := range a.rsaKeys {
+			return key
+		}
+	}
+	return a.rsaKeys[kid]
+}
+
+func decodeJWTPart(part string, target any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// loadJWKS reads the RSA signing keys of a JSON Web Key Set file.
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid modulus: %w", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid exponent: %w", jwk.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %s: unsupported exponent", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no RSA signing keys", path)
+	}
+	return keys, nil
+}
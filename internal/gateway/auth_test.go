@@ -0,0 +1,341 @@
+package gateway
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testSecret = "test-secret"
+
+func signHS256(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+	signed := encodeJWTPart(t, map[string]any{"alg": "HS256", "typ": "JWT"}) + "." + encodeJWTPart(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	signed := encodeJWTPart(t, map[string]any{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + encodeJWTPart(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeJWTPart(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to encode token part: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func writeJWKS(t *testing.T, kid string, key *rsa.PublicKey) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatalf("failed to encode jwks: %v", err)
+	}
+	return writeConfig(t, "jwks.json", string(data))
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	auth, err := NewAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{
+			{Key: "worker-key", Subject: "worker", Scopes: []string{"orders:write"}},
+			{Key: "", Subject: "disabled"},
+		},
+		JWT: JWTConfig{
+			Issuer:      "orderflow",
+			Audience:    "gateway",
+			HS256Secret: testSecret,
+			JWKSFile:    writeJWKS(t, "key-1", &rsaKey.PublicKey),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"sub":   "user-1",
+			"iss":   "orderflow",
+			"aud":   []string{"gateway", "other"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "orders:read orders:write",
+		}
+	}
+	with := func(key string, value any) map[string]any {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	t.Run("accepts credentials", func(t *testing.T) {
+		scpClaims := with("scope", nil)
+		scpClaims["scp"] = []string{"inventory:admin"}
+
+		tests := map[string]struct {
+			header, value string
+			want          Identity
+		}{
+			"api key": {
+				"X-API-Key", "worker-key",
+				Identity{Subject: "worker", Scopes: []string{"orders:write"}, Method: "api_key"},
+			},
+			"HS256 token": {
+				"Authorization", "Bearer " + signHS256(t, testSecret, valid()),
+				Identity{Subject: "user-1", Scopes: []string{"orders:read", "orders:write"}, Method: "jwt"},
+			},
+			"RS256 token": {
+				"Authorization", "Bearer " + signRS256(t, rsaKey, "key-1", valid()),
+				Identity{Subject: "user-1", Scopes: []string{"orders:read", "orders:write"}, Method: "jwt"},
+			},
+			"scp claim": {
+				"Authorization", "Bearer " + signHS256(t, testSecret, scpClaims),
+				Identity{Subject: "user-1", Scopes: []string{"inventory:admin"}, Method: "jwt"},
+			},
+		}
+
+		for name, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.Header.Set(tt.header, tt.value)
+
+			identity, err := auth.Authenticate(req)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+				continue
+			}
+			if identity.Subject != tt.want.Subject || identity.Method != tt.want.Method || !identity.HasScopes(tt.want.Scopes) || len(identity.Scopes) != len(tt.want.Scopes) {
+				t.Errorf("%s: expected %+v, got %+v", name, tt.want, identity)
+			}
+		}
+	})
+
+	t.Run("rejects credentials", func(t *testing.T) {
+		unsigned := encodeJWTPart(t, map[string]any{"alg": "none"}) + "." + encodeJWTPart(t, valid()) + "."
+		tests := map[string]struct{ header, value string }{
+			"unknown api key":           {"X-API-Key", "guess"},
+			"basic auth":                {"Authorization", "Basic d29ya2VyOmtleQ=="},
+			"malformed token":           {"Authorization", "Bearer not-a-token"},
+			"unsigned token":            {"Authorization", "Bearer " + unsigned},
+			"wrong secret":              {"Authorization", "Bearer " + signHS256(t, "other-secret", valid())},
+			"unknown RSA key":           {"Authorization", "Bearer " + signRS256(t, otherKey, "key-1", valid())},
+			"unknown kid":               {"Authorization", "Bearer " + signRS256(t, rsaKey, "key-2", valid())},
+			"expired":                   {"Authorization", "Bearer " + signHS256(t, testSecret, with("exp", time.Now().Add(-time.Hour).Unix()))},
+			"not yet valid":             {"Authorization", "Bearer " + signHS256(t, testSecret, with("nbf", time.Now().Add(time.Hour).Unix()))},
+			"no expiry":                 {"Authorization", "Bearer " + signHS256(t, testSecret, with("exp", nil))},
+			"no subject":                {"Authorization", "Bearer " + signHS256(t, testSecret, with("sub", nil))},
+			"wrong issuer":              {"Authorization", "Bearer " + signHS256(t, testSecret, with("iss", "someone-else"))},
+			"wrong audience":            {"Authorization", "Bearer " + signHS256(t, testSecret, with("aud", "other"))},
+			"RS256 key as HS256 secret": {"Authorization", "Bearer " + signHS256(t, string(rsaKey.N.Bytes()), valid())},
+		}
+		for name, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.Header.Set(tt.header, tt.value)
+
+			if _, err := auth.Authenticate(req); !errors.Is(err, errInvalidCredentials) {
+				t.Errorf("%s: expected errInvalidCredentials, got %v", name, err)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if _, err := auth.Authenticate(req); !errors.Is(err, errMissingCredentials) {
+			t.Errorf("expected errMissingCredentials, got %v", err)
+		}
+	})
+}
+
+func TestRouter_Auth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Subject", r.Header.Get(HeaderAuthSubject))
+		w.Header().Set("X-Upstream-Scopes", r.Header.Get(HeaderAuthScopes))
+		w.Header().Set("X-Upstream-Actor", r.Header.Get(HeaderActor))
+		w.Header().Set("X-Upstream-API-Key", r.Header.Get("X-API-Key"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    url: `+upstream.URL+`
+auth:
+  api_keys:
+    - key: worker-key
+      subject: worker
+      scopes: [orders:write]
+    - key: reader-key
+      subject: reader
+      scopes: [orders:read]
+routes:
+  - method: GET
+    pattern: /orders
+    upstream: orders
+  - method: PATCH
+    pattern: /orders/{id}/status
+    upstream: orders
+    middleware:
+      - name: auth
+        options:
+          scopes: [orders:write]
+`)
+	router := NewRouter(path, upstream.Client(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := router.Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	patch := func(apiKey string) *http.Request {
+		req := httptest.NewRequest(http.MethodPatch, "/orders/1/status", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		return req
+	}
+
+	t.Run("requires credentials", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, patch(""))
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rec.Code)
+		}
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Error("expected a WWW-Authenticate header")
+		}
+	})
+
+	t.Run("requires the route's scopes", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, patch("reader-key"))
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", rec.Code)
+		}
+	})
+
+	t.Run("passes the identity upstream and records it on the span", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		ctx, span := provider.Tracer("test").Start(context.Background(), "gateway")
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, patch("worker-key").WithContext(ctx))
+		span.End()
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		if got := rec.Header().Get("X-Upstream-Subject"); got != "worker" {
+			t.Errorf("expected subject worker, got %q", got)
+		}
+		if got := rec.Header().Get("X-Upstream-Scopes"); got != "orders:write" {
+			t.Errorf("expected scopes orders:write, got %q", got)
+		}
+		if got := rec.Header().Get("X-Upstream-Actor"); got != "worker" {
+			t.Errorf("expected actor worker, got %q", got)
+		}
+		if got := rec.Header().Get("X-Upstream-API-Key"); got != "" {
+			t.Errorf("expected the API key not to be forwarded, got %q", got)
+		}
+
+		ended := recorder.Ended()
+		if len(ended) != 1 {
+			t.Fatalf("expected 1 span, got %d", len(ended))
+		}
+		attrs := map[string]string{}
+		for _, attr := range ended[0].Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		if attrs["enduser.id"] != "worker" {
+			t.Errorf("expected enduser.id worker, got %q", attrs["enduser.id"])
+		}
+		if attrs["gateway.auth.method"] != "api_key" {
+			t.Errorf("expected gateway.auth.method api_key, got %q", attrs["gateway.auth.method"])
+		}
+	})
+
+	t.Run("drops identity headers sent by clients", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set(HeaderAuthSubject, "admin")
+		req.Header.Set(HeaderAuthScopes, "inventory:admin")
+		req.Header.Set(HeaderActor, "admin")
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("X-Upstream-Subject"); got != "" {
+			t.Errorf("expected no subject upstream, got %q", got)
+		}
+		if got := rec.Header().Get("X-Upstream-Scopes"); got != "" {
+			t.Errorf("expected no scopes upstream, got %q", got)
+		}
+		if got := rec.Header().Get("X-Upstream-Actor"); got != "" {
+			t.Errorf("expected no actor upstream, got %q", got)
+		}
+	})
+
+	t.Run("replaces the actor sent by clients with the verified subject", func(t *testing.T) {
+		req := patch("worker-key")
+		req.Header.Set(HeaderActor, "admin")
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("X-Upstream-Actor"); got != "worker" {
+			t.Errorf("expected actor worker, got %q", got)
+		}
+	})
+}
+
+func TestLoadJWKS(t *testing.T) {
+	if _, err := loadJWKS(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	if _, err := loadJWKS(writeConfig(t, "jwks.json", `{"keys":[{"kty":"EC","kid":"ec-1"}]}`)); err == nil {
+		t.Error("expected an error for a key set without RSA keys")
+	}
+}
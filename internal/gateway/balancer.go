@@ -0,0 +1,374 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrNoHealthyEndpoints is returned when every endpoint of an upstream is
+// failing its health checks or ejected.
+var ErrNoHealthyEndpoints = errors.New("no healthy endpoints")
+
+const (
+	BalanceRoundRobin    = "round_robin"
+	BalanceLeastRequests = "least_requests"
+)
+
+// Health check defaults, used when the upstream config leaves them out.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultUnhealthyThreshold  = 3
+	defaultHealthyThreshold    = 2
+	defaultEjectFor            = 30 * time.Second
+)
+
+// HealthCheckConfig polls Path on every endpoint each Interval. An endpoint
+// stops getting traffic after UnhealthyThreshold failed checks in a row and
+// gets it back after HealthyThreshold passed checks in a row. Checks are off
+// without a Path.
+type HealthCheckConfig struct {
+	Path               string   `json:"path" yaml:"path"`
+	Interval           Duration `json:"interval" yaml:"interval"`
+	Timeout            Duration `json:"timeout" yaml:"timeout"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+	HealthyThreshold   int      `json:"healthy_threshold" yaml:"healthy_threshold"`
+}
+
+// EjectionConfig takes an endpoint out of rotation for EjectFor after
+// ConsecutiveFailures failed requests in a row. The last endpoint in rotation
+// is never ejected. Ejection is off when ConsecutiveFailures is zero.
+type EjectionConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures" yaml:"consecutive_failures"`
+	EjectFor            Duration `json:"eject_for" yaml:"eject_for"`
+}
+
+// PoolConfig holds how an endpoint pool spreads and withholds traffic.
+type PoolConfig struct {
+	Balancer    string
+	HealthCheck HealthCheckConfig
+	Ejection    EjectionConfig
+}
+
+// Endpoint is one replica of an upstream.
+type Endpoint struct {
+	URL      string
+	inflight atomic.Int64
+
+	mu             sync.Mutex
+	unhealthy      bool
+	checkFailures  int
+	checkSuccesses int
+	failures       int
+	ejectedUntil   time.Time
+}
+
+// EndpointPool picks the endpoint of an upstream each request goes to.
+type EndpointPool struct {
+	name      string
+	endpoints []*Endpoint
+	config    PoolConfig
+	logger    *slog.Logger
+	now       func() time.Time
+	next      atomic.Uint64
+
+	healthGauge metric.Int64Gauge
+	startOnce   sync.Once
+	stop        context.CancelFunc
+	stopMu      sync.Mutex
+}
+
+func NewEndpointPool(name string, urls []string, config PoolConfig, logger *slog.Logger) *EndpointPool {
+	if config.Balancer == "" {
+		config.Balancer = BalanceRoundRobin
+	}
+
+	gauge, err := otel.Meter(proxyMeterName).Int64Gauge("gateway.upstream.endpoint.healthy",
+		metric.WithDescription("Whether an upstream endpoint passes its health checks: 1 healthy, 0 unhealthy"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	p := &EndpointPool{
+		name:        name,
+		config:      config,
+		logger:      logger,
+		now:         time.Now,
+		healthGauge: gauge,
+	}
+	for _, url := range urls {
+		p.endpoints = append(p.endpoints, &Endpoint{URL: url})
+	}
+	return p
+}
+
+// sameAs reports whether the pool was built from the given endpoints and
+// config, so a reload can keep it and its health state.
+func (p *EndpointPool) sameAs(urls []string, config PoolConfig) bool {
+	if config.Balancer == "" {
+		config.Balancer = BalanceRoundRobin
+	}
+	if p.config != config || len(p.endpoints) != len(urls) {
+		return false
+	}
+	for i, endpoint := range p.endpoints {
+		if endpoint.URL != urls[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Pick chooses an endpoint for a request and counts the request as
+// outstanding on it until Done is called.
+func (p *EndpointPool) Pick() (*Endpoint, error) {
+	now := p.now()
+	start := int((p.next.Add(1) - 1) % uint64(len(p.endpoints)))
+
+	var chosen *Endpoint
+	for i := range p.endpoints {
+		endpoint := p.endpoints[(start+i)%len(p.endpoints)]
+		if !endpoint.available(now) {
+			continue
+		}
+		if p.config.Balancer == BalanceRoundRobin {
+			chosen = endpoint
+			break
+		}
+		if chosen == nil || endpoint.inflight.Load() < chosen.inflight.Load() {
+			chosen = endpoint
+		}
+	}
+	if chosen == nil {
+		return nil, ErrNoHealthyEndpoints
+	}
+
+	chosen.inflight.Add(1)
+	return chosen, nil
+}
+
+// Done ends a request Pick chose the endpoint for.
+func (p *EndpointPool) Done(endpoint *Endpoint) {
+	endpoint.inflight.Add(-1)
+}
+
+// Report records the outcome of a request for passive ejection.
+func (p *EndpointPool) Report(endpoint *Endpoint, success bool) {
+	if p.config.Ejection.ConsecutiveFailures <= 0 {
+		return
+	}
+
+	now := p.now()
+	others := p.othersAvailable(endpoint, now)
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if success {
+		endpoint.failures = 0
+		return
+	}
+
+	endpoint.failures++
+	if endpoint.failures >= p.config.Ejection.ConsecutiveFailures && others {
+		ejectFor := time.Duration(p.config.Ejection.EjectFor)
+		if ejectFor <= 0 {
+			ejectFor = defaultEjectFor
+		}
+		endpoint.failures = 0
+		endpoint.ejectedUntil = now.Add(ejectFor)
+		p.logger.Warn("upstream endpoint ejected", "upstream", p.name, "endpoint", endpoint.URL, "for", ejectFor)
+	}
+}
+
+// othersAvailable reports whether an endpoint other than endpoint can take
+// requests.
+func (p *EndpointPool) othersAvailable(endpoint *Endpoint, now time.Time) bool {
+	for _, other := range p.endpoints {
+		if other != endpoint && other.available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Endpoint) available(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.unhealthy && !now.Before(e.ejectedUntil)
+}
+
+// Start begins health checking the endpoints with client, if the pool has a
+// health check path. It does nothing after the first call.
+func (p *EndpointPool) Start(client *http.Client) {
+	p.startOnce.Do(func() {
+		if p.config.HealthCheck.Path == "" {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopMu.Lock()
+		p.stop = cancel
+		p.stopMu.Unlock()
+
+		interval := time.Duration(p.config.HealthCheck.Interval)
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				p.checkAll(ctx, client)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
+
+// Stop ends the pool's health checks.
+func (p *EndpointPool) Stop() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop != nil {
+		p.stop()
+	}
+}
+
+func (p *EndpointPool) checkAll(ctx context.Context, client *http.Client) {
+	var wg sync.WaitGroup
+	for _, endpoint := range p.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.check(ctx, client, endpoint)
+			if ctx.Err() != nil {
+				return
+			}
+			p.recordCheck(endpoint, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *EndpointPool) check(ctx context.Context, client *http.Client, endpoint *Endpoint) error {
+	timeout := time.Duration(p.config.HealthCheck.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.URL+p.config.HealthCheck.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func (p *EndpointPool) recordCheck(endpoint *Endpoint, err error) {
+	unhealthyThreshold := p.config.HealthCheck.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	healthyThreshold := p.config.HealthCheck.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	wasUnhealthy := endpoint.unhealthy
+	if err != nil {
+		endpoint.checkSuccesses = 0
+		endpoint.checkFailures++
+		if endpoint.checkFailures >= unhealthyThreshold {
+			endpoint.unhealthy = true
+		}
+	} else {
+		endpoint.checkFailures = 0
+		endpoint.checkSuccesses++
+		if endpoint.checkSuccesses >= healthyThreshold {
+			endpoint.unhealthy = false
+		}
+	}
+
+	if endpoint.unhealthy != wasUnhealthy {
+		if endpoint.unhealthy {
+			p.logger.Warn("upstream endpoint unhealthy", "upstream", p.name, "endpoint", endpoint.URL, "error", err)
+		} else {
+			p.logger.Info("upstream endpoint healthy", "upstream", p.name, "endpoint", endpoint.URL)
+		}
+	}
+
+	if p.healthGauge != nil {
+		healthy := int64(1)
+		if endpoint.unhealthy {
+			healthy = 0
+		}
+		p.healthGauge.Record(context.Background(), healthy, metric.WithAttributes(
+			attribute.String("gateway.upstream", p.name),
+			attribute.String("gateway.upstream.endpoint", endpoint.URL),
+		))
+	}
+}
+
+type endpointKey struct{}
+
+// NewTransport returns the transport the gateway's HTTP client should use. It
+// traces each request with a client span that records the upstream endpoint
+// the request went to.
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(endpointTransport{base: base})
+}
+
+// endpointTransport runs inside the otelhttp transport, where the request
+// context holds the client span.
+type endpointTransport struct {
+	base http.RoundTripper
+}
+
+func (t endpointTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if endpoint, ok := r.Context().Value(endpointKey{}).(*Endpoint); ok {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("gateway.upstream.endpoint", endpoint.URL))
+	}
+	return t.base.RoundTrip(r)
+}
+
+// endpointURLs returns the endpoints of an upstream config, which may give a
+// single url, a list of endpoints, or both.
+func endpointURLs(upstream UpstreamConfig) []string {
+	urls := slices.Clone(upstream.Endpoints)
+	if upstream.URL != "" && !slices.Contains(urls, upstream.URL) {
+		urls = append([]string{upstream.URL}, urls...)
+	}
+	return urls
+}
@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestPool(urls []string, config PoolConfig) *EndpointPool {
+	return NewEndpointPool("orders", urls, config, slog.New(slog.DiscardHandler))
+}
+
+func pickURL(t *testing.T, pool *EndpointPool) string {
+	t.Helper()
+	endpoint, err := pool.Pick()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.Done(endpoint)
+	return endpoint.URL
+}
+
+func TestEndpointPool_Pick(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+
+	t.Run("round robin", func(t *testing.T) {
+		pool := newTestPool(urls, PoolConfig{})
+
+		counts := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			counts[pickURL(t, pool)]++
+		}
+		for _, url := range urls {
+			if counts[url] != 2 {
+				t.Errorf("expected %s to get 2 requests, got %d", url, counts[url])
+			}
+		}
+	})
+
+	t.Run("least requests", func(t *testing.T) {
+		pool := newTestPool(urls, PoolConfig{Balancer: BalanceLeastRequests})
+
+		first, _ := pool.Pick()
+		second, _ := pool.Pick()
+		if first == second {
+			t.Fatalf("expected outstanding requests to spread, both went to %s", first.URL)
+		}
+		third, _ := pool.Pick()
+		if third == first || third == second {
+			t.Errorf("expected the idle endpoint, got %s", third.URL)
+		}
+
+		pool.Done(second)
+		if got := pickURL(t, pool); got != second.URL {
+			t.Errorf("expected %s with no outstanding requests, got %s", second.URL, got)
+		}
+	})
+
+	t.Run("skips unhealthy endpoints", func(t *testing.T) {
+		pool := newTestPool(urls, PoolConfig{})
+		pool.endpoints[1].unhealthy = true
+
+		for i := 0; i < 6; i++ {
+			if got := pickURL(t, pool); got == "http://b" {
+				t.Fatal("expected the unhealthy endpoint to get no requests")
+			}
+		}
+	})
+
+	t.Run("no healthy endpoints", func(t *testing.T) {
+		pool := newTestPool(urls, PoolConfig{})
+		for _, endpoint := range pool.endpoints {
+			endpoint.unhealthy = true
+		}
+
+		if _, err := pool.Pick(); !errors.Is(err, ErrNoHealthyEndpoints) {
+			t.Errorf("expected ErrNoHealthyEndpoints, got %v", err)
+		}
+	})
+}
+
+func TestEndpointPool_Ejection(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool := newTestPool([]string{"http://a", "http://b"}, PoolConfig{
+		Ejection: EjectionConfig{ConsecutiveFailures: 2, EjectFor: Duration(30 * time.Second)},
+	})
+	pool.now = func() time.Time { return now }
+	a := pool.endpoints[0]
+
+	pool.Report(a, false)
+	pool.Report(a, true)
+	pool.Report(a, false)
+	if !a.available(now) {
+		t.Fatal("expected a success to reset the failure count")
+	}
+
+	pool.Report(a, false)
+	if a.available(now) {
+		t.Fatal("expected the endpoint to be ejected after 2 failures in a row")
+	}
+	for i := 0; i < 4; i++ {
+		if got := pickURL(t, pool); got != "http://b" {
+			t.Fatalf("expected requests to go to http://b, got %s", got)
+		}
+	}
+
+	b := pool.endpoints[1]
+	pool.Report(b, false)
+	pool.Report(b, false)
+	if !b.available(now) {
+		t.Error("expected the last endpoint in rotation not to be ejected")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !a.available(now) {
+		t.Error("expected the endpoint back after eject_for")
+	}
+}
+
+func TestEndpointPool_HealthCheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			t.Errorf("expected a check of /health, got %s", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+
+	pool := newTestPool([]string{backend.URL}, PoolConfig{
+		HealthCheck: HealthCheckConfig{Path: "/health", UnhealthyThreshold: 2, HealthyThreshold: 2},
+	})
+	endpoint := pool.endpoints[0]
+	ctx := context.Background()
+
+	status.Store(http.StatusServiceUnavailable)
+	pool.checkAll(ctx, backend.Client())
+	if !endpoint.available(time.Now()) {
+		t.Fatal("expected one failed check to leave the endpoint in rotation")
+	}
+	pool.checkAll(ctx, backend.Client())
+	if _, err := pool.Pick(); !errors.Is(err, ErrNoHealthyEndpoints) {
+		t.Fatalf("expected the endpoint out of rotation after 2 failed checks, got %v", err)
+	}
+
+	status.Store(http.StatusOK)
+	pool.checkAll(ctx, backend.Client())
+	if endpoint.available(time.Now()) {
+		t.Fatal("expected one passed check to keep the endpoint out of rotation")
+	}
+	pool.checkAll(ctx, backend.Client())
+	if !endpoint.available(time.Now()) {
+		t.Error("expected the endpoint back after 2 passed checks")
+	}
+}
+
+func TestRouter_Endpoints(t *testing.T) {
+	var hitsA, hitsB atomic.Int32
+	backendA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsA.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendA.Close()
+	backendB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsB.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backendB.Close()
+
+	path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    endpoints:
+      - `+backendA.URL+`
+      - `+backendB.URL+`
+    ejection:
+      consecutive_failures: 2
+      eject_for: 1m
+routes:
+  - method: GET
+    pattern: /orders
+    upstream: orders
+`)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client := &http.Client{Transport: NewTransport(http.DefaultTransport)}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	router := NewRouter(path, client, logger)
+	if err := router.Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer router.Close()
+
+	get := func() int {
+		ctx, span := tp.Tracer("test").Start(context.Background(), "gateway")
+		defer span.End()
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if hitsA.Load() != 2 || hitsB.Load() != 2 {
+		t.Fatalf("expected 2 requests per endpoint, got %d and %d", hitsA.Load(), hitsB.Load())
+	}
+
+	for i := 0; i < 4; i++ {
+		if code := get(); code != http.StatusOK {
+			t.Errorf("expected the failing endpoint to be ejected, got status %d", code)
+		}
+	}
+	if hitsB.Load() != 2 {
+		t.Errorf("expected no requests to the ejected endpoint, got %d", hitsB.Load()-2)
+	}
+
+	endpoints := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		for _, attr := range span.Attributes() {
+			if attr.Key == attribute.Key("gateway.upstream.endpoint") {
+				endpoints[attr.Value.AsString()] = true
+			}
+		}
+	}
+	if !endpoints[backendA.URL] || !endpoints[backendB.URL] {
+		t.Errorf("expected client spans to record both endpoints, got %v", endpoints)
+	}
+}
@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrCircuitOpen is returned for requests to an upstream whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig opens the breaker after FailureThreshold failed
+// requests in a row. After OpenFor it lets one request through, and closes
+// again if that request succeeds.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold" yaml:"failure_threshold"`
+	OpenFor          Duration `json:"open_for" yaml:"open_for"`
+}
+
+// CircuitBreaker stops sending requests to an upstream that keeps failing,
+// so callers get an answer at once instead of waiting for it to time out.
+type CircuitBreaker struct {
+	name   string
+	config CircuitBreakerConfig
+	now    func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// generation counts state changes, so a request can tell whether the
+	// state it started in still holds.
+	generation uint64
+
+	stateGauge metric.Int64Gauge
+}
+
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	if config.OpenFor <= 0 {
+		config.OpenFor = Duration(10 * time.Second)
+	}
+
+	gauge, err := otel.Meter(proxyMeterName).Int64Gauge("gateway.circuit_breaker.state",
+		metric.WithDescription("Circuit breaker state per upstream: 0 closed, 1 half open, 2 open"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	b := &CircuitBreaker{
+		name:       name,
+		config:     config,
+		now:        time.Now,
+		stateGauge: gauge,
+	}
+	b.record(BreakerClosed)
+	return b
+}
+
+// State returns the breaker's current state.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState()
+}
+
+// BreakerToken identifies a request Allow let through. Pass it to Done or
+// Release when the request ends.
+type BreakerToken struct {
+	generation uint64
+	probe      bool
+}
+
+// Allow reports whether a request may go to the upstream now. Every allowed
+// request must be followed by a call to Done or Release with the returned
+// token.
+func (b *CircuitBreaker) Allow() (BreakerToken, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.currentState()
+	switch state {
+	case BreakerOpen:
+		return BreakerToken{}, ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return BreakerToken{}, ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return BreakerToken{generation: b.generation, probe: state == BreakerHalfOpen}, nil
+}
+
+// Done records the outcome of a request Allow let through. Only the half
+// open probe decides whether the breaker closes again; other requests count
+// only if the breaker has not changed state since they started.
+func (b *CircuitBreaker) Done(token BreakerToken, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.currentState()
+	if token.generation != b.generation {
+		return
+	}
+	if token.probe {
+		b.probing = false
+	}
+
+	if success {
+		b.failures = 0
+		if state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if state == BreakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// Release ends a request Allow let through without counting it either way.
+func (b *CircuitBreaker) Release(token BreakerToken) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if token.probe && token.generation == b.generation {
+		b.probing = false
+	}
+}
+
+// currentState moves an open breaker to half open once OpenFor has passed.
+func (b *CircuitBreaker) currentState() BreakerState {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= time.Duration(b.config.OpenFor) {
+		b.setState(BreakerHalfOpen)
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	b.generation++
+	b.probing = false
+	b.record(state)
+}
+
+func (b *CircuitBreaker) record(state BreakerState) {
+	if b.stateGauge != nil {
+		b.stateGauge.Record(context.Background(), int64(state), metric.WithAttributes(
+			attribute.String("gateway.upstream", b.name),
+		))
+	}
+}
@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newBreaker := func() *CircuitBreaker {
+		b := NewCircuitBreaker("orders", CircuitBreakerConfig{FailureThreshold: 3, OpenFor: Duration(10 * time.Second)})
+		b.now = func() time.Time { return now }
+		return b
+	}
+	request := func(b *CircuitBreaker, success bool) error {
+		token, err := b.Allow()
+		if err != nil {
+			return err
+		}
+		b.Done(token, success)
+		return nil
+	}
+
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		b := newBreaker()
+		_ = request(b, false)
+		_ = request(b, false)
+		_ = request(b, true)
+		_ = request(b, false)
+		_ = request(b, false)
+		if b.State() != BreakerClosed {
+			t.Fatalf("expected a success to reset the count, got %s", b.State())
+		}
+
+		_ = request(b, false)
+		if b.State() != BreakerOpen {
+			t.Fatalf("expected open, got %s", b.State())
+		}
+		if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("expected ErrCircuitOpen, got %v", err)
+		}
+	})
+
+	t.Run("lets one probe through when half open", func(t *testing.T) {
+		b := newBreaker()
+		for i := 0; i < 3; i++ {
+			_ = request(b, false)
+		}
+
+		now = now.Add(10 * time.Second)
+		if b.State() != BreakerHalfOpen {
+			t.Fatalf("expected half open, got %s", b.State())
+		}
+		probe, err := b.Allow()
+		if err != nil {
+			t.Fatalf("expected the probe to be allowed, got %v", err)
+		}
+		if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("expected a second request to wait for the probe, got %v", err)
+		}
+
+		b.Done(probe, false)
+		if b.State() != BreakerOpen {
+			t.Fatalf("expected a failed probe to reopen the breaker, got %s", b.State())
+		}
+
+		now = now.Add(10 * time.Second)
+		if err := request(b, true); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if b.State() != BreakerClosed {
+			t.Errorf("expected a successful probe to close the breaker, got %s", b.State())
+		}
+	})
+
+	t.Run("releasing a probe lets another through", func(t *testing.T) {
+		b := newBreaker()
+		for i := 0; i < 3; i++ {
+			_ = request(b, false)
+		}
+		now = now.Add(10 * time.Second)
+
+		probe, err := b.Allow()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b.Release(probe)
+		if _, err := b.Allow(); err != nil {
+			t.Errorf("expected a new probe after release, got %v", err)
+		}
+	})
+
+	t.Run("requests that started before half open do not decide it", func(t *testing.T) {
+		b := newBreaker()
+		stale, err := b.Allow()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		released, err := b.Allow()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			_ = request(b, false)
+		}
+		now = now.Add(10 * time.Second)
+
+		probe, err := b.Allow()
+		if err != nil {
+			t.Fatalf("expected the probe to be allowed, got %v", err)
+		}
+
+		b.Done(stale, true)
+		b.Release(released)
+		if b.State() != BreakerHalfOpen {
+			t.Fatalf("expected a stale success to leave the breaker half open, got %s", b.State())
+		}
+		if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("expected requests to keep waiting for the probe, got %v", err)
+		}
+
+		b.Done(probe, false)
+		if b.State() != BreakerOpen {
+			t.Fatalf("expected the failed probe to reopen the breaker, got %s", b.State())
+		}
+	})
+}
@@ -0,0 +1,504 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultCacheMaxBytes      = 64 << 20
+	defaultCacheMaxEntryBytes = 1 << 20
+)
+
+// Cache statuses recorded on the gateway span as gateway.cache.status.
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+	cacheBypass      = "bypass"
+)
+
+// CacheConfig bounds the response cache shared by the routes that list the
+// cache middleware. Responses larger than MaxEntryBytes are not cached.
+type CacheConfig struct {
+	MaxBytes      int64 `json:"max_bytes" yaml:"max_bytes"`
+	MaxEntryBytes int64 `json:"max_entry_bytes" yaml:"max_entry_bytes"`
+}
+
+// cacheableStatus lists the statuses the cache stores, the ones HTTP caches
+// may store without being told explicitly.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cachedResponse is a stored response. It is not changed once stored;
+// revalidation stores a new one.
+type cachedResponse struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	vary     map[string]string
+	storedAt time.Time
+	// age is how old the response already was when it was stored.
+	age      time.Duration
+	lifetime time.Duration
+}
+
+func (e *cachedResponse) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+func (e *cachedResponse) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.storedAt)
+}
+
+func (e *cachedResponse) fresh(now time.Time) bool {
+	return e.currentAge(now) < e.lifetime
+}
+
+func (e *cachedResponse) hasValidators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// matches reports whether the response can answer r, given the request
+// headers it varies on.
+func (e *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ResponseCache keeps upstream responses in memory, evicting the least
+// recently used ones once MaxBytes is reached.
+type ResponseCache struct {
+	mu            sync.Mutex
+	maxBytes      int64
+	maxEntryBytes int64
+	size          int64
+	entries       map[string]*list.Element
+	lru           *list.List
+	now           func() time.Time
+}
+
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{
+		maxBytes:      defaultCacheMaxBytes,
+		maxEntryBytes: defaultCacheMaxEntryBytes,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		now:           time.Now,
+	}
+}
+
+// SetLimits applies config, evicting entries if the cache shrank. Zero
+// values mean the defaults.
+func (c *ResponseCache) SetLimits(config CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxBytes = config.MaxBytes
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultCacheMaxBytes
+	}
+	c.maxEntryBytes = config.MaxEntryBytes
+	if c.maxEntryBytes <= 0 {
+		c.maxEntryBytes = defaultCacheMaxEntryBytes
+	}
+	c.evict()
+}
+
+func (c *ResponseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedResponse)
+}
+
+func (c *ResponseCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(entry.key)
+	size := entry.size()
+	if size > c.maxBytes {
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	c.evict()
+}
+
+func (c *ResponseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *ResponseCache) removeLocked(key string) {
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.size -= elem.Value.(*cachedResponse).size()
+	}
+}
+
+func (c *ResponseCache) evict() {
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cachedResponse).key)
+	}
+}
+
+func (c *ResponseCache) entryLimit() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxEntryBytes
+}
+
+// cacheMiddleware caches GET responses following their Cache-Control,
+// Expires, ETag and Last-Modified headers. Stale responses with a validator
+// are revalidated with a conditional request. The ttl option replaces the
+// freshness lifetime the upstream gives. Responses marked no-store or
+// private are never stored. Entries are shared by every caller, so responses
+// to requests with credentials are only stored when the upstream marks them
+// public or gives them an s-maxage, whatever the ttl.
+func cacheMiddleware(cache *ResponseCache) MiddlewareFactory {
+	return func(options map[string]any) (Middleware, error) {
+		var opts struct {
+			TTL Duration `json:"ttl"`
+		}
+		if err := decodeOptions(options, &opts); err != nil {
+			return nil, err
+		}
+		if opts.TTL < 0 {
+			return nil, fmt.Errorf("ttl must not be negative")
+		}
+		ttl := time.Duration(opts.TTL)
+
+		requests, err := otel.Meter("gateway/cache").Int64Counter("gateway.cache.requests",
+			metric.WithDescription("Requests to cached routes by cache status"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key := r.URL.RequestURI()
+				record := func(status string) {
+					attrs := []attribute.KeyValue{
+						attribute.String("http.route", r.Pattern),
+						attribute.String("gateway.cache.status", status),
+					}
+					trace.SpanFromContext(r.Context()).SetAttributes(attrs[1])
+					requests.Add(r.Context(), 1, metric.WithAttributes(attrs...))
+				}
+
+				requestDirectives := parseCacheControl(r.Header)
+				if r.Method != http.MethodGet || hasDirective(requestDirectives, "no-store") {
+					record(cacheBypass)
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				now := cache.now()
+				entry := cache.get(key)
+				if entry != nil && !entry.matches(r) {
+					entry = nil
+				}
+				mustRevalidate := hasDirective(requestDirectives, "no-cache") || requestDirectives["max-age"] == "0"
+				if entry != nil && !mustRevalidate && entry.fresh(now) {
+					record(cacheHit)
+					serveCached(w, r, entry, now)
+					return
+				}
+
+				upstreamReq := r
+				if entry != nil && entry.hasValidators() {
+					upstreamReq = r.Clone(r.Context())
+					upstreamReq.Header.Del("If-None-Match")
+					upstreamReq.Header.Del("If-Modified-Since")
+					if etag := entry.header.Get("ETag"); etag != "" {
+						upstreamReq.Header.Set("If-None-Match", etag)
+					}
+					if modified := entry.header.Get("Last-Modified"); modified != "" {
+						upstreamReq.Header.Set("If-Modified-Since", modified)
+					}
+				}
+
+				rec := &cacheRecorder{w: w, header: make(http.Header), status: http.StatusOK, limit: cache.entryLimit()}
+				next.ServeHTTP(rec, upstreamReq)
+				if rec.passthrough {
+					record(cacheMiss)
+					return
+				}
+
+				now = cache.now()
+				if upstreamReq != r && rec.status == http.StatusNotModified {
+					updated := entry.revalidated(rec.header, now, ttl)
+					cache.put(updated)
+					record(cacheRevalidated)
+					serveCached(w, r, updated, now)
+					return
+				}
+
+				record(cacheMiss)
+				stored := newCachedResponse(key, r, rec, now, ttl)
+				if stored == nil {
+					cache.remove(key)
+					rec.flush()
+					return
+				}
+				cache.put(stored)
+				serveCached(w, r, stored, now)
+			})
+		}, nil
+	}
+}
+
+// newCachedResponse returns the response rec recorded for r as a cache entry,
+// or nil if it may not be stored.
+func newCachedResponse(key string, r *http.Request, rec *cacheRecorder, now time.Time, ttl time.Duration) *cachedResponse {
+	if !cacheableStatus[rec.status] {
+		return nil
+	}
+
+	directives := parseCacheControl(rec.header)
+	if hasDirective(directives, "no-store") || hasDirective(directives, "private") {
+		return nil
+	}
+	if hasCredentials(r) && !hasDirective(directives, "public") && directives["s-maxage"] == "" {
+		return nil
+	}
+
+	vary := make(map[string]string)
+	for _, value := range rec.header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = r.Header.Get(name)
+			}
+		}
+	}
+
+	entry := &cachedResponse{
+		key:      key,
+		status:   rec.status,
+		header:   rec.header.Clone(),
+		body:     bytes.Clone(rec.body.Bytes()),
+		vary:     vary,
+		storedAt: now,
+		age:      ageOf(rec.header),
+		lifetime: freshnessLifetime(rec.header, ttl),
+	}
+	if entry.lifetime <= 0 && !entry.hasValidators() {
+		return nil
+	}
+	return entry
+}
+
+// revalidated returns a copy of e updated with the headers of a 304 answer to
+// a conditional request.
+func (e *cachedResponse) revalidated(header http.Header, now time.Time, ttl time.Duration) *cachedResponse {
+	updated := *e
+	updated.header = e.header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Type", "Content-Encoding":
+			continue
+		}
+		updated.header[name] = values
+	}
+	updated.storedAt = now
+	updated.age = ageOf(header)
+	updated.lifetime = freshnessLifetime(updated.header, ttl)
+	return &updated
+}
+
+// serveCached answers r from entry, with a 304 when the client's
+// If-None-Match matches it.
+func serveCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse, now time.Time) {
+	copyHeader(w.Header(), entry.header)
+	w.Header().Set("Age", strconv.Itoa(int(entry.currentAge(now).Seconds())))
+
+	if etagMatches(r.Header.Get("If-None-Match"), entry.header.Get("ETag")) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.status)
+	_, _ = w.Write(entry.body)
+}
+
+// freshnessLifetime returns how long a response stays fresh: ttl if set,
+// then s-maxage, max-age, and Expires. Responses marked no-cache are stale at
+// once.
+func freshnessLifetime(header http.Header, ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+
+	directives := parseCacheControl(header)
+	if hasDirective(directives, "no-cache") {
+		return 0
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expiresAt.Sub(date)
+	}
+	return 0
+}
+
+func ageOf(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Age"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parseCacheControl returns the Cache-Control directives in header by
+// lowercase name, with their unquoted values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func hasDirective(directives map[string]string, name string) bool {
+	_, ok := directives[name]
+	return ok
+}
+
+func hasCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+		return true
+	}
+	_, ok := IdentityFromContext(r.Context())
+	return ok
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder holds a response back so the cache can decide what to do with
+// it. Once the body passes limit it gives up and streams the response to w.
+type cacheRecorder struct {
+	w           http.ResponseWriter
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	limit       int64
+	wroteHeader bool
+	passthrough bool
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.passthrough {
+		return rec.w.Header()
+	}
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	if rec.passthrough {
+		return rec.w.Write(p)
+	}
+	if int64(rec.body.Len()+len(p)) > rec.limit {
+		rec.passthrough = true
+		rec.flush()
+		return rec.w.Write(p)
+	}
+	return rec.body.Write(p)
+}
+
+// flush sends what was recorded to w.
+func (rec *cacheRecorder) flush() {
+	copyHeader(rec.w.Header(), rec.header)
+	rec.w.WriteHeader(rec.status)
+	_, _ = rec.w.Write(rec.body.Bytes())
+}
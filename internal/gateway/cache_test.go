@@ -0,0 +1,274 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestResponseCache_Evict(t *testing.T) {
+	cache := NewResponseCache()
+	entry := func(key string) *cachedResponse {
+		return &cachedResponse{key: key, header: http.Header{}, body: make([]byte, 98)}
+	}
+	cache.SetLimits(CacheConfig{MaxBytes: 300})
+
+	cache.put(entry("/a"))
+	cache.put(entry("/b"))
+	cache.put(entry("/c"))
+	if cache.get("/a") == nil {
+		t.Fatal("expected /a to fit")
+	}
+
+	// /b is now the least recently used.
+	cache.put(entry("/d"))
+	if cache.get("/b") != nil {
+		t.Error("expected /b to be evicted")
+	}
+	for _, key := range []string{"/a", "/c", "/d"} {
+		if cache.get(key) == nil {
+			t.Errorf("expected %s to stay cached", key)
+		}
+	}
+
+	cache.SetLimits(CacheConfig{MaxBytes: 100})
+	if cache.get("/d") == nil || cache.get("/a") != nil || cache.get("/c") != nil {
+		t.Error("expected shrinking the cache to keep only the most recent entry")
+	}
+}
+
+func TestRouter_Cache(t *testing.T) {
+	var calls atomic.Int32
+	var lastIfNoneMatch atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		lastIfNoneMatch.Store(r.Header.Get("If-None-Match"))
+
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/large":
+			w.Header().Set("Cache-Control", "max-age=60")
+			_, _ = w.Write([]byte(strings.Repeat("x", 2048)))
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = w.Write([]byte(r.URL.Path + " " + r.Header.Get("Accept-Language")))
+	}))
+	defer upstream.Close()
+
+	path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  svc:
+    url: `+upstream.URL+`
+cache:
+  max_entry_bytes: 1024
+routes:
+  - method: GET
+    pattern: /ttl
+    upstream: svc
+    middleware:
+      - name: cache
+        options:
+          ttl: 30s
+  - method: GET
+    pattern: /{path}
+    upstream: svc
+    middleware:
+      - name: cache
+`)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newRouter := func(t *testing.T) (*Router, *time.Time) {
+		t.Helper()
+		router := NewRouter(path, upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		router.cache.now = func() time.Time { return now }
+		return router, &now
+	}
+	do := func(router *Router, method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	// upstreamCalls returns how many requests reached the upstream during fn.
+	upstreamCalls := func(fn func()) int {
+		before := calls.Load()
+		fn()
+		return int(calls.Load() - before)
+	}
+
+	t.Run("serves fresh responses from the cache", func(t *testing.T) {
+		router, now := newRouter(t)
+
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		get := func() *httptest.ResponseRecorder {
+			ctx, span := tp.Tracer("test").Start(context.Background(), "gateway")
+			defer span.End()
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/max-age", nil).WithContext(ctx))
+			return rec
+		}
+
+		n := upstreamCalls(func() {
+			get()
+			*now = now.Add(10 * time.Second)
+			rec := get()
+			if rec.Code != http.StatusOK || rec.Body.String() != "/max-age " {
+				t.Errorf("expected the cached response, got %d %q", rec.Code, rec.Body.String())
+			}
+			if rec.Header().Get("Age") != "10" {
+				t.Errorf("expected Age 10, got %q", rec.Header().Get("Age"))
+			}
+		})
+		if n != 1 {
+			t.Errorf("expected 1 upstream call, got %d", n)
+		}
+
+		var statuses []string
+		for _, span := range recorder.Ended() {
+			for _, attr := range span.Attributes() {
+				if attr.Key == "gateway.cache.status" {
+					statuses = append(statuses, attr.Value.AsString())
+				}
+			}
+		}
+		if strings.Join(statuses, ",") != "miss,hit" {
+			t.Errorf("expected a miss then a hit on the spans, got %v", statuses)
+		}
+
+		*now = now.Add(time.Minute)
+		if n := upstreamCalls(func() { get() }); n != 1 {
+			t.Errorf("expected a stale response to be fetched again, got %d calls", n)
+		}
+	})
+
+	t.Run("route ttl overrides the upstream", func(t *testing.T) {
+		router, now := newRouter(t)
+
+		n := upstreamCalls(func() {
+			do(router, http.MethodGet, "/ttl", nil)
+			*now = now.Add(29 * time.Second)
+			do(router, http.MethodGet, "/ttl", nil)
+		})
+		if n != 1 {
+			t.Errorf("expected 1 upstream call within the ttl, got %d", n)
+		}
+
+		*now = now.Add(time.Second)
+		if n := upstreamCalls(func() { do(router, http.MethodGet, "/ttl", nil) }); n != 1 {
+			t.Errorf("expected a call after the ttl, got %d", n)
+		}
+	})
+
+	t.Run("revalidates with the ETag", func(t *testing.T) {
+		router, _ := newRouter(t)
+
+		do(router, http.MethodGet, "/etag", nil)
+		rec := do(router, http.MethodGet, "/etag", nil)
+		if lastIfNoneMatch.Load() != `"v1"` {
+			t.Errorf("expected a conditional request, got If-None-Match %q", lastIfNoneMatch.Load())
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != "/etag " {
+			t.Errorf("expected the cached body after a 304, got %d %q", rec.Code, rec.Body.String())
+		}
+
+		rec = do(router, http.MethodGet, "/etag", http.Header{"If-None-Match": {`"v1"`}})
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("expected 304 for a matching client ETag, got %d", rec.Code)
+		}
+	})
+
+	t.Run("does not store what it must not", func(t *testing.T) {
+		router, _ := newRouter(t)
+
+		tests := []struct {
+			path   string
+			header http.Header
+			calls  int
+		}{
+			{"/no-store", nil, 2},
+			{"/private", nil, 2},
+			{"/max-age", http.Header{"Cache-Control": {"no-store"}}, 2},
+			{"/large", nil, 2},
+			{"/public", http.Header{"Authorization": {"Bearer token"}}, 1},
+			{"/ttl", http.Header{"Authorization": {"Bearer token"}}, 2},
+			{"/ttl", http.Header{"X-Api-Key": {"key"}}, 2},
+		}
+		for _, tt := range tests {
+			n := upstreamCalls(func() {
+				for i := 0; i < 2; i++ {
+					rec := do(router, http.MethodGet, tt.path, tt.header)
+					if rec.Code != http.StatusOK {
+						t.Errorf("%s: expected status 200, got %d", tt.path, rec.Code)
+					}
+				}
+			})
+			if n != tt.calls {
+				t.Errorf("%s: expected %d upstream calls, got %d", tt.path, tt.calls, n)
+			}
+		}
+
+		authorized := http.Header{"Authorization": {"Bearer token"}}
+		n := upstreamCalls(func() {
+			do(router, http.MethodGet, "/other", authorized)
+			do(router, http.MethodGet, "/other", authorized)
+		})
+		if n != 2 {
+			t.Errorf("expected responses to requests with credentials not to be stored, got %d calls", n)
+		}
+	})
+
+	t.Run("keys on the headers the response varies on", func(t *testing.T) {
+		router, _ := newRouter(t)
+
+		english := http.Header{"Accept-Language": {"en"}}
+		german := http.Header{"Accept-Language": {"de"}}
+		n := upstreamCalls(func() {
+			do(router, http.MethodGet, "/vary", english)
+			do(router, http.MethodGet, "/vary", english)
+			if rec := do(router, http.MethodGet, "/vary", german); rec.Body.String() != "/vary de" {
+				t.Errorf("expected the German response, got %q", rec.Body.String())
+			}
+		})
+		if n != 2 {
+			t.Errorf("expected 2 upstream calls, got %d", n)
+		}
+	})
+}
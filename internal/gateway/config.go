@@ -0,0 +1,212 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultRouteTimeout = 10 * time.Second
+
+// Config is the gateway's routing table. Values in the file may refer to
+// environment variables as $VAR or ${VAR}.
+type Config struct {
+	Upstreams map[string]UpstreamConfig `json:"upstreams" yaml:"upstreams"`
+	Defaults  RouteDefaults             `json:"defaults" yaml:"defaults"`
+	Auth      AuthConfig                `json:"auth" yaml:"auth"`
+	Cache     CacheConfig               `json:"cache" yaml:"cache"`
+	Routes    []RouteConfig             `json:"routes" yaml:"routes"`
+}
+
+// UpstreamConfig describes a backend service, reached at URL or spread over
+// Endpoints by Balancer. Timeout bounds each attempt at a request, while a
+// route's timeout bounds the request with all its retries. A CircuitBreaker
+// with no FailureThreshold is disabled.
+type UpstreamConfig struct {
+	URL            string               `json:"url" yaml:"url"`
+	Endpoints      []string             `json:"endpoints" yaml:"endpoints"`
+	Balancer       string               `json:"balancer" yaml:"balancer"`
+	HealthCheck    HealthCheckConfig    `json:"health_check" yaml:"health_check"`
+	Ejection       EjectionConfig       `json:"ejection" yaml:"ejection"`
+	Timeout        Duration             `json:"timeout" yaml:"timeout"`
+	Retry          RetryConfig          `json:"retry" yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker" yaml:"circuit_breaker"`
+}
+
+// RouteDefaults apply to every route that does not set its own.
+type RouteDefaults struct {
+	Timeout    Duration           `json:"timeout" yaml:"timeout"`
+	Middleware []MiddlewareConfig `json:"middleware" yaml:"middleware"`
+}
+
+// RouteConfig sends requests matching Method and Pattern, in http.ServeMux
+// syntax, to Upstream, or answers them with an Aggregate of upstream calls.
+// Middleware runs after the default middleware, in the order listed.
+type RouteConfig struct {
+	Method     string             `json:"method" yaml:"method"`
+	Pattern    string             `json:"pattern" yaml:"pattern"`
+	Upstream   string             `json:"upstream" yaml:"upstream"`
+	Aggregate  AggregateConfig    `json:"aggregate" yaml:"aggregate"`
+	Rewrite    RewriteConfig      `json:"rewrite" yaml:"rewrite"`
+	Timeout    Duration           `json:"timeout" yaml:"timeout"`
+	Middleware []MiddlewareConfig `json:"middleware" yaml:"middleware"`
+}
+
+// RewriteConfig turns the request path into the upstream path. Path, when
+// set, replaces it and may use the route's {wildcards}. Otherwise StripPrefix
+// is removed from the front and AddPrefix put in its place.
+type RewriteConfig struct {
+	Path        string `json:"path" yaml:"path"`
+	StripPrefix string `json:"strip_prefix" yaml:"strip_prefix"`
+	AddPrefix   string `json:"add_prefix" yaml:"add_prefix"`
+}
+
+// MiddlewareConfig names a registered middleware and its options.
+type MiddlewareConfig struct {
+	Name    string         `json:"name" yaml:"name"`
+	Options map[string]any `json:"options" yaml:"options"`
+}
+
+// Duration reads durations such as "1.5s" from YAML and JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// LoadConfig reads the routing table from path. Files ending in .json are
+// read as JSON, anything else as YAML.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := []byte(os.ExpandEnv(string(data)))
+
+	var cfg Config
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(expanded, &cfg)
+	} else {
+		err = yaml.Unmarshal(expanded, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	for name, upstream := range c.Upstreams {
+		urls := endpointURLs(upstream)
+		if len(urls) == 0 || slices.Contains(urls, "") {
+			return fmt.Errorf("upstream %s has no url", name)
+		}
+		switch upstream.Balancer {
+		case "", BalanceRoundRobin, BalanceLeastRequests:
+		default:
+			return fmt.Errorf("upstream %s: unknown balancer %q", name, upstream.Balancer)
+		}
+		if upstream.Timeout < 0 || upstream.Retry.Attempts < 0 || upstream.CircuitBreaker.FailureThreshold < 0 {
+			return fmt.Errorf("upstream %s: timeout, retry attempts and failure threshold must not be negative", name)
+		}
+	}
+
+	if c.Cache.MaxBytes < 0 || c.Cache.MaxEntryBytes < 0 {
+		return fmt.Errorf("cache sizes must not be negative")
+	}
+
+	if len(c.Routes) == 0 {
+		return fmt.Errorf("no routes")
+	}
+
+	for i, route := range c.Routes {
+		if route.Method == "" || route.Pattern == "" {
+			return fmt.Errorf("route %d needs a method and a pattern", i)
+		}
+		if !strings.HasPrefix(route.Pattern, "/") {
+			return fmt.Errorf("route %s %s: pattern must start with /", route.Method, route.Pattern)
+		}
+		if route.Aggregate.Name != "" {
+			if route.Upstream != "" {
+				return fmt.Errorf("route %s %s: set an upstream or an aggregate, not both", route.Method, route.Pattern)
+			}
+		} else if _, ok := c.Upstreams[route.Upstream]; !ok {
+			return fmt.Errorf("route %s %s: unknown upstream %q", route.Method, route.Pattern, route.Upstream)
+		}
+		if route.Timeout < 0 {
+			return fmt.Errorf("route %s %s: timeout must not be negative", route.Method, route.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// timeout returns how long the route waits for its upstream.
+func (c *Config) timeout(route RouteConfig) time.Duration {
+	if route.Timeout > 0 {
+		return time.Duration(route.Timeout)
+	}
+	if c.Defaults.Timeout > 0 {
+		return time.Duration(c.Defaults.Timeout)
+	}
+	return defaultRouteTimeout
+}
+
+// apply returns the upstream path for r.
+func (rw RewriteConfig) apply(r *http.Request) string {
+	if rw.Path != "" {
+		return expandPathValues(rw.Path, r)
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, rw.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(rw.AddPrefix, "/") + path
+}
+
+// expandPathValues replaces each {name} in template with the request's path
+// value of that name.
+func expandPathValues(template string, r *http.Request) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start
+
+		name := strings.TrimSuffix(template[start+1:end], "...")
+		b.WriteString(template[:start])
+		b.WriteString(r.PathValue(name))
+		template = template[end+1:]
+	}
+	b.WriteString(template)
+	return b.String()
+}
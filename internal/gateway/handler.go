@@ -1,58 +1,128 @@
 package gateway
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
-	"strings"
+	"time"
 )
 
+// Handler proxies the requests of one route to its upstream service.
 type Handler struct {
-	ordersProxy    *ServiceProxy
-	inventoryProxy *ServiceProxy
-	logger         *slog.Logger
+	proxy   *ServiceProxy
+	rewrite RewriteConfig
+	timeout time.Duration
+	logger  *slog.Logger
 }
 
-func NewHandler(ordersProxy, inventoryProxy *ServiceProxy, logger *slog.Logger) *Handler {
+// NewHandler returns a handler that forwards requests to proxy with the path
+// rewritten by rewrite. A positive timeout bounds the upstream call,
+// including reading its response, except for event streams, which it only
+// bounds until they start.
+func NewHandler(proxy *ServiceProxy, rewrite RewriteConfig, timeout time.Duration, logger *slog.Logger) *Handler {
 	return &Handler{
-		ordersProxy:    ordersProxy,
-		inventoryProxy: inventoryProxy,
-		logger:         logger,
+		proxy:   proxy,
+		rewrite: rewrite,
+		timeout: timeout,
+		logger:  logger,
 	}
 }
 
-func (h *Handler) HandleOrders(w http.ResponseWriter, r *http.Request) {
-	h.proxyRequest(w, r, h.ordersProxy, r.URL.Path)
-}
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lift := func() {}
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, lift, cancel = timeoutUntilStream(ctx, h.timeout)
+		defer cancel()
+	}
 
-func (h *Handler) HandleInventory(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/inventory")
-	h.proxyRequest(w, r, h.inventoryProxy, path)
-}
+	path := h.rewrite.apply(r)
 
-func (h *Handler) proxyRequest(w http.ResponseWriter, r *http.Request, proxy *ServiceProxy, path string) {
-	resp, err := proxy.ForwardRequest(r.Context(), r, path)
+	resp, err := h.proxy.ForwardRequest(ctx, r, path)
 	if err != nil {
 		h.logger.Error("failed to forward request", "error", err, "path", path)
-		h.writeError(w, http.StatusBadGateway, "service unavailable")
+		status, message := forwardErrorStatus(err)
+		h.writeError(w, status, message)
 		return
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
-		w.Header().Set("Content-Type", contentType)
+	CopyResponseHeader(w.Header(), resp.Header)
+
+	h.logger.Info("request proxied", "method", r.Method, "path", path, "status", resp.StatusCode)
+
+	if isEventStream(resp.Header) {
+		lift()
+		h.stream(w, resp)
+		return
 	}
 
 	w.WriteHeader(resp.StatusCode)
 
-	h.logger.Info("request proxied", "method", r.Method, "path", path, "status", resp.StatusCode)
-
 	if _, err := io.Copy(w, resp.Body); err != nil {
 		h.logger.Error("failed to copy response body", "error", err)
 	}
 }
 
+// stream copies an event stream to the client, flushing each chunk as it
+// arrives, until either side goes away.
+func (h *Handler) stream(w http.ResponseWriter, resp *http.Response) {
+	rc := http.NewResponseController(w)
+	// The stream lasts as long as the client listens, past the server's
+	// write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		h.logger.Error("failed to clear write deadline", "error", err)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	_ = rc.Flush()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forwardErrorStatus returns the status and message to answer with when
+// ForwardRequest fails with err.
+func forwardErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrNoHealthyEndpoints):
+		return http.StatusServiceUnavailable, "service unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "upstream timed out"
+	default:
+		return http.StatusBadGateway, "service unavailable"
+	}
+}
+
+// withTimeout bounds the requests next serves by timeout, if positive.
+func withTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (h *Handler) writeError(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"bufio"
 	"encoding/json"
 	"io"
 	"log/slog"
@@ -8,9 +9,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
-func TestHandler_HandleOrders(t *testing.T) {
+func TestHandler_ServeHTTP(t *testing.T) {
 	t.Run("proxies GET /orders", func(t *testing.T) {
 		ordersServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.URL.Path != "/orders" {
@@ -27,14 +29,15 @@ func TestHandler_HandleOrders(t *testing.T) {
 
 		handler := NewHandler(
 			NewServiceProxy(ordersServer.URL, ordersServer.Client()),
-			NewServiceProxy("http://unused", http.DefaultClient),
+			RewriteConfig{},
+			0,
 			slog.New(slog.NewTextHandler(io.Discard, nil)),
 		)
 
 		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
 		rec := httptest.NewRecorder()
 
-		handler.HandleOrders(rec, req)
+		handler.ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusOK {
 			t.Errorf("expected status 200, got %d", rec.Code)
@@ -61,31 +64,66 @@ func TestHandler_HandleOrders(t *testing.T) {
 
 		handler := NewHandler(
 			NewServiceProxy(ordersServer.URL, ordersServer.Client()),
-			NewServiceProxy("http://unused", http.DefaultClient),
+			RewriteConfig{},
+			0,
 			slog.New(slog.NewTextHandler(io.Discard, nil)),
 		)
 
 		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"customer_id":"123"}`))
 		rec := httptest.NewRecorder()
 
-		handler.HandleOrders(rec, req)
+		handler.ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusCreated {
 			t.Errorf("expected status 201, got %d", rec.Code)
 		}
 	})
 
+	t.Run("forwards If-Match and returns the ETag", func(t *testing.T) {
+		ordersServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-Match") != `"3"` {
+				t.Errorf("expected If-Match \"3\", got %q", r.Header.Get("If-Match"))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"4"`)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"id":"1","version":4}`))
+		}))
+		defer ordersServer.Close()
+
+		handler := NewHandler(
+			NewServiceProxy(ordersServer.URL, ordersServer.Client()),
+			RewriteConfig{},
+			0,
+			slog.New(slog.NewTextHandler(io.Discard, nil)),
+		)
+
+		req := httptest.NewRequest(http.MethodPatch, "/orders/1/status", strings.NewReader(`{"status":"confirmed"}`))
+		req.Header.Set("If-Match", `"3"`)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", rec.Code)
+		}
+		if rec.Header().Get("ETag") != `"4"` {
+			t.Errorf("expected ETag \"4\", got %q", rec.Header().Get("ETag"))
+		}
+	})
+
 	t.Run("returns 502 when orders service unavailable", func(t *testing.T) {
 		handler := NewHandler(
 			NewServiceProxy("http://localhost:99999", &http.Client{}),
-			NewServiceProxy("http://unused", http.DefaultClient),
+			RewriteConfig{},
+			0,
 			slog.New(slog.NewTextHandler(io.Discard, nil)),
 		)
 
 		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
 		rec := httptest.NewRecorder()
 
-		handler.HandleOrders(rec, req)
+		handler.ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusBadGateway {
 			t.Errorf("expected status 502, got %d", rec.Code)
@@ -99,9 +137,31 @@ func TestHandler_HandleOrders(t *testing.T) {
 			t.Errorf("expected 'service unavailable', got %s", resp["error"])
 		}
 	})
+	t.Run("returns 504 when the upstream exceeds the route timeout", func(t *testing.T) {
+		ordersServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer ordersServer.Close()
+
+		handler := NewHandler(
+			NewServiceProxy(ordersServer.URL, ordersServer.Client()),
+			RewriteConfig{},
+			50*time.Millisecond,
+			slog.New(slog.NewTextHandler(io.Discard, nil)),
+		)
+
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("expected status 504, got %d", rec.Code)
+		}
+	})
 }
 
-func TestHandler_HandleInventory(t *testing.T) {
+func TestHandler_Rewrite(t *testing.T) {
 	t.Run("strips /inventory prefix and forwards to inventory service", func(t *testing.T) {
 		inventoryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.URL.Path != "/stock/item-123" {
@@ -114,15 +174,16 @@ func TestHandler_HandleInventory(t *testing.T) {
 		defer inventoryServer.Close()
 
 		handler := NewHandler(
-			NewServiceProxy("http://unused", http.DefaultClient),
 			NewServiceProxy(inventoryServer.URL, inventoryServer.Client()),
+			RewriteConfig{StripPrefix: "/inventory"},
+			0,
 			slog.New(slog.NewTextHandler(io.Discard, nil)),
 		)
 
 		req := httptest.NewRequest(http.MethodGet, "/inventory/stock/item-123", nil)
 		rec := httptest.NewRecorder()
 
-		handler.HandleInventory(rec, req)
+		handler.ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusOK {
 			t.Errorf("expected status 200, got %d", rec.Code)
@@ -138,15 +199,16 @@ func TestHandler_HandleInventory(t *testing.T) {
 		defer inventoryServer.Close()
 
 		handler := NewHandler(
-			NewServiceProxy("http://unused", http.DefaultClient),
 			NewServiceProxy(inventoryServer.URL, inventoryServer.Client()),
+			RewriteConfig{StripPrefix: "/inventory"},
+			0,
 			slog.New(slog.NewTextHandler(io.Discard, nil)),
 		)
 
 		req := httptest.NewRequest(http.MethodGet, "/inventory/stock/unknown", nil)
 		rec := httptest.NewRecorder()
 
-		handler.HandleInventory(rec, req)
+		handler.ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusNotFound {
 			t.Errorf("expected status 404, got %d", rec.Code)
@@ -155,18 +217,85 @@ func TestHandler_HandleInventory(t *testing.T) {
 
 	t.Run("returns 502 when inventory service unavailable", func(t *testing.T) {
 		handler := NewHandler(
-			NewServiceProxy("http://unused", http.DefaultClient),
 			NewServiceProxy("http://localhost:99999", &http.Client{}),
+			RewriteConfig{StripPrefix: "/inventory"},
+			0,
 			slog.New(slog.NewTextHandler(io.Discard, nil)),
 		)
 
 		req := httptest.NewRequest(http.MethodGet, "/inventory/stock/item-123", nil)
 		rec := httptest.NewRecorder()
 
-		handler.HandleInventory(rec, req)
+		handler.ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusBadGateway {
 			t.Errorf("expected status 502, got %d", rec.Code)
 		}
 	})
 }
+
+func TestHandler_EventStream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("id: 1\ndata: first\n\n"))
+		http.NewResponseController(w).Flush()
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte("id: 2\ndata: second\n\n"))
+	}))
+	defer upstream.Close()
+
+	// Both timeouts are far shorter than the stream.
+	handler := NewHandler(
+		NewServiceProxy(upstream.URL, upstream.Client(), WithTimeout(50*time.Millisecond)),
+		RewriteConfig{},
+		50*time.Millisecond,
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+	gateway := httptest.NewServer(handler)
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/events")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		t.Helper()
+		var event strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read event: %v", err)
+			}
+			if line == "\n" {
+				return event.String()
+			}
+			event.WriteString(line)
+		}
+	}
+
+	// The first event arrives while the upstream is still holding the stream
+	// open, so it was flushed.
+	if event := readEvent(); event != "id: 1\ndata: first\n" {
+		t.Errorf("unexpected first event: %q", event)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if event := readEvent(); event != "id: 2\ndata: second\n" {
+		t.Errorf("expected the stream to outlive the timeouts, got %q", event)
+	}
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Middleware wraps the handler of a route.
+type Middleware func(http.Handler) http.Handler
+
+// MiddlewareFactory builds a middleware from the options given to it in the
+// route config.
+type MiddlewareFactory func(options map[string]any) (Middleware, error)
+
+// decodeOptions fills target, a pointer to a struct with json tags, from
+// middleware options.
+func decodeOptions(options map[string]any, target any) error {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+// writeMiddlewareError answers a request a middleware refuses to pass on, in
+// the same shape as the services' errors.
+func writeMiddlewareError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// setHeadersMiddleware sets fixed headers on the request sent upstream and on
+// the response sent to the client.
+func setHeadersMiddleware(options map[string]any) (Middleware, error) {
+	var opts struct {
+		Request  map[string]string `json:"request"`
+		Response map[string]string `json:"response"`
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range opts.Request {
+				r.Header.Set(name, value)
+			}
+			for name, value := range opts.Response {
+				w.Header().Set(name, value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// maxBodyBytesMiddleware rejects request bodies larger than the limit option.
+func maxBodyBytesMiddleware(options map[string]any) (Middleware, error) {
+	var opts struct {
+		Limit int64 `json:"limit"`
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > opts.Limit {
+				writeMiddlewareError(w, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, opts.Limit)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -1,31 +1,387 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// hopHeaders apply to a single connection and must not be forwarded by
+// proxies (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const proxyMeterName = "gateway/proxy"
+
+// Retry backoff defaults, used when the upstream config leaves them out.
+const (
+	defaultInitialBackoff = 50 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+)
+
+// RetryConfig retries failed requests up to Attempts times in total, waiting
+// a random time up to InitialBackoff before the second attempt and doubling
+// that bound on each further attempt, up to MaxBackoff.
+type RetryConfig struct {
+	Attempts       int      `json:"attempts" yaml:"attempts"`
+	InitialBackoff Duration `json:"initial_backoff" yaml:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff" yaml:"max_backoff"`
+}
+
 type ServiceProxy struct {
-	baseURL string
+	pool    *EndpointPool
 	client  *http.Client
+	name    string
+	timeout time.Duration
+	retry   RetryConfig
+	breaker *CircuitBreaker
+	retries metric.Int64Counter
+}
+
+type ProxyOption func(*ServiceProxy)
+
+// WithName names the upstream in span attributes and metrics.
+func WithName(name string) ProxyOption {
+	return func(p *ServiceProxy) { p.name = name }
+}
+
+// WithTimeout bounds each attempt at a request, including reading the
+// response body.
+func WithTimeout(timeout time.Duration) ProxyOption {
+	return func(p *ServiceProxy) { p.timeout = timeout }
 }
 
-func NewServiceProxy(baseURL string, client *http.Client) *ServiceProxy {
-	return &ServiceProxy{
-		baseURL: baseURL,
-		client:  client,
+// WithRetry retries requests that are safe to repeat when the upstream
+// cannot be reached or answers 502, 503 or 504.
+func WithRetry(retry RetryConfig) ProxyOption {
+	return func(p *ServiceProxy) { p.retry = retry }
+}
+
+// WithEndpointPool sends requests to the endpoints of pool instead of the
+// proxy's base URL.
+func WithEndpointPool(pool *EndpointPool) ProxyOption {
+	return func(p *ServiceProxy) { p.pool = pool }
+}
+
+// WithCircuitBreaker fails requests with ErrCircuitOpen while breaker is open.
+func WithCircuitBreaker(breaker *CircuitBreaker) ProxyOption {
+	return func(p *ServiceProxy) { p.breaker = breaker }
+}
+
+func NewServiceProxy(baseURL string, client *http.Client, opts ...ProxyOption) *ServiceProxy {
+	p := &ServiceProxy{
+		client: client,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.pool == nil {
+		p.pool = NewEndpointPool(p.name, []string{baseURL}, PoolConfig{}, slog.New(slog.DiscardHandler))
+	}
+
+	retries, err := otel.Meter(proxyMeterName).Int64Counter("gateway.upstream.retries",
+		metric.WithDescription("Requests the gateway sent to an upstream again after a failure"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	p.retries = retries
+
+	return p
 }
 
+// ForwardRequest sends r to path on the service with its query string and
+// end-to-end headers, and tells the service who the client is with the
+// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers.
+//
+// Requests that are safe to repeat are retried according to the proxy's
+// RetryConfig: GET, HEAD, OPTIONS, PUT and DELETE, and other methods only
+// when the client sent an Idempotency-Key.
 func (p *ServiceProxy) ForwardRequest(ctx context.Context, r *http.Request, path string) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, r.Method, p.baseURL+path, r.Body)
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	span := trace.SpanFromContext(ctx)
+	if p.name != "" {
+		span.SetAttributes(attribute.String("gateway.upstream", p.name))
+	}
+
+	attempts := 1
+	if p.retry.Attempts > 1 && isRetryable(r) {
+		attempts = p.retry.Attempts
+	}
+
+	// Retried requests need their body again, so read it up front.
+	var body []byte
+	buffered := attempts > 1 && r.Body != nil && r.Body != http.NoBody
+	if buffered {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		resp, err = p.send(ctx, r, path, body, buffered)
+		if attempt == attempts || ctx.Err() != nil || !shouldRetry(resp, err) {
+			break
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		if p.retries != nil {
+			p.retries.Add(ctx, 1, metric.WithAttributes(attribute.String("gateway.upstream", p.name)))
+		}
+		if err := sleepContext(ctx, p.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+
+	span.SetAttributes(attribute.Int("gateway.upstream.attempts", attempt))
+	if p.breaker != nil {
+		span.SetAttributes(attribute.String("gateway.circuit_breaker.state", p.breaker.State().String()))
+	}
+
+	return resp, err
+}
+
+// send makes one attempt at the request, on an endpoint picked for it.
+func (p *ServiceProxy) send(ctx context.Context, r *http.Request, path string, body []byte, buffered bool) (*http.Response, error) {
+	var token BreakerToken
+	if p.breaker != nil {
+		var err error
+		if token, err = p.breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint, err := p.pool.Pick()
+	if err != nil {
+		if p.breaker != nil {
+			p.breaker.Release(token)
+		}
+		return nil, err
+	}
+
+	lift, cancel := func() {}, context.CancelFunc(func() {})
+	if p.timeout > 0 {
+		ctx, lift, cancel = timeoutUntilStream(ctx, p.timeout)
+	}
+	ctx = context.WithValue(ctx, endpointKey{}, endpoint)
+	done := func() {
+		cancel()
+		p.pool.Done(endpoint)
+	}
+
+	url := endpoint.URL + path
+
+	var req *http.Request
+	if buffered {
+		req, err = http.NewRequestWithContext(ctx, r.Method, url, bytes.NewReader(body))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, r.Method, url, r.Body)
+		if err == nil {
+			req.ContentLength = r.ContentLength
+		}
+	}
 	if err != nil {
+		done()
+		if p.breaker != nil {
+			p.breaker.Release(token)
+		}
 		return nil, err
 	}
 
-	if contentType := r.Header.Get("Content-Type"); contentType != "" {
-		req.Header.Set("Content-Type", contentType)
+	copyHeader(req.Header, r.Header)
+	removeHopHeaders(req.Header)
+	setForwardedHeaders(req.Header, r)
+
+	resp, err := p.client.Do(req)
+	if err == nil && isEventStream(resp.Header) {
+		lift()
+	}
+	if err != nil && ctx.Err() != nil {
+		// Say why the request was cut short: a timeout or the client leaving.
+		err = fmt.Errorf("%w: %v", context.Cause(ctx), err)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// The client went away; that says nothing about the upstream.
+		if p.breaker != nil {
+			p.breaker.Release(token)
+		}
+	} else {
+		success := err == nil && resp.StatusCode < http.StatusInternalServerError
+		p.pool.Report(endpoint, success)
+		if p.breaker != nil {
+			p.breaker.Done(token, success)
+		}
+	}
+
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &closeNotifier{ReadCloser: resp.Body, onClose: done}
+	return resp, nil
+}
+
+// backoff returns a random wait before the attempt after the given one.
+func (p *ServiceProxy) backoff(attempt int) time.Duration {
+	initial := time.Duration(p.retry.InitialBackoff)
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	maxBackoff := time.Duration(p.retry.MaxBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
 	}
 
-	return p.client.Do(req)
+	bound := maxBackoff
+	if shift := attempt - 1; shift < 32 && initial<<shift < maxBackoff {
+		bound = initial << shift
+	}
+	return rand.N(bound + 1)
+}
+
+func isRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrCircuitOpen) && !errors.Is(err, ErrNoHealthyEndpoints) && !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// errTimedOut is the cause of contexts cancelled by timeoutUntilStream.
+var errTimedOut = fmt.Errorf("timed out: %w", context.DeadlineExceeded)
+
+// timeoutUntilStream is context.WithTimeout, except that calling lift removes
+// the timeout. It is lifted once an upstream starts an event stream, which
+// lasts for as long as the client listens.
+func timeoutUntilStream(ctx context.Context, timeout time.Duration) (context.Context, func(), context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(errTimedOut) })
+	return ctx, func() { timer.Stop() }, func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// isEventStream reports whether a response is a stream of server-sent events.
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// closeNotifier ends an attempt, releasing its timeout and its endpoint, once
+// the response body has been read.
+type closeNotifier struct {
+	io.ReadCloser
+	onClose func()
+	once    sync.Once
+}
+
+func (c *closeNotifier) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+// CopyResponseHeader copies the end-to-end headers of a service response to
+// the response sent to the client.
+func CopyResponseHeader(dst, src http.Header) {
+	header := src.Clone()
+	removeHopHeaders(header)
+	copyHeader(dst, header)
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from header, including the
+// ones the Connection header names.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func setForwardedHeaders(header http.Header, r *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", clientIP)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", r.Host)
 }
@@ -2,11 +2,17 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServiceProxy_ForwardRequest(t *testing.T) {
@@ -83,3 +89,453 @@ func TestServiceProxy_ForwardRequest(t *testing.T) {
 		}
 	})
 }
+
+func TestServiceProxy_ForwardRequestURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		path      string
+		wantPath  string
+		wantQuery string
+	}{
+		{
+			name:     "without query string",
+			target:   "/orders",
+			path:     "/orders",
+			wantPath: "/orders",
+		},
+		{
+			name:      "with pagination and filters",
+			target:    "/customers/c1/orders?status=shipped&limit=5&offset=10",
+			path:      "/customers/c1/orders",
+			wantPath:  "/customers/c1/orders",
+			wantQuery: "status=shipped&limit=5&offset=10",
+		},
+		{
+			name:      "keeps escaping intact",
+			target:    "/inventory/backorders?item_id=ITEM%20001&note=a%26b",
+			path:      "/backorders",
+			wantPath:  "/backorders",
+			wantQuery: "item_id=ITEM%20001&note=a%26b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tt.wantPath {
+					t.Errorf("expected path %s, got %s", tt.wantPath, r.URL.Path)
+				}
+				if r.URL.RawQuery != tt.wantQuery {
+					t.Errorf("expected query %q, got %q", tt.wantQuery, r.URL.RawQuery)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			proxy := NewServiceProxy(server.URL, server.Client())
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			resp, err := proxy.ForwardRequest(context.Background(), req, tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_ = resp.Body.Close()
+		})
+	}
+}
+
+func TestServiceProxy_ForwardRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		want    map[string]string
+		absent  []string
+	}{
+		{
+			name: "forwards end-to-end headers",
+			prepare: func(r *http.Request) {
+				r.Header.Set("Accept", "application/json")
+				r.Header.Set("Authorization", "Bearer token")
+				r.Header.Set("X-Actor", "storefront")
+				r.Header.Set("If-Match", `"3"`)
+				r.Header.Set("X-Request-Source", "mobile")
+			},
+			want: map[string]string{
+				"Accept":           "application/json",
+				"Authorization":    "Bearer token",
+				"X-Actor":          "storefront",
+				"If-Match":         `"3"`,
+				"X-Request-Source": "mobile",
+			},
+		},
+		{
+			name: "strips hop-by-hop headers",
+			prepare: func(r *http.Request) {
+				r.Header.Set("Connection", "keep-alive, X-Session-Hint")
+				r.Header.Set("Keep-Alive", "timeout=5")
+				r.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+				r.Header.Set("Upgrade", "websocket")
+				r.Header.Set("Te", "trailers")
+				r.Header.Set("X-Session-Hint", "abc")
+				r.Header.Set("X-Request-Source", "mobile")
+			},
+			want: map[string]string{
+				"X-Request-Source": "mobile",
+			},
+			absent: []string{"Keep-Alive", "Proxy-Authorization", "Upgrade", "Te", "X-Session-Hint"},
+		},
+		{
+			name: "identifies the client",
+			prepare: func(r *http.Request) {
+				r.RemoteAddr = "203.0.113.7:51234"
+				r.Host = "shop.example.com"
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "shop.example.com",
+			},
+		},
+		{
+			name: "appends to an existing X-Forwarded-For",
+			prepare: func(r *http.Request) {
+				r.RemoteAddr = "203.0.113.7:51234"
+				r.Header.Set("X-Forwarded-For", "198.51.100.1")
+			},
+			want: map[string]string{
+				"X-Forwarded-For": "198.51.100.1, 203.0.113.7",
+			},
+		},
+		{
+			name: "reports https for TLS clients",
+			prepare: func(r *http.Request) {
+				r.TLS = &tls.ConnectionState{}
+			},
+			want: map[string]string{
+				"X-Forwarded-Proto": "https",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.want {
+					if got := r.Header.Get(name); got != value {
+						t.Errorf("expected %s %q, got %q", name, value, got)
+					}
+				}
+				for _, name := range tt.absent {
+					if got := r.Header.Get(name); got != "" {
+						t.Errorf("expected %s to be stripped, got %q", name, got)
+					}
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			proxy := NewServiceProxy(server.URL, server.Client())
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			tt.prepare(req)
+			resp, err := proxy.ForwardRequest(context.Background(), req, "/orders")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_ = resp.Body.Close()
+		})
+	}
+}
+
+func TestCopyResponseHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    http.Header
+		want   http.Header
+		absent []string
+	}{
+		{
+			name: "copies end-to-end headers",
+			src: http.Header{
+				"Content-Type":  {"application/json"},
+				"Etag":          {`"2"`},
+				"Cache-Control": {"no-store"},
+				"Location":      {"/orders/1"},
+				"Set-Cookie":    {"a=1", "b=2"},
+			},
+			want: http.Header{
+				"Content-Type":  {"application/json"},
+				"Etag":          {`"2"`},
+				"Cache-Control": {"no-store"},
+				"Location":      {"/orders/1"},
+				"Set-Cookie":    {"a=1", "b=2"},
+			},
+		},
+		{
+			name: "drops hop-by-hop headers",
+			src: http.Header{
+				"Connection":        {"X-Upstream-Hint"},
+				"Keep-Alive":        {"timeout=5"},
+				"Transfer-Encoding": {"chunked"},
+				"X-Upstream-Hint":   {"1"},
+				"X-Request-Id":      {"abc"},
+			},
+			want: http.Header{
+				"X-Request-Id": {"abc"},
+			},
+			absent: []string{"Connection", "Keep-Alive", "Transfer-Encoding", "X-Upstream-Hint"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := http.Header{}
+			CopyResponseHeader(dst, tt.src)
+
+			for name, values := range tt.want {
+				got := dst.Values(name)
+				if strings.Join(got, "|") != strings.Join(values, "|") {
+					t.Errorf("expected %s %v, got %v", name, values, got)
+				}
+			}
+			for _, name := range tt.absent {
+				if _, ok := dst[http.CanonicalHeaderKey(name)]; ok {
+					t.Errorf("expected %s to be dropped", name)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceProxy_Retry(t *testing.T) {
+	retry := RetryConfig{Attempts: 3, InitialBackoff: Duration(time.Millisecond), MaxBackoff: Duration(5 * time.Millisecond)}
+
+	// flaky answers 503 to the first failures requests and records the
+	// bodies it was sent.
+	flaky := func(failures int) (*httptest.Server, *[]string) {
+		var mu sync.Mutex
+		var bodies []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			bodies = append(bodies, string(body))
+			attempt := len(bodies)
+			mu.Unlock()
+
+			if attempt <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		return server, &bodies
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		header       http.Header
+		failures     int
+		wantStatus   int
+		wantAttempts int
+	}{
+		{
+			name:         "retries GET until it succeeds",
+			method:       http.MethodGet,
+			failures:     2,
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up after the last attempt",
+			method:       http.MethodGet,
+			failures:     5,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 3,
+		},
+		{
+			name:         "never retries POST without an idempotency key",
+			method:       http.MethodPost,
+			body:         `{"customer_id":"1"}`,
+			failures:     1,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 1,
+		},
+		{
+			name:         "retries POST with an idempotency key and resends the body",
+			method:       http.MethodPost,
+			body:         `{"customer_id":"1"}`,
+			header:       http.Header{"Idempotency-Key": {"key-1"}},
+			failures:     1,
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "never retries PATCH without an idempotency key",
+			method:       http.MethodPatch,
+			body:         `{"status":"confirmed"}`,
+			failures:     1,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 1,
+		},
+		{
+			name:         "retries PUT and resends the body",
+			method:       http.MethodPut,
+			body:         `{"tax_rate_bps":725}`,
+			failures:     1,
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "retries DELETE",
+			method:       http.MethodDelete,
+			failures:     1,
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, bodies := flaky(tt.failures)
+			defer server.Close()
+
+			proxy := NewServiceProxy(server.URL, server.Client(), WithRetry(retry))
+			req := httptest.NewRequest(tt.method, "/orders", strings.NewReader(tt.body))
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+
+			resp, err := proxy.ForwardRequest(context.Background(), req, "/orders")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if len(*bodies) != tt.wantAttempts {
+				t.Fatalf("expected %d attempts, got %d", tt.wantAttempts, len(*bodies))
+			}
+			for i, body := range *bodies {
+				if body != tt.body {
+					t.Errorf("attempt %d: expected body %q, got %q", i+1, tt.body, body)
+				}
+			}
+		})
+	}
+
+	t.Run("retries attempts that time out", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				<-r.Context().Done()
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		proxy := NewServiceProxy(server.URL, server.Client(), WithRetry(retry), WithTimeout(50*time.Millisecond))
+		resp, err := proxy.ForwardRequest(context.Background(), httptest.NewRequest(http.MethodGet, "/stock", nil), "/stock")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || calls.Load() != 2 {
+			t.Errorf("expected success on the second attempt, got status %d after %d attempts", resp.StatusCode, calls.Load())
+		}
+	})
+
+	t.Run("a POST without an idempotency key that times out creates exactly one order", func(t *testing.T) {
+		// The upstream creates the order and then takes too long to answer,
+		// so the gateway cannot tell whether the write happened.
+		var created atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			created.Add(1)
+			<-r.Context().Done()
+		}))
+
+		proxy := NewServiceProxy(server.URL, server.Client(), WithRetry(retry), WithTimeout(50*time.Millisecond))
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"customer_id":"1"}`))
+		if resp, err := proxy.ForwardRequest(context.Background(), req, "/orders"); err == nil {
+			_ = resp.Body.Close()
+		}
+
+		// Close waits for every request the upstream received.
+		server.Close()
+		if got := created.Load(); got != 1 {
+			t.Errorf("expected exactly one order, got %d", got)
+		}
+	})
+
+	t.Run("stops retrying when the request context ends", func(t *testing.T) {
+		server, _ := flaky(5)
+		defer server.Close()
+
+		slow := RetryConfig{Attempts: 5, InitialBackoff: Duration(time.Second), MaxBackoff: Duration(time.Second)}
+		proxy := NewServiceProxy(server.URL, server.Client(), WithRetry(slow))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := proxy.ForwardRequest(ctx, httptest.NewRequest(http.MethodGet, "/stock", nil), "/stock")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected to stop waiting when the context ended, took %s", elapsed)
+		}
+	})
+}
+
+func TestServiceProxy_CircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	breaker := NewCircuitBreaker("inventory", CircuitBreakerConfig{FailureThreshold: 2, OpenFor: Duration(time.Minute)})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	proxy := NewServiceProxy(server.URL, server.Client(), WithName("inventory"), WithCircuitBreaker(breaker))
+	handler := NewHandler(proxy, RewriteConfig{}, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	get := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stock", nil))
+		return rec.Code
+	}
+
+	get()
+	get()
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("expected the breaker to open after 2 failures, got %s", breaker.State())
+	}
+
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 while open, got %d", code)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected no request to reach the upstream while open, got %d calls", calls.Load())
+	}
+
+	healthy.Store(true)
+	now = now.Add(time.Minute)
+	if code := get(); code != http.StatusOK {
+		t.Errorf("expected the probe to succeed, got %d", code)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("expected the breaker to close after a successful probe, got %s", breaker.State())
+	}
+}
@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sweepEvery is how many takes the memory store waits between dropping
+// buckets that have refilled completely.
+const sweepEvery = 1024
+
+// RateLimit is a token bucket that holds up to Burst tokens and refills at
+// Rate tokens per second. Each request takes one token.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitResult is the state of a bucket after a take.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the next token, when the take was refused.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// RateLimitStore keeps the token buckets of the rate_limit middleware. The
+// memory store is local to one gateway; a store shared between gateways
+// would enforce one limit across all of them.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+// MemoryRateLimitStore keeps token buckets in memory.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	takes   int
+	now     func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	s.takes++
+	if s.takes%sweepEvery == 0 {
+		s.sweep(now)
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok || bucket.limit != limit {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		s.buckets[key] = bucket
+	}
+	bucket.refill(now)
+
+	result := RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - bucket.tokens) / limit.Rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsToDuration((float64(limit.Burst) - bucket.tokens) / limit.Rate)
+
+	return result, nil
+}
+
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range s.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.updated = now
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// rateLimitMiddleware limits requests per route. The key option picks whose
+// requests share a bucket: "ip" per client address, "api_key" per caller
+// verified by an earlier auth middleware (falling back to the client
+// address), or "route" for all requests to the route together.
+func rateLimitMiddleware(store RateLimitStore) MiddlewareFactory {
+	return func(options map[string]any) (Middleware, error) {
+		var opts struct {
+			Requests int      `json:"requests"`
+			Per      Duration `json:"per"`
+			Burst    int      `json:"burst"`
+			Key      string   `json:"key"`
+		}
+		if err := decodeOptions(options, &opts); err != nil {
+			return nil, err
+		}
+		if opts.Requests <= 0 {
+			return nil, fmt.Errorf("requests must be positive")
+		}
+		if opts.Per <= 0 {
+			opts.Per = Duration(time.Second)
+		}
+		if opts.Burst <= 0 {
+			opts.Burst = opts.Requests
+		}
+		switch opts.Key {
+		case "":
+			opts.Key = "ip"
+		case "ip", "api_key", "route":
+		default:
+			return nil, fmt.Errorf("unknown key %q", opts.Key)
+		}
+
+		limit := RateLimit{
+			Rate:  float64(opts.Requests) / time.Duration(opts.Per).Seconds(),
+			Burst: opts.Burst,
+		}
+
+		rejected, err := otel.Meter("gateway/ratelimit").Int64Counter("gateway.rate_limit.rejected",
+			metric.WithDescription("Requests refused by the gateway rate limiter"),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				span := trace.SpanFromContext(r.Context())
+
+				result, err := store.Take(r.Context(), r.Pattern+" "+rateLimitKey(r, opts.Key), limit)
+				if err != nil {
+					// A broken store should not take the gateway down with it.
+					span.RecordError(fmt.Errorf("rate limit store: %w", err))
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+				w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+				w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+				if !result.Allowed {
+					attrs := []attribute.KeyValue{
+						attribute.String("http.route", r.Pattern),
+						attribute.String("gateway.rate_limit.key", opts.Key),
+					}
+					span.AddEvent("rate limit exceeded", trace.WithAttributes(attrs...))
+					rejected.Add(r.Context(), 1, metric.WithAttributes(attrs...))
+
+					w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(result.RetryAfter))))
+					writeMiddlewareError(w, http.StatusTooManyRequests, "rate limit exceeded")
+					return
+				}
+
+				next.ServeHTTP(w, r)
+			})
+		}, nil
+	}
+}
+
+func rateLimitKey(r *http.Request, kind string) string {
+	switch kind {
+	case "route":
+		return "route"
+	case "api_key":
+		if identity, ok := IdentityFromContext(r.Context()); ok {
+			return "subject:" + identity.Subject
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,234 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	limit := RateLimit{Rate: 1, Burst: 2}
+	ctx := context.Background()
+
+	take := func(key string) RateLimitResult {
+		t.Helper()
+		result, err := store.Take(ctx, key, limit)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result
+	}
+
+	if result := take("a"); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("expected first take allowed with 1 remaining, got %+v", result)
+	}
+	if result := take("a"); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("expected second take allowed with 0 remaining, got %+v", result)
+	}
+
+	result := take("a")
+	if result.Allowed {
+		t.Fatal("expected the empty bucket to refuse")
+	}
+	if result.RetryAfter != time.Second || result.Reset != 2*time.Second {
+		t.Errorf("expected retry after 1s and reset in 2s, got %+v", result)
+	}
+
+	if result := take("b"); !result.Allowed {
+		t.Error("expected another key to have its own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if result := take("a"); result.Allowed || result.RetryAfter != 500*time.Millisecond {
+		t.Errorf("expected refusal with retry after 500ms, got %+v", result)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if result := take("a"); !result.Allowed {
+		t.Errorf("expected a refilled token, got %+v", result)
+	}
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(context.Context, string, RateLimit) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("store unavailable")
+}
+
+func TestRouter_RateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	config := func(key string) string {
+		return writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    url: `+upstream.URL+`
+auth:
+  api_keys:
+    - key: key-a
+      subject: a
+    - key: key-b
+      subject: b
+routes:
+  - method: POST
+    pattern: /orders
+    upstream: orders
+    middleware:
+      - name: auth
+      - name: rate_limit
+        options:
+          requests: 1
+          per: 1m
+          burst: 2
+          key: `+key+`
+`)
+	}
+	post := func(router *Router, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("refuses requests over the limit", func(t *testing.T) {
+		reader := sdkmetric.NewManualReader()
+		otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+		router := NewRouter(config("ip"), upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			rec := post(router, "10.0.0.1:5000", "key-a")
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("request %d: expected status 201, got %d", i+1, rec.Code)
+			}
+			if rec.Header().Get("RateLimit-Limit") != "2" {
+				t.Errorf("expected RateLimit-Limit 2, got %q", rec.Header().Get("RateLimit-Limit"))
+			}
+		}
+
+		recorder := tracetest.NewSpanRecorder()
+		ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test").Start(context.Background(), "gateway")
+		req := httptest.NewRequest(http.MethodPost, "/orders", nil).WithContext(ctx)
+		req.RemoteAddr = "10.0.0.1:5001"
+		req.Header.Set("X-API-Key", "key-b")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		span.End()
+
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status 429, got %d", rec.Code)
+		}
+		if rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("expected Retry-After 60, got %q", rec.Header().Get("Retry-After"))
+		}
+		if rec.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("expected RateLimit-Remaining 0, got %q", rec.Header().Get("RateLimit-Remaining"))
+		}
+		if rec.Header().Get("RateLimit-Reset") != "120" {
+			t.Errorf("expected RateLimit-Reset 120, got %q", rec.Header().Get("RateLimit-Reset"))
+		}
+
+		events := recorder.Ended()[0].Events()
+		if len(events) != 1 || events[0].Name != "rate limit exceeded" {
+			t.Errorf("expected a rate limit exceeded event, got %+v", events)
+		}
+
+		var metrics metricdata.ResourceMetrics
+		if err := reader.Collect(context.Background(), &metrics); err != nil {
+			t.Fatalf("failed to collect metrics: %v", err)
+		}
+		var rejected int64
+		for _, scope := range metrics.ScopeMetrics {
+			for _, m := range scope.Metrics {
+				if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == "gateway.rate_limit.rejected" {
+					for _, point := range sum.DataPoints {
+						rejected += point.Value
+					}
+				}
+			}
+		}
+		if rejected != 1 {
+			t.Errorf("expected 1 rejection recorded, got %d", rejected)
+		}
+
+		if rec := post(router, "10.0.0.2:5000", "key-a"); rec.Code != http.StatusCreated {
+			t.Errorf("expected another client to be allowed, got %d", rec.Code)
+		}
+	})
+
+	t.Run("keys by API key", func(t *testing.T) {
+		router := NewRouter(config("api_key"), upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		post(router, "10.0.0.1:5000", "key-a")
+		post(router, "10.0.0.2:5000", "key-a")
+		if rec := post(router, "10.0.0.3:5000", "key-a"); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("expected key-a to be limited from any address, got %d", rec.Code)
+		}
+		if rec := post(router, "10.0.0.1:5000", "key-b"); rec.Code != http.StatusCreated {
+			t.Errorf("expected key-b to have its own limit, got %d", rec.Code)
+		}
+	})
+
+	t.Run("keeps buckets across reloads", func(t *testing.T) {
+		router := NewRouter(config("route"), upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		post(router, "10.0.0.1:5000", "key-a")
+		post(router, "10.0.0.2:5000", "key-b")
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec := post(router, "10.0.0.3:5000", "key-a"); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("expected the route limit to survive a reload, got %d", rec.Code)
+		}
+	})
+
+	t.Run("lets requests through when the store fails", func(t *testing.T) {
+		router := NewRouter(config("ip"), upstream.Client(), logger)
+		router.SetRateLimitStore(failingRateLimitStore{})
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if rec := post(router, "10.0.0.1:5000", "key-a"); rec.Code != http.StatusCreated {
+				t.Errorf("request %d: expected status 201, got %d", i+1, rec.Code)
+			}
+		}
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		router := NewRouter(config("cookie"), upstream.Client(), logger)
+		if err := router.Load(); err == nil {
+			t.Error("expected an error for an unknown key")
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/telemetry"
+)
+
+// Router serves the routes of the gateway config. Reload swaps in a new
+// routing table without dropping requests in flight.
+type Router struct {
+	path       string
+	client     *http.Client
+	logger     *slog.Logger
+	middleware map[string]MiddlewareFactory
+	aggregates map[string]AggregateFactory
+	rateLimits RateLimitStore
+	cache      *ResponseCache
+	breakers   map[string]*CircuitBreaker
+	pools      map[string]*EndpointPool
+	health     *http.Client
+	loadMu     sync.Mutex
+	mux        atomic.Pointer[http.ServeMux]
+}
+
+func NewRouter(path string, client *http.Client, logger *slog.Logger) *Router {
+	return &Router{
+		path:   path,
+		client: client,
+		logger: logger,
+		middleware: map[string]MiddlewareFactory{
+			"set_headers":    setHeadersMiddleware,
+			"max_body_bytes": maxBodyBytesMiddleware,
+		},
+		aggregates: map[string]AggregateFactory{
+			"order_details": orderDetailsAggregate,
+		},
+		rateLimits: NewMemoryRateLimitStore(),
+		cache:      NewResponseCache(),
+		breakers:   make(map[string]*CircuitBreaker),
+		pools:      make(map[string]*EndpointPool),
+		// Health checks are not traced; they would drown out real requests.
+		health: &http.Client{},
+	}
+}
+
+// RegisterMiddleware makes a middleware available to routes under name.
+// Call it before Load.
+func (rt *Router) RegisterMiddleware(name string, factory MiddlewareFactory) {
+	rt.middleware[name] = factory
+}
+
+// RegisterAggregate makes an aggregate available to routes under name. Call
+// it before Load.
+func (rt *Router) RegisterAggregate(name string, factory AggregateFactory) {
+	rt.aggregates[name] = factory
+}
+
+// SetRateLimitStore replaces the in-memory store of the rate_limit
+// middleware. Call it before Load.
+func (rt *Router) SetRateLimitStore(store RateLimitStore) {
+	rt.rateLimits = store
+}
+
+// Load reads the config file and starts serving its routes. If the file is
+// invalid the routes already loaded stay in place.
+func (rt *Router) Load() error {
+	rt.loadMu.Lock()
+	defer rt.loadMu.Unlock()
+
+	cfg, err := LoadConfig(rt.path)
+	if err != nil {
+		return err
+	}
+
+	mux, pools, breakers, err := rt.build(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", rt.path, err)
+	}
+
+	for name, pool := range rt.pools {
+		if pools[name] != pool {
+			pool.Stop()
+		}
+	}
+	for _, pool := range pools {
+		pool.Start(rt.health)
+	}
+	rt.pools = pools
+	rt.breakers = breakers
+	rt.cache.SetLimits(cfg.Cache)
+
+	rt.mux.Store(mux)
+	rt.logger.Info("routes loaded", "path", rt.path, "routes", len(cfg.Routes))
+	return nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, name := range identityHeaders {
+		r.Header.Del(name)
+	}
+
+	mux := rt.mux.Load()
+	if mux == nil {
+		http.NotFound(w, r)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// Close stops the health checks of all upstreams.
+func (rt *Router) Close() {
+	rt.loadMu.Lock()
+	defer rt.loadMu.Unlock()
+
+	for _, pool := range rt.pools {
+		pool.Stop()
+	}
+}
+
+// build returns the mux for cfg and the endpoint pools and circuit breakers of
+// its upstreams. Pools and breakers whose settings did not change are carried
+// over, health and breaker state included. Nothing on rt changes, so a config
+// that fails to build leaves the loaded one untouched.
+func (rt *Router) build(cfg *Config) (mux *http.ServeMux, pools map[string]*EndpointPool, breakers map[string]*CircuitBreaker, err error) {
+	// ServeMux panics on invalid or conflicting patterns.
+	defer func() {
+		if p := recover(); p != nil {
+			mux, pools, breakers, err = nil, nil, nil, fmt.Errorf("%v", p)
+		}
+	}()
+
+	pools = make(map[string]*EndpointPool, len(cfg.Upstreams))
+	breakers = make(map[string]*CircuitBreaker, len(cfg.Upstreams))
+	proxies := make(map[string]*ServiceProxy, len(cfg.Upstreams))
+	for name, upstream := range cfg.Upstreams {
+		urls := endpointURLs(upstream)
+		poolConfig := PoolConfig{
+			Balancer:    upstream.Balancer,
+			HealthCheck: upstream.HealthCheck,
+			Ejection:    upstream.Ejection,
+		}
+		pool, ok := rt.pools[name]
+		if !ok || !pool.sameAs(urls, poolConfig) {
+			pool = NewEndpointPool(name, urls, poolConfig, rt.logger)
+		}
+		pools[name] = pool
+
+		opts := []ProxyOption{
+			WithName(name),
+			WithEndpointPool(pool),
+			WithTimeout(time.Duration(upstream.Timeout)),
+			WithRetry(upstream.Retry),
+		}
+		if breaker := rt.breaker(name, upstream.CircuitBreaker); breaker != nil {
+			breakers[name] = breaker
+			opts = append(opts, WithCircuitBreaker(breaker))
+		}
+		proxies[name] = NewServiceProxy("", rt.client, opts...)
+	}
+
+	authenticator, err := NewAuthenticator(cfg.Auth)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	factories := maps.Clone(rt.middleware)
+	factories["auth"] = authenticator.authMiddleware
+	factories["rate_limit"] = rateLimitMiddleware(rt.rateLimits)
+	factories["cache"] = cacheMiddleware(rt.cache)
+
+	mux = http.NewServeMux()
+	for _, route := range cfg.Routes {
+		var handler http.Handler
+		if route.Aggregate.Name != "" {
+			factory, ok := rt.aggregates[route.Aggregate.Name]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("route %s %s: unknown aggregate %q", route.Method, route.Pattern, route.Aggregate.Name)
+			}
+			aggregate, err := factory(proxies, route.Aggregate.Options, rt.logger)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("route %s %s: aggregate %s: %w", route.Method, route.Pattern, route.Aggregate.Name, err)
+			}
+			handler = withTimeout(aggregate, cfg.timeout(route))
+		} else {
+			handler = NewHandler(proxies[route.Upstream], route.Rewrite, cfg.timeout(route), rt.logger)
+		}
+
+		chain := append(append([]MiddlewareConfig{}, cfg.Defaults.Middleware...), route.Middleware...)
+		for i := len(chain) - 1; i >= 0; i-- {
+			factory, ok := factories[chain[i].Name]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("route %s %s: unknown middleware %q", route.Method, route.Pattern, chain[i].Name)
+			}
+			middleware, err := factory(chain[i].Options)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("route %s %s: middleware %s: %w", route.Method, route.Pattern, chain[i].Name, err)
+			}
+			handler = middleware(handler)
+		}
+
+		mux.HandleFunc(route.Method+" "+route.Pattern, telemetry.WithHTTPRoute(handler.ServeHTTP))
+	}
+
+	return mux, pools, breakers, nil
+}
+
+// breaker returns the circuit breaker of an upstream, keeping its state
+// across reloads unless its settings changed.
+func (rt *Router) breaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	if config.FailureThreshold == 0 {
+		return nil
+	}
+	if breaker, ok := rt.breakers[name]; ok && breaker.config == config {
+		return breaker
+	}
+	return NewCircuitBreaker(name, config)
+}
@@ -0,0 +1,324 @@
+package gateway
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("reads YAML and expands environment variables", func(t *testing.T) {
+		t.Setenv("TEST_ORDERS_URL", "http://orders:8081")
+		path := writeConfig(t, "gateway.yaml", `
+upstreams:
+  orders:
+    url: ${TEST_ORDERS_URL}
+defaults:
+  timeout: 2s
+routes:
+  - method: GET
+    pattern: /orders
+    upstream: orders
+  - method: GET
+    pattern: /orders/{id}
+    upstream: orders
+    timeout: 500ms
+`)
+
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.Upstreams["orders"].URL != "http://orders:8081" {
+			t.Errorf("expected expanded url, got %q", cfg.Upstreams["orders"].URL)
+		}
+		if got := cfg.timeout(cfg.Routes[0]); got != 2*time.Second {
+			t.Errorf("expected default timeout 2s, got %s", got)
+		}
+		if got := cfg.timeout(cfg.Routes[1]); got != 500*time.Millisecond {
+			t.Errorf("expected route timeout 500ms, got %s", got)
+		}
+	})
+
+	t.Run("reads JSON", func(t *testing.T) {
+		path := writeConfig(t, "gateway.json", `{
+			"upstreams": {"orders": {"url": "http://orders:8081"}},
+			"routes": [{"method": "GET", "pattern": "/orders", "upstream": "orders"}]
+		}`)
+
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := cfg.timeout(cfg.Routes[0]); got != defaultRouteTimeout {
+			t.Errorf("expected timeout %s, got %s", defaultRouteTimeout, got)
+		}
+	})
+
+	t.Run("rejects invalid configs", func(t *testing.T) {
+		tests := map[string]string{
+			"unknown upstream": `
+upstreams:
+  orders:
+    url: http://orders:8081
+routes:
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+`,
+			"empty url": `
+upstreams:
+  orders:
+    url: ${TEST_UNSET_URL}
+routes:
+  - method: GET
+    pattern: /orders
+    upstream: orders
+`,
+			"bad timeout": `
+upstreams:
+  orders:
+    url: http://orders:8081
+routes:
+  - method: GET
+    pattern: /orders
+    upstream: orders
+    timeout: soon
+`,
+		}
+		for name, content := range tests {
+			if _, err := LoadConfig(writeConfig(t, "gateway.yaml", content)); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+	})
+
+	t.Run("loads the shipped config", func(t *testing.T) {
+		t.Setenv("ORDERS_SERVICE_URL", "http://orders:8081")
+		t.Setenv("INVENTORY_SERVICE_URL", "http://inventory:8082")
+
+		router := NewRouter(filepath.Join("..", "..", "config", "gateway.yaml"), http.DefaultClient, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestRouter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.Header().Set("X-Upstream-Team", r.Header.Get("X-Team"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	config := func(routes string) string {
+		return "upstreams:\n  inventory:\n    url: " + upstream.URL + "\nroutes:\n" + routes
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("rewrites paths", func(t *testing.T) {
+		path := writeConfig(t, "gateway.yaml", config(`
+  - method: GET
+    pattern: /inventory/stock/{itemId}
+    upstream: inventory
+    rewrite:
+      strip_prefix: /inventory
+  - method: GET
+    pattern: /items/{itemId}/stock
+    upstream: inventory
+    rewrite:
+      path: /stock/{itemId}
+  - method: GET
+    pattern: /warehouse/{rest...}
+    upstream: inventory
+    rewrite:
+      strip_prefix: /warehouse
+      add_prefix: /locations
+`))
+		router := NewRouter(path, upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		tests := map[string]string{
+			"/inventory/stock/item-1": "/stock/item-1",
+			"/items/item-2/stock":     "/stock/item-2",
+			"/warehouse/WH-1/stock":   "/locations/WH-1/stock",
+		}
+		for requestPath, want := range tests {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, requestPath, nil))
+
+			if got := rec.Header().Get("X-Upstream-Path"); got != want {
+				t.Errorf("%s: expected upstream path %s, got %s", requestPath, want, got)
+			}
+		}
+	})
+
+	t.Run("applies route middleware", func(t *testing.T) {
+		path := writeConfig(t, "gateway.yaml", config(`
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+    middleware:
+      - name: set_headers
+        options:
+          request:
+            X-Team: fulfilment
+          response:
+            Cache-Control: no-store
+  - method: POST
+    pattern: /items
+    upstream: inventory
+    middleware:
+      - name: max_body_bytes
+        options:
+          limit: 8
+`))
+		router := NewRouter(path, upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stock", nil))
+		if got := rec.Header().Get("X-Upstream-Team"); got != "fulfilment" {
+			t.Errorf("expected request header to reach upstream, got %q", got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("expected Cache-Control no-store, got %q", got)
+		}
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"item_id":"too-long"}`)))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", rec.Code)
+		}
+	})
+
+	t.Run("rejects unknown middleware", func(t *testing.T) {
+		path := writeConfig(t, "gateway.yaml", config(`
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+    middleware:
+      - name: teleport
+`))
+		if err := NewRouter(path, upstream.Client(), logger).Load(); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("reload keeps the current routes when the new config is invalid", func(t *testing.T) {
+		path := writeConfig(t, "gateway.yaml", config(`
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+`))
+		router := NewRouter(path, upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		conflicting := config(`
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+`)
+		if err := os.WriteFile(path, []byte(conflicting), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if err := router.Load(); err == nil {
+			t.Fatal("expected an error for conflicting routes")
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stock", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected the old route to keep working, got %d", rec.Code)
+		}
+
+		updated := config(`
+  - method: GET
+    pattern: /locations
+    upstream: inventory
+`)
+		if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/locations", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected the new route to be served, got %d", rec.Code)
+		}
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stock", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected the removed route to 404, got %d", rec.Code)
+		}
+	})
+
+	t.Run("a failed reload keeps the circuit breakers in use", func(t *testing.T) {
+		withBreaker := func(threshold string, routes string) string {
+			return "upstreams:\n  inventory:\n    url: " + upstream.URL +
+				"\n    circuit_breaker:\n      failure_threshold: " + threshold + "\n      open_for: 10s\nroutes:\n" + routes
+		}
+		route := `
+  - method: GET
+    pattern: /stock
+    upstream: inventory
+`
+		path := writeConfig(t, "gateway.yaml", withBreaker("5", route))
+		router := NewRouter(path, upstream.Client(), logger)
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		breaker := router.breakers["inventory"]
+		if breaker == nil {
+			t.Fatal("expected a circuit breaker for inventory")
+		}
+
+		if err := os.WriteFile(path, []byte(withBreaker("3", route+route)), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if err := router.Load(); err == nil {
+			t.Fatal("expected an error for conflicting routes")
+		}
+		if router.breakers["inventory"] != breaker {
+			t.Error("expected the failed reload to leave the breaker in place")
+		}
+
+		if err := os.WriteFile(path, []byte(withBreaker("3", route)), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if err := router.Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if router.breakers["inventory"] == breaker {
+			t.Error("expected new breaker settings to replace the breaker")
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package inventory
+
+import "github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+
+type locationStock struct {
+	itemID     string
+	locationID string
+	available  int
+}
+
+type allocation struct {
+	itemID     string
+	locationID string
+	quantity   int
+}
+
+// allocate decides which locations fulfil requested. stock must be ordered by
+// location priority. A location that can ship every item wins; otherwise each
+// item is served from a single location where possible, and only then split
+// across locations in priority order. Items that cannot be covered at all are
+// returned as shortfalls.
+func allocate(itemIDs []string, requested map[string]int, stock []locationStock) ([]allocation, []domain.StockShortfall) {
+	var locations []string
+	byItem := make(map[string][]locationStock)
+	availableAt := make(map[string]map[string]int)
+	for _, s := range stock {
+		if availableAt[s.locationID] == nil {
+			availableAt[s.locationID] = make(map[string]int)
+			locations = append(locations, s.locationID)
+		}
+		availableAt[s.locationID][s.itemID] = s.available
+		byItem[s.itemID] = append(byItem[s.itemID], s)
+	}
+
+	for _, locationID := range locations {
+		if coversAll(availableAt[locationID], itemIDs, requested) {
+			allocations := make([]allocation, 0, len(itemIDs))
+			for _, itemID := range itemIDs {
+				allocations = append(allocations, allocation{itemID: itemID, locationID: locationID, quantity: requested[itemID]})
+			}
+			return allocations, nil
+		}
+	}
+
+	var allocations []allocation
+	var shortfalls []domain.StockShortfall
+	for _, itemID := range itemIDs {
+		itemAllocations, ok := allocateItem(itemID, requested[itemID], byItem[itemID])
+		if !ok {
+			total := 0
+			for _, s := range byItem[itemID] {
+				total += s.available
+			}
+			shortfalls = append(shortfalls, domain.StockShortfall{
+				ItemID:    itemID,
+				Requested: requested[itemID],
+				Available: total,
+			})
+			continue
+		}
+		allocations = append(allocations, itemAllocations...)
+	}
+
+	return allocations, shortfalls
+}
+
+func coversAll(available map[string]int, itemIDs []string, requested map[string]int) bool {
+	for _, itemID := range itemIDs {
+		if available[itemID] < requested[itemID] {
+			return false
+		}
+	}
+	return true
+}
+
+func allocateItem(itemID string, quantity int, stock []locationStock) ([]allocation, bool) {
+	for _, s := range stock {
+		if s.available >= quantity {
+			return []allocation{{itemID: itemID, locationID: s.locationID, quantity: quantity}}, true
+		}
+	}
+
+	var allocations []allocation
+	remaining := quantity
+	for _, s := range stock {
+		if remaining == 0 {
+			break
+		}
+		take := min(s.available, remaining)
+		if take <= 0 {
+			continue
+		}
+		allocations = append(allocations, allocation{itemID: itemID, locationID: s.locationID, quantity: take})
+		remaining -= take
+	}
+
+	return allocations, remaining == 0
+}
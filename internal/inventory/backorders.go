@@ -0,0 +1,270 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
+)
+
+const (
+	BackorderWaiting   = "waiting"
+	BackorderFilled    = "filled"
+	BackorderCancelled = "cancelled"
+)
+
+// CreateBackorder queues orderID until stock for all of items arrives.
+// Queueing an order twice keeps its original place in the queue.
+func (r *InventoryRepository) CreateBackorder(ctx context.Context, orderID, customerID string, items []domain.ReservationItem) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO backorders (order_id, customer_id, status, created_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (order_id) DO NOTHING
+	`, orderID, customerID, BackorderWaiting)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return nil
+	}
+
+	for _, item := range items {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO backorder_items (order_id, item_id, quantity)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (order_id, item_id) DO UPDATE
+			SET quantity = backorder_items.quantity + EXCLUDED.quantity
+		`, orderID, item.ItemID, item.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *InventoryRepository) GetBackorder(ctx context.Context, orderID string) (*domain.Backorder, error) {
+	backorders, err := r.queryBackorders(ctx, `
+		SELECT order_id, customer_id, status, created_at, filled_at
+		FROM backorders
+		WHERE order_id = $1
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(backorders) == 0 {
+		return nil, nil
+	}
+
+	return &backorders[0], nil
+}
+
+// CancelBackorder takes a waiting order out of the queue. Filled and already
+// cancelled backorders are left as they are.
+func (r *InventoryRepository) CancelBackorder(ctx context.Context, orderID string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE backorders SET status = $2
+		WHERE order_id = $1 AND status = $3
+	`, orderID, BackorderCancelled, BackorderWaiting)
+	return err
+}
+
+// ListBackorders returns waiting backorders in queue order, optionally only
+// those that need itemID.
+func (r *InventoryRepository) ListBackorders(ctx context.Context, itemID string) ([]domain.Backorder, error) {
+	return r.queryBackorders(ctx, `
+		SELECT order_id, customer_id, status, created_at, filled_at
+		FROM backorders b
+		WHERE status = 'waiting'
+			AND ($1 = '' OR EXISTS (
+				SELECT 1 FROM backorder_items i
+				WHERE i.order_id = b.order_id AND i.item_id = $1
+			))
+		ORDER BY id
+	`, itemID)
+}
+
+func (r *InventoryRepository) queryBackorders(ctx context.Context, query string, arg string) ([]domain.Backorder, error) {
+	rows, err := r.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	backorders := []domain.Backorder{}
+	index := make(map[string]int)
+	for rows.Next() {
+		var b domain.Backorder
+		var filledAt sql.NullTime
+		if err := rows.Scan(&b.OrderID, &b.CustomerID, &b.Status, &b.CreatedAt, &filledAt); err != nil {
+			return nil, err
+		}
+		if filledAt.Valid {
+			b.FilledAt = &filledAt.Time
+		}
+		b.Items = []domain.ReservationItem{}
+		index[b.OrderID] = len(backorders)
+		backorders = append(backorders, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(backorders) == 0 {
+		return backorders, nil
+	}
+
+	orderIDs := make([]string, 0, len(backorders))
+	for _, b := range backorders {
+		orderIDs = append(orderIDs, b.OrderID)
+	}
+
+	itemRows, err := r.db.QueryContext(ctx, `
+		SELECT order_id, item_id, quantity
+		FROM backorder_items
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, item_id
+	`, pq.Array(orderIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = itemRows.Close() }()
+
+	for itemRows.Next() {
+		var orderID string
+		var item domain.ReservationItem
+		if err := itemRows.Scan(&orderID, &item.ItemID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		b := &backorders[index[orderID]]
+		b.Items = append(b.Items, item)
+	}
+
+	if err := itemRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return backorders, nil
+}
+
+// FillBackorders reserves stock for the backorders waiting on itemID, oldest
+// first, and returns the IDs of the orders it filled. It stops at the first
+// backorder that still cannot be filled so later orders never jump the queue.
+// Each fill queues a stock.backorder_filled event in the outbox.
+func (r *InventoryRepository) FillBackorders(ctx context.Context, itemID, actor string) ([]string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT b.order_id, b.customer_id
+		FROM backorders b
+		JOIN backorder_items i ON i.order_id = b.order_id
+		WHERE b.status = $1 AND i.item_id = $2
+		ORDER BY b.id
+		FOR UPDATE OF b
+	`, BackorderWaiting, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	var queue []domain.Backorder
+	for rows.Next() {
+		var b domain.Backorder
+		if err := rows.Scan(&b.OrderID, &b.CustomerID); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		queue = append(queue, b)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	var filled []string
+	for _, b := range queue {
+		items, err := backorderItems(ctx, tx, b.OrderID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.reserveItems(ctx, tx, b.OrderID, items, actor)
+		if errors.Is(err, ErrInsufficientStock) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE backorders SET status = $2, filled_at = NOW()
+			WHERE order_id = $1
+		`, b.OrderID, BackorderFilled)
+		if err != nil {
+			return nil, err
+		}
+
+		event := domain.BackorderFilledEvent{
+			OrderID:    b.OrderID,
+			CustomerID: b.CustomerID,
+			Items:      items,
+			FilledAt:   time.Now().UTC(),
+		}
+		if err := messaging.Enqueue(ctx, tx, domain.TopicStockBackorderFilled, b.OrderID, event); err != nil {
+			return nil, err
+		}
+
+		filled = append(filled, b.OrderID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return filled, nil
+}
+
+func backorderItems(ctx context.Context, tx *sql.Tx, orderID string) ([]domain.ReservationItem, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT item_id, quantity
+		FROM backorder_items
+		WHERE order_id = $1
+		ORDER BY item_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var items []domain.ReservationItem
+	for rows.Next() {
+		var item domain.ReservationItem
+		if err := rows.Scan(&item.ItemID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
@@ -5,6 +5,10 @@ import (
 	"errors"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 )
 
 type Handler struct {
@@ -19,6 +23,16 @@ func NewHandler(repo *InventoryRepository, logger *slog.Logger) *Handler {
 	}
 }
 
+// HandleHealth answers 503 while the inventory database is unreachable.
+func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := h.repo.Ping(r.Context()); err != nil {
+		h.logger.Error("health check failed", "error", err)
+		h.writeError(w, http.StatusServiceUnavailable, "database unavailable")
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
 func (h *Handler) HandleListStock(w http.ResponseWriter, r *http.Request) {
 	items, err := h.repo.ListAll(r.Context())
 	if err != nil {
@@ -54,8 +68,81 @@ func (h *Handler) HandleGetStock(w http.ResponseWriter, r *http.Request) {
 	h.writeJSON(w, http.StatusOK, stock)
 }
 
+func (h *Handler) HandleListItemLocations(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("itemId")
+	if itemID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing item id")
+		return
+	}
+
+	stock, err := h.repo.GetStock(r.Context(), itemID)
+	if err != nil {
+		h.logger.Error("failed to get stock", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if stock == nil {
+		h.writeError(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	levels, err := h.repo.ListItemLocations(r.Context(), itemID)
+	if err != nil {
+		h.logger.Error("failed to list item locations", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("item locations listed", "item_id", itemID, "count", len(levels))
+	h.writeJSON(w, http.StatusOK, levels)
+}
+
+func (h *Handler) HandleListLocations(w http.ResponseWriter, r *http.Request) {
+	locations, err := h.repo.ListLocations(r.Context())
+	if err != nil {
+		h.logger.Error("failed to list locations", "error", err)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("locations listed", "count", len(locations))
+	h.writeJSON(w, http.StatusOK, locations)
+}
+
+func (h *Handler) HandleListLocationStock(w http.ResponseWriter, r *http.Request) {
+	locationID := r.PathValue("locationId")
+	if locationID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing location id")
+		return
+	}
+
+	location, err := h.repo.GetLocation(r.Context(), locationID)
+	if err != nil {
+		h.logger.Error("failed to get location", "error", err, "location_id", locationID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if location == nil {
+		h.writeError(w, http.StatusNotFound, "location not found")
+		return
+	}
+
+	levels, err := h.repo.ListLocationStock(r.Context(), locationID)
+	if err != nil {
+		h.logger.Error("failed to list location stock", "error", err, "location_id", locationID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("location stock listed", "location_id", locationID, "count", len(levels))
+	h.writeJSON(w, http.StatusOK, levels)
+}
+
 type reserveRequest struct {
-	Quantity int `json:"quantity"`
+	OrderID  string `json:"order_id"`
+	Quantity int    `json:"quantity"`
 }
 
 func (h *Handler) HandleReserve(w http.ResponseWriter, r *http.Request) {
@@ -71,6 +158,16 @@ func (h *Handler) HandleReserve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.OrderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	if req.Quantity <= 0 {
+		h.writeError(w, http.StatusBadRequest, "quantity must be positive")
+		return
+	}
+
 	stock, err := h.repo.GetStock(r.Context(), itemID)
 	if err != nil {
 		h.logger.Error("failed to get stock", "error", err, "item_id", itemID)
@@ -83,12 +180,16 @@ func (h *Handler) HandleReserve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.repo.Reserve(r.Context(), itemID, req.Quantity); err != nil {
+	if err := h.repo.Reserve(r.Context(), req.OrderID, itemID, req.Quantity, actorFromRequest(r)); err != nil {
 		if errors.Is(err, ErrInsufficientStock) {
 			h.writeError(w, http.StatusConflict, "insufficient stock")
 			return
 		}
-		h.logger.Error("failed to reserve stock", "error", err, "item_id", itemID, "quantity", req.Quantity)
+		if errors.Is(err, ErrReservationMismatch) {
+			h.writeError(w, http.StatusConflict, "order already holds a different quantity of this item")
+			return
+		}
+		h.logger.Error("failed to reserve stock", "error", err, "order_id", req.OrderID, "item_id", itemID, "quantity", req.Quantity)
 		h.writeError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
@@ -100,12 +201,12 @@ func (h *Handler) HandleReserve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.logger.Info("stock reserved", "item_id", itemID, "quantity", req.Quantity)
+	h.logger.Info("stock reserved", "order_id", req.OrderID, "item_id", itemID, "quantity", req.Quantity)
 	h.writeJSON(w, http.StatusOK, stock)
 }
 
 type releaseRequest struct {
-	Quantity int `json:"quantity"`
+	OrderID string `json:"order_id"`
 }
 
 func (h *Handler) HandleRelease(w http.ResponseWriter, r *http.Request) {
@@ -121,8 +222,13 @@ func (h *Handler) HandleRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.repo.Release(r.Context(), itemID, req.Quantity); err != nil {
-		h.logger.Error("failed to release stock", "error", err, "item_id", itemID, "quantity", req.Quantity)
+	if req.OrderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	if err := h.repo.Release(r.Context(), req.OrderID, itemID, actorFromRequest(r)); err != nil {
+		h.logger.Error("failed to release stock", "error", err, "order_id", req.OrderID, "item_id", itemID)
 		h.writeError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
@@ -134,10 +240,694 @@ func (h *Handler) HandleRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.logger.Info("stock released", "item_id", itemID, "quantity", req.Quantity)
+	if stock == nil {
+		h.writeError(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	h.logger.Info("stock released", "order_id", req.OrderID, "item_id", itemID)
 	h.writeJSON(w, http.StatusOK, stock)
 }
 
+type createReservationRequest struct {
+	OrderID string                   `json:"order_id"`
+	Items   []domain.ReservationItem `json:"items"`
+}
+
+type shortfallResponse struct {
+	Error      string                  `json:"error"`
+	Shortfalls []domain.StockShortfall `json:"shortfalls"`
+}
+
+func (h *Handler) HandleCreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req createReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.OrderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		h.writeError(w, http.StatusBadRequest, "at least one item is required")
+		return
+	}
+
+	for _, item := range req.Items {
+		if item.ItemID == "" {
+			h.writeError(w, http.StatusBadRequest, "missing item id")
+			return
+		}
+		if item.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, "quantity must be positive")
+			return
+		}
+	}
+
+	if err := h.repo.ReserveItems(r.Context(), req.OrderID, req.Items, actorFromRequest(r)); err != nil {
+		var shortfall *ShortfallError
+		if errors.As(err, &shortfall) {
+			h.logger.Info("reservation rejected", "order_id", req.OrderID, "shortfalls", len(shortfall.Shortfalls))
+			h.writeJSON(w, http.StatusConflict, shortfallResponse{
+				Error:      "insufficient stock",
+				Shortfalls: shortfall.Shortfalls,
+			})
+			return
+		}
+		if errors.Is(err, ErrReservationMismatch) {
+			h.writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		h.logger.Error("failed to reserve items", "error", err, "order_id", req.OrderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	reservations, err := h.repo.ListReservations(r.Context(), req.OrderID)
+	if err != nil {
+		h.logger.Error("failed to list reservations", "error", err, "order_id", req.OrderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("items reserved", "order_id", req.OrderID, "count", len(reservations))
+	h.writeJSON(w, http.StatusOK, reservations)
+}
+
+func (h *Handler) HandleConfirmReservations(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("orderId")
+	if orderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	if err := h.repo.ConfirmReservations(r.Context(), orderID); err != nil {
+		if errors.Is(err, ErrNoReservations) {
+			h.writeError(w, http.StatusConflict, "order holds no reservations")
+			return
+		}
+		h.logger.Error("failed to confirm reservations", "error", err, "order_id", orderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	reservations, err := h.repo.ListReservations(r.Context(), orderID)
+	if err != nil {
+		h.logger.Error("failed to list reservations", "error", err, "order_id", orderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("reservations confirmed", "order_id", orderID, "count", len(reservations))
+	h.writeJSON(w, http.StatusOK, reservations)
+}
+
+func (h *Handler) HandleCommitReservations(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("orderId")
+	if orderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	committed, err := h.repo.CommitReservations(r.Context(), orderID, actorFromRequest(r))
+	if err != nil {
+		h.logger.Error("failed to commit reservations", "error", err, "order_id", orderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("reservations committed", "order_id", orderID, "count", len(committed))
+	h.writeJSON(w, http.StatusOK, committed)
+}
+
+func (h *Handler) HandleListReservations(w http.ResponseWriter, r *http.Request) {
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order_id query parameter")
+		return
+	}
+
+	reservations, err := h.repo.ListReservations(r.Context(), orderID)
+	if err != nil {
+		h.logger.Error("failed to list reservations", "error", err, "order_id", orderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("reservations listed", "order_id", orderID, "count", len(reservations))
+	h.writeJSON(w, http.StatusOK, reservations)
+}
+
+const (
+	defaultMovementsLimit = 50
+	maxMovementsLimit     = 500
+)
+
+type movementsResponse struct {
+	Movements  []domain.StockMovement `json:"movements"`
+	NextBefore *int64                 `json:"next_before,omitempty"`
+}
+
+func (h *Handler) HandleListMovements(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("itemId")
+	if itemID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing item id")
+		return
+	}
+
+	limit := defaultMovementsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxMovementsLimit {
+			h.writeError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			h.writeError(w, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+		before = n
+	}
+
+	stock, err := h.repo.GetStock(r.Context(), itemID)
+	if err != nil {
+		h.logger.Error("failed to get stock", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if stock == nil {
+		h.writeError(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	movements, err := h.repo.ListMovements(r.Context(), itemID, before, limit)
+	if err != nil {
+		h.logger.Error("failed to list stock movements", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	resp := movementsResponse{Movements: movements}
+	if len(movements) == limit {
+		next := movements[len(movements)-1].ID
+		resp.NextBefore = &next
+	}
+
+	h.logger.Info("stock movements listed", "item_id", itemID, "count", len(movements))
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+type reconciliationResponse struct {
+	Consistent    bool                      `json:"consistent"`
+	Discrepancies []domain.StockDiscrepancy `json:"discrepancies"`
+}
+
+func (h *Handler) HandleReconcile(w http.ResponseWriter, r *http.Request) {
+	discrepancies, err := h.repo.Reconcile(r.Context())
+	if err != nil {
+		h.logger.Error("failed to reconcile stock", "error", err)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if len(discrepancies) > 0 {
+		h.logger.Warn("stock counters disagree with ledger", "items", len(discrepancies))
+	}
+
+	h.writeJSON(w, http.StatusOK, reconciliationResponse{
+		Consistent:    len(discrepancies) == 0,
+		Discrepancies: discrepancies,
+	})
+}
+
+type createItemRequest struct {
+	ItemID           string `json:"item_id"`
+	Name             string `json:"name"`
+	InitialQuantity  int    `json:"initial_quantity"`
+	LocationID       string `json:"location_id"`
+	ReorderThreshold int    `json:"reorder_threshold"`
+}
+
+func (h *Handler) HandleCreateItem(w http.ResponseWriter, r *http.Request) {
+	var req createItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if msg := validateItemID(req.ItemID); msg != "" {
+		h.writeError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if msg := validateItemName(req.Name); msg != "" {
+		h.writeError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if req.InitialQuantity < 0 {
+		h.writeError(w, http.StatusBadRequest, "initial quantity must not be negative")
+		return
+	}
+
+	if req.ReorderThreshold < 0 {
+		h.writeError(w, http.StatusBadRequest, "reorder threshold must not be negative")
+		return
+	}
+
+	item := domain.Item{
+		ItemID:           req.ItemID,
+		Name:             strings.TrimSpace(req.Name),
+		ReorderThreshold: req.ReorderThreshold,
+	}
+	if err := h.repo.CreateItem(r.Context(), item, req.InitialQuantity, req.LocationID, actorFromRequest(r)); err != nil {
+		if errors.Is(err, ErrItemExists) {
+			h.writeError(w, http.StatusConflict, "item already exists")
+			return
+		}
+		if errors.Is(err, ErrLocationNotFound) {
+			h.writeError(w, http.StatusBadRequest, "unknown location")
+			return
+		}
+		h.logger.Error("failed to create item", "error", err, "item_id", req.ItemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	stock, err := h.repo.GetStock(r.Context(), item.ItemID)
+	if err != nil {
+		h.logger.Error("failed to get stock", "error", err, "item_id", item.ItemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("item created", "item_id", item.ItemID, "initial_quantity", req.InitialQuantity)
+	h.writeJSON(w, http.StatusCreated, stock)
+}
+
+type updateItemRequest struct {
+	Name             *string `json:"name"`
+	ReorderThreshold *int    `json:"reorder_threshold"`
+}
+
+func (h *Handler) HandleUpdateItem(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("itemId")
+	if itemID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing item id")
+		return
+	}
+
+	var req updateItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Name == nil && req.ReorderThreshold == nil {
+		h.writeError(w, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	var update ItemUpdate
+	if req.Name != nil {
+		if msg := validateItemName(*req.Name); msg != "" {
+			h.writeError(w, http.StatusBadRequest, msg)
+			return
+		}
+		name := strings.TrimSpace(*req.Name)
+		update.Name = &name
+	}
+
+	if req.ReorderThreshold != nil {
+		if *req.ReorderThreshold < 0 {
+			h.writeError(w, http.StatusBadRequest, "reorder threshold must not be negative")
+			return
+		}
+		update.ReorderThreshold = req.ReorderThreshold
+	}
+
+	item, err := h.repo.UpdateItem(r.Context(), itemID, update)
+	if err != nil {
+		h.logger.Error("failed to update item", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if item == nil {
+		h.writeError(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	h.logger.Info("item updated", "item_id", itemID)
+	h.writeJSON(w, http.StatusOK, item)
+}
+
+type restockRequest struct {
+	Quantity   int    `json:"quantity"`
+	LocationID string `json:"location_id"`
+}
+
+func (h *Handler) HandleRestock(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("itemId")
+	if itemID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing item id")
+		return
+	}
+
+	var req restockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Quantity <= 0 {
+		h.writeError(w, http.StatusBadRequest, "quantity must be positive")
+		return
+	}
+
+	if err := h.repo.Restock(r.Context(), itemID, req.LocationID, req.Quantity, actorFromRequest(r)); err != nil {
+		if errors.Is(err, ErrItemNotFound) {
+			h.writeError(w, http.StatusNotFound, "item not found")
+			return
+		}
+		if errors.Is(err, ErrLocationNotFound) {
+			h.writeError(w, http.StatusBadRequest, "unknown location")
+			return
+		}
+		h.logger.Error("failed to restock", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("item restocked", "item_id", itemID, "quantity", req.Quantity)
+	h.fillBackorders(r, itemID)
+	h.writeStock(w, r, itemID)
+}
+
+type adjustRequest struct {
+	Delta      int    `json:"delta"`
+	Reason     string `json:"reason"`
+	LocationID string `json:"location_id"`
+}
+
+func (h *Handler) HandleAdjust(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("itemId")
+	if itemID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing item id")
+		return
+	}
+
+	var req adjustRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Delta == 0 {
+		h.writeError(w, http.StatusBadRequest, "delta must not be zero")
+		return
+	}
+
+	if !AdjustmentReasons[req.Reason] {
+		h.writeError(w, http.StatusBadRequest, "unknown adjustment reason")
+		return
+	}
+
+	if err := h.repo.Adjust(r.Context(), itemID, req.LocationID, req.Delta, req.Reason, actorFromRequest(r)); err != nil {
+		if errors.Is(err, ErrItemNotFound) {
+			h.writeError(w, http.StatusNotFound, "item not found")
+			return
+		}
+		if errors.Is(err, ErrLocationNotFound) {
+			h.writeError(w, http.StatusBadRequest, "unknown location")
+			return
+		}
+		if errors.Is(err, ErrInsufficientStock) {
+			h.writeError(w, http.StatusConflict, "adjustment would make available stock negative")
+			return
+		}
+		h.logger.Error("failed to adjust stock", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("stock adjusted", "item_id", itemID, "delta", req.Delta, "reason", req.Reason)
+	if req.Delta > 0 {
+		h.fillBackorders(r, itemID)
+	}
+	h.writeStock(w, r, itemID)
+}
+
+// fillBackorders hands newly available stock to waiting backorders. The stock
+// change has already been committed, so a failure here is only logged and
+// the backorders wait for the next restock.
+func (h *Handler) fillBackorders(r *http.Request, itemID string) {
+	filled, err := h.repo.FillBackorders(r.Context(), itemID, actorFromRequest(r))
+	if err != nil {
+		h.logger.Error("failed to fill backorders", "error", err, "item_id", itemID)
+		return
+	}
+
+	if len(filled) > 0 {
+		h.logger.Info("backorders filled", "item_id", itemID, "order_ids", filled)
+	}
+}
+
+type receiveReturnRequest struct {
+	ReturnID   string              `json:"return_id"`
+	OrderID    string              `json:"order_id"`
+	LocationID string              `json:"location_id"`
+	Items      []domain.ReturnItem `json:"items"`
+}
+
+type receiveReturnResponse struct {
+	ReturnID  string `json:"return_id"`
+	OrderID   string `json:"order_id"`
+	Restocked bool   `json:"restocked"`
+}
+
+// HandleReceiveReturn restocks the items of a customer return. Receiving the
+// same return again succeeds without restocking twice, and reports
+// restocked false.
+func (h *Handler) HandleReceiveReturn(w http.ResponseWriter, r *http.Request) {
+	var req receiveReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.ReturnID == "" || req.OrderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing return or order id")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		h.writeError(w, http.StatusBadRequest, "at least one item is required")
+		return
+	}
+
+	for _, item := range req.Items {
+		if item.ItemID == "" {
+			h.writeError(w, http.StatusBadRequest, "missing item id")
+			return
+		}
+		if item.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, "quantity must be positive")
+			return
+		}
+	}
+
+	restocked, err := h.repo.ReceiveReturn(r.Context(), req.ReturnID, req.OrderID, req.LocationID, req.Items, actorFromRequest(r))
+	if err != nil {
+		if errors.Is(err, ErrItemNotFound) {
+			h.writeError(w, http.StatusNotFound, "item not found")
+			return
+		}
+		if errors.Is(err, ErrLocationNotFound) {
+			h.writeError(w, http.StatusBadRequest, "unknown location")
+			return
+		}
+		h.logger.Error("failed to receive return", "error", err, "return_id", req.ReturnID, "order_id", req.OrderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if restocked {
+		h.logger.Info("return restocked", "return_id", req.ReturnID, "order_id", req.OrderID, "items", len(req.Items))
+		for _, item := range req.Items {
+			h.fillBackorders(r, item.ItemID)
+		}
+	}
+
+	h.writeJSON(w, http.StatusOK, receiveReturnResponse{
+		ReturnID:  req.ReturnID,
+		OrderID:   req.OrderID,
+		Restocked: restocked,
+	})
+}
+
+type createBackorderRequest struct {
+	OrderID    string                   `json:"order_id"`
+	CustomerID string                   `json:"customer_id"`
+	Items      []domain.ReservationItem `json:"items"`
+}
+
+func (h *Handler) HandleCreateBackorder(w http.ResponseWriter, r *http.Request) {
+	var req createBackorderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.OrderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	if req.CustomerID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing customer id")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		h.writeError(w, http.StatusBadRequest, "at least one item is required")
+		return
+	}
+
+	for _, item := range req.Items {
+		if item.ItemID == "" {
+			h.writeError(w, http.StatusBadRequest, "missing item id")
+			return
+		}
+		if item.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, "quantity must be positive")
+			return
+		}
+	}
+
+	if err := h.repo.CreateBackorder(r.Context(), req.OrderID, req.CustomerID, req.Items); err != nil {
+		h.logger.Error("failed to create backorder", "error", err, "order_id", req.OrderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	backorder, err := h.repo.GetBackorder(r.Context(), req.OrderID)
+	if err != nil {
+		h.logger.Error("failed to get backorder", "error", err, "order_id", req.OrderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("backorder queued", "order_id", req.OrderID, "items", len(req.Items))
+	h.writeJSON(w, http.StatusOK, backorder)
+}
+
+func (h *Handler) HandleListBackorders(w http.ResponseWriter, r *http.Request) {
+	itemID := r.URL.Query().Get("item_id")
+
+	backorders, err := h.repo.ListBackorders(r.Context(), itemID)
+	if err != nil {
+		h.logger.Error("failed to list backorders", "error", err)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("backorders listed", "count", len(backorders))
+	h.writeJSON(w, http.StatusOK, backorders)
+}
+
+func (h *Handler) HandleCancelBackorder(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("orderId")
+	if orderID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	if err := h.repo.CancelBackorder(r.Context(), orderID); err != nil {
+		h.logger.Error("failed to cancel backorder", "error", err, "order_id", orderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	backorder, err := h.repo.GetBackorder(r.Context(), orderID)
+	if err != nil {
+		h.logger.Error("failed to get backorder", "error", err, "order_id", orderID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if backorder == nil {
+		h.writeError(w, http.StatusNotFound, "backorder not found")
+		return
+	}
+
+	h.logger.Info("backorder cancelled", "order_id", orderID, "status", backorder.Status)
+	h.writeJSON(w, http.StatusOK, backorder)
+}
+
+func (h *Handler) writeStock(w http.ResponseWriter, r *http.Request, itemID string) {
+	stock, err := h.repo.GetStock(r.Context(), itemID)
+	if err != nil {
+		h.logger.Error("failed to get stock", "error", err, "item_id", itemID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, stock)
+}
+
+const (
+	maxItemIDLength   = 64
+	maxItemNameLength = 200
+)
+
+// validateItemID returns a client-facing message when id cannot be used as
+// an item id. Ids end up in URL paths, so they are kept to a safe charset.
+func validateItemID(id string) string {
+	if id == "" {
+		return "missing item id"
+	}
+	if len(id) > maxItemIDLength {
+		return "item id is too long"
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "item id may only contain letters, digits, '-' and '_'"
+		}
+	}
+	return ""
+}
+
+func validateItemName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "missing item name"
+	}
+	if len(name) > maxItemNameLength {
+		return "item name is too long"
+	}
+	return ""
+}
+
+// actorFromRequest identifies who caused a stock movement. Callers name
+// themselves with the X-Actor header.
+func actorFromRequest(r *http.Request) string {
+	if actor := r.Header.Get("X-Actor"); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
 func (h *Handler) writeJSON(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -4,18 +4,115 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
+)
+
+var (
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrItemExists        = errors.New("item already exists")
+	ErrItemNotFound      = errors.New("item not found")
+	ErrLocationNotFound  = errors.New("location not found")
+	// ErrReservationMismatch is returned when an order asks again for an
+	// item it already holds, but for a different quantity.
+	ErrReservationMismatch = errors.New("order already holds a different quantity")
+	// ErrNoReservations is returned when confirming an order that holds
+	// nothing, typically because its reservations expired first.
+	ErrNoReservations = errors.New("order holds no reservations")
 )
 
-var ErrInsufficientStock = errors.New("insufficient stock")
+// ShortfallError reports every item that could not be reserved. It matches
+// ErrInsufficientStock with errors.Is.
+type ShortfallError struct {
+	Shortfalls []domain.StockShortfall
+}
+
+func (e *ShortfallError) Error() string {
+	return fmt.Sprintf("insufficient stock for %d item(s)", len(e.Shortfalls))
+}
+
+func (e *ShortfallError) Is(target error) bool {
+	return target == ErrInsufficientStock
+}
+
+const (
+	defaultReservationTTL = 15 * time.Minute
+	defaultLocationID     = "WH-MAIN"
+)
+
+// Reasons recorded on stock movements. Manual adjustments record their
+// adjustment reason code instead, see AdjustmentReasons.
+const (
+	ReasonInitialStock = "initial_stock"
+	ReasonReserve      = "reserve"
+	ReasonRelease      = "release"
+	ReasonExpire       = "expire"
+	ReasonRestock      = "restock"
+	ReasonShip         = "ship"
+	ReasonReturn       = "return"
+)
+
+// AdjustmentReasons are the reason codes accepted for manual stock
+// adjustments.
+var AdjustmentReasons = map[string]bool{
+	"damaged":              true,
+	"lost":                 true,
+	"found":                true,
+	"count_correction":     true,
+	"returned_to_supplier": true,
+}
+
+const sweeperActor = "reservation-sweeper"
 
 type InventoryRepository struct {
-	db *sql.DB
+	db                *sql.DB
+	reservationTTL    time.Duration
+	defaultLocationID string
+}
+
+type RepositoryOption func(*InventoryRepository)
+
+// WithReservationTTL sets how long a reservation is held before the sweeper
+// may expire it. A zero or negative ttl makes reservations never expire.
+func WithReservationTTL(ttl time.Duration) RepositoryOption {
+	return func(r *InventoryRepository) {
+		r.reservationTTL = ttl
+	}
 }
 
-func NewInventoryRepository(db *sql.DB) *InventoryRepository {
-	return &InventoryRepository{db: db}
+// WithDefaultLocation sets the location used for stock changes that do not
+// name one.
+func WithDefaultLocation(locationID string) RepositoryOption {
+	return func(r *InventoryRepository) {
+		r.defaultLocationID = locationID
+	}
+}
+
+func NewInventoryRepository(db *sql.DB, opts ...RepositoryOption) *InventoryRepository {
+	r := &InventoryRepository{
+		db:                db,
+		reservationTTL:    defaultReservationTTL,
+		defaultLocationID: defaultLocationID,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Ping checks that the database can be reached.
+func (r *InventoryRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
 }
 
 func (r *InventoryRepository) ListAll(ctx context.Context) ([]domain.StockLevel, error) {
@@ -63,46 +160,897 @@ func (r *InventoryRepository) GetStock(ctx context.Context, itemID string) (*dom
 	return stock, nil
 }
 
-func (r *InventoryRepository) Reserve(ctx context.Context, itemID string, quantity int) error {
-	result, err := r.db.ExecContext(ctx, `
+// CreateItem adds item to the catalogue with initialQuantity units available
+// at locationID, or at the default location when locationID is empty.
+func (r *InventoryRepository) CreateItem(ctx context.Context, item domain.Item, initialQuantity int, locationID, actor string) error {
+	locationID = r.locationOrDefault(locationID)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := requireLocation(ctx, tx, locationID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO items (item_id, name, reorder_threshold, available, reserved)
+		VALUES ($1, $2, $3, 0, 0)
+	`, item.ItemID, item.Name, item.ReorderThreshold)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrItemExists
+		}
+		return err
+	}
+
+	if initialQuantity > 0 {
+		err = applyMovement(ctx, tx, movement{
+			itemID:         item.ItemID,
+			locationID:     locationID,
+			availableDelta: initialQuantity,
+			reason:         ReasonInitialStock,
+			actor:          actor,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ItemUpdate lists the item fields to change. Nil fields are left as they are.
+type ItemUpdate struct {
+	Name             *string
+	ReorderThreshold *int
+}
+
+func (r *InventoryRepository) UpdateItem(ctx context.Context, itemID string, update ItemUpdate) (*domain.Item, error) {
+	item := &domain.Item{}
+
+	err := r.db.QueryRowContext(ctx, `
 		UPDATE items
-		SET available = available - $2, reserved = reserved + $2
-		WHERE item_id = $1 AND available >= $2
-	`, itemID, quantity)
+		SET name = COALESCE($2::varchar, name),
+			reorder_threshold = COALESCE($3::integer, reorder_threshold)
+		WHERE item_id = $1
+		RETURNING item_id, name, reorder_threshold
+	`, itemID, update.Name, update.ReorderThreshold).Scan(&item.ItemID, &item.Name, &item.ReorderThreshold)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// Restock adds quantity units of itemID at locationID, or at the default
+// location when locationID is empty.
+func (r *InventoryRepository) Restock(ctx context.Context, itemID, locationID string, quantity int, actor string) error {
+	return r.changeAvailable(ctx, itemID, locationID, quantity, ReasonRestock, actor)
+}
+
+// Adjust corrects an item's available stock at locationID by delta, recording
+// reason as the movement reason. It refuses to take available stock at the
+// location below zero.
+func (r *InventoryRepository) Adjust(ctx context.Context, itemID, locationID string, delta int, reason, actor string) error {
+	return r.changeAvailable(ctx, itemID, locationID, delta, reason, actor)
+}
+
+func (r *InventoryRepository) changeAvailable(ctx context.Context, itemID, locationID string, delta int, reason, actor string) error {
+	locationID = r.locationOrDefault(locationID)
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	rowsAffected, err := result.RowsAffected()
+	// The item row lock serialises every change to the item's location rows,
+	// see applyMovement.
+	err = tx.QueryRowContext(ctx, `
+		SELECT item_id FROM items
+		WHERE item_id = $1
+		FOR UPDATE
+	`, itemID).Scan(&itemID)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrItemNotFound
+		}
+		return err
+	}
+
+	if err := requireLocation(ctx, tx, locationID); err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
+	var available int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(available), 0)
+		FROM stock_locations
+		WHERE item_id = $1 AND location_id = $2
+	`, itemID, locationID).Scan(&available)
+	if err != nil {
+		return err
+	}
+
+	if available+delta < 0 {
 		return ErrInsufficientStock
 	}
 
+	err = applyMovement(ctx, tx, movement{
+		itemID:         itemID,
+		locationID:     locationID,
+		availableDelta: delta,
+		reason:         reason,
+		actor:          actor,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Reserve holds quantity units of itemID for orderID. An order holds an item
+// at most once, so repeating the call for the same order and quantity is a
+// no-op. Repeating it with another quantity returns ErrReservationMismatch.
+func (r *InventoryRepository) Reserve(ctx context.Context, orderID, itemID string, quantity int, actor string) error {
+	return r.ReserveItems(ctx, orderID, []domain.ReservationItem{{ItemID: itemID, Quantity: quantity}}, actor)
+}
+
+// ReserveItems reserves every item for orderID in a single transaction, or
+// none of them. Item rows are locked in item_id order so concurrent
+// multi-item reservations cannot deadlock. Items the order already holds in
+// the requested quantity are skipped, and the rest are spread over locations
+// by allocate. Nothing is reserved when the order holds an item in another
+// quantity; ErrReservationMismatch is returned instead. When stock is
+// short, the returned *ShortfallError lists each item that could not be
+// covered.
+func (r *InventoryRepository) ReserveItems(ctx context.Context, orderID string, items []domain.ReservationItem, actor string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := r.reserveItems(ctx, tx, orderID, items, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *InventoryRepository) reserveItems(ctx context.Context, tx *sql.Tx, orderID string, items []domain.ReservationItem, actor string) error {
+	requested := make(map[string]int, len(items))
+	for _, item := range items {
+		requested[item.ItemID] += item.Quantity
+	}
+
+	itemIDs := make([]string, 0, len(requested))
+	for itemID := range requested {
+		itemIDs = append(itemIDs, itemID)
+	}
+	sort.Strings(itemIDs)
+
+	if err := lockItems(ctx, tx, itemIDs); err != nil {
+		return err
+	}
+
+	held, err := heldItems(ctx, tx, orderID, itemIDs)
+	if err != nil {
+		return err
+	}
+
+	pending := make([]string, 0, len(itemIDs))
+	for _, itemID := range itemIDs {
+		quantity, ok := held[itemID]
+		if !ok {
+			pending = append(pending, itemID)
+			continue
+		}
+		if quantity != requested[itemID] {
+			return fmt.Errorf("%w: %s holds %d, requested %d", ErrReservationMismatch, itemID, quantity, requested[itemID])
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	stock, err := stockByLocation(ctx, tx, pending)
+	if err != nil {
+		return err
+	}
+
+	allocations, shortfalls := allocate(pending, requested, stock)
+	if len(shortfalls) > 0 {
+		return &ShortfallError{Shortfalls: shortfalls}
+	}
+
+	var ttlSeconds sql.NullFloat64
+	if r.reservationTTL > 0 {
+		ttlSeconds = sql.NullFloat64{Float64: r.reservationTTL.Seconds(), Valid: true}
+	}
+	traceParent := traceParentFromContext(ctx)
+
+	for _, a := range allocations {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO reservations (order_id, item_id, location_id, quantity, created_at, expires_at, trace_parent)
+			VALUES ($1, $2, $3, $4, NOW(), NOW() + $5::float8 * INTERVAL '1 second', $6)
+		`, orderID, a.itemID, a.locationID, a.quantity, ttlSeconds, traceParent)
+		if err != nil {
+			return err
+		}
+
+		err = applyMovement(ctx, tx, movement{
+			itemID:         a.itemID,
+			locationID:     a.locationID,
+			availableDelta: -a.quantity,
+			reservedDelta:  a.quantity,
+			reason:         ReasonReserve,
+			orderID:        orderID,
+			actor:          actor,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (r *InventoryRepository) Release(ctx context.Context, itemID string, quantity int) error {
+// stockByLocation returns the available stock of itemIDs at every location
+// that has some, in location priority order.
+func stockByLocation(ctx context.Context, tx *sql.Tx, itemIDs []string) ([]locationStock, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT s.item_id, s.location_id, s.available
+		FROM stock_locations s
+		JOIN locations l ON l.location_id = s.location_id
+		WHERE s.item_id = ANY($1) AND s.available > 0
+		ORDER BY l.priority, s.location_id, s.item_id
+	`, pq.Array(itemIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var stock []locationStock
+	for rows.Next() {
+		var s locationStock
+		if err := rows.Scan(&s.itemID, &s.locationID, &s.available); err != nil {
+			return nil, err
+		}
+		stock = append(stock, s)
+	}
+
+	return stock, rows.Err()
+}
+
+func heldItems(ctx context.Context, tx *sql.Tx, orderID string, itemIDs []string) (map[string]int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT item_id, SUM(quantity)
+		FROM reservations
+		WHERE order_id = $1 AND item_id = ANY($2)
+		GROUP BY item_id
+	`, orderID, pq.Array(itemIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	held := make(map[string]int)
+	for rows.Next() {
+		var itemID string
+		var quantity int
+		if err := rows.Scan(&itemID, &quantity); err != nil {
+			return nil, err
+		}
+		held[itemID] = quantity
+	}
+
+	return held, rows.Err()
+}
+
+// lockItems locks the items rows of itemIDs in item order. Every transaction
+// that changes reservations takes these locks before touching the
+// reservations rows, so two of them never wait on each other's locks.
+func lockItems(ctx context.Context, tx *sql.Tx, itemIDs []string) error {
+	_, err := tx.ExecContext(ctx, `
+		SELECT item_id
+		FROM items
+		WHERE item_id = ANY($1)
+		ORDER BY item_id
+		FOR UPDATE
+	`, pq.Array(itemIDs))
+	return err
+}
+
+// Release returns the stock orderID holds on itemID at every location.
+// Releasing an item the order does not hold is a no-op.
+func (r *InventoryRepository) Release(ctx context.Context, orderID, itemID, actor string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := lockItems(ctx, tx, []string{itemID}); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM reservations
+		WHERE order_id = $1 AND item_id = $2
+		RETURNING location_id, quantity
+	`, orderID, itemID)
+	if err != nil {
+		return err
+	}
+
+	var released []allocation
+	for rows.Next() {
+		a := allocation{itemID: itemID}
+		if err := rows.Scan(&a.locationID, &a.quantity); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		released = append(released, a)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	_ = rows.Close()
+
+	if len(released) == 0 {
+		return nil
+	}
+
+	sort.Slice(released, func(i, j int) bool {
+		return released[i].locationID < released[j].locationID
+	})
+
+	for _, a := range released {
+		err := applyMovement(ctx, tx, movement{
+			itemID:         itemID,
+			locationID:     a.locationID,
+			availableDelta: a.quantity,
+			reservedDelta:  -a.quantity,
+			reason:         ReasonRelease,
+			orderID:        orderID,
+			actor:          actor,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *InventoryRepository) ListReservations(ctx context.Context, orderID string) ([]domain.Reservation, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT order_id, item_id, location_id, quantity, created_at, expires_at
+		FROM reservations
+		WHERE order_id = $1
+		ORDER BY item_id, location_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	reservations := []domain.Reservation{}
+	for rows.Next() {
+		var reservation domain.Reservation
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&reservation.OrderID, &reservation.ItemID, &reservation.LocationID, &reservation.Quantity, &reservation.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			reservation.ExpiresAt = &expiresAt.Time
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+// ConfirmReservations clears the expiry of every reservation orderID holds,
+// keeping the stock reserved until it is released or shipped. It returns
+// ErrNoReservations when the order holds nothing, so a confirmation that lost
+// the race with the expiry sweeper is not mistaken for a success.
+func (r *InventoryRepository) ConfirmReservations(ctx context.Context, orderID string) error {
 	result, err := r.db.ExecContext(ctx, `
+		UPDATE reservations SET expires_at = NULL
+		WHERE order_id = $1
+	`, orderID)
+	if err != nil {
+		return err
+	}
+
+	confirmed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if confirmed == 0 {
+		return ErrNoReservations
+	}
+	return nil
+}
+
+// CommitReservations takes the stock orderID holds out of inventory once it
+// has shipped: reserved stock goes down and available stock is untouched.
+// It returns the reservations it committed; committing an order that holds
+// nothing is a no-op, so redelivered events are harmless.
+func (r *InventoryRepository) CommitReservations(ctx context.Context, orderID, actor string) ([]domain.Reservation, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var itemIDs []string
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(DISTINCT item_id ORDER BY item_id), '{}')
+		FROM reservations
+		WHERE order_id = $1
+	`, orderID).Scan(pq.Array(&itemIDs))
+	if err != nil {
+		return nil, err
+	}
+	if err := lockItems(ctx, tx, itemIDs); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM reservations
+		WHERE order_id = $1
+		RETURNING order_id, item_id, location_id, quantity, created_at
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	committed := []domain.Reservation{}
+	for rows.Next() {
+		var reservation domain.Reservation
+		if err := rows.Scan(&reservation.OrderID, &reservation.ItemID, &reservation.LocationID, &reservation.Quantity, &reservation.CreatedAt); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		committed = append(committed, reservation)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	sort.Slice(committed, func(i, j int) bool {
+		if committed[i].ItemID != committed[j].ItemID {
+			return committed[i].ItemID < committed[j].ItemID
+		}
+		return committed[i].LocationID < committed[j].LocationID
+	})
+
+	for _, reservation := range committed {
+		err := applyMovement(ctx, tx, movement{
+			itemID:        reservation.ItemID,
+			locationID:    reservation.LocationID,
+			reservedDelta: -reservation.Quantity,
+			reason:        ReasonShip,
+			orderID:       orderID,
+			actor:         actor,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return committed, nil
+}
+
+type ExpiredReservation struct {
+	domain.Reservation
+	TraceParent string
+}
+
+// ExpireReservations releases up to limit reservations whose expiry has
+// passed and writes a stock.reservation_expired event to the outbox for each
+// one. Rows locked by another transaction are skipped so several sweepers can
+// run side by side.
+func (r *InventoryRepository) ExpireReservations(ctx context.Context, limit int) ([]ExpiredReservation, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// The items are locked before the reservations, as reserveItems does.
+	// Only reservations of the locked items are released; any that expire
+	// in between are left for a later sweep.
+	itemRows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT item_id
+		FROM (
+			SELECT item_id
+			FROM reservations
+			WHERE expires_at <= NOW()
+			ORDER BY expires_at
+			LIMIT $1
+		) expired
+		ORDER BY item_id
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var itemIDs []string
+	for itemRows.Next() {
+		var itemID string
+		if err := itemRows.Scan(&itemID); err != nil {
+			_ = itemRows.Close()
+			return nil, err
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+	if err := itemRows.Err(); err != nil {
+		_ = itemRows.Close()
+		return nil, err
+	}
+	_ = itemRows.Close()
+
+	if len(itemIDs) == 0 {
+		return nil, nil
+	}
+
+	if err := lockItems(ctx, tx, itemIDs); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM reservations
+		WHERE (order_id, item_id, location_id) IN (
+			SELECT order_id, item_id, location_id
+			FROM reservations
+			WHERE expires_at <= NOW() AND item_id = ANY($2)
+			ORDER BY expires_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING order_id, item_id, location_id, quantity, created_at, expires_at, COALESCE(trace_parent, '')
+	`, limit, pq.Array(itemIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []ExpiredReservation
+	for rows.Next() {
+		var reservation ExpiredReservation
+		var expiresAt time.Time
+		if err := rows.Scan(&reservation.OrderID, &reservation.ItemID, &reservation.LocationID, &reservation.Quantity, &reservation.CreatedAt, &expiresAt, &reservation.TraceParent); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		reservation.ExpiresAt = &expiresAt
+		expired = append(expired, reservation)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	sort.Slice(expired, func(i, j int) bool {
+		if expired[i].ItemID != expired[j].ItemID {
+			return expired[i].ItemID < expired[j].ItemID
+		}
+		return expired[i].LocationID < expired[j].LocationID
+	})
+
+	for _, reservation := range expired {
+		err := applyMovement(ctx, tx, movement{
+			itemID:         reservation.ItemID,
+			locationID:     reservation.LocationID,
+			availableDelta: reservation.Quantity,
+			reservedDelta:  -reservation.Quantity,
+			reason:         ReasonExpire,
+			orderID:        reservation.OrderID,
+			actor:          sweeperActor,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		event := domain.ReservationExpiredEvent{
+			OrderID:    reservation.OrderID,
+			ItemID:     reservation.ItemID,
+			LocationID: reservation.LocationID,
+			Quantity:   reservation.Quantity,
+			ReservedAt: reservation.CreatedAt,
+			ExpiredAt:  *reservation.ExpiresAt,
+		}
+		if err := messaging.Enqueue(ctx, tx, domain.TopicStockReservationExpired, reservation.OrderID, event); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// traceParentFromContext returns the W3C traceparent of the active span so a
+// later, unrelated trace can link back to the request that reserved stock.
+func traceParentFromContext(ctx context.Context) sql.NullString {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	traceParent := carrier.Get("traceparent")
+	return sql.NullString{String: traceParent, Valid: traceParent != ""}
+}
+
+type movement struct {
+	itemID         string
+	locationID     string
+	availableDelta int
+	reservedDelta  int
+	reason         string
+	orderID        string
+	actor          string
+}
+
+// applyMovement changes an item's counters at a location and in aggregate,
+// and appends the change to the stock ledger. It must run in the same
+// transaction as the operation that caused the movement so counters and
+// ledger never drift apart. The item row is updated first, so its lock also
+// guards the item's location rows. A movement that takes available stock
+// below the item's reorder threshold queues a stock.low event in the outbox.
+func applyMovement(ctx context.Context, tx *sql.Tx, m movement) error {
+	var name string
+	var available, threshold int
+	err := tx.QueryRowContext(ctx, `
 		UPDATE items
-		SET available = available + $2, reserved = reserved - $2
-		WHERE item_id = $1 AND reserved >= $2
-	`, itemID, quantity)
+		SET available = available + $2, reserved = reserved + $3
+		WHERE item_id = $1
+		RETURNING name, available, reorder_threshold
+	`, m.itemID, m.availableDelta, m.reservedDelta).Scan(&name, &available, &threshold)
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	if available < threshold && available-m.availableDelta >= threshold {
+		event := domain.StockLowEvent{
+			ItemID:           m.itemID,
+			Name:             name,
+			Available:        available,
+			ReorderThreshold: threshold,
+			Reason:           m.reason,
+			OrderID:          m.orderID,
+			Timestamp:        time.Now().UTC(),
+		}
+		if err := messaging.Enqueue(ctx, tx, domain.TopicStockLow, m.itemID, event); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO stock_locations (item_id, location_id, available, reserved)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (item_id, location_id) DO UPDATE
+		SET available = stock_locations.available + EXCLUDED.available,
+			reserved = stock_locations.reserved + EXCLUDED.reserved
+	`, m.itemID, m.locationID, m.availableDelta, m.reservedDelta)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return errors.New("insufficient reserved stock to release")
+	var traceID sql.NullString
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.HasTraceID() {
+		traceID = sql.NullString{String: spanCtx.TraceID().String(), Valid: true}
 	}
 
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO stock_movements (item_id, location_id, available_delta, reserved_delta, reason, order_id, actor, trace_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, NOW())
+	`, m.itemID, m.locationID, m.availableDelta, m.reservedDelta, m.reason, m.orderID, m.actor, traceID)
+	return err
+}
+
+// ListMovements returns an item's ledger entries, newest first. Pass the
+// smallest ID of the previous page as before to fetch the next one.
+func (r *InventoryRepository) ListMovements(ctx context.Context, itemID string, before int64, limit int) ([]domain.StockMovement, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, item_id, location_id, available_delta, reserved_delta, reason, COALESCE(order_id, ''), actor, COALESCE(trace_id, ''), created_at
+		FROM stock_movements
+		WHERE item_id = $1 AND ($2::bigint = 0 OR id < $2::bigint)
+		ORDER BY id DESC
+		LIMIT $3
+	`, itemID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	movements := []domain.StockMovement{}
+	for rows.Next() {
+		var m domain.StockMovement
+		if err := rows.Scan(&m.ID, &m.ItemID, &m.LocationID, &m.AvailableDelta, &m.ReservedDelta, &m.Reason, &m.OrderID, &m.Actor, &m.TraceID, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		movements = append(movements, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movements, nil
+}
+
+// Reconcile compares every item's counters, in aggregate and per location,
+// with the sums of its ledger entries and returns the ones that disagree.
+func (r *InventoryRepository) Reconcile(ctx context.Context) ([]domain.StockDiscrepancy, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT i.item_id, '' AS location_id, i.available, i.reserved,
+			COALESCE(SUM(m.available_delta), 0), COALESCE(SUM(m.reserved_delta), 0)
+		FROM items i
+		LEFT JOIN stock_movements m ON m.item_id = i.item_id
+		GROUP BY i.item_id, i.available, i.reserved
+		HAVING i.available <> COALESCE(SUM(m.available_delta), 0)
+			OR i.reserved <> COALESCE(SUM(m.reserved_delta), 0)
+		UNION ALL
+		SELECT s.item_id, s.location_id, s.available, s.reserved,
+			COALESCE(SUM(m.available_delta), 0), COALESCE(SUM(m.reserved_delta), 0)
+		FROM stock_locations s
+		LEFT JOIN stock_movements m ON m.item_id = s.item_id AND m.location_id = s.location_id
+		GROUP BY s.item_id, s.location_id, s.available, s.reserved
+		HAVING s.available <> COALESCE(SUM(m.available_delta), 0)
+			OR s.reserved <> COALESCE(SUM(m.reserved_delta), 0)
+		ORDER BY 1, 2
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	discrepancies := []domain.StockDiscrepancy{}
+	for rows.Next() {
+		var d domain.StockDiscrepancy
+		if err := rows.Scan(&d.ItemID, &d.LocationID, &d.Available, &d.Reserved, &d.LedgerAvailable, &d.LedgerReserved); err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return discrepancies, nil
+}
+
+func (r *InventoryRepository) locationOrDefault(locationID string) string {
+	if locationID == "" {
+		return r.defaultLocationID
+	}
+	return locationID
+}
+
+func requireLocation(ctx context.Context, tx *sql.Tx, locationID string) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM locations WHERE location_id = $1)
+	`, locationID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrLocationNotFound
+	}
 	return nil
 }
+
+func (r *InventoryRepository) ListLocations(ctx context.Context) ([]domain.Location, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT location_id, name, priority
+		FROM locations
+		ORDER BY priority, location_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	locations := []domain.Location{}
+	for rows.Next() {
+		var location domain.Location
+		if err := rows.Scan(&location.LocationID, &location.Name, &location.Priority); err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return locations, nil
+}
+
+func (r *InventoryRepository) GetLocation(ctx context.Context, locationID string) (*domain.Location, error) {
+	location := &domain.Location{}
+
+	err := r.db.QueryRowContext(ctx, `
+		SELECT location_id, name, priority
+		FROM locations
+		WHERE location_id = $1
+	`, locationID).Scan(&location.LocationID, &location.Name, &location.Priority)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return location, nil
+}
+
+// ListItemLocations returns an item's stock at each location that has ever
+// held it, in location priority order.
+func (r *InventoryRepository) ListItemLocations(ctx context.Context, itemID string) ([]domain.LocationStockLevel, error) {
+	return r.listLocationStock(ctx, `
+		SELECT s.item_id, s.location_id, s.available, s.reserved
+		FROM stock_locations s
+		JOIN locations l ON l.location_id = s.location_id
+		WHERE s.item_id = $1
+		ORDER BY l.priority, s.location_id
+	`, itemID)
+}
+
+func (r *InventoryRepository) ListLocationStock(ctx context.Context, locationID string) ([]domain.LocationStockLevel, error) {
+	return r.listLocationStock(ctx, `
+		SELECT item_id, location_id, available, reserved
+		FROM stock_locations
+		WHERE location_id = $1
+		ORDER BY item_id
+	`, locationID)
+}
+
+func (r *InventoryRepository) listLocationStock(ctx context.Context, query string, arg string) ([]domain.LocationStockLevel, error) {
+	rows, err := r.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	levels := []domain.LocationStockLevel{}
+	for rows.Next() {
+		var level domain.LocationStockLevel
+		if err := rows.Scan(&level.ItemID, &level.LocationID, &level.Available, &level.Reserved); err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return levels, nil
+}
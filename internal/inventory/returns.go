@@ -0,0 +1,85 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
+)
+
+// ReceiveReturn puts the items of a customer return back into available stock
+// at locationID, or at the default location when locationID is empty, and
+// queues a stock.return_restocked event in the outbox. Each return is
+// restocked once: it reports false when returnID was already received.
+func (r *InventoryRepository) ReceiveReturn(ctx context.Context, returnID, orderID, locationID string, items []domain.ReturnItem, actor string) (bool, error) {
+	locationID = r.locationOrDefault(locationID)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := requireLocation(ctx, tx, locationID); err != nil {
+		return false, err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO returns (return_id, order_id, location_id, received_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (return_id) DO NOTHING
+	`, returnID, orderID, locationID)
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if inserted == 0 {
+		return false, nil
+	}
+
+	items = append([]domain.ReturnItem(nil), items...)
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ItemID < items[j].ItemID
+	})
+
+	for _, item := range items {
+		err := applyMovement(ctx, tx, movement{
+			itemID:         item.ItemID,
+			locationID:     locationID,
+			availableDelta: item.Quantity,
+			reason:         ReasonReturn,
+			orderID:        orderID,
+			actor:          actor,
+		})
+		if err == sql.ErrNoRows {
+			return false, ErrItemNotFound
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	event := domain.ReturnRestockedEvent{
+		ReturnID:   returnID,
+		OrderID:    orderID,
+		LocationID: locationID,
+		Items:      items,
+		Timestamp:  time.Now().UTC(),
+	}
+	if err := messaging.Enqueue(ctx, tx, domain.TopicStockReturnRestocked, orderID, event); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
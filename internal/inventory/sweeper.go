@@ -0,0 +1,108 @@
+package inventory
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var sweeperTracer = otel.Tracer("inventory/sweeper")
+
+// Sweeper periodically releases reservations whose TTL has passed, so stock
+// held by a worker that died mid-order does not stay locked forever.
+type Sweeper struct {
+	repo      *InventoryRepository
+	interval  time.Duration
+	batchSize int
+	logger    *slog.Logger
+}
+
+func NewSweeper(repo *InventoryRepository, interval time.Duration, batchSize int, logger *slog.Logger) *Sweeper {
+	return &Sweeper{
+		repo:      repo,
+		interval:  interval,
+		batchSize: batchSize,
+		logger:    logger,
+	}
+}
+
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sweep(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Error("failed to sweep expired reservations", "error", err)
+			}
+		}
+	}
+}
+
+// Sweep releases expired reservations in batches until none are left and
+// returns how many it released. Each sweep starts a new trace whose span
+// links to the traces that created the expired reservations.
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	ctx, span := sweeperTracer.Start(ctx, "sweep expired reservations",
+		trace.WithNewRoot(),
+		trace.WithAttributes(attribute.Int("inventory.sweep.batch_size", s.batchSize)),
+	)
+	defer span.End()
+
+	total := 0
+	for {
+		expired, err := s.repo.ExpireReservations(ctx, s.batchSize)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return total, err
+		}
+
+		for _, reservation := range expired {
+			if link, ok := linkToReservation(reservation); ok {
+				span.AddLink(link)
+			}
+		}
+
+		total += len(expired)
+		if len(expired) < s.batchSize {
+			break
+		}
+	}
+
+	span.SetAttributes(attribute.Int("inventory.sweep.expired_count", total))
+	if total > 0 {
+		s.logger.Info("expired reservations released", "count", total)
+	}
+
+	return total, nil
+}
+
+func linkToReservation(reservation ExpiredReservation) (trace.Link, bool) {
+	if reservation.TraceParent == "" {
+		return trace.Link{}, false
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": reservation.TraceParent}
+	spanCtx := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	if !spanCtx.IsValid() {
+		return trace.Link{}, false
+	}
+
+	return trace.Link{
+		SpanContext: spanCtx,
+		Attributes: []attribute.KeyValue{
+			attribute.String("order.id", reservation.OrderID),
+			attribute.String("inventory.item_id", reservation.ItemID),
+		},
+	}, true
+}
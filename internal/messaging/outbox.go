@@ -0,0 +1,166 @@
+package messaging
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Enqueue stores event in the outbox table as part of tx, so the event is
+// published if and only if tx commits. The table is resolved through the
+// connection's search_path, letting each service schema keep its own outbox.
+// The active trace context is stored alongside the event so that delivery
+// continues the trace of the request that caused it.
+func Enqueue(ctx context.Context, tx *sql.Tx, topic, key string, event any) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	traceContext, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox (topic, message_key, payload, trace_context)
+		VALUES ($1, $2, $3, $4)
+	`, topic, key, payload, traceContext)
+	return err
+}
+
+// OutboxRelay publishes outbox entries to Kafka. Delivery is at least once:
+// an entry is marked published only after Kafka accepted it, so a crash in
+// between publishes it again.
+type OutboxRelay struct {
+	db        *sql.DB
+	producer  *Producer
+	interval  time.Duration
+	batchSize int
+	logger    *slog.Logger
+}
+
+func NewOutboxRelay(db *sql.DB, producer *Producer, interval time.Duration, batchSize int, logger *slog.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		db:        db,
+		producer:  producer,
+		interval:  interval,
+		batchSize: batchSize,
+		logger:    logger,
+	}
+}
+
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Relay(ctx); err != nil && ctx.Err() == nil {
+				r.logger.Error("failed to relay outbox", "error", err)
+			}
+		}
+	}
+}
+
+// Relay publishes pending entries in batches until none are left and returns
+// how many it published.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		published, err := r.relayBatch(ctx)
+		total += published
+		if err != nil || published < r.batchSize {
+			return total, err
+		}
+	}
+}
+
+type outboxEntry struct {
+	id           int64
+	topic        string
+	key          string
+	payload      json.RawMessage
+	traceContext propagation.MapCarrier
+}
+
+// relayBatch publishes entries in id order and stops at the first failure, so
+// events for the same key are never delivered out of order. Rows are locked
+// with SKIP LOCKED so several relays can run side by side.
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, topic, message_key, payload, trace_context
+		FROM outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		var payload, traceContext []byte
+		if err := rows.Scan(&entry.id, &entry.topic, &entry.key, &payload, &traceContext); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		entry.payload = payload
+		if err := json.Unmarshal(traceContext, &entry.traceContext); err != nil {
+			r.logger.Warn("ignoring invalid outbox trace context", "error", err, "outbox_id", entry.id)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return 0, err
+	}
+	_ = rows.Close()
+
+	var published []int64
+	var publishErr error
+	for _, entry := range entries {
+		msgCtx := otel.GetTextMapPropagator().Extract(ctx, entry.traceContext)
+		if err := r.producer.PublishTo(msgCtx, entry.topic, entry.key, entry.payload); err != nil {
+			publishErr = err
+			break
+		}
+		published = append(published, entry.id)
+	}
+
+	if len(published) > 0 {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE outbox SET published_at = NOW()
+			WHERE id = ANY($1)
+		`, pq.Array(published))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(published), publishErr
+}
@@ -24,7 +24,6 @@ func NewProducer(brokers []string, topic string) *Producer {
 		topic: topic,
 		writer: &kafka.Writer{
 			Addr:                   kafka.TCP(brokers...),
-			Topic:                  topic,
 			Balancer:               &kafka.LeastBytes{},
 			AllowAutoTopicCreation: true,
 			BatchTimeout:           100 * time.Millisecond,
@@ -33,23 +32,29 @@ func NewProducer(brokers []string, topic string) *Producer {
 }
 
 func (p *Producer) Publish(ctx context.Context, key string, event any) error {
+	return p.PublishTo(ctx, p.topic, key, event)
+}
+
+// PublishTo sends event to topic instead of the producer's default topic.
+func (p *Producer) PublishTo(ctx context.Context, topic, key string, event any) error {
 	data, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
 
 	msg := kafka.Message{
+		Topic: topic,
 		Key:   []byte(key),
 		Value: data,
 	}
 
-	ctx, span := producerTracer.Start(ctx, "send "+p.topic,
+	ctx, span := producerTracer.Start(ctx, "send "+topic,
 		trace.WithSpanKind(trace.SpanKindProducer),
 		trace.WithAttributes(
 			semconv.MessagingSystemKafka,
 			semconv.MessagingOperationName("send"),
 			semconv.MessagingOperationTypePublish,
-			semconv.MessagingDestinationName(p.topic),
+			semconv.MessagingDestinationName(topic),
 			semconv.MessagingKafkaMessageKey(key),
 		),
 	)
@@ -0,0 +1,73 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+)
+
+// ListByCustomer returns a page of customerID's orders, newest first. When
+// statuses is not empty only orders in one of them are returned.
+func (r *OrderRepository) ListByCustomer(ctx context.Context, customerID string, statuses []domain.OrderStatus, limit, offset int) ([]domain.Order, error) {
+	filter := make([]string, len(statuses))
+	for i, status := range statuses {
+		filter[i] = string(status)
+	}
+
+	return r.queryOrders(ctx, `
+		SELECT `+orderColumns+`
+		FROM orders
+		WHERE customer_id = $1
+		  AND (cardinality($2::text[]) = 0 OR status = ANY($2))
+		ORDER BY created_at DESC, id
+		LIMIT $3 OFFSET $4
+	`, customerID, pq.Array(filter), limit, offset)
+}
+
+// CustomerSummary aggregates the orders of customerID. A customer without
+// orders gets a zero summary.
+func (r *OrderRepository) CustomerSummary(ctx context.Context, customerID string) (*domain.CustomerSummary, error) {
+	summary := &domain.CustomerSummary{
+		CustomerID:    customerID,
+		LifetimeValue: []domain.Money{},
+	}
+
+	var lastOrderAt sql.NullTime
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), MAX(created_at)
+		FROM orders
+		WHERE customer_id = $1
+	`, customerID).Scan(&summary.OrderCount, &lastOrderAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastOrderAt.Valid {
+		summary.LastOrderAt = &lastOrderAt.Time
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT currency, SUM(total - refunded_total)
+		FROM orders
+		WHERE customer_id = $1 AND status <> $2
+		GROUP BY currency
+		ORDER BY currency
+	`, customerID, domain.OrderStatusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var value domain.Money
+		if err := rows.Scan(&value.Currency, &value.Amount); err != nil {
+			return nil, err
+		}
+		summary.LifetimeValue = append(summary.LifetimeValue, value)
+	}
+
+	return summary, rows.Err()
+}
@@ -0,0 +1,127 @@
+package orders
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// statusChannel is the Postgres channel recordStatusChange notifies, with the
+// order ID as payload, when an order's status changes.
+const statusChannel = "order_status"
+
+// listenerPingInterval is how often an idle listener checks its connection.
+const listenerPingInterval = 90 * time.Second
+
+// StatusNotifier listens for status change notifications from Postgres and
+// wakes the event streams of the orders they name. Notifications are sent on
+// commit, so a woken stream always finds the new history entry.
+type StatusNotifier struct {
+	listener *pq.Listener
+	logger   *slog.Logger
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func NewStatusNotifier(postgresURL string, logger *slog.Logger) (*StatusNotifier, error) {
+	n := &StatusNotifier{
+		logger:      logger,
+		subscribers: make(map[string]map[chan struct{}]struct{}),
+	}
+	n.listener = pq.NewListener(postgresURL, time.Second, time.Minute, n.listenerEvent)
+	if err := n.listener.Listen(statusChannel); err != nil {
+		_ = n.listener.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Run dispatches notifications until ctx is done.
+func (n *StatusNotifier) Run(ctx context.Context) {
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-n.listener.Notify:
+			// A nil notification follows a reconnect, after which
+			// notifications may have been lost.
+			if notification == nil {
+				n.wakeAll()
+				continue
+			}
+			n.wake(notification.Extra)
+		case <-ping.C:
+			go func() { _ = n.listener.Ping() }()
+		}
+	}
+}
+
+func (n *StatusNotifier) Close() error {
+	return n.listener.Close()
+}
+
+// Subscribe returns a channel that receives a value when orderID's status
+// changes. Changes that happen while a value is pending are merged into it.
+// Call the returned function to unsubscribe.
+func (n *StatusNotifier) Subscribe(orderID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subscribers[orderID] == nil {
+		n.subscribers[orderID] = make(map[chan struct{}]struct{})
+	}
+	n.subscribers[orderID][ch] = struct{}{}
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subscribers[orderID], ch)
+		if len(n.subscribers[orderID]) == 0 {
+			delete(n.subscribers, orderID)
+		}
+	}
+}
+
+func (n *StatusNotifier) wake(orderID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subscribers[orderID] {
+		signal(ch)
+	}
+}
+
+func (n *StatusNotifier) wakeAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, subscribers := range n.subscribers {
+		for ch := range subscribers {
+			signal(ch)
+		}
+	}
+}
+
+func (n *StatusNotifier) listenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventDisconnected:
+		n.logger.Warn("status listener disconnected", "error", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		n.logger.Error("failed to reconnect status listener", "error", err)
+	case pq.ListenerEventReconnected:
+		n.logger.Info("status listener reconnected")
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
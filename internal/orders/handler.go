@@ -2,31 +2,72 @@ package orders
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
 )
 
+const (
+	// eventHeartbeatInterval is how often an idle event stream sends a
+	// comment, so proxies keep the connection open. Each heartbeat also
+	// checks for changes a lost notification would have missed.
+	eventHeartbeatInterval = 15 * time.Second
+	// eventRetry is how long clients wait before reconnecting a dropped
+	// event stream.
+	eventRetry = 3 * time.Second
+)
+
 type Handler struct {
 	repo     *OrderRepository
+	pricer   *Pricer
 	producer *messaging.Producer
+	notifier *StatusNotifier
 	logger   *slog.Logger
 }
 
 func NewHandler(repo *OrderRepository, producer *messaging.Producer, logger *slog.Logger) *Handler {
 	return &Handler{
 		repo:     repo,
+		pricer:   NewPricer(repo),
 		producer: producer,
 		logger:   logger,
 	}
 }
 
+// SetStatusNotifier makes event streams push status changes as soon as they
+// are committed. Without one, streams only see changes at each heartbeat.
+func (h *Handler) SetStatusNotifier(notifier *StatusNotifier) {
+	h.notifier = notifier
+}
+
+// HandleHealth answers 503 while the orders database is unreachable.
+func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := h.repo.Ping(r.Context()); err != nil {
+		h.logger.Error("health check failed", "error", err)
+		h.writeError(w, http.StatusServiceUnavailable, "database unavailable")
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
 type createOrderRequest struct {
-	CustomerID string             `json:"customer_id"`
-	Items      []domain.OrderItem `json:"items"`
+	CustomerID     string             `json:"customer_id"`
+	Items          []domain.OrderItem `json:"items"`
+	AllowBackorder bool               `json:"allow_backorder"`
+	Currency       string             `json:"currency"`
+	PromoCode      string             `json:"promo_code"`
+	Region         string             `json:"region"`
 }
 
 func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
@@ -36,20 +77,60 @@ func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var total int64
-	for _, item := range req.Items {
-		total += int64(item.Quantity) * item.Price
+	// Clients that predate currencies send none and are charged in the
+	// default currency. Items without a currency take the order's.
+	if req.Currency == "" {
+		req.Currency = domain.DefaultCurrency
+		for _, item := range req.Items {
+			if item.Price.Currency != "" {
+				req.Currency = item.Price.Currency
+				break
+			}
+		}
+	}
+
+	if err := domain.ValidateCurrency(req.Currency); err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for i, item := range req.Items {
+		if item.Price.Currency == "" {
+			req.Items[i].Price.Currency = req.Currency
+			continue
+		}
+		if item.Price.Currency != req.Currency {
+			h.writeError(w, http.StatusBadRequest, fmt.Sprintf("item %s is priced in %s but the order is in %s", item.ItemID, item.Price.Currency, req.Currency))
+			return
+		}
 	}
 
 	order := &domain.Order{
-		CustomerID: req.CustomerID,
-		Items:      req.Items,
-		Total:      total,
-		Status:     domain.OrderStatusPending,
-		CreatedAt:  time.Now().UTC(),
+		CustomerID:     req.CustomerID,
+		Items:          req.Items,
+		PromoCode:      strings.TrimSpace(req.PromoCode),
+		Region:         strings.TrimSpace(req.Region),
+		Total:          domain.NewMoney(0, req.Currency),
+		Status:         domain.OrderStatusPending,
+		AllowBackorder: req.AllowBackorder,
+		CreatedAt:      time.Now().UTC(),
 	}
 
-	if err := h.repo.Create(r.Context(), order); err != nil {
+	if err := h.pricer.Price(r.Context(), order); err != nil {
+		if isPricingError(err) {
+			h.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		h.logger.Error("failed to price order", "error", err)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if err := h.repo.Create(r.Context(), order, actorFromRequest(r)); err != nil {
+		if errors.Is(err, ErrInvalidPromoCode) {
+			h.writeError(w, http.StatusConflict, err.Error())
+			return
+		}
 		h.logger.Error("failed to create order", "error", err)
 		h.writeError(w, http.StatusInternalServerError, "internal server error")
 		return
@@ -57,10 +138,11 @@ func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 
 	if h.producer != nil {
 		event := domain.OrderCreatedEvent{
-			OrderID:    order.ID,
-			CustomerID: order.CustomerID,
-			Items:      order.Items,
-			Timestamp:  order.CreatedAt,
+			OrderID:        order.ID,
+			CustomerID:     order.CustomerID,
+			Items:          order.Items,
+			AllowBackorder: order.AllowBackorder,
+			Timestamp:      order.CreatedAt,
 		}
 		if err := h.producer.Publish(r.Context(), order.ID, event); err != nil {
 			h.logger.Error("failed to publish order created event", "error", err, "order_id", order.ID)
@@ -68,6 +150,7 @@ func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	h.logger.Info("order created", "order_id", order.ID, "customer_id", order.CustomerID)
+	w.Header().Set("ETag", etag(order))
 	h.writeJSON(w, http.StatusCreated, order)
 }
 
@@ -91,11 +174,14 @@ func (h *Handler) HandleGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	h.logger.Info("order retrieved", "order_id", order.ID)
+	w.Header().Set("ETag", etag(order))
 	h.writeJSON(w, http.StatusOK, order)
 }
 
 type updateStatusRequest struct {
-	Status domain.OrderStatus `json:"status"`
+	Status      domain.OrderStatus      `json:"status"`
+	Allocations []domain.ItemAllocation `json:"allocations"`
+	Reason      string                  `json:"reason"`
 }
 
 func (h *Handler) HandleUpdateStatus(w http.ResponseWriter, r *http.Request) {
@@ -105,14 +191,50 @@ func (h *Handler) HandleUpdateStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ifVersions, err := ifMatchVersions(r)
+	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) {
+			h.writeError(w, http.StatusPreconditionFailed, "order has been modified")
+			return
+		}
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	var req updateStatusRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.writeError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
-	order, err := h.repo.UpdateStatus(r.Context(), id, req.Status)
+	if req.Status == domain.OrderStatusShipped {
+		h.writeError(w, http.StatusBadRequest, "orders are shipped by creating shipments")
+		return
+	}
+
+	for _, a := range req.Allocations {
+		if a.ItemID == "" || a.LocationID == "" || a.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, "allocations need an item id, a location id and a positive quantity")
+			return
+		}
+	}
+
+	order, current, err := h.repo.UpdateStatus(r.Context(), id, StatusChange{
+		Status:      req.Status,
+		Allocations: req.Allocations,
+		Actor:       actorFromRequest(r),
+		Reason:      req.Reason,
+		IfVersions:  ifVersions,
+	})
 	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) {
+			h.writeError(w, http.StatusPreconditionFailed, "order has been modified")
+			return
+		}
+		if errors.Is(err, ErrInvalidTransition) {
+			h.writeError(w, http.StatusConflict, fmt.Sprintf("cannot move order from %s to %s", current, req.Status))
+			return
+		}
 		h.logger.Error("failed to update order status", "error", err, "id", id)
 		h.writeError(w, http.StatusInternalServerError, "internal server error")
 		return
@@ -124,9 +246,526 @@ func (h *Handler) HandleUpdateStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	h.logger.Info("order status updated", "order_id", order.ID, "status", order.Status)
+	w.Header().Set("ETag", etag(order))
+	h.writeJSON(w, http.StatusOK, order)
+}
+
+type cancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *Handler) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	ifVersions, err := ifMatchVersions(r)
+	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) {
+			h.writeError(w, http.StatusPreconditionFailed, "order has been modified")
+			return
+		}
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req cancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	order, previous, err := h.repo.UpdateStatus(r.Context(), id, StatusChange{
+		Status:     domain.OrderStatusCancelled,
+		Actor:      actorFromRequest(r),
+		Reason:     req.Reason,
+		IfVersions: ifVersions,
+		Announce:   true,
+	})
+	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) {
+			h.writeError(w, http.StatusPreconditionFailed, "order has been modified")
+			return
+		}
+		if errors.Is(err, ErrInvalidTransition) {
+			h.writeError(w, http.StatusConflict, fmt.Sprintf("cannot cancel a %s order", previous))
+			return
+		}
+		if errors.Is(err, ErrPartiallyShipped) {
+			h.writeError(w, http.StatusConflict, "cannot cancel an order that has started shipping")
+			return
+		}
+		h.logger.Error("failed to cancel order", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	w.Header().Set("ETag", etag(order))
+
+	if previous == domain.OrderStatusCancelled {
+		h.writeJSON(w, http.StatusOK, order)
+		return
+	}
+
+	h.logger.Info("order cancelled", "order_id", order.ID, "previous_status", previous)
 	h.writeJSON(w, http.StatusOK, order)
 }
 
+// HandleHistory returns the order's status changes, oldest first.
+func (h *Handler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	order, err := h.repo.GetByID(r.Context(), id)
+	if err != nil {
+		h.logger.Error("failed to get order", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	history, err := h.repo.History(r.Context(), id)
+	if err != nil {
+		h.logger.Error("failed to get order history", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("order history retrieved", "order_id", id, "count", len(history))
+	h.writeJSON(w, http.StatusOK, history)
+}
+
+// HandleEvents streams an order's status changes as server-sent "status"
+// events, starting with its history. Each event's id is its history entry ID,
+// so a client reconnecting with Last-Event-ID gets only what it missed.
+func (h *Handler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	var lastID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		parsed, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || parsed < 0 {
+			h.writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+		lastID = parsed
+	}
+
+	order, err := h.repo.GetByID(ctx, id)
+	if err != nil {
+		h.logger.Error("failed to get order", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	// Subscribe before reading the history so no change falls in between.
+	var changed <-chan struct{}
+	if h.notifier != nil {
+		var unsubscribe func()
+		changed, unsubscribe = h.notifier.Subscribe(id)
+		defer unsubscribe()
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream lasts as long as the client listens, past the server's
+	// write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		h.logger.Error("failed to clear write deadline", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds()); err != nil {
+		return
+	}
+	_ = rc.Flush()
+
+	h.logger.Info("order event stream opened", "order_id", id, "last_event_id", lastID)
+	span := trace.SpanFromContext(ctx)
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		changes, err := h.repo.HistoryAfter(ctx, id, lastID)
+		if err != nil {
+			if ctx.Err() == nil {
+				// Closing makes the client reconnect and resume.
+				h.logger.Error("failed to get order history", "error", err, "id", id)
+			}
+			return
+		}
+
+		for _, change := range changes {
+			data, err := json.Marshal(change)
+			if err != nil {
+				h.logger.Error("failed to encode status change", "error", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", change.ID, data); err != nil {
+				return
+			}
+			lastID = change.ID
+			span.AddEvent("status change sent", trace.WithAttributes(
+				attribute.Int64("order.status_change.id", change.ID),
+				attribute.String("order.status", string(change.ToStatus)),
+			))
+		}
+		if len(changes) > 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type createShipmentRequest struct {
+	Carrier        string                `json:"carrier"`
+	TrackingNumber string                `json:"tracking_number"`
+	Items          []domain.ShipmentItem `json:"items"`
+}
+
+func (h *Handler) HandleCreateShipment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	var req createShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Carrier == "" || req.TrackingNumber == "" {
+		h.writeError(w, http.StatusBadRequest, "carrier and tracking_number are required")
+		return
+	}
+
+	for _, item := range req.Items {
+		if item.ItemID == "" || item.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, "shipment items need an item id and a positive quantity")
+			return
+		}
+	}
+
+	shipment := &domain.Shipment{
+		OrderID:        id,
+		Carrier:        req.Carrier,
+		TrackingNumber: req.TrackingNumber,
+		Items:          req.Items,
+	}
+
+	order, current, err := h.repo.CreateShipment(r.Context(), shipment, actorFromRequest(r))
+	if err != nil {
+		if errors.Is(err, ErrInvalidTransition) {
+			h.writeError(w, http.StatusConflict, fmt.Sprintf("cannot ship a %s order", current))
+			return
+		}
+		if errors.Is(err, ErrInvalidShipment) {
+			h.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		h.logger.Error("failed to create shipment", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	h.logger.Info("shipment created", "order_id", id, "shipment_id", shipment.ID, "carrier", shipment.Carrier, "order_status", order.Status)
+	h.writeJSON(w, http.StatusCreated, shipment)
+}
+
+func (h *Handler) HandleListShipments(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	order, err := h.repo.GetByID(r.Context(), id)
+	if err != nil {
+		h.logger.Error("failed to get order", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	shipments, err := h.repo.ListShipments(r.Context(), id)
+	if err != nil {
+		h.logger.Error("failed to list shipments", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("shipments listed", "order_id", id, "count", len(shipments))
+	h.writeJSON(w, http.StatusOK, shipments)
+}
+
+type createReturnRequest struct {
+	Reason string              `json:"reason"`
+	Items  []domain.ReturnItem `json:"items"`
+}
+
+func (h *Handler) HandleCreateReturn(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	var req createReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		h.writeError(w, http.StatusBadRequest, "at least one item is required")
+		return
+	}
+
+	for _, item := range req.Items {
+		if item.ItemID == "" || item.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, "return items need an item id and a positive quantity")
+			return
+		}
+	}
+
+	ret := &domain.Return{
+		OrderID: id,
+		Reason:  req.Reason,
+		Items:   req.Items,
+	}
+
+	order, current, err := h.repo.CreateReturn(r.Context(), ret)
+	if err != nil {
+		if errors.Is(err, ErrInvalidTransition) {
+			h.writeError(w, http.StatusConflict, fmt.Sprintf("cannot return items of a %s order", current))
+			return
+		}
+		if errors.Is(err, ErrInvalidReturn) {
+			h.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		h.logger.Error("failed to create return", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	h.logger.Info("return requested", "order_id", id, "return_id", ret.ID, "items", len(ret.Items))
+	h.writeJSON(w, http.StatusCreated, ret)
+}
+
+func (h *Handler) HandleListReturns(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order id")
+		return
+	}
+
+	order, err := h.repo.GetByID(r.Context(), id)
+	if err != nil {
+		h.logger.Error("failed to get order", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if order == nil {
+		h.writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	returns, err := h.repo.ListReturns(r.Context(), id)
+	if err != nil {
+		h.logger.Error("failed to list returns", "error", err, "id", id)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("returns listed", "order_id", id, "count", len(returns))
+	h.writeJSON(w, http.StatusOK, returns)
+}
+
+// HandleReceiveReturn records that the warehouse got the returned items back.
+func (h *Handler) HandleReceiveReturn(w http.ResponseWriter, r *http.Request) {
+	h.updateReturnStatus(w, r, domain.ReturnStatusReceived)
+}
+
+// HandleRefundReturn refunds a received return. The worker calls it once the
+// returned items are back in stock.
+func (h *Handler) HandleRefundReturn(w http.ResponseWriter, r *http.Request) {
+	h.updateReturnStatus(w, r, domain.ReturnStatusRefunded)
+}
+
+func (h *Handler) updateReturnStatus(w http.ResponseWriter, r *http.Request, status domain.ReturnStatus) {
+	id := r.PathValue("id")
+	returnID := r.PathValue("returnId")
+	if id == "" || returnID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing order or return id")
+		return
+	}
+
+	ret, previous, err := h.repo.UpdateReturnStatus(r.Context(), id, returnID, status)
+	if err != nil {
+		if errors.Is(err, ErrInvalidReturnTransition) {
+			h.writeError(w, http.StatusConflict, fmt.Sprintf("cannot move return from %s to %s", previous, status))
+			return
+		}
+		h.logger.Error("failed to update return status", "error", err, "id", id, "return_id", returnID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if ret == nil {
+		h.writeError(w, http.StatusNotFound, "return not found")
+		return
+	}
+
+	h.logger.Info("return status updated", "order_id", id, "return_id", returnID, "status", ret.Status)
+	h.writeJSON(w, http.StatusOK, ret)
+}
+
+const (
+	defaultCustomerOrdersLimit = 20
+	maxCustomerOrdersLimit     = 100
+)
+
+type customerOrdersResponse struct {
+	Orders     []domain.Order `json:"orders"`
+	NextOffset *int           `json:"next_offset,omitempty"`
+}
+
+// HandleListByCustomer pages through a customer's orders, newest first. The
+// status query parameter may be repeated or hold a comma-separated list.
+func (h *Handler) HandleListByCustomer(w http.ResponseWriter, r *http.Request) {
+	customerID := r.PathValue("customerId")
+	if customerID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing customer id")
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := defaultCustomerOrdersLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxCustomerOrdersLimit {
+			h.writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	var offset int
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.writeError(w, http.StatusBadRequest, "invalid offset")
+			return
+		}
+		offset = n
+	}
+
+	var statuses []domain.OrderStatus
+	for _, v := range query["status"] {
+		for _, s := range strings.Split(v, ",") {
+			status := domain.OrderStatus(strings.TrimSpace(s))
+			if !status.IsValid() {
+				h.writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid status %q", s))
+				return
+			}
+			statuses = append(statuses, status)
+		}
+	}
+
+	orders, err := h.repo.ListByCustomer(r.Context(), customerID, statuses, limit, offset)
+	if err != nil {
+		h.logger.Error("failed to list customer orders", "error", err, "customer_id", customerID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	resp := customerOrdersResponse{Orders: orders}
+	if len(orders) == limit {
+		next := offset + limit
+		resp.NextOffset = &next
+	}
+
+	h.logger.Info("customer orders listed", "customer_id", customerID, "count", len(orders))
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) HandleCustomerSummary(w http.ResponseWriter, r *http.Request) {
+	customerID := r.PathValue("customerId")
+	if customerID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing customer id")
+		return
+	}
+
+	summary, err := h.repo.CustomerSummary(r.Context(), customerID)
+	if err != nil {
+		h.logger.Error("failed to summarize customer orders", "error", err, "customer_id", customerID)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("customer summary retrieved", "customer_id", customerID, "order_count", summary.OrderCount)
+	h.writeJSON(w, http.StatusOK, summary)
+}
+
 func (h *Handler) HandleList(w http.ResponseWriter, r *http.Request) {
 	orders, err := h.repo.List(r.Context())
 	if err != nil {
@@ -151,6 +790,237 @@ func (h *Handler) HandleListNPlus1(w http.ResponseWriter, r *http.Request) {
 	h.writeJSON(w, http.StatusOK, orders)
 }
 
+type createPromoCodeRequest struct {
+	Code        string            `json:"code"`
+	Description string            `json:"description"`
+	Scope       domain.PromoScope `json:"scope"`
+	ItemID      string            `json:"item_id"`
+	PercentOff  int               `json:"percent_off"`
+	AmountOff   *domain.Money     `json:"amount_off"`
+	ValidFrom   *time.Time        `json:"valid_from"`
+	ValidUntil  *time.Time        `json:"valid_until"`
+	MaxUses     *int              `json:"max_uses"`
+}
+
+func (h *Handler) HandleCreatePromoCode(w http.ResponseWriter, r *http.Request) {
+	var req createPromoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if message := validatePromoCode(req); message != "" {
+		h.writeError(w, http.StatusBadRequest, message)
+		return
+	}
+
+	promo := &domain.PromoCode{
+		Code:        req.Code,
+		Description: req.Description,
+		Scope:       req.Scope,
+		ItemID:      req.ItemID,
+		PercentOff:  req.PercentOff,
+		AmountOff:   req.AmountOff,
+		ValidFrom:   req.ValidFrom,
+		ValidUntil:  req.ValidUntil,
+		MaxUses:     req.MaxUses,
+	}
+
+	if err := h.repo.CreatePromoCode(r.Context(), promo); err != nil {
+		if errors.Is(err, ErrPromoCodeExists) {
+			h.writeError(w, http.StatusConflict, "promo code already exists")
+			return
+		}
+		h.logger.Error("failed to create promo code", "error", err, "code", req.Code)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("promo code created", "code", promo.Code, "scope", promo.Scope)
+	h.writeJSON(w, http.StatusCreated, promo)
+}
+
+func validatePromoCode(req createPromoCodeRequest) string {
+	switch {
+	case req.Code == "":
+		return "missing code"
+	case req.Scope != domain.PromoScopeOrder && req.Scope != domain.PromoScopeLine:
+		return "scope must be order or line"
+	case (req.Scope == domain.PromoScopeLine) != (req.ItemID != ""):
+		return "line promo codes need an item_id and order promo codes must not have one"
+	case (req.PercentOff != 0) == (req.AmountOff != nil):
+		return "set exactly one of percent_off and amount_off"
+	case req.AmountOff == nil && (req.PercentOff < 1 || req.PercentOff > 100):
+		return "percent_off must be between 1 and 100"
+	case req.ValidFrom != nil && req.ValidUntil != nil && !req.ValidUntil.After(*req.ValidFrom):
+		return "valid_until must be after valid_from"
+	case req.MaxUses != nil && *req.MaxUses <= 0:
+		return "max_uses must be positive"
+	}
+
+	if req.AmountOff != nil {
+		if req.AmountOff.Amount <= 0 {
+			return "amount_off must be positive"
+		}
+		if err := domain.ValidateCurrency(req.AmountOff.Currency); err != nil {
+			return err.Error()
+		}
+	}
+
+	return ""
+}
+
+func (h *Handler) HandleGetPromoCode(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	if code == "" {
+		h.writeError(w, http.StatusBadRequest, "missing promo code")
+		return
+	}
+
+	promo, err := h.repo.GetPromoCode(r.Context(), code)
+	if err != nil {
+		h.logger.Error("failed to get promo code", "error", err, "code", code)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if promo == nil {
+		h.writeError(w, http.StatusNotFound, "promo code not found")
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, promo)
+}
+
+func (h *Handler) HandleListPricingRegions(w http.ResponseWriter, r *http.Request) {
+	regions, err := h.repo.ListPricingRegions(r.Context())
+	if err != nil {
+		h.logger.Error("failed to list pricing regions", "error", err)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, regions)
+}
+
+type savePricingRegionRequest struct {
+	Currency         string `json:"currency"`
+	TaxRateBps       int    `json:"tax_rate_bps"`
+	ShippingFee      int64  `json:"shipping_fee"`
+	FreeShippingOver *int64 `json:"free_shipping_over"`
+}
+
+// HandleSavePricingRegion creates a region or replaces its currency, tax rate
+// and shipping fee. Regions saved without a currency price in the default
+// currency. Orders already placed keep the prices they were given.
+func (h *Handler) HandleSavePricingRegion(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	if region == "" {
+		h.writeError(w, http.StatusBadRequest, "missing region")
+		return
+	}
+
+	var req savePricingRegionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.TaxRateBps < 0 || req.ShippingFee < 0 || (req.FreeShippingOver != nil && *req.FreeShippingOver < 0) {
+		h.writeError(w, http.StatusBadRequest, "rates and fees must not be negative")
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = domain.DefaultCurrency
+	}
+	if err := domain.ValidateCurrency(req.Currency); err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	saved := domain.PricingRegion{
+		Region:           region,
+		Currency:         req.Currency,
+		TaxRateBps:       req.TaxRateBps,
+		ShippingFee:      req.ShippingFee,
+		FreeShippingOver: req.FreeShippingOver,
+	}
+
+	if err := h.repo.SavePricingRegion(r.Context(), saved); err != nil {
+		h.logger.Error("failed to save pricing region", "error", err, "region", region)
+		h.writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	h.logger.Info("pricing region saved", "region", region, "tax_rate_bps", saved.TaxRateBps)
+	h.writeJSON(w, http.StatusOK, saved)
+}
+
+// isPricingError reports whether err is the client's fault: a bad promo code,
+// an unknown region, a currency the region does not price in or amounts that
+// cannot be added up.
+func isPricingError(err error) bool {
+	return errors.Is(err, ErrInvalidPromoCode) ||
+		errors.Is(err, ErrUnknownRegion) ||
+		errors.Is(err, ErrRegionCurrency) ||
+		errors.Is(err, domain.ErrMixedCurrencies) ||
+		errors.Is(err, domain.ErrMoneyOverflow) ||
+		errors.Is(err, domain.ErrNegativeQuantity)
+}
+
+// etag identifies the version of order a client has seen. Send it back in
+// If-Match to make an update conditional on the order being unchanged.
+func etag(order *domain.Order) string {
+	return strconv.Quote(strconv.Itoa(order.Version))
+}
+
+var errInvalidIfMatch = errors.New("invalid If-Match header")
+
+// ifMatchVersions returns the order versions listed in the If-Match header,
+// any of which lets an update proceed, or nil when the update is
+// unconditional. If-Match uses strong comparison, so weak tags never match;
+// a list without any strong tag fails with ErrVersionMismatch. "*" is only
+// valid as the whole header, and malformed lists fail with errInvalidIfMatch.
+func ifMatchVersions(r *http.Request) ([]int, error) {
+	header := strings.TrimSpace(strings.Join(r.Header.Values("If-Match"), ","))
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+
+	var versions []int
+	for _, entry := range strings.Split(header, ",") {
+		entry = strings.TrimSpace(entry)
+		weak := strings.HasPrefix(entry, "W/")
+		tag := strings.TrimPrefix(entry, "W/")
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' || strings.Contains(tag[1:len(tag)-1], `"`) {
+			return nil, fmt.Errorf("%w: %q is not an entity tag", errInvalidIfMatch, entry)
+		}
+		if weak {
+			continue
+		}
+
+		// Tags that are not versions are well formed but match no order.
+		if version, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil && version > 0 {
+			versions = append(versions, version)
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrVersionMismatch
+	}
+	return versions, nil
+}
+
+// actorFromRequest identifies who changed an order. Callers name themselves
+// with the X-Actor header.
+func actorFromRequest(r *http.Request) string {
+	if actor := r.Header.Get("X-Actor"); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
 func (h *Handler) writeJSON(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
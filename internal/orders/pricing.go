@@ -0,0 +1,455 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+)
+
+var pricingTracer = otel.Tracer("orders/pricing")
+
+var (
+	ErrInvalidPromoCode = errors.New("invalid promo code")
+	ErrUnknownRegion    = errors.New("unknown region")
+	ErrRegionCurrency   = errors.New("order currency does not match region")
+	ErrPromoCodeExists  = errors.New("promo code already exists")
+)
+
+// Pricer prices orders in stages: subtotal, promo code, line discounts, order
+// discount, tax and shipping, then the total. Each stage runs in a child span
+// of the "price order" span so traces show where a price came from.
+type Pricer struct {
+	repo *OrderRepository
+}
+
+func NewPricer(repo *OrderRepository) *Pricer {
+	return &Pricer{repo: repo}
+}
+
+// pricing is the state passed from one stage to the next.
+type pricing struct {
+	order  *domain.Order
+	promo  *domain.PromoCode
+	region *domain.PricingRegion
+}
+
+type pricingStage struct {
+	name  string
+	apply func(ctx context.Context, p *pricing) error
+}
+
+// Price fills in the line discounts and the subtotal, discount, tax, shipping
+// and total of order from its items, promo code and region. Every item must
+// be priced in the order's currency. Unknown, expired or used up promo codes
+// fail with ErrInvalidPromoCode, unknown regions with ErrUnknownRegion and
+// orders in another currency than their region with ErrRegionCurrency.
+// Promo codes are checked against the order's creation time. Orders without a
+// region pay neither tax nor shipping.
+func (pr *Pricer) Price(ctx context.Context, order *domain.Order) error {
+	ctx, span := pricingTracer.Start(ctx, "price order", trace.WithAttributes(
+		attribute.String("pricing.currency", order.Total.Currency),
+		attribute.String("pricing.promo_code", order.PromoCode),
+		attribute.String("pricing.region", order.Region),
+		attribute.Int("pricing.line_count", len(order.Items)),
+	))
+	defer span.End()
+
+	stages := []pricingStage{
+		{"subtotal", pr.subtotal},
+		{"promo code", pr.promoCode},
+		{"line discounts", pr.lineDiscounts},
+		{"order discount", pr.orderDiscount},
+		{"tax", pr.tax},
+		{"shipping", pr.shipping},
+		{"total", pr.total},
+	}
+
+	p := &pricing{order: order}
+	for _, stage := range stages {
+		if err := pr.runStage(ctx, stage, p); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	span.SetAttributes(attribute.Int64("pricing.total", order.Total.Amount))
+	return nil
+}
+
+func (pr *Pricer) runStage(ctx context.Context, stage pricingStage, p *pricing) error {
+	ctx, span := pricingTracer.Start(ctx, "pricing "+stage.name)
+	defer span.End()
+
+	if err := stage.apply(ctx, p); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (pr *Pricer) subtotal(ctx context.Context, p *pricing) error {
+	currency := p.order.Total.Currency
+
+	subtotal := domain.NewMoney(0, currency)
+	if len(p.order.Items) > 0 {
+		var err error
+		subtotal, err = domain.OrderTotal(p.order.Items)
+		if err != nil {
+			return err
+		}
+		if subtotal.Currency != currency {
+			return domain.ErrMixedCurrencies
+		}
+	}
+
+	for i := range p.order.Items {
+		p.order.Items[i].Discount = domain.NewMoney(0, currency)
+	}
+
+	p.order.Subtotal = subtotal
+	p.order.Discount = domain.NewMoney(0, currency)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("pricing.subtotal", subtotal.Amount))
+	return nil
+}
+
+func (pr *Pricer) promoCode(ctx context.Context, p *pricing) error {
+	code := p.order.PromoCode
+	if code == "" {
+		return nil
+	}
+
+	promo, err := pr.repo.GetPromoCode(ctx, code)
+	if err != nil {
+		return err
+	}
+	if promo == nil {
+		return fmt.Errorf("%w: %s does not exist", ErrInvalidPromoCode, code)
+	}
+	if !promo.ActiveAt(p.order.CreatedAt) {
+		return fmt.Errorf("%w: %s is not valid at this time", ErrInvalidPromoCode, code)
+	}
+	if promo.MaxUses != nil && promo.Uses >= *promo.MaxUses {
+		return fmt.Errorf("%w: %s has been used up", ErrInvalidPromoCode, code)
+	}
+	if promo.AmountOff != nil && promo.AmountOff.Currency != p.order.Total.Currency {
+		return fmt.Errorf("%w: %s only applies to orders in %s", ErrInvalidPromoCode, code, promo.AmountOff.Currency)
+	}
+	if promo.Scope == domain.PromoScopeLine && !hasItem(p.order.Items, promo.ItemID) {
+		return fmt.Errorf("%w: %s only applies to orders of %s", ErrInvalidPromoCode, code, promo.ItemID)
+	}
+
+	p.promo = promo
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("pricing.promo_scope", string(promo.Scope)))
+	return nil
+}
+
+func hasItem(items []domain.OrderItem, itemID string) bool {
+	for _, item := range items {
+		if item.ItemID == itemID {
+			return true
+		}
+	}
+	return false
+}
+
+func (pr *Pricer) lineDiscounts(ctx context.Context, p *pricing) error {
+	if p.promo == nil || p.promo.Scope != domain.PromoScopeLine {
+		return nil
+	}
+
+	for i := range p.order.Items {
+		item := &p.order.Items[i]
+		if item.ItemID != p.promo.ItemID {
+			continue
+		}
+
+		line, err := item.Price.Mul(item.Quantity)
+		if err != nil {
+			return err
+		}
+
+		var discount domain.Money
+		if p.promo.AmountOff != nil {
+			discount, err = p.promo.AmountOff.Mul(item.Quantity)
+		} else {
+			discount, err = line.Percent(int64(p.promo.PercentOff) * 100)
+		}
+		if err != nil {
+			return err
+		}
+
+		item.Discount = capAt(discount, line)
+		if p.order.Discount, err = p.order.Discount.Add(item.Discount); err != nil {
+			return err
+		}
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("pricing.line_discount", p.order.Discount.Amount))
+	return nil
+}
+
+func (pr *Pricer) orderDiscount(ctx context.Context, p *pricing) error {
+	if p.promo == nil || p.promo.Scope != domain.PromoScopeOrder {
+		return nil
+	}
+
+	base, err := p.order.Subtotal.Sub(p.order.Discount)
+	if err != nil {
+		return err
+	}
+
+	var discount domain.Money
+	if p.promo.AmountOff != nil {
+		discount = *p.promo.AmountOff
+	} else if discount, err = base.Percent(int64(p.promo.PercentOff) * 100); err != nil {
+		return err
+	}
+
+	discount = capAt(discount, base)
+	if p.order.Discount, err = p.order.Discount.Add(discount); err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("pricing.order_discount", discount.Amount))
+	return nil
+}
+
+// capAt keeps a discount from exceeding the amount it applies to.
+func capAt(discount, limit domain.Money) domain.Money {
+	if discount.Amount > limit.Amount {
+		return limit
+	}
+	return discount
+}
+
+func (pr *Pricer) tax(ctx context.Context, p *pricing) error {
+	p.order.Tax = domain.NewMoney(0, p.order.Total.Currency)
+	if p.order.Region == "" {
+		return nil
+	}
+
+	region, err := pr.repo.GetPricingRegion(ctx, p.order.Region)
+	if err != nil {
+		return err
+	}
+	if region == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownRegion, p.order.Region)
+	}
+	if region.Currency != p.order.Total.Currency {
+		return fmt.Errorf("%w: %s prices orders in %s, not %s", ErrRegionCurrency, region.Region, region.Currency, p.order.Total.Currency)
+	}
+	p.region = region
+
+	taxable, err := p.order.Subtotal.Sub(p.order.Discount)
+	if err != nil {
+		return err
+	}
+	if p.order.Tax, err = taxable.Percent(int64(region.TaxRateBps)); err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("pricing.tax_rate_bps", region.TaxRateBps),
+		attribute.Int64("pricing.tax", p.order.Tax.Amount),
+	)
+	return nil
+}
+
+func (pr *Pricer) shipping(ctx context.Context, p *pricing) error {
+	p.order.Shipping = domain.NewMoney(0, p.order.Total.Currency)
+	if p.region == nil {
+		return nil
+	}
+
+	discounted := p.order.Subtotal.Amount - p.order.Discount.Amount
+	free := p.region.FreeShippingOver != nil && discounted >= *p.region.FreeShippingOver
+	if !free {
+		p.order.Shipping.Amount = p.region.ShippingFee
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Bool("pricing.free_shipping", free),
+		attribute.Int64("pricing.shipping", p.order.Shipping.Amount),
+	)
+	return nil
+}
+
+func (pr *Pricer) total(ctx context.Context, p *pricing) error {
+	total, err := p.order.Subtotal.Sub(p.order.Discount)
+	if err != nil {
+		return err
+	}
+	if total, err = total.Add(p.order.Tax); err != nil {
+		return err
+	}
+	if total, err = total.Add(p.order.Shipping); err != nil {
+		return err
+	}
+
+	p.order.Total = total
+	return nil
+}
+
+// redeemPromoCode counts a use of code. It must run in the transaction that
+// creates the order so a code cannot be used more often than allowed when
+// orders race for its last use.
+func redeemPromoCode(ctx context.Context, tx *sql.Tx, code string, at time.Time) error {
+	result, err := tx.ExecContext(ctx, `
+		UPDATE promo_codes SET uses = uses + 1
+		WHERE code = $1
+		  AND (max_uses IS NULL OR uses < max_uses)
+		  AND (valid_from IS NULL OR valid_from <= $2)
+		  AND (valid_until IS NULL OR valid_until > $2)
+	`, code, at)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s is no longer available", ErrInvalidPromoCode, code)
+	}
+	return nil
+}
+
+func (r *OrderRepository) CreatePromoCode(ctx context.Context, promo *domain.PromoCode) error {
+	var amountOff sql.NullInt64
+	var currency sql.NullString
+	if promo.AmountOff != nil {
+		amountOff = sql.NullInt64{Int64: promo.AmountOff.Amount, Valid: true}
+		currency = sql.NullString{String: promo.AmountOff.Currency, Valid: true}
+	}
+
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO promo_codes (code, description, scope, item_id, percent_off, amount_off, currency, valid_from, valid_until, max_uses)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), $6, $7, $8, $9, $10)
+		RETURNING uses, created_at
+	`, promo.Code, promo.Description, promo.Scope, promo.ItemID, promo.PercentOff, amountOff, currency,
+		promo.ValidFrom, promo.ValidUntil, promo.MaxUses).Scan(&promo.Uses, &promo.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrPromoCodeExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (r *OrderRepository) GetPromoCode(ctx context.Context, code string) (*domain.PromoCode, error) {
+	promo := &domain.PromoCode{}
+
+	var itemID, currency sql.NullString
+	var percentOff, maxUses sql.NullInt32
+	var amountOff sql.NullInt64
+	var validFrom, validUntil sql.NullTime
+	err := r.db.QueryRowContext(ctx, `
+		SELECT code, description, scope, item_id, percent_off, amount_off, currency, valid_from, valid_until, max_uses, uses, created_at
+		FROM promo_codes
+		WHERE code = $1
+	`, code).Scan(&promo.Code, &promo.Description, &promo.Scope, &itemID, &percentOff, &amountOff, &currency,
+		&validFrom, &validUntil, &maxUses, &promo.Uses, &promo.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	promo.ItemID = itemID.String
+	promo.PercentOff = int(percentOff.Int32)
+	if amountOff.Valid {
+		amount := domain.NewMoney(amountOff.Int64, currency.String)
+		promo.AmountOff = &amount
+	}
+	if validFrom.Valid {
+		promo.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		promo.ValidUntil = &validUntil.Time
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int32)
+		promo.MaxUses = &n
+	}
+
+	return promo, nil
+}
+
+func (r *OrderRepository) GetPricingRegion(ctx context.Context, region string) (*domain.PricingRegion, error) {
+	regions, err := r.queryPricingRegions(ctx, `
+		SELECT region, currency, tax_rate_bps, shipping_fee, free_shipping_over
+		FROM pricing_regions
+		WHERE region = $1
+	`, region)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(regions) == 0 {
+		return nil, nil
+	}
+
+	return &regions[0], nil
+}
+
+func (r *OrderRepository) ListPricingRegions(ctx context.Context) ([]domain.PricingRegion, error) {
+	return r.queryPricingRegions(ctx, `
+		SELECT region, currency, tax_rate_bps, shipping_fee, free_shipping_over
+		FROM pricing_regions
+		ORDER BY region
+	`)
+}
+
+// SavePricingRegion creates the region or replaces its rates.
+func (r *OrderRepository) SavePricingRegion(ctx context.Context, region domain.PricingRegion) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO pricing_regions (region, currency, tax_rate_bps, shipping_fee, free_shipping_over)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (region) DO UPDATE
+		SET currency = EXCLUDED.currency,
+		    tax_rate_bps = EXCLUDED.tax_rate_bps,
+		    shipping_fee = EXCLUDED.shipping_fee,
+		    free_shipping_over = EXCLUDED.free_shipping_over
+	`, region.Region, region.Currency, region.TaxRateBps, region.ShippingFee, region.FreeShippingOver)
+	return err
+}
+
+func (r *OrderRepository) queryPricingRegions(ctx context.Context, query string, args ...any) ([]domain.PricingRegion, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	regions := []domain.PricingRegion{}
+	for rows.Next() {
+		var region domain.PricingRegion
+		var freeShippingOver sql.NullInt64
+		if err := rows.Scan(&region.Region, &region.Currency, &region.TaxRateBps, &region.ShippingFee, &freeShippingOver); err != nil {
+			return nil, err
+		}
+		if freeShippingOver.Valid {
+			region.FreeShippingOver = &freeShippingOver.Int64
+		}
+		regions = append(regions, region)
+	}
+
+	return regions, rows.Err()
+}
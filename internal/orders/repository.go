@@ -3,11 +3,21 @@ package orders
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	ErrVersionMismatch   = errors.New("order version mismatch")
 )
 
 type OrderRepository struct {
@@ -18,7 +28,12 @@ func NewOrderRepository(db *sql.DB) *OrderRepository {
 	return &OrderRepository{db: db}
 }
 
-func (r *OrderRepository) Create(ctx context.Context, order *domain.Order) error {
+// Ping checks that the database can be reached.
+func (r *OrderRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r *OrderRepository) Create(ctx context.Context, order *domain.Order, actor string) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -27,10 +42,18 @@ func (r *OrderRepository) Create(ctx context.Context, order *domain.Order) error
 
 	order.ID = uuid.New().String()
 
+	if order.PromoCode != "" {
+		if err := redeemPromoCode(ctx, tx, order.PromoCode, order.CreatedAt); err != nil {
+			return err
+		}
+	}
+
 	_, err = tx.ExecContext(ctx, `
-		INSERT INTO orders (id, customer_id, status, total, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $5)
-	`, order.ID, order.CustomerID, order.Status, order.Total, order.CreatedAt)
+		INSERT INTO orders (id, customer_id, status, promo_code, region, subtotal, discount, tax, shipping, total, currency, allow_backorder, created_at, updated_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8, $9, $10, $11, $12, $13, $13)
+	`, order.ID, order.CustomerID, order.Status, order.PromoCode, order.Region,
+		order.Subtotal.Amount, order.Discount.Amount, order.Tax.Amount, order.Shipping.Amount, order.Total.Amount, order.Total.Currency,
+		order.AllowBackorder, order.CreatedAt)
 	if err != nil {
 		return err
 	}
@@ -38,25 +61,53 @@ func (r *OrderRepository) Create(ctx context.Context, order *domain.Order) error
 	for _, item := range order.Items {
 		itemID := uuid.New().String()
 		_, err = tx.ExecContext(ctx, `
-			INSERT INTO order_items (id, order_id, item_id, quantity, price)
-			VALUES ($1, $2, $3, $4, $5)
-		`, itemID, order.ID, item.ItemID, item.Quantity, item.Price)
+			INSERT INTO order_items (id, order_id, item_id, quantity, price, currency, discount)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, itemID, order.ID, item.ItemID, item.Quantity, item.Price.Amount, item.Price.Currency, item.Discount.Amount)
 		if err != nil {
 			return err
 		}
 	}
 
+	if err := recordStatusChange(ctx, tx, order.ID, "", order.Status, actor, ""); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
+// orderColumns are the columns scanOrder reads, in order.
+const orderColumns = `id, customer_id, status, promo_code, region, subtotal, discount, tax, shipping, total, currency, allow_backorder, refunded_total, version, created_at`
+
+func scanOrder(row interface{ Scan(...any) error }, order *domain.Order) error {
+	var promoCode, region sql.NullString
+	var currency string
+	err := row.Scan(&order.ID, &order.CustomerID, &order.Status, &promoCode, &region,
+		&order.Subtotal.Amount, &order.Discount.Amount, &order.Tax.Amount, &order.Shipping.Amount, &order.Total.Amount, &currency,
+		&order.AllowBackorder, &order.RefundedTotal.Amount, &order.Version, &order.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	order.PromoCode = promoCode.String
+	order.Region = region.String
+	order.Subtotal.Currency = currency
+	order.Discount.Currency = currency
+	order.Tax.Currency = currency
+	order.Shipping.Currency = currency
+	order.Total.Currency = currency
+	order.RefundedTotal.Currency = currency
+	return nil
+}
+
 func (r *OrderRepository) GetByID(ctx context.Context, id string) (*domain.Order, error) {
 	order := &domain.Order{}
 
-	err := r.db.QueryRowContext(ctx, `
-		SELECT id, customer_id, status, total, created_at
+	err := scanOrder(r.db.QueryRowContext(ctx, `
+		SELECT `+orderColumns+`
 		FROM orders
 		WHERE id = $1
-	`, id).Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total, &order.CreatedAt)
+	`, id), order)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -64,58 +115,189 @@ func (r *OrderRepository) GetByID(ctx context.Context, id string) (*domain.Order
 		return nil, err
 	}
 
-	rows, err := r.db.QueryContext(ctx, `
-		SELECT item_id, quantity, price
+	order.Items, err = queryItems(ctx, r.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := r.loadAllocations(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	attachAllocations(order, allocations[id])
+
+	return order, nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryItems(ctx context.Context, q queryer, orderID string) ([]domain.OrderItem, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT item_id, quantity, price, currency, discount
 		FROM order_items
 		WHERE order_id = $1
-	`, id)
+	`, orderID)
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = rows.Close() }()
 
+	var items []domain.OrderItem
 	for rows.Next() {
 		var item domain.OrderItem
-		if err := rows.Scan(&item.ItemID, &item.Quantity, &item.Price); err != nil {
+		if err := rows.Scan(&item.ItemID, &item.Quantity, &item.Price.Amount, &item.Price.Currency, &item.Discount.Amount); err != nil {
 			return nil, err
 		}
-		order.Items = append(order.Items, item)
+		item.Discount.Currency = item.Price.Currency
+		items = append(items, item)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+	return items, rows.Err()
+}
 
-	return order, nil
+// StatusChange describes a status update. Allocations, when set, replace the
+// stock locations recorded for the order's line items. Actor and Reason are
+// recorded in the order's status history. Non-empty IfVersions makes the
+// update conditional on the order still being at one of those versions. Announce
+// writes an order.cancelled event to the outbox when the order is cancelled,
+// so its stock is released; the worker leaves it unset when it cancels an
+// order it could not reserve stock for.
+type StatusChange struct {
+	Status      domain.OrderStatus
+	Allocations []domain.ItemAllocation
+	Actor       string
+	Reason      string
+	IfVersions  []int
+	Announce    bool
 }
 
-func (r *OrderRepository) UpdateStatus(ctx context.Context, id string, status domain.OrderStatus) (*domain.Order, error) {
-	result, err := r.db.ExecContext(ctx, `
-		UPDATE orders SET status = $1, updated_at = NOW()
-		WHERE id = $2
-	`, status, id)
+// UpdateStatus moves the order to change.Status and returns the updated order
+// along with the status it held before. Setting the current status again is a
+// no-op so redelivered worker events stay harmless. Orders that have started
+// shipping cannot be cancelled. Every change bumps the order's
+// version; when change.IfVersions does not list it, nothing is changed and
+// ErrVersionMismatch is returned.
+func (r *OrderRepository) UpdateStatus(ctx context.Context, id string, change StatusChange) (*domain.Order, domain.OrderStatus, error) {
+	status := change.Status
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	rowsAffected, err := result.RowsAffected()
+	var current domain.OrderStatus
+	var version int
+	var customerID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, version, customer_id FROM orders
+		WHERE id = $1
+		FOR UPDATE
+	`, id).Scan(&current, &version, &customerID)
 	if err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	if len(change.IfVersions) > 0 && !slices.Contains(change.IfVersions, version) {
+		return nil, current, ErrVersionMismatch
 	}
 
-	if rowsAffected == 0 {
-		return nil, nil
+	if current != status {
+		if !current.CanTransitionTo(status) {
+			return nil, current, ErrInvalidTransition
+		}
+
+		if status == domain.OrderStatusCancelled {
+			var shipped bool
+			err = tx.QueryRowContext(ctx, `
+				SELECT EXISTS (SELECT 1 FROM shipments WHERE order_id = $1)
+			`, id).Scan(&shipped)
+			if err != nil {
+				return nil, "", err
+			}
+			if shipped {
+				return nil, current, ErrPartiallyShipped
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE orders SET status = $1, version = version + 1, updated_at = NOW()
+			WHERE id = $2
+		`, status, id)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if err := recordStatusChange(ctx, tx, id, current, status, change.Actor, change.Reason); err != nil {
+			return nil, "", err
+		}
+
+		if status == domain.OrderStatusCancelled && change.Announce {
+			items, err := queryItems(ctx, tx, id)
+			if err != nil {
+				return nil, "", err
+			}
+			event := domain.OrderCancelledEvent{
+				OrderID:        id,
+				CustomerID:     customerID,
+				Items:          items,
+				PreviousStatus: current,
+				Reason:         change.Reason,
+				Timestamp:      time.Now().UTC(),
+			}
+			if err := messaging.Enqueue(ctx, tx, domain.TopicOrderCancelled, id, event); err != nil {
+				return nil, "", err
+			}
+		}
 	}
 
-	return r.GetByID(ctx, id)
+	if len(change.Allocations) > 0 {
+		if err := replaceAllocations(ctx, tx, id, change.Allocations); err != nil {
+			return nil, "", err
+		}
+
+		if current == status {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE orders SET version = version + 1, updated_at = NOW()
+				WHERE id = $1
+			`, id)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	order, err := r.GetByID(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return order, current, nil
 }
 
 func (r *OrderRepository) List(ctx context.Context) ([]domain.Order, error) {
-	rows, err := r.db.QueryContext(ctx, `
-		SELECT id, customer_id, status, total, created_at
+	return r.queryOrders(ctx, `
+		SELECT `+orderColumns+`
 		FROM orders
 		ORDER BY created_at DESC
 	`)
+}
+
+// queryOrders runs query, which must select the columns of orders in the
+// order List does, and loads the items and allocations of every order found
+// with one query each.
+func (r *OrderRepository) queryOrders(ctx context.Context, query string, args ...any) ([]domain.Order, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -126,7 +308,7 @@ func (r *OrderRepository) List(ctx context.Context) ([]domain.Order, error) {
 
 	for rows.Next() {
 		var order domain.Order
-		if err := rows.Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total, &order.CreatedAt); err != nil {
+		if err := scanOrder(rows, &order); err != nil {
 			return nil, err
 		}
 		order.Items = []domain.OrderItem{}
@@ -143,7 +325,7 @@ func (r *OrderRepository) List(ctx context.Context) ([]domain.Order, error) {
 	}
 
 	itemRows, err := r.db.QueryContext(ctx, `
-		SELECT order_id, item_id, quantity, price
+		SELECT order_id, item_id, quantity, price, currency, discount
 		FROM order_items
 		WHERE order_id = ANY($1)
 	`, pq.Array(orderIDs))
@@ -155,9 +337,10 @@ func (r *OrderRepository) List(ctx context.Context) ([]domain.Order, error) {
 	for itemRows.Next() {
 		var orderID string
 		var item domain.OrderItem
-		if err := itemRows.Scan(&orderID, &item.ItemID, &item.Quantity, &item.Price); err != nil {
+		if err := itemRows.Scan(&orderID, &item.ItemID, &item.Quantity, &item.Price.Amount, &item.Price.Currency, &item.Discount.Amount); err != nil {
 			return nil, err
 		}
+		item.Discount.Currency = item.Price.Currency
 		order := orderMap[orderID]
 		order.Items = append(order.Items, item)
 	}
@@ -166,8 +349,14 @@ func (r *OrderRepository) List(ctx context.Context) ([]domain.Order, error) {
 		return nil, err
 	}
 
+	allocations, err := r.loadAllocations(ctx, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+
 	orders := make([]domain.Order, 0, len(orderIDs))
 	for _, id := range orderIDs {
+		attachAllocations(orderMap[id], allocations[id])
 		orders = append(orders, *orderMap[id])
 	}
 
@@ -176,7 +365,7 @@ func (r *OrderRepository) List(ctx context.Context) ([]domain.Order, error) {
 
 func (r *OrderRepository) ListNPlus1(ctx context.Context) ([]domain.Order, error) {
 	rows, err := r.db.QueryContext(ctx, `
-		SELECT id, customer_id, status, total, created_at
+		SELECT `+orderColumns+`
 		FROM orders
 		ORDER BY created_at DESC
 	`)
@@ -188,7 +377,7 @@ func (r *OrderRepository) ListNPlus1(ctx context.Context) ([]domain.Order, error
 	var orders []domain.Order
 	for rows.Next() {
 		var order domain.Order
-		if err := rows.Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total, &order.CreatedAt); err != nil {
+		if err := scanOrder(rows, &order); err != nil {
 			return nil, err
 		}
 		orders = append(orders, order)
@@ -200,7 +389,7 @@ func (r *OrderRepository) ListNPlus1(ctx context.Context) ([]domain.Order, error
 
 	for i := range orders {
 		itemRows, err := r.db.QueryContext(ctx, `
-			SELECT item_id, quantity, price
+			SELECT item_id, quantity, price, currency, discount
 			FROM order_items
 			WHERE order_id = $1
 		`, orders[i].ID)
@@ -210,10 +399,11 @@ func (r *OrderRepository) ListNPlus1(ctx context.Context) ([]domain.Order, error
 
 		for itemRows.Next() {
 			var item domain.OrderItem
-			if err := itemRows.Scan(&item.ItemID, &item.Quantity, &item.Price); err != nil {
+			if err := itemRows.Scan(&item.ItemID, &item.Quantity, &item.Price.Amount, &item.Price.Currency, &item.Discount.Amount); err != nil {
 				_ = itemRows.Close()
 				return nil, err
 			}
+			item.Discount.Currency = item.Price.Currency
 			orders[i].Items = append(orders[i].Items, item)
 		}
 
@@ -226,3 +416,122 @@ func (r *OrderRepository) ListNPlus1(ctx context.Context) ([]domain.Order, error
 
 	return orders, nil
 }
+
+// recordStatusChange appends a transition to the order's status history and
+// notifies the status channel, which Postgres delivers on commit. It must run
+// in the transaction that changes the status.
+func recordStatusChange(ctx context.Context, tx *sql.Tx, orderID string, from, to domain.OrderStatus, actor, reason string) error {
+	var traceID sql.NullString
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.HasTraceID() {
+		traceID = sql.NullString{String: spanCtx.TraceID().String(), Valid: true}
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, to_status, actor, reason, trace_id, created_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, NOW())
+	`, orderID, from, to, actor, reason, traceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, statusChannel, orderID)
+	return err
+}
+
+// History returns the status changes of orderID, oldest first.
+func (r *OrderRepository) History(ctx context.Context, orderID string) ([]domain.StatusChange, error) {
+	return r.HistoryAfter(ctx, orderID, 0)
+}
+
+// HistoryAfter returns the status changes of orderID with an ID above
+// afterID, oldest first.
+func (r *OrderRepository) HistoryAfter(ctx context.Context, orderID string, afterID int64) ([]domain.StatusChange, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, order_id, COALESCE(from_status, ''), to_status, actor, reason, COALESCE(trace_id, ''), created_at
+		FROM order_status_history
+		WHERE order_id = $1 AND id > $2
+		ORDER BY id
+	`, orderID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	history := []domain.StatusChange{}
+	for rows.Next() {
+		var c domain.StatusChange
+		if err := rows.Scan(&c.ID, &c.OrderID, &c.FromStatus, &c.ToStatus, &c.Actor, &c.Reason, &c.TraceID, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+
+	return history, rows.Err()
+}
+
+func replaceAllocations(ctx context.Context, tx *sql.Tx, orderID string, allocations []domain.ItemAllocation) error {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM order_item_allocations
+		WHERE order_id = $1
+	`, orderID)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range allocations {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_item_allocations (order_id, item_id, location_id, quantity)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (order_id, item_id, location_id) DO UPDATE
+			SET quantity = order_item_allocations.quantity + EXCLUDED.quantity
+		`, orderID, a.ItemID, a.LocationID, a.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadAllocations returns the allocations of orderIDs keyed by order and
+// item ID.
+func (r *OrderRepository) loadAllocations(ctx context.Context, orderIDs []string) (map[string]map[string][]domain.Allocation, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT order_id, item_id, location_id, quantity
+		FROM order_item_allocations
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, item_id, location_id
+	`, pq.Array(orderIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	allocations := make(map[string]map[string][]domain.Allocation)
+	for rows.Next() {
+		var orderID, itemID string
+		var a domain.Allocation
+		if err := rows.Scan(&orderID, &itemID, &a.LocationID, &a.Quantity); err != nil {
+			return nil, err
+		}
+		if allocations[orderID] == nil {
+			allocations[orderID] = make(map[string][]domain.Allocation)
+		}
+		allocations[orderID][itemID] = append(allocations[orderID][itemID], a)
+	}
+
+	return allocations, rows.Err()
+}
+
+// attachAllocations sets the allocations of each item on the order's first
+// line for that item. Stock is reserved per item, so repeated lines share
+// one set of allocations.
+func attachAllocations(order *domain.Order, byItem map[string][]domain.Allocation) {
+	for i := range order.Items {
+		itemID := order.Items[i].ItemID
+		if allocations, ok := byItem[itemID]; ok {
+			order.Items[i].Allocations = allocations
+			delete(byItem, itemID)
+		}
+	}
+}
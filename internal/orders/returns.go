@@ -0,0 +1,414 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
+)
+
+var (
+	ErrInvalidReturn           = errors.New("invalid return")
+	ErrInvalidReturnTransition = errors.New("invalid return status transition")
+)
+
+// CreateReturn records a return request for line items of a shipped order.
+// An item cannot be returned more times than it was ordered, counting every
+// earlier return of the order. It returns nil, "", nil when the order does
+// not exist and the order's status with ErrInvalidTransition when the order
+// has not shipped. The order.return_requested event is written to the outbox
+// in the same transaction.
+func (r *OrderRepository) CreateReturn(ctx context.Context, ret *domain.Return) (*domain.Order, domain.OrderStatus, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var current domain.OrderStatus
+	var customerID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, customer_id FROM orders
+		WHERE id = $1
+		FOR UPDATE
+	`, ret.OrderID).Scan(&current, &customerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	if current != domain.OrderStatusShipped {
+		return nil, current, ErrInvalidTransition
+	}
+
+	returnable, err := returnableQuantities(ctx, tx, ret.OrderID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(ret.Items, func(i, j int) bool {
+		return ret.Items[i].ItemID < ret.Items[j].ItemID
+	})
+
+	for i, item := range ret.Items {
+		if i > 0 && ret.Items[i-1].ItemID == item.ItemID {
+			return nil, "", &LineItemError{Kind: ErrInvalidReturn, Reason: fmt.Sprintf("item %s is listed twice", item.ItemID)}
+		}
+		left, ok := returnable[item.ItemID]
+		if !ok {
+			return nil, "", &LineItemError{Kind: ErrInvalidReturn, Reason: fmt.Sprintf("item %s is not part of the order", item.ItemID)}
+		}
+		if item.Quantity > left {
+			return nil, "", &LineItemError{Kind: ErrInvalidReturn, Reason: fmt.Sprintf("item %s has only %d unit(s) left to return", item.ItemID, left)}
+		}
+	}
+
+	ret.ID = uuid.New().String()
+	ret.Status = domain.ReturnStatusRequested
+	ret.CreatedAt = time.Now().UTC()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO returns (id, order_id, status, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, ret.ID, ret.OrderID, ret.Status, ret.Reason, ret.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, item := range ret.Items {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO return_items (return_id, item_id, quantity)
+			VALUES ($1, $2, $3)
+		`, ret.ID, item.ItemID, item.Quantity)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := enqueueReturnEvent(ctx, tx, customerID, ret); err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	order, err := r.GetByID(ctx, ret.OrderID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return order, current, nil
+}
+
+// returnableQuantities returns, per item, how many units of the order have
+// not been returned yet.
+func returnableQuantities(ctx context.Context, tx *sql.Tx, orderID string) (map[string]int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT item_id, SUM(quantity)
+		FROM order_items
+		WHERE order_id = $1
+		GROUP BY item_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	returnable := make(map[string]int)
+	for rows.Next() {
+		var itemID string
+		var quantity int
+		if err := rows.Scan(&itemID, &quantity); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		returnable[itemID] = quantity
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	returned, err := tx.QueryContext(ctx, `
+		SELECT ri.item_id, SUM(ri.quantity)
+		FROM return_items ri
+		JOIN returns rt ON rt.id = ri.return_id
+		WHERE rt.order_id = $1
+		GROUP BY ri.item_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = returned.Close() }()
+
+	for returned.Next() {
+		var itemID string
+		var quantity int
+		if err := returned.Scan(&itemID, &quantity); err != nil {
+			return nil, err
+		}
+		returnable[itemID] -= quantity
+	}
+
+	return returnable, returned.Err()
+}
+
+// UpdateReturnStatus moves a return of orderID to status and returns it along
+// with the status it held before. Moving a return to the status it already
+// has is a no-op so redelivered worker events stay harmless. Refunding a
+// return records its refund amount, priced at the lowest price the item was
+// ordered at after line discounts, and adds it to the order's refunded
+// total. Each change writes the matching order.return_* event to the outbox
+// in the same transaction. It returns nil, "", nil when the return does not
+// exist.
+func (r *OrderRepository) UpdateReturnStatus(ctx context.Context, orderID, returnID string, status domain.ReturnStatus) (*domain.Return, domain.ReturnStatus, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Lock the order first, like CreateReturn, so that refunds and new return
+	// requests for the same order queue up behind each other.
+	var customerID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT customer_id FROM orders
+		WHERE id = $1
+		FOR UPDATE
+	`, orderID).Scan(&customerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	var current domain.ReturnStatus
+	err = tx.QueryRowContext(ctx, `
+		SELECT status FROM returns
+		WHERE id = $1 AND order_id = $2
+		FOR UPDATE
+	`, returnID, orderID).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	if current != status {
+		if !current.CanTransitionTo(status) {
+			return nil, current, ErrInvalidReturnTransition
+		}
+
+		switch status {
+		case domain.ReturnStatusReceived:
+			_, err = tx.ExecContext(ctx, `
+				UPDATE returns SET status = $2, received_at = NOW()
+				WHERE id = $1
+			`, returnID, status)
+		case domain.ReturnStatusRefunded:
+			err = refundReturn(ctx, tx, orderID, returnID)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		ret, err := getReturn(ctx, tx, orderID, returnID)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := enqueueReturnEvent(ctx, tx, customerID, ret); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	ret, err := r.GetReturn(ctx, orderID, returnID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ret, current, nil
+}
+
+// refundReturn refunds what the customer paid for the returned units. The
+// order's total less shipping, i.e. its discounted subtotal plus tax, is spread
+// over the lines in proportion to their price after line discounts, so each
+// line carries its share of the order discount and of the tax. Each returned
+// line is rounded half away from zero to the minor unit, and the refund never
+// exceeds what is left to refund on the order.
+func refundReturn(ctx context.Context, tx *sql.Tx, orderID, returnID string) error {
+	var amount int64
+	err := tx.QueryRowContext(ctx, `
+		WITH lines AS (
+			SELECT item_id, SUM(quantity) AS quantity, SUM(price * quantity - discount) AS net
+			FROM order_items
+			WHERE order_id = $1
+			GROUP BY item_id
+		)
+		SELECT LEAST(
+			COALESCE(SUM(ROUND(
+				ri.quantity * l.net * (o.total - o.shipping)::numeric
+				/ NULLIF(l.quantity * (SELECT SUM(net) FROM lines), 0)
+			)), 0),
+			MAX(o.total - o.shipping - o.refunded_total)
+		)::bigint
+		FROM return_items ri
+		JOIN lines l ON l.item_id = ri.item_id
+		JOIN orders o ON o.id = $1
+		WHERE ri.return_id = $2
+	`, orderID, returnID).Scan(&amount)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE returns SET status = $2, refund_amount = $3, refunded_at = NOW()
+		WHERE id = $1
+	`, returnID, domain.ReturnStatusRefunded, amount)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders SET refunded_total = refunded_total + $2, version = version + 1, updated_at = NOW()
+		WHERE id = $1
+	`, orderID, amount)
+	return err
+}
+
+// returnTopics are the topics return events are published to, by the status
+// the return reached.
+var returnTopics = map[domain.ReturnStatus]string{
+	domain.ReturnStatusRequested: domain.TopicOrderReturnRequested,
+	domain.ReturnStatusReceived:  domain.TopicOrderReturnReceived,
+	domain.ReturnStatusRefunded:  domain.TopicOrderReturnRefunded,
+}
+
+func enqueueReturnEvent(ctx context.Context, tx *sql.Tx, customerID string, ret *domain.Return) error {
+	event := domain.ReturnEvent{
+		ReturnID:   ret.ID,
+		OrderID:    ret.OrderID,
+		CustomerID: customerID,
+		Status:     ret.Status,
+		Items:      ret.Items,
+		Timestamp:  time.Now().UTC(),
+	}
+	if ret.RefundAmount != nil {
+		event.RefundAmount = *ret.RefundAmount
+	}
+	return messaging.Enqueue(ctx, tx, returnTopics[ret.Status], ret.OrderID, event)
+}
+
+func (r *OrderRepository) GetReturn(ctx context.Context, orderID, returnID string) (*domain.Return, error) {
+	return getReturn(ctx, r.db, orderID, returnID)
+}
+
+func getReturn(ctx context.Context, q queryer, orderID, returnID string) (*domain.Return, error) {
+	returns, err := queryReturns(ctx, q, `
+		SELECT r.id, r.order_id, r.status, r.reason, r.refund_amount, o.currency, r.created_at, r.received_at, r.refunded_at
+		FROM returns r
+		JOIN orders o ON o.id = r.order_id
+		WHERE r.order_id = $1 AND r.id = $2
+	`, orderID, returnID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(returns) == 0 {
+		return nil, nil
+	}
+
+	return &returns[0], nil
+}
+
+// ListReturns returns the returns of orderID, oldest first.
+func (r *OrderRepository) ListReturns(ctx context.Context, orderID string) ([]domain.Return, error) {
+	return queryReturns(ctx, r.db, `
+		SELECT r.id, r.order_id, r.status, r.reason, r.refund_amount, o.currency, r.created_at, r.received_at, r.refunded_at
+		FROM returns r
+		JOIN orders o ON o.id = r.order_id
+		WHERE r.order_id = $1
+		ORDER BY r.created_at, r.id
+	`, orderID)
+}
+
+func queryReturns(ctx context.Context, q queryer, query string, args ...any) ([]domain.Return, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	returns := []domain.Return{}
+	index := make(map[string]int)
+	var returnIDs []string
+	for rows.Next() {
+		var ret domain.Return
+		var refundAmount sql.NullInt64
+		var currency string
+		var receivedAt, refundedAt sql.NullTime
+		if err := rows.Scan(&ret.ID, &ret.OrderID, &ret.Status, &ret.Reason, &refundAmount, &currency, &ret.CreatedAt, &receivedAt, &refundedAt); err != nil {
+			return nil, err
+		}
+		if refundAmount.Valid {
+			amount := domain.NewMoney(refundAmount.Int64, currency)
+			ret.RefundAmount = &amount
+		}
+		if receivedAt.Valid {
+			ret.ReceivedAt = &receivedAt.Time
+		}
+		if refundedAt.Valid {
+			ret.RefundedAt = &refundedAt.Time
+		}
+		ret.Items = []domain.ReturnItem{}
+		index[ret.ID] = len(returns)
+		returns = append(returns, ret)
+		returnIDs = append(returnIDs, ret.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(returnIDs) == 0 {
+		return returns, nil
+	}
+
+	itemRows, err := q.QueryContext(ctx, `
+		SELECT return_id, item_id, quantity
+		FROM return_items
+		WHERE return_id = ANY($1)
+		ORDER BY return_id, item_id
+	`, pq.Array(returnIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = itemRows.Close() }()
+
+	for itemRows.Next() {
+		var returnID string
+		var item domain.ReturnItem
+		if err := itemRows.Scan(&returnID, &item.ItemID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		ret := &returns[index[returnID]]
+		ret.Items = append(ret.Items, item)
+	}
+
+	return returns, itemRows.Err()
+}
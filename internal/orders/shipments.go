@@ -0,0 +1,286 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
+)
+
+var (
+	ErrInvalidShipment  = errors.New("invalid shipment")
+	ErrPartiallyShipped = errors.New("order is partially shipped")
+)
+
+// LineItemError explains why the line items of a shipment or return were
+// rejected. It matches Kind with errors.Is.
+type LineItemError struct {
+	Kind   error
+	Reason string
+}
+
+func (e *LineItemError) Error() string {
+	return e.Reason
+}
+
+func (e *LineItemError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// CreateShipment records a shipment of a confirmed order. A shipment without
+// items sends everything that has not shipped yet. The order moves to shipped
+// when nothing is left to send, in which case the returned order has status
+// shipped and an order.shipped event is written to the outbox in the same
+// transaction. It returns nil, "", nil when the order does not exist and the
+// order's status with ErrInvalidTransition when it cannot ship.
+func (r *OrderRepository) CreateShipment(ctx context.Context, shipment *domain.Shipment, actor string) (*domain.Order, domain.OrderStatus, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var current domain.OrderStatus
+	var customerID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, customer_id FROM orders
+		WHERE id = $1
+		FOR UPDATE
+	`, shipment.OrderID).Scan(&current, &customerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	if current != domain.OrderStatusConfirmed {
+		return nil, current, ErrInvalidTransition
+	}
+
+	remaining, err := unshippedQuantities(ctx, tx, shipment.OrderID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(shipment.Items) == 0 {
+		for itemID, quantity := range remaining {
+			if quantity > 0 {
+				shipment.Items = append(shipment.Items, domain.ShipmentItem{ItemID: itemID, Quantity: quantity})
+			}
+		}
+		if len(shipment.Items) == 0 {
+			return nil, "", &LineItemError{Kind: ErrInvalidShipment, Reason: "nothing left to ship"}
+		}
+	}
+
+	sort.Slice(shipment.Items, func(i, j int) bool {
+		return shipment.Items[i].ItemID < shipment.Items[j].ItemID
+	})
+
+	for i, item := range shipment.Items {
+		if i > 0 && shipment.Items[i-1].ItemID == item.ItemID {
+			return nil, "", &LineItemError{Kind: ErrInvalidShipment, Reason: fmt.Sprintf("item %s is listed twice", item.ItemID)}
+		}
+		left, ok := remaining[item.ItemID]
+		if !ok {
+			return nil, "", &LineItemError{Kind: ErrInvalidShipment, Reason: fmt.Sprintf("item %s is not part of the order", item.ItemID)}
+		}
+		if item.Quantity > left {
+			return nil, "", &LineItemError{Kind: ErrInvalidShipment, Reason: fmt.Sprintf("item %s has only %d unit(s) left to ship", item.ItemID, left)}
+		}
+		remaining[item.ItemID] = left - item.Quantity
+	}
+
+	shipment.ID = uuid.New().String()
+	shipment.CreatedAt = time.Now().UTC()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO shipments (id, order_id, carrier, tracking_number, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, shipment.ID, shipment.OrderID, shipment.Carrier, shipment.TrackingNumber, shipment.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, item := range shipment.Items {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO shipment_items (shipment_id, item_id, quantity)
+			VALUES ($1, $2, $3)
+		`, shipment.ID, item.ItemID, item.Quantity)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	complete := true
+	for _, left := range remaining {
+		if left > 0 {
+			complete = false
+			break
+		}
+	}
+
+	if complete {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE orders SET status = $1, version = version + 1, updated_at = NOW()
+			WHERE id = $2
+		`, domain.OrderStatusShipped, shipment.OrderID)
+		if err != nil {
+			return nil, "", err
+		}
+
+		reason := fmt.Sprintf("shipment %s via %s", shipment.ID, shipment.Carrier)
+		if err := recordStatusChange(ctx, tx, shipment.OrderID, current, domain.OrderStatusShipped, actor, reason); err != nil {
+			return nil, "", err
+		}
+
+		shipments, err := queryShipments(ctx, tx, shipment.OrderID)
+		if err != nil {
+			return nil, "", err
+		}
+		event := domain.OrderShippedEvent{
+			OrderID:    shipment.OrderID,
+			CustomerID: customerID,
+			Shipments:  shipments,
+			Timestamp:  shipment.CreatedAt,
+		}
+		if err := messaging.Enqueue(ctx, tx, domain.TopicOrderShipped, shipment.OrderID, event); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	order, err := r.GetByID(ctx, shipment.OrderID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return order, current, nil
+}
+
+// unshippedQuantities returns, per item, how many units of the order have not
+// shipped yet.
+func unshippedQuantities(ctx context.Context, tx *sql.Tx, orderID string) (map[string]int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT item_id, SUM(quantity)
+		FROM order_items
+		WHERE order_id = $1
+		GROUP BY item_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[string]int)
+	for rows.Next() {
+		var itemID string
+		var quantity int
+		if err := rows.Scan(&itemID, &quantity); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		remaining[itemID] = quantity
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	shipped, err := tx.QueryContext(ctx, `
+		SELECT si.item_id, SUM(si.quantity)
+		FROM shipment_items si
+		JOIN shipments s ON s.id = si.shipment_id
+		WHERE s.order_id = $1
+		GROUP BY si.item_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = shipped.Close() }()
+
+	for shipped.Next() {
+		var itemID string
+		var quantity int
+		if err := shipped.Scan(&itemID, &quantity); err != nil {
+			return nil, err
+		}
+		remaining[itemID] -= quantity
+	}
+
+	return remaining, shipped.Err()
+}
+
+// ListShipments returns the shipments of orderID, oldest first.
+func (r *OrderRepository) ListShipments(ctx context.Context, orderID string) ([]domain.Shipment, error) {
+	return queryShipments(ctx, r.db, orderID)
+}
+
+func queryShipments(ctx context.Context, q queryer, orderID string) ([]domain.Shipment, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT id, order_id, carrier, tracking_number, created_at
+		FROM shipments
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	shipments := []domain.Shipment{}
+	index := make(map[string]int)
+	var shipmentIDs []string
+	for rows.Next() {
+		var s domain.Shipment
+		if err := rows.Scan(&s.ID, &s.OrderID, &s.Carrier, &s.TrackingNumber, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.Items = []domain.ShipmentItem{}
+		index[s.ID] = len(shipments)
+		shipments = append(shipments, s)
+		shipmentIDs = append(shipmentIDs, s.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(shipmentIDs) == 0 {
+		return shipments, nil
+	}
+
+	itemRows, err := q.QueryContext(ctx, `
+		SELECT shipment_id, item_id, quantity
+		FROM shipment_items
+		WHERE shipment_id = ANY($1)
+		ORDER BY shipment_id, item_id
+	`, pq.Array(shipmentIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = itemRows.Close() }()
+
+	for itemRows.Next() {
+		var shipmentID string
+		var item domain.ShipmentItem
+		if err := itemRows.Scan(&shipmentID, &item.ItemID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		s := &shipments[index[shipmentID]]
+		s.Items = append(s.Items, item)
+	}
+
+	return shipments, itemRows.Err()
+}
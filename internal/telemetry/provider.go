@@ -6,8 +6,10 @@ import (
 	"os"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
@@ -48,6 +50,45 @@ func InitTracerProvider(ctx context.Context, serviceName, serviceVersion string)
 	return tp.Shutdown, nil
 }
 
+// InitMeterProvider exports metrics to the same collector as traces and makes
+// the provider global, so otel.Meter works anywhere in the service.
+func InitMeterProvider(ctx context.Context, serviceName, serviceVersion string) (func(context.Context) error, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "localhost:4317"
+	}
+
+	exporter, err := otlpmetricgrpc.New(ctx,
+		otlpmetricgrpc.WithEndpoint(endpoint),
+		otlpmetricgrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(serviceVersion),
+	)
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+
+	otel.SetMeterProvider(mp)
+
+	return mp.Shutdown, nil
+}
+
+// NotHealthCheck is an otelhttp filter that skips GET /health. The gateway
+// polls each replica's health every few seconds, and those spans would drown
+// out real traces.
+func NotHealthCheck(r *http.Request) bool {
+	return r.URL.Path != "/health"
+}
+
 // WithHTTPRoute wraps an http.HandlerFunc to add the http.route attribute
 // to the current span using the request's Pattern (Go 1.22+).
 // This works around otelhttp not adding the route attribute after routing.
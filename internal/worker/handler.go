@@ -4,34 +4,72 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 )
 
+// errStatusConflict means the orders service rejected a status change because
+// the order moved to another state first, e.g. the customer cancelled it.
+var errStatusConflict = errors.New("order status conflict")
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// errReservationExpired means inventory no longer holds the order's stock:
+// the expiry sweeper released it before the worker confirmed it.
+var errReservationExpired = errors.New("stock reservation expired")
+
+// errVersionConflict means the order changed between reading its ETag and
+// updating it.
+var errVersionConflict = errors.New("order version conflict")
+
+// maxStatusUpdateAttempts bounds how often a status update is retried when
+// the order keeps changing underneath it.
+const maxStatusUpdateAttempts = 3
+
+// actor names the worker in the audit records kept by other services.
+const actor = "worker"
+
+const defaultAlertRecipient = "inventory-alerts@example.com"
+
 type NotificationHandler struct {
 	emailServiceURL     string
 	ordersServiceURL    string
 	inventoryServiceURL string
+	alertRecipient      string
 	httpClient          *http.Client
 	logger              *slog.Logger
 }
 
-func NewNotificationHandler(emailServiceURL, ordersServiceURL, inventoryServiceURL string, client *http.Client, logger *slog.Logger) *NotificationHandler {
-	return &NotificationHandler{
+type NotificationOption func(*NotificationHandler)
+
+// WithAlertRecipient sets the address that receives operational alerts such
+// as low stock warnings.
+func WithAlertRecipient(address string) NotificationOption {
+	return func(h *NotificationHandler) {
+		h.alertRecipient = address
+	}
+}
+
+func NewNotificationHandler(emailServiceURL, ordersServiceURL, inventoryServiceURL string, client *http.Client, logger *slog.Logger, opts ...NotificationOption) *NotificationHandler {
+	h := &NotificationHandler{
 		emailServiceURL:     emailServiceURL,
 		ordersServiceURL:    ordersServiceURL,
 		inventoryServiceURL: inventoryServiceURL,
+		alertRecipient:      defaultAlertRecipient,
 		httpClient:          client,
 		logger:              logger,
 	}
-}
 
-type reservedItem struct {
-	ItemID   string
-	Quantity int
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
 }
 
 func (h *NotificationHandler) Handle(ctx context.Context, payload []byte) error {
@@ -42,13 +80,25 @@ func (h *NotificationHandler) Handle(ctx context.Context, payload []byte) error
 
 	h.logger.Info("processing order created event", "order_id", event.OrderID, "customer_id", event.CustomerID)
 
-	reserved, err := h.reserveStock(ctx, event)
-	if err != nil {
+	itemIDs := orderItemIDs(event.Items)
+
+	if err := h.reserveStock(ctx, event); err != nil {
+		if errors.Is(err, errInsufficientStock) && event.AllowBackorder {
+			h.logger.Info("insufficient stock, backordering order", "reason", err.Error(), "order_id", event.OrderID)
+			return h.backorder(ctx, event, err.Error())
+		}
+
 		h.logger.Error("failed to reserve stock", "error", err, "order_id", event.OrderID)
 
-		h.releaseStock(ctx, reserved)
+		// A rejected reservation holds nothing. Any other failure may have
+		// reserved the items before the response was lost.
+		reason := err.Error()
+		if !errors.Is(err, errInsufficientStock) {
+			h.releaseStock(ctx, event.OrderID, itemIDs)
+			reason = "stock reservation failed"
+		}
 
-		if err := h.updateOrderStatus(ctx, event.OrderID, domain.OrderStatusCancelled); err != nil {
+		if err := h.updateOrderStatus(ctx, event.OrderID, domain.OrderStatusCancelled, nil, reason); err != nil {
 			h.logger.Error("failed to cancel order", "error", err, "order_id", event.OrderID)
 			return fmt.Errorf("cancel order after stock failure: %w", err)
 		}
@@ -62,87 +112,600 @@ func (h *NotificationHandler) Handle(ctx context.Context, payload []byte) error
 		return nil
 	}
 
+	wanted := make(map[string]int, len(event.Items))
+	for _, item := range event.Items {
+		wanted[item.ItemID] += item.Quantity
+	}
+	reservations, err := h.confirmReservations(ctx, event.OrderID, wanted)
+	if errors.Is(err, errReservationExpired) {
+		return h.cancelExpired(ctx, event.OrderID, event.CustomerID, itemIDs)
+	}
+	if err != nil {
+		h.logger.Error("failed to confirm reservations", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("confirm reservations: %w", err)
+	}
+
+	if err := h.updateOrderStatus(ctx, event.OrderID, domain.OrderStatusConfirmed, allocationsFrom(reservations), "stock reserved"); err != nil {
+		if errors.Is(err, errStatusConflict) {
+			h.logger.Info("order changed before confirmation, releasing stock", "order_id", event.OrderID)
+			h.releaseStock(ctx, event.OrderID, itemIDs)
+			return nil
+		}
+		h.logger.Error("failed to update order status", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("update order status: %w", err)
+	}
+
 	if err := h.sendConfirmationEmail(ctx, event); err != nil {
 		h.logger.Error("failed to send confirmation email", "error", err, "order_id", event.OrderID)
 		return fmt.Errorf("send confirmation email: %w", err)
 	}
 
-	if err := h.updateOrderStatus(ctx, event.OrderID, domain.OrderStatusConfirmed); err != nil {
+	h.logger.Info("order processing complete", "order_id", event.OrderID)
+	return nil
+}
+
+func (h *NotificationHandler) HandleOrderCancelled(ctx context.Context, payload []byte) error {
+	var event domain.OrderCancelledEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal order cancelled event: %w", err)
+	}
+
+	h.logger.Info("processing order cancelled event", "order_id", event.OrderID, "previous_status", event.PreviousStatus)
+
+	// Releases are scoped to the order and idempotent, so it is safe to release
+	// every line item even if some of them were never reserved.
+	h.releaseStock(ctx, event.OrderID, orderItemIDs(event.Items))
+
+	if event.PreviousStatus == domain.OrderStatusBackordered {
+		if err := h.cancelBackorder(ctx, event.OrderID); err != nil {
+			h.logger.Error("failed to cancel backorder", "error", err, "order_id", event.OrderID)
+			return fmt.Errorf("cancel backorder: %w", err)
+		}
+	}
+
+	if err := h.sendCustomerCancellationEmail(ctx, event); err != nil {
+		h.logger.Error("failed to send cancellation email", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("send cancellation email: %w", err)
+	}
+
+	h.logger.Info("order cancellation processed", "order_id", event.OrderID)
+	return nil
+}
+
+func (h *NotificationHandler) HandleOrderShipped(ctx context.Context, payload []byte) error {
+	var event domain.OrderShippedEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal order shipped event: %w", err)
+	}
+
+	h.logger.Info("processing order shipped event", "order_id", event.OrderID, "shipments", len(event.Shipments))
+
+	if err := h.commitReservations(ctx, event.OrderID); err != nil {
+		h.logger.Error("failed to commit reservations", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("commit reservations: %w", err)
+	}
+
+	if err := h.sendShippingEmail(ctx, event); err != nil {
+		h.logger.Error("failed to send shipping email", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("send shipping email: %w", err)
+	}
+
+	h.logger.Info("order shipment processed", "order_id", event.OrderID)
+	return nil
+}
+
+func (h *NotificationHandler) HandleReturnRequested(ctx context.Context, payload []byte) error {
+	var event domain.ReturnEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal return requested event: %w", err)
+	}
+
+	h.logger.Info("processing return requested event", "order_id", event.OrderID, "return_id", event.ReturnID)
+
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Return Requested: " + event.OrderID,
+		"body": fmt.Sprintf("We have registered your return %s for %d item(s) of order %s. Please send them back quoting the return number.",
+			event.ReturnID, len(event.Items), event.OrderID),
+	}
+
+	if err := h.sendEmail(ctx, body); err != nil {
+		h.logger.Error("failed to send return requested email", "error", err, "order_id", event.OrderID, "return_id", event.ReturnID)
+		return fmt.Errorf("send return requested email: %w", err)
+	}
+
+	h.logger.Info("return request processed", "order_id", event.OrderID, "return_id", event.ReturnID)
+	return nil
+}
+
+// HandleReturnReceived puts returned items back into stock. Inventory answers
+// with a stock.return_restocked event, which triggers the refund.
+func (h *NotificationHandler) HandleReturnReceived(ctx context.Context, payload []byte) error {
+	var event domain.ReturnEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal return received event: %w", err)
+	}
+
+	h.logger.Info("processing return received event", "order_id", event.OrderID, "return_id", event.ReturnID)
+
+	if err := h.restockReturn(ctx, event); err != nil {
+		h.logger.Error("failed to restock return", "error", err, "order_id", event.OrderID, "return_id", event.ReturnID)
+		return fmt.Errorf("restock return: %w", err)
+	}
+
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Return Received: " + event.OrderID,
+		"body":    fmt.Sprintf("We have received return %s for order %s. Your refund is on its way.", event.ReturnID, event.OrderID),
+	}
+
+	if err := h.sendEmail(ctx, body); err != nil {
+		h.logger.Error("failed to send return received email", "error", err, "order_id", event.OrderID, "return_id", event.ReturnID)
+		return fmt.Errorf("send return received email: %w", err)
+	}
+
+	h.logger.Info("return receipt processed", "order_id", event.OrderID, "return_id", event.ReturnID)
+	return nil
+}
+
+func (h *NotificationHandler) HandleReturnRestocked(ctx context.Context, payload []byte) error {
+	var event domain.ReturnRestockedEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal return restocked event: %w", err)
+	}
+
+	h.logger.Info("processing return restocked event", "order_id", event.OrderID, "return_id", event.ReturnID)
+
+	if err := h.refundReturn(ctx, event.OrderID, event.ReturnID); err != nil {
+		if errors.Is(err, errStatusConflict) {
+			h.logger.Warn("return cannot be refunded in its current state", "order_id", event.OrderID, "return_id", event.ReturnID)
+			return nil
+		}
+		h.logger.Error("failed to refund return", "error", err, "order_id", event.OrderID, "return_id", event.ReturnID)
+		return fmt.Errorf("refund return: %w", err)
+	}
+
+	h.logger.Info("return refunded", "order_id", event.OrderID, "return_id", event.ReturnID)
+	return nil
+}
+
+func (h *NotificationHandler) HandleReturnRefunded(ctx context.Context, payload []byte) error {
+	var event domain.ReturnEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal return refunded event: %w", err)
+	}
+
+	h.logger.Info("processing return refunded event", "order_id", event.OrderID, "return_id", event.ReturnID, "refund_amount", event.RefundAmount.String())
+
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Refund Issued: " + event.OrderID,
+		"body": fmt.Sprintf("We have refunded %s for return %s of order %s.",
+			event.RefundAmount, event.ReturnID, event.OrderID),
+	}
+
+	if err := h.sendEmail(ctx, body); err != nil {
+		h.logger.Error("failed to send refund email", "error", err, "order_id", event.OrderID, "return_id", event.ReturnID)
+		return fmt.Errorf("send refund email: %w", err)
+	}
+
+	h.logger.Info("refund notification sent", "order_id", event.OrderID, "return_id", event.ReturnID)
+	return nil
+}
+
+func (h *NotificationHandler) HandleStockLow(ctx context.Context, payload []byte) error {
+	var event domain.StockLowEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal stock low event: %w", err)
+	}
+
+	h.logger.Info("processing stock low event", "item_id", event.ItemID, "available", event.Available, "reorder_threshold", event.ReorderThreshold)
+
+	body := map[string]string{
+		"to":      h.alertRecipient,
+		"subject": "Low Stock: " + event.ItemID,
+		"body": fmt.Sprintf("%s (%s) is down to %d available units, below its reorder threshold of %d.",
+			event.Name, event.ItemID, event.Available, event.ReorderThreshold),
+	}
+
+	if err := h.sendEmail(ctx, body); err != nil {
+		h.logger.Error("failed to send low stock alert", "error", err, "item_id", event.ItemID)
+		return fmt.Errorf("send low stock alert: %w", err)
+	}
+
+	h.logger.Info("low stock alert sent", "item_id", event.ItemID)
+	return nil
+}
+
+// backorder parks an order that cannot be reserved yet. The status changes
+// first so that a backorder filled straight away can confirm the order.
+func (h *NotificationHandler) backorder(ctx context.Context, event domain.OrderCreatedEvent, reason string) error {
+	if err := h.updateOrderStatus(ctx, event.OrderID, domain.OrderStatusBackordered, nil, reason); err != nil {
+		if errors.Is(err, errStatusConflict) {
+			h.logger.Info("order changed before backordering", "order_id", event.OrderID)
+			return nil
+		}
 		h.logger.Error("failed to update order status", "error", err, "order_id", event.OrderID)
 		return fmt.Errorf("update order status: %w", err)
 	}
 
-	h.logger.Info("order processing complete", "order_id", event.OrderID)
+	if err := h.createBackorder(ctx, event); err != nil {
+		h.logger.Error("failed to create backorder", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("create backorder: %w", err)
+	}
+
+	if err := h.sendBackorderedEmail(ctx, event); err != nil {
+		h.logger.Error("failed to send backordered email", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("send backordered email: %w", err)
+	}
+
+	h.logger.Info("order backordered", "order_id", event.OrderID)
 	return nil
 }
 
-func (h *NotificationHandler) reserveStock(ctx context.Context, event domain.OrderCreatedEvent) ([]reservedItem, error) {
-	var reserved []reservedItem
+func (h *NotificationHandler) HandleBackorderFilled(ctx context.Context, payload []byte) error {
+	var event domain.BackorderFilledEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal backorder filled event: %w", err)
+	}
+
+	h.logger.Info("processing backorder filled event", "order_id", event.OrderID)
 
+	wanted := make(map[string]int, len(event.Items))
 	for _, item := range event.Items {
-		body := map[string]int{"quantity": item.Quantity}
-		data, err := json.Marshal(body)
-		if err != nil {
-			return reserved, fmt.Errorf("marshal reserve request: %w", err)
-		}
+		wanted[item.ItemID] += item.Quantity
+	}
+	reservations, err := h.confirmReservations(ctx, event.OrderID, wanted)
+	if errors.Is(err, errReservationExpired) {
+		return h.cancelExpired(ctx, event.OrderID, event.CustomerID, reservationItemIDs(event.Items))
+	}
+	if err != nil {
+		h.logger.Error("failed to confirm reservations", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("confirm reservations: %w", err)
+	}
 
-		url := fmt.Sprintf("%s/stock/%s/reserve", h.inventoryServiceURL, item.ItemID)
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
-		if err != nil {
-			return reserved, fmt.Errorf("create reserve request: %w", err)
+	if err := h.updateOrderStatus(ctx, event.OrderID, domain.OrderStatusConfirmed, allocationsFrom(reservations), "backorder filled"); err != nil {
+		if errors.Is(err, errStatusConflict) {
+			h.logger.Info("backordered order changed before confirmation, releasing stock", "order_id", event.OrderID)
+			h.releaseStock(ctx, event.OrderID, reservationItemIDs(event.Items))
+			return nil
 		}
-		req.Header.Set("Content-Type", "application/json")
+		h.logger.Error("failed to update order status", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("update order status: %w", err)
+	}
 
-		resp, err := h.httpClient.Do(req)
-		if err != nil {
-			return reserved, fmt.Errorf("reserve stock for item %s: %w", item.ItemID, err)
+	if err := h.sendBackorderFilledEmail(ctx, event); err != nil {
+		h.logger.Error("failed to send confirmation email", "error", err, "order_id", event.OrderID)
+		return fmt.Errorf("send confirmation email: %w", err)
+	}
+
+	h.logger.Info("backordered order confirmed", "order_id", event.OrderID)
+	return nil
+}
+
+type reservationRequest struct {
+	OrderID string                   `json:"order_id"`
+	Items   []domain.ReservationItem `json:"items"`
+}
+
+type shortfallResponse struct {
+	Shortfalls []domain.StockShortfall `json:"shortfalls"`
+}
+
+func (h *NotificationHandler) reserveStock(ctx context.Context, event domain.OrderCreatedEvent) error {
+	body := reservationRequest{OrderID: event.OrderID}
+	for _, item := range event.Items {
+		body.Items = append(body.Items, domain.ReservationItem{ItemID: item.ItemID, Quantity: item.Quantity})
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal reservation request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.inventoryServiceURL+"/reservations", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create reservation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("reserve stock: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusConflict {
+		var shortfall shortfallResponse
+		if err := json.NewDecoder(resp.Body).Decode(&shortfall); err != nil {
+			return errInsufficientStock
 		}
-		_ = resp.Body.Close()
+		items := make([]string, 0, len(shortfall.Shortfalls))
+		for _, s := range shortfall.Shortfalls {
+			items = append(items, fmt.Sprintf("%s (requested %d, available %d)", s.ItemID, s.Requested, s.Available))
+		}
+		return fmt.Errorf("%w: %s", errInsufficientStock, strings.Join(items, ", "))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// confirmReservations stops the order's reservations from expiring once the
+// worker has committed to confirming the order, and returns them so the order
+// can record where each item ships from. It returns errReservationExpired
+// unless the order still holds the wanted quantity of every item.
+func (h *NotificationHandler) confirmReservations(ctx context.Context, orderID string, wanted map[string]int) ([]domain.Reservation, error) {
+	url := fmt.Sprintf("%s/reservations/%s/confirm", h.inventoryServiceURL, orderID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
 
-		if resp.StatusCode == http.StatusConflict {
-			return reserved, fmt.Errorf("insufficient stock for item %s", item.ItemID)
+	if resp.StatusCode == http.StatusConflict {
+		return nil, errReservationExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+	}
+
+	var reservations []domain.Reservation
+	if err := json.NewDecoder(resp.Body).Decode(&reservations); err != nil {
+		return nil, fmt.Errorf("decode reservations: %w", err)
+	}
+
+	// The sweeper releases reservations in batches, so some of an order's
+	// items may be gone while others were just confirmed.
+	held := make(map[string]int, len(reservations))
+	for _, reservation := range reservations {
+		held[reservation.ItemID] += reservation.Quantity
+	}
+	for itemID, quantity := range wanted {
+		if held[itemID] != quantity {
+			return nil, errReservationExpired
 		}
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return reserved, fmt.Errorf("inventory service returned status %d for item %s", resp.StatusCode, item.ItemID)
+	return reservations, nil
+}
+
+// cancelExpired cancels an order whose reservations expired before the worker
+// could confirm them, releasing whatever part of them is left.
+func (h *NotificationHandler) cancelExpired(ctx context.Context, orderID, customerID string, itemIDs []string) error {
+	h.logger.Warn("stock reservation expired before confirmation, cancelling order", "order_id", orderID)
+	h.releaseStock(ctx, orderID, itemIDs)
+
+	if err := h.updateOrderStatus(ctx, orderID, domain.OrderStatusCancelled, nil, errReservationExpired.Error()); err != nil {
+		if errors.Is(err, errStatusConflict) {
+			h.logger.Info("order changed before cancellation", "order_id", orderID)
+			return nil
 		}
+		h.logger.Error("failed to cancel order", "error", err, "order_id", orderID)
+		return fmt.Errorf("cancel order after reservation expiry: %w", err)
+	}
+
+	if err := h.sendExpiredEmail(ctx, orderID, customerID); err != nil {
+		h.logger.Error("failed to send cancellation email", "error", err, "order_id", orderID)
+		return fmt.Errorf("send cancellation email: %w", err)
+	}
+
+	return nil
+}
+
+// commitReservations takes the order's reserved stock out of inventory once it
+// has shipped.
+func (h *NotificationHandler) commitReservations(ctx context.Context, orderID string) error {
+	url := fmt.Sprintf("%s/reservations/%s/commit", h.inventoryServiceURL, orderID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
 
-		reserved = append(reserved, reservedItem{ItemID: item.ItemID, Quantity: item.Quantity})
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
 	}
 
-	return reserved, nil
+	return nil
+}
+
+func allocationsFrom(reservations []domain.Reservation) []domain.ItemAllocation {
+	allocations := make([]domain.ItemAllocation, 0, len(reservations))
+	for _, r := range reservations {
+		allocations = append(allocations, domain.ItemAllocation{
+			ItemID:     r.ItemID,
+			LocationID: r.LocationID,
+			Quantity:   r.Quantity,
+		})
+	}
+	return allocations
 }
 
-func (h *NotificationHandler) releaseStock(ctx context.Context, reserved []reservedItem) {
-	for _, item := range reserved {
-		body := map[string]int{"quantity": item.Quantity}
+func (h *NotificationHandler) releaseStock(ctx context.Context, orderID string, itemIDs []string) {
+	for _, itemID := range itemIDs {
+		body := map[string]string{"order_id": orderID}
 		data, err := json.Marshal(body)
 		if err != nil {
-			h.logger.Error("failed to marshal release request", "error", err, "item_id", item.ItemID)
+			h.logger.Error("failed to marshal release request", "error", err, "item_id", itemID)
 			continue
 		}
 
-		url := fmt.Sprintf("%s/stock/%s/release", h.inventoryServiceURL, item.ItemID)
+		url := fmt.Sprintf("%s/stock/%s/release", h.inventoryServiceURL, itemID)
 		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
 		if err != nil {
-			h.logger.Error("failed to create release request", "error", err, "item_id", item.ItemID)
+			h.logger.Error("failed to create release request", "error", err, "item_id", itemID)
 			continue
 		}
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Actor", actor)
 
 		resp, err := h.httpClient.Do(req)
 		if err != nil {
-			h.logger.Error("failed to release stock", "error", err, "item_id", item.ItemID)
+			h.logger.Error("failed to release stock", "error", err, "item_id", itemID)
 			continue
 		}
 		_ = resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			h.logger.Error("failed to release stock", "status", resp.StatusCode, "item_id", item.ItemID)
+			h.logger.Error("failed to release stock", "status", resp.StatusCode, "item_id", itemID)
 		}
 	}
 }
 
+type returnRequest struct {
+	ReturnID string              `json:"return_id"`
+	OrderID  string              `json:"order_id"`
+	Items    []domain.ReturnItem `json:"items"`
+}
+
+func (h *NotificationHandler) restockReturn(ctx context.Context, event domain.ReturnEvent) error {
+	data, err := json.Marshal(returnRequest{
+		ReturnID: event.ReturnID,
+		OrderID:  event.OrderID,
+		Items:    event.Items,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.inventoryServiceURL+"/returns", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (h *NotificationHandler) refundReturn(ctx context.Context, orderID, returnID string) error {
+	url := fmt.Sprintf("%s/orders/%s/returns/%s/refund", h.ordersServiceURL, orderID, returnID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusConflict {
+		return errStatusConflict
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("orders service returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+type backorderRequest struct {
+	OrderID    string                   `json:"order_id"`
+	CustomerID string                   `json:"customer_id"`
+	Items      []domain.ReservationItem `json:"items"`
+}
+
+func (h *NotificationHandler) createBackorder(ctx context.Context, event domain.OrderCreatedEvent) error {
+	body := backorderRequest{OrderID: event.OrderID, CustomerID: event.CustomerID}
+	for _, item := range event.Items {
+		body.Items = append(body.Items, domain.ReservationItem{ItemID: item.ItemID, Quantity: item.Quantity})
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.inventoryServiceURL+"/backorders", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// cancelBackorder drops the order from the backorder queue. An order that was
+// never queued is not an error.
+func (h *NotificationHandler) cancelBackorder(ctx context.Context, orderID string) error {
+	url := fmt.Sprintf("%s/backorders/%s/cancel", h.inventoryServiceURL, orderID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func reservationItemIDs(items []domain.ReservationItem) []string {
+	itemIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ItemID)
+	}
+	return itemIDs
+}
+
+func orderItemIDs(items []domain.OrderItem) []string {
+	itemIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ItemID)
+	}
+	return itemIDs
+}
+
 func (h *NotificationHandler) sendConfirmationEmail(ctx context.Context, event domain.OrderCreatedEvent) error {
 	body := map[string]string{
 		"to":      event.CustomerID + "@example.com",
@@ -163,6 +726,61 @@ func (h *NotificationHandler) sendCancellationEmail(ctx context.Context, event d
 	return h.sendEmail(ctx, body)
 }
 
+func (h *NotificationHandler) sendExpiredEmail(ctx context.Context, orderID, customerID string) error {
+	body := map[string]string{
+		"to":      customerID + "@example.com",
+		"subject": "Order Cancelled: " + orderID,
+		"body":    fmt.Sprintf("Your order %s has been cancelled because its items could not be held for it. You will be reimbursed.", orderID),
+	}
+
+	return h.sendEmail(ctx, body)
+}
+
+func (h *NotificationHandler) sendBackorderedEmail(ctx context.Context, event domain.OrderCreatedEvent) error {
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Order Backordered: " + event.OrderID,
+		"body":    fmt.Sprintf("Some items in your order %s are out of stock. We will confirm it as soon as they arrive.", event.OrderID),
+	}
+
+	return h.sendEmail(ctx, body)
+}
+
+func (h *NotificationHandler) sendBackorderFilledEmail(ctx context.Context, event domain.BackorderFilledEvent) error {
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Order Confirmation: " + event.OrderID,
+		"body":    fmt.Sprintf("Good news! The items for your backordered order %s have arrived and it is now confirmed.", event.OrderID),
+	}
+
+	return h.sendEmail(ctx, body)
+}
+
+func (h *NotificationHandler) sendShippingEmail(ctx context.Context, event domain.OrderShippedEvent) error {
+	tracking := make([]string, 0, len(event.Shipments))
+	for _, s := range event.Shipments {
+		tracking = append(tracking, fmt.Sprintf("%s %s", s.Carrier, s.TrackingNumber))
+	}
+
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Order Shipped: " + event.OrderID,
+		"body":    fmt.Sprintf("Your order %s is on its way. Tracking: %s.", event.OrderID, strings.Join(tracking, ", ")),
+	}
+
+	return h.sendEmail(ctx, body)
+}
+
+func (h *NotificationHandler) sendCustomerCancellationEmail(ctx context.Context, event domain.OrderCancelledEvent) error {
+	body := map[string]string{
+		"to":      event.CustomerID + "@example.com",
+		"subject": "Order Cancelled: " + event.OrderID,
+		"body":    fmt.Sprintf("Your order %s has been cancelled as requested.", event.OrderID),
+	}
+
+	return h.sendEmail(ctx, body)
+}
+
 func (h *NotificationHandler) sendEmail(ctx context.Context, body map[string]string) error {
 	data, err := json.Marshal(body)
 	if err != nil {
@@ -188,9 +806,22 @@ func (h *NotificationHandler) sendEmail(ctx context.Context, body map[string]str
 	return nil
 }
 
-func (h *NotificationHandler) updateOrderStatus(ctx context.Context, orderID string, status domain.OrderStatus) error {
-	body := map[string]string{
-		"status": string(status),
+type statusUpdateRequest struct {
+	Status      domain.OrderStatus      `json:"status"`
+	Allocations []domain.ItemAllocation `json:"allocations,omitempty"`
+	Reason      string                  `json:"reason,omitempty"`
+}
+
+// updateOrderStatus moves the order to status. reason ends up in the order's
+// status history. The update is made conditional on the version of the order
+// the worker just read. If the order changed in between, it is read again and
+// the update retried while the transition still applies, so the worker never
+// overwrites a change it has not seen.
+func (h *NotificationHandler) updateOrderStatus(ctx context.Context, orderID string, status domain.OrderStatus, allocations []domain.ItemAllocation, reason string) error {
+	body := statusUpdateRequest{
+		Status:      status,
+		Allocations: allocations,
+		Reason:      reason,
 	}
 
 	data, err := json.Marshal(body)
@@ -198,12 +829,63 @@ func (h *NotificationHandler) updateOrderStatus(ctx context.Context, orderID str
 		return err
 	}
 
+	for attempt := 1; ; attempt++ {
+		current, etag, err := h.orderState(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if current != status && !current.CanTransitionTo(status) {
+			return errStatusConflict
+		}
+
+		err = h.patchOrderStatus(ctx, orderID, etag, data)
+		if !errors.Is(err, errVersionConflict) || attempt == maxStatusUpdateAttempts {
+			return err
+		}
+
+		h.logger.Info("order changed during status update, retrying", "order_id", orderID, "status", status, "attempt", attempt)
+	}
+}
+
+// orderState returns the order's current status and its ETag.
+func (h *NotificationHandler) orderState(ctx context.Context, orderID string) (domain.OrderStatus, string, error) {
+	url := fmt.Sprintf("%s/orders/%s", h.ordersServiceURL, orderID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("orders service returned status %d", resp.StatusCode)
+	}
+
+	var order struct {
+		Status domain.OrderStatus `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return "", "", err
+	}
+
+	return order.Status, resp.Header.Get("ETag"), nil
+}
+
+func (h *NotificationHandler) patchOrderStatus(ctx context.Context, orderID, etag string, data []byte) error {
 	url := fmt.Sprintf("%s/orders/%s/status", h.ordersServiceURL, orderID)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", actor)
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
 
 	resp, err := h.httpClient.Do(req)
 	if err != nil {
@@ -211,9 +893,14 @@ func (h *NotificationHandler) updateOrderStatus(ctx context.Context, orderID str
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errStatusConflict
+	case http.StatusPreconditionFailed:
+		return errVersionConflict
+	default:
 		return fmt.Errorf("orders service returned status %d", resp.StatusCode)
 	}
-
-	return nil
 }
@@ -0,0 +1,9 @@
+CREATE TABLE inventory.reservations (
+    order_id VARCHAR NOT NULL,
+    item_id VARCHAR NOT NULL REFERENCES inventory.items(item_id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (order_id, item_id)
+);
+
+CREATE INDEX idx_reservations_item_id ON inventory.reservations(item_id);
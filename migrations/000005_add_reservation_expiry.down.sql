@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS inventory.idx_reservations_expires_at;
+ALTER TABLE inventory.reservations
+    DROP COLUMN IF EXISTS trace_parent,
+    DROP COLUMN IF EXISTS expires_at;
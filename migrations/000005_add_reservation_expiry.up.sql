@@ -0,0 +1,5 @@
+ALTER TABLE inventory.reservations
+    ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN trace_parent VARCHAR;
+
+CREATE INDEX idx_reservations_expires_at ON inventory.reservations(expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS inventory.stock_movements;
+DROP FUNCTION IF EXISTS inventory.reject_stock_movement_changes();
@@ -0,0 +1,27 @@
+CREATE TABLE inventory.stock_movements (
+    id BIGSERIAL PRIMARY KEY,
+    item_id VARCHAR NOT NULL REFERENCES inventory.items(item_id),
+    available_delta INTEGER NOT NULL,
+    reserved_delta INTEGER NOT NULL,
+    reason VARCHAR NOT NULL,
+    order_id VARCHAR,
+    actor VARCHAR NOT NULL,
+    trace_id VARCHAR,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_stock_movements_item_id ON inventory.stock_movements(item_id, id);
+
+CREATE FUNCTION inventory.reject_stock_movement_changes() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'inventory.stock_movements is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER stock_movements_append_only
+    BEFORE UPDATE OR DELETE ON inventory.stock_movements
+    FOR EACH ROW EXECUTE FUNCTION inventory.reject_stock_movement_changes();
+
+INSERT INTO inventory.stock_movements (item_id, available_delta, reserved_delta, reason, actor)
+SELECT item_id, available, reserved, 'opening_balance', 'migration'
+FROM inventory.items;
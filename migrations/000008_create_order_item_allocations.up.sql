@@ -0,0 +1,7 @@
+CREATE TABLE orders.order_item_allocations (
+    order_id UUID NOT NULL REFERENCES orders.orders(id) ON DELETE CASCADE,
+    item_id VARCHAR NOT NULL,
+    location_id VARCHAR NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (order_id, item_id, location_id)
+);
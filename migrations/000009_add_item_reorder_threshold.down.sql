@@ -0,0 +1 @@
+ALTER TABLE inventory.items DROP COLUMN IF EXISTS reorder_threshold;
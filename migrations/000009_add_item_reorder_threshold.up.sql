@@ -0,0 +1,5 @@
+ALTER TABLE inventory.items
+    ADD COLUMN reorder_threshold INTEGER NOT NULL DEFAULT 0 CHECK (reorder_threshold >= 0);
+
+-- Seed items alert when a fifth of their opening stock is left.
+UPDATE inventory.items SET reorder_threshold = available / 5;
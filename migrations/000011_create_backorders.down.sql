@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS inventory.backorder_items;
+DROP TABLE IF EXISTS inventory.backorders;
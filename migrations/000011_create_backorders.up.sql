@@ -0,0 +1,18 @@
+CREATE TABLE inventory.backorders (
+    id BIGSERIAL PRIMARY KEY,
+    order_id VARCHAR NOT NULL UNIQUE,
+    customer_id VARCHAR NOT NULL,
+    status VARCHAR NOT NULL DEFAULT 'waiting',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    filled_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE inventory.backorder_items (
+    order_id VARCHAR NOT NULL REFERENCES inventory.backorders(order_id) ON DELETE CASCADE,
+    item_id VARCHAR NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (order_id, item_id)
+);
+
+CREATE INDEX idx_backorder_items_item_id ON inventory.backorder_items(item_id);
+CREATE INDEX idx_backorders_waiting ON inventory.backorders(id) WHERE status = 'waiting';
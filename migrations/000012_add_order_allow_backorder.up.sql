@@ -0,0 +1 @@
+ALTER TABLE orders.orders ADD COLUMN allow_backorder BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS orders.shipment_items;
+DROP TABLE IF EXISTS orders.shipments;
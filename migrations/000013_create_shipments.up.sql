@@ -0,0 +1,16 @@
+CREATE TABLE orders.shipments (
+    id UUID PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders.orders(id) ON DELETE CASCADE,
+    carrier VARCHAR NOT NULL,
+    tracking_number VARCHAR NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_shipments_order_id ON orders.shipments(order_id);
+
+CREATE TABLE orders.shipment_items (
+    shipment_id UUID NOT NULL REFERENCES orders.shipments(id) ON DELETE CASCADE,
+    item_id VARCHAR NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (shipment_id, item_id)
+);
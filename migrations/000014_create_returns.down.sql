@@ -0,0 +1,3 @@
+ALTER TABLE orders.orders DROP COLUMN IF EXISTS refunded_total;
+DROP TABLE IF EXISTS orders.return_items;
+DROP TABLE IF EXISTS orders.returns;
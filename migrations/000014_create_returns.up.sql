@@ -0,0 +1,21 @@
+CREATE TABLE orders.returns (
+    id UUID PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders.orders(id) ON DELETE CASCADE,
+    status VARCHAR NOT NULL DEFAULT 'requested',
+    reason VARCHAR NOT NULL DEFAULT '',
+    refund_amount BIGINT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE,
+    refunded_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_returns_order_id ON orders.returns(order_id);
+
+CREATE TABLE orders.return_items (
+    return_id UUID NOT NULL REFERENCES orders.returns(id) ON DELETE CASCADE,
+    item_id VARCHAR NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (return_id, item_id)
+);
+
+ALTER TABLE orders.orders ADD COLUMN refunded_total BIGINT NOT NULL DEFAULT 0;
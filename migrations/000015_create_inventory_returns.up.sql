@@ -0,0 +1,6 @@
+CREATE TABLE inventory.returns (
+    return_id VARCHAR PRIMARY KEY,
+    order_id VARCHAR NOT NULL,
+    location_id VARCHAR NOT NULL REFERENCES inventory.locations(location_id),
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
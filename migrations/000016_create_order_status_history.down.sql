@@ -0,0 +1 @@
+DROP TABLE IF EXISTS orders.order_status_history;
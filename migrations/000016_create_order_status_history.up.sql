@@ -0,0 +1,16 @@
+CREATE TABLE orders.order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders.orders(id) ON DELETE CASCADE,
+    from_status VARCHAR,
+    to_status VARCHAR NOT NULL,
+    actor VARCHAR NOT NULL,
+    reason VARCHAR NOT NULL DEFAULT '',
+    trace_id VARCHAR,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_order_status_history_order_id ON orders.order_status_history(order_id, id);
+
+INSERT INTO orders.order_status_history (order_id, to_status, actor, reason, created_at)
+SELECT id, status, 'migration', 'status before history was recorded', updated_at
+FROM orders.orders;
@@ -0,0 +1 @@
+ALTER TABLE orders.orders DROP COLUMN IF EXISTS version;
@@ -0,0 +1 @@
+ALTER TABLE orders.orders ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,2 @@
+ALTER TABLE orders.order_items DROP COLUMN IF EXISTS currency;
+ALTER TABLE orders.orders DROP COLUMN IF EXISTS currency;
@@ -0,0 +1,2 @@
+ALTER TABLE orders.orders ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders.order_items ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
@@ -0,0 +1,12 @@
+ALTER TABLE orders.order_items DROP COLUMN IF EXISTS discount;
+
+ALTER TABLE orders.orders
+    DROP COLUMN IF EXISTS shipping,
+    DROP COLUMN IF EXISTS tax,
+    DROP COLUMN IF EXISTS discount,
+    DROP COLUMN IF EXISTS subtotal,
+    DROP COLUMN IF EXISTS region,
+    DROP COLUMN IF EXISTS promo_code;
+
+DROP TABLE IF EXISTS orders.pricing_regions;
+DROP TABLE IF EXISTS orders.promo_codes;
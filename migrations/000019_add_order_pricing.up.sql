@@ -0,0 +1,42 @@
+CREATE TABLE orders.promo_codes (
+    code VARCHAR PRIMARY KEY,
+    description VARCHAR NOT NULL DEFAULT '',
+    scope VARCHAR NOT NULL CHECK (scope IN ('order', 'line')),
+    item_id VARCHAR,
+    percent_off INTEGER CHECK (percent_off BETWEEN 1 AND 100),
+    amount_off BIGINT CHECK (amount_off > 0),
+    currency CHAR(3),
+    valid_from TIMESTAMP WITH TIME ZONE,
+    valid_until TIMESTAMP WITH TIME ZONE,
+    max_uses INTEGER CHECK (max_uses > 0),
+    uses INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    CHECK ((percent_off IS NULL) <> (amount_off IS NULL)),
+    CHECK (amount_off IS NULL OR currency IS NOT NULL),
+    CHECK ((scope = 'line') = (item_id IS NOT NULL))
+);
+
+CREATE TABLE orders.pricing_regions (
+    region VARCHAR PRIMARY KEY,
+    tax_rate_bps INTEGER NOT NULL CHECK (tax_rate_bps >= 0),
+    shipping_fee BIGINT NOT NULL DEFAULT 0 CHECK (shipping_fee >= 0),
+    free_shipping_over BIGINT
+);
+
+INSERT INTO orders.pricing_regions (region, tax_rate_bps, shipping_fee, free_shipping_over) VALUES
+    ('US-CA', 725, 599, 5000),
+    ('US-NY', 400, 599, 5000),
+    ('DE', 1900, 499, 7500),
+    ('GB', 2000, 399, NULL);
+
+ALTER TABLE orders.orders
+    ADD COLUMN promo_code VARCHAR,
+    ADD COLUMN region VARCHAR,
+    ADD COLUMN subtotal BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN discount BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN tax BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN shipping BIGINT NOT NULL DEFAULT 0;
+
+UPDATE orders.orders SET subtotal = total;
+
+ALTER TABLE orders.order_items ADD COLUMN discount BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+CREATE TABLE orders.outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR NOT NULL,
+    message_key VARCHAR NOT NULL,
+    payload JSONB NOT NULL,
+    trace_context JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    published_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_outbox_unpublished ON orders.outbox(id) WHERE published_at IS NULL;
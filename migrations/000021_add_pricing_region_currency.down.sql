@@ -0,0 +1 @@
+ALTER TABLE orders.pricing_regions DROP COLUMN IF EXISTS currency;
@@ -0,0 +1,4 @@
+ALTER TABLE orders.pricing_regions ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+
+UPDATE orders.pricing_regions SET currency = 'EUR' WHERE region = 'DE';
+UPDATE orders.pricing_regions SET currency = 'GBP' WHERE region = 'GB';
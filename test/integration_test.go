@@ -3,19 +3,29 @@
 package test
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/domain"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/inventory"
+	"github.com/joao-fontenele/orderflow-otel-demo/internal/messaging"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/orders"
 	"github.com/joao-fontenele/orderflow-otel-demo/internal/worker"
 )
@@ -62,8 +72,8 @@ func TestOrderCreationFlow(t *testing.T) {
 	if createdOrder.Status != domain.OrderStatusPending {
 		t.Fatalf("expected status '%s', got '%s'", domain.OrderStatusPending, createdOrder.Status)
 	}
-	if createdOrder.Total != 2000 {
-		t.Fatalf("expected total 2000, got %d", createdOrder.Total)
+	if createdOrder.Total != domain.NewMoney(2000, "USD") {
+		t.Fatalf("expected total 2000 USD, got %s", createdOrder.Total)
 	}
 
 	fetchedOrder, err := repo.GetByID(ctx, createdOrder.ID)
@@ -98,6 +108,8 @@ func TestInventoryReserve(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /stock/{itemId}", handler.HandleGetStock)
 	mux.HandleFunc("POST /stock/{itemId}/reserve", handler.HandleReserve)
+	mux.HandleFunc("POST /stock/{itemId}/release", handler.HandleRelease)
+	mux.HandleFunc("GET /reservations", handler.HandleListReservations)
 
 	req := httptest.NewRequest(http.MethodGet, "/stock/ITEM-001", nil)
 	rec := httptest.NewRecorder()
@@ -119,130 +131,2711 @@ func TestInventoryReserve(t *testing.T) {
 		t.Fatalf("expected initial reserved stock 0, got %d", initialStock.Reserved)
 	}
 
-	reserveBody := `{"quantity": 10}`
-	req = httptest.NewRequest(http.MethodPost, "/stock/ITEM-001/reserve", strings.NewReader(reserveBody))
+	reserveBody := `{"order_id": "order-1", "quantity": 10}`
+	for range 2 {
+		req = httptest.NewRequest(http.MethodPost, "/stock/ITEM-001/reserve", strings.NewReader(reserveBody))
+		req.Header.Set("Content-Type", "application/json")
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+
+	var updatedStock domain.StockLevel
+	if err := json.NewDecoder(rec.Body).Decode(&updatedStock); err != nil {
+		t.Fatalf("failed to decode updated stock: %v", err)
+	}
+
+	if updatedStock.Available != 90 {
+		t.Fatalf("expected available stock 90 after repeated reserve, got %d", updatedStock.Available)
+	}
+	if updatedStock.Reserved != 10 {
+		t.Fatalf("expected reserved stock 10 after repeated reserve, got %d", updatedStock.Reserved)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/stock/ITEM-001/reserve", strings.NewReader(`{"order_id": "order-1", "quantity": 5}`))
 	req.Header.Set("Content-Type", "application/json")
 	rec = httptest.NewRecorder()
 	mux.ServeHTTP(rec, req)
 
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d for a repeated reserve with another quantity, got %d: %s", http.StatusConflict, rec.Code, rec.Body.String())
+	}
+
+	mismatchStock, err := repo.GetStock(ctx, "ITEM-001")
+	if err != nil {
+		t.Fatalf("failed to get stock: %v", err)
+	}
+	if mismatchStock.Available != 90 || mismatchStock.Reserved != 10 {
+		t.Fatalf("expected a rejected reserve to leave stock at 90/10, got %d/%d", mismatchStock.Available, mismatchStock.Reserved)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/reservations?order_id=order-1", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
 	if rec.Code != http.StatusOK {
 		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
 	}
 
-	var updatedStock domain.StockLevel
-	if err := json.NewDecoder(rec.Body).Decode(&updatedStock); err != nil {
-		t.Fatalf("failed to decode updated stock: %v", err)
+	var reservations []domain.Reservation
+	if err := json.NewDecoder(rec.Body).Decode(&reservations); err != nil {
+		t.Fatalf("failed to decode reservations: %v", err)
+	}
+	if len(reservations) != 1 || reservations[0].ItemID != "ITEM-001" || reservations[0].Quantity != 10 {
+		t.Fatalf("expected one reservation of 10 x ITEM-001, got %+v", reservations)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/stock/ITEM-001/release", strings.NewReader(`{"order_id": "order-2"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var afterForeignRelease domain.StockLevel
+	if err := json.NewDecoder(rec.Body).Decode(&afterForeignRelease); err != nil {
+		t.Fatalf("failed to decode stock: %v", err)
+	}
+	if afterForeignRelease.Reserved != 10 {
+		t.Fatalf("expected another order's release to leave reserved at 10, got %d", afterForeignRelease.Reserved)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/stock/ITEM-001/release", strings.NewReader(`{"order_id": "order-1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var releasedStock domain.StockLevel
+	if err := json.NewDecoder(rec.Body).Decode(&releasedStock); err != nil {
+		t.Fatalf("failed to decode stock: %v", err)
+	}
+	if releasedStock.Available != 100 || releasedStock.Reserved != 0 {
+		t.Fatalf("expected stock back at 100/0 after release, got %d/%d", releasedStock.Available, releasedStock.Reserved)
+	}
+}
+
+func TestReserveItemsIsAllOrNothing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	repo := inventory.NewInventoryRepository(inventoryDB)
+	handler := inventory.NewHandler(repo, slog.Default())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reservations", handler.HandleCreateReservation)
+
+	reqBody := `{
+		"order_id": "order-multi",
+		"items": [
+			{"item_id": "ITEM-004", "quantity": 5},
+			{"item_id": "ITEM-005", "quantity": 31},
+			{"item_id": "ITEM-404", "quantity": 1}
+		]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/reservations", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusConflict, rec.Code, rec.Body.String())
+	}
+
+	var rejection struct {
+		Shortfalls []domain.StockShortfall `json:"shortfalls"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&rejection); err != nil {
+		t.Fatalf("failed to decode rejection: %v", err)
+	}
+
+	expected := []domain.StockShortfall{
+		{ItemID: "ITEM-005", Requested: 31, Available: 30},
+		{ItemID: "ITEM-404", Requested: 1, Available: 0},
+	}
+	if len(rejection.Shortfalls) != len(expected) {
+		t.Fatalf("expected shortfalls %+v, got %+v", expected, rejection.Shortfalls)
+	}
+	for i := range expected {
+		if rejection.Shortfalls[i] != expected[i] {
+			t.Fatalf("expected shortfalls %+v, got %+v", expected, rejection.Shortfalls)
+		}
+	}
+
+	stock, err := repo.GetStock(ctx, "ITEM-004")
+	if err != nil {
+		t.Fatalf("failed to get stock: %v", err)
+	}
+	if stock.Available != 75 || stock.Reserved != 0 {
+		t.Fatalf("expected ITEM-004 untouched at 75/0, got %d/%d", stock.Available, stock.Reserved)
+	}
+
+	reqBody = `{
+		"order_id": "order-multi",
+		"items": [
+			{"item_id": "ITEM-004", "quantity": 5},
+			{"item_id": "ITEM-005", "quantity": 30}
+		]
+	}`
+	req = httptest.NewRequest(http.MethodPost, "/reservations", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var reservations []domain.Reservation
+	if err := json.NewDecoder(rec.Body).Decode(&reservations); err != nil {
+		t.Fatalf("failed to decode reservations: %v", err)
+	}
+	if len(reservations) != 2 {
+		t.Fatalf("expected 2 reservations, got %+v", reservations)
+	}
+}
+
+func TestReservationLocationPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	repo := inventory.NewInventoryRepository(inventoryDB)
+
+	// ITEM-A: WH-MAIN 4, WH-EAST 10. ITEM-B: WH-MAIN 0, WH-EAST 3.
+	for _, item := range []struct {
+		id         string
+		main, east int
+	}{
+		{id: "ITEM-A", main: 4, east: 10},
+		{id: "ITEM-B", main: 0, east: 3},
+	} {
+		if err := repo.CreateItem(ctx, domain.Item{ItemID: item.id, Name: item.id}, item.main, "WH-MAIN", "test"); err != nil {
+			t.Fatalf("failed to create %s: %v", item.id, err)
+		}
+		if err := repo.Restock(ctx, item.id, "WH-EAST", item.east, "test"); err != nil {
+			t.Fatalf("failed to restock %s: %v", item.id, err)
+		}
+	}
+
+	locationsOf := func(orderID string) map[string]string {
+		t.Helper()
+		reservations, err := repo.ListReservations(ctx, orderID)
+		if err != nil {
+			t.Fatalf("failed to list reservations: %v", err)
+		}
+		got := make(map[string]string)
+		for _, r := range reservations {
+			got[r.ItemID] += fmt.Sprintf("%s:%d ", r.LocationID, r.Quantity)
+		}
+		return got
+	}
+
+	t.Run("one location ships the whole order", func(t *testing.T) {
+		items := []domain.ReservationItem{{ItemID: "ITEM-A", Quantity: 2}, {ItemID: "ITEM-B", Quantity: 1}}
+		if err := repo.ReserveItems(ctx, "single", items, "test"); err != nil {
+			t.Fatalf("failed to reserve: %v", err)
+		}
+
+		got := locationsOf("single")
+		if got["ITEM-A"] != "WH-EAST:2 " || got["ITEM-B"] != "WH-EAST:1 " {
+			t.Fatalf("expected both items from WH-EAST, got %v", got)
+		}
+	})
+
+	t.Run("items split across locations", func(t *testing.T) {
+		items := []domain.ReservationItem{{ItemID: "ITEM-A", Quantity: 12}}
+		if err := repo.ReserveItems(ctx, "split", items, "test"); err != nil {
+			t.Fatalf("failed to reserve: %v", err)
+		}
+
+		if got := locationsOf("split"); got["ITEM-A"] != "WH-MAIN:4 WH-EAST:8 " {
+			t.Fatalf("expected ITEM-A split between WH-MAIN and WH-EAST, got %v", got)
+		}
+	})
+
+	t.Run("release returns stock to each location", func(t *testing.T) {
+		if err := repo.Release(ctx, "split", "ITEM-A", "test"); err != nil {
+			t.Fatalf("failed to release: %v", err)
+		}
+
+		levels, err := repo.ListItemLocations(ctx, "ITEM-A")
+		if err != nil {
+			t.Fatalf("failed to list item locations: %v", err)
+		}
+		if len(levels) != 2 || levels[0].Available != 4 || levels[1].Available != 8 {
+			t.Fatalf("unexpected location stock after release: %+v", levels)
+		}
+
+		total, err := repo.GetStock(ctx, "ITEM-A")
+		if err != nil {
+			t.Fatalf("failed to get stock: %v", err)
+		}
+		if total.Available != 12 || total.Reserved != 2 {
+			t.Fatalf("unexpected aggregate stock: %+v", total)
+		}
+	})
+
+	discrepancies, err := repo.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if len(discrepancies) != 0 {
+		t.Fatalf("expected counters to match the ledger, got %+v", discrepancies)
+	}
+}
+
+func TestSweeperReleasesExpiredReservations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := inventory.NewInventoryRepository(inventoryDB, inventory.WithReservationTTL(50*time.Millisecond))
+	sweeper := inventory.NewSweeper(repo, time.Minute, 1, logger)
+
+	if err := repo.Reserve(ctx, "order-abandoned", "ITEM-006", 10, "test"); err != nil {
+		t.Fatalf("failed to reserve stock: %v", err)
+	}
+	if err := repo.Reserve(ctx, "order-abandoned", "ITEM-007", 10, "test"); err != nil {
+		t.Fatalf("failed to reserve stock: %v", err)
+	}
+	if err := repo.Reserve(ctx, "order-confirmed", "ITEM-006", 5, "test"); err != nil {
+		t.Fatalf("failed to reserve stock: %v", err)
+	}
+	if err := repo.ConfirmReservations(ctx, "order-confirmed"); err != nil {
+		t.Fatalf("failed to confirm reservations: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	expired, err := sweeper.Sweep(ctx)
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if expired != 2 {
+		t.Fatalf("expected 2 expired reservations, got %d", expired)
+	}
+
+	stock, err := repo.GetStock(ctx, "ITEM-006")
+	if err != nil {
+		t.Fatalf("failed to get stock: %v", err)
+	}
+	if stock.Available != 145 || stock.Reserved != 5 {
+		t.Fatalf("expected ITEM-006 at 145/5 after sweep, got %d/%d", stock.Available, stock.Reserved)
+	}
+
+	rows, err := inventoryDB.QueryContext(ctx, `
+		SELECT payload FROM outbox WHERE topic = $1 AND message_key = $2
+	`, domain.TopicStockReservationExpired, "order-abandoned")
+	if err != nil {
+		t.Fatalf("failed to read reservation expired events: %v", err)
+	}
+	var expiredItems []string
+	for rows.Next() {
+		var payload []byte
+		if err := rows.Scan(&payload); err != nil {
+			t.Fatalf("failed to scan reservation expired event: %v", err)
+		}
+		var event domain.ReservationExpiredEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatalf("failed to decode reservation expired event: %v", err)
+		}
+		if event.Quantity != 10 {
+			t.Fatalf("expected the expired event to carry the held quantity, got %+v", event)
+		}
+		expiredItems = append(expiredItems, event.ItemID)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("failed to read reservation expired events: %v", err)
+	}
+	_ = rows.Close()
+	slices.Sort(expiredItems)
+	if !slices.Equal(expiredItems, []string{"ITEM-006", "ITEM-007"}) {
+		t.Fatalf("expected one queued expired event per released hold, got %v", expiredItems)
+	}
+
+	abandoned, err := repo.ListReservations(ctx, "order-abandoned")
+	if err != nil {
+		t.Fatalf("failed to list reservations: %v", err)
+	}
+	if len(abandoned) != 0 {
+		t.Fatalf("expected abandoned reservations to be gone, got %+v", abandoned)
+	}
+
+	confirmed, err := repo.ListReservations(ctx, "order-confirmed")
+	if err != nil {
+		t.Fatalf("failed to list reservations: %v", err)
+	}
+	if len(confirmed) != 1 || confirmed[0].ExpiresAt != nil {
+		t.Fatalf("expected confirmed reservation to be kept without expiry, got %+v", confirmed)
+	}
+}
+
+func TestStockLedgerMatchesCounters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	repo := inventory.NewInventoryRepository(inventoryDB)
+	handler := inventory.NewHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /stock/{itemId}/reserve", handler.HandleReserve)
+	mux.HandleFunc("POST /stock/{itemId}/release", handler.HandleRelease)
+	mux.HandleFunc("GET /stock/{itemId}/movements", handler.HandleListMovements)
+	mux.HandleFunc("GET /stock/reconciliation", handler.HandleReconcile)
+
+	post := func(path, body string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Actor", "ledger-test")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s: expected status %d, got %d: %s", path, http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+
+	post("/stock/ITEM-008/reserve", `{"order_id": "ledger-1", "quantity": 3}`)
+	post("/stock/ITEM-008/reserve", `{"order_id": "ledger-2", "quantity": 4}`)
+	post("/stock/ITEM-008/release", `{"order_id": "ledger-1"}`)
+
+	req := httptest.NewRequest(http.MethodGet, "/stock/ITEM-008/movements?limit=2", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var page struct {
+		Movements  []domain.StockMovement `json:"movements"`
+		NextBefore *int64                 `json:"next_before"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode movements: %v", err)
+	}
+
+	if len(page.Movements) != 2 || page.NextBefore == nil {
+		t.Fatalf("expected a full first page with a cursor, got %+v", page)
+	}
+	latest := page.Movements[0]
+	if latest.Reason != inventory.ReasonRelease || latest.OrderID != "ledger-1" || latest.AvailableDelta != 3 || latest.ReservedDelta != -3 {
+		t.Fatalf("unexpected latest movement: %+v", latest)
+	}
+	if latest.Actor != "ledger-test" {
+		t.Fatalf("expected actor ledger-test, got %s", latest.Actor)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/stock/ITEM-008/movements?limit=2&before=%d", *page.NextBefore), nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var next struct {
+		Movements []domain.StockMovement `json:"movements"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&next); err != nil {
+		t.Fatalf("failed to decode movements: %v", err)
+	}
+	if len(next.Movements) != 2 || next.Movements[1].Reason != "opening_balance" {
+		t.Fatalf("expected the reserve and the opening balance on page two, got %+v", next.Movements)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/stock/reconciliation", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var reconciliation struct {
+		Consistent    bool                      `json:"consistent"`
+		Discrepancies []domain.StockDiscrepancy `json:"discrepancies"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&reconciliation); err != nil {
+		t.Fatalf("failed to decode reconciliation: %v", err)
+	}
+	if !reconciliation.Consistent {
+		t.Fatalf("expected counters to match the ledger, got %+v", reconciliation.Discrepancies)
+	}
+
+	if _, err := inventoryDB.ExecContext(ctx, `UPDATE items SET available = available + 1 WHERE item_id = 'ITEM-008'`); err != nil {
+		t.Fatalf("failed to tamper with counters: %v", err)
+	}
+
+	discrepancies, err := repo.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if len(discrepancies) != 1 || discrepancies[0].ItemID != "ITEM-008" {
+		t.Fatalf("expected ITEM-008 to be reported, got %+v", discrepancies)
+	}
+}
+
+func TestItemManagement(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	repo := inventory.NewInventoryRepository(inventoryDB)
+	handler := inventory.NewHandler(repo, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /items", handler.HandleCreateItem)
+	mux.HandleFunc("PATCH /items/{itemId}", handler.HandleUpdateItem)
+	mux.HandleFunc("POST /stock/{itemId}/restock", handler.HandleRestock)
+	mux.HandleFunc("POST /stock/{itemId}/adjust", handler.HandleAdjust)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Actor", "ops")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("create item", func(t *testing.T) {
+		rec := do(http.MethodPost, "/items", `{"item_id": "ITEM-100", "name": "Widget", "initial_quantity": 10}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+
+		var stock domain.StockLevel
+		if err := json.NewDecoder(rec.Body).Decode(&stock); err != nil {
+			t.Fatalf("failed to decode stock: %v", err)
+		}
+		if stock.Available != 10 || stock.Reserved != 0 {
+			t.Fatalf("unexpected stock: %+v", stock)
+		}
+
+		rec = do(http.MethodPost, "/items", `{"item_id": "ITEM-100", "name": "Widget"}`)
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("expected status %d for duplicate item, got %d", http.StatusConflict, rec.Code)
+		}
+	})
+
+	t.Run("invalid items are rejected", func(t *testing.T) {
+		for _, body := range []string{
+			`{"item_id": "", "name": "Widget"}`,
+			`{"item_id": "ITEM/101", "name": "Widget"}`,
+			`{"item_id": "ITEM-101", "name": "  "}`,
+			`{"item_id": "ITEM-101", "name": "Widget", "initial_quantity": -1}`,
+		} {
+			if rec := do(http.MethodPost, "/items", body); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d, got %d", body, http.StatusBadRequest, rec.Code)
+			}
+		}
+	})
+
+	t.Run("rename item", func(t *testing.T) {
+		rec := do(http.MethodPatch, "/items/ITEM-100", `{"name": "Blue Widget"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var item domain.Item
+		if err := json.NewDecoder(rec.Body).Decode(&item); err != nil {
+			t.Fatalf("failed to decode item: %v", err)
+		}
+		if item.Name != "Blue Widget" {
+			t.Fatalf("expected renamed item, got %+v", item)
+		}
+
+		if rec := do(http.MethodPatch, "/items/NOPE", `{"name": "Ghost"}`); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+		}
+	})
+
+	t.Run("restock and adjust", func(t *testing.T) {
+		if rec := do(http.MethodPost, "/stock/ITEM-100/restock", `{"quantity": 5}`); rec.Code != http.StatusOK {
+			t.Fatalf("restock: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		if rec := do(http.MethodPost, "/stock/ITEM-100/restock", `{"quantity": 0}`); rec.Code != http.StatusBadRequest {
+			t.Fatalf("restock: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if rec := do(http.MethodPost, "/stock/ITEM-100/adjust", `{"delta": -2, "reason": "misplaced"}`); rec.Code != http.StatusBadRequest {
+			t.Fatalf("adjust: expected status %d for unknown reason, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if rec := do(http.MethodPost, "/stock/ITEM-100/adjust", `{"delta": -100, "reason": "lost"}`); rec.Code != http.StatusConflict {
+			t.Fatalf("adjust: expected status %d, got %d", http.StatusConflict, rec.Code)
+		}
+
+		rec := do(http.MethodPost, "/stock/ITEM-100/adjust", `{"delta": -2, "reason": "damaged"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("adjust: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var stock domain.StockLevel
+		if err := json.NewDecoder(rec.Body).Decode(&stock); err != nil {
+			t.Fatalf("failed to decode stock: %v", err)
+		}
+		if stock.Available != 13 {
+			t.Fatalf("expected 13 available, got %+v", stock)
+		}
+	})
+
+	movements, err := repo.ListMovements(ctx, "ITEM-100", 0, 10)
+	if err != nil {
+		t.Fatalf("failed to list movements: %v", err)
+	}
+	reasons := make([]string, 0, len(movements))
+	for _, m := range movements {
+		if m.Actor != "ops" {
+			t.Errorf("expected actor ops, got %+v", m)
+		}
+		reasons = append(reasons, m.Reason)
+	}
+	if got := strings.Join(reasons, ","); got != "damaged,restock,initial_stock" {
+		t.Fatalf("unexpected ledger reasons: %s", got)
+	}
+
+	discrepancies, err := repo.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if len(discrepancies) != 0 {
+		t.Fatalf("expected counters to match the ledger, got %+v", discrepancies)
+	}
+}
+
+func TestLowStockAlert(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	brokers, cleanupKafka := SetupKafka(ctx, t)
+	defer cleanupKafka()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	repo := inventory.NewInventoryRepository(inventoryDB)
+
+	item := domain.Item{ItemID: "ITEM-LOW", Name: "Scarce Widget", ReorderThreshold: 5}
+	if err := repo.CreateItem(ctx, item, 10, "", "test"); err != nil {
+		t.Fatalf("failed to create item: %v", err)
+	}
+
+	for i, qty := range []int{4, 2, 1} {
+		if err := repo.Reserve(ctx, fmt.Sprintf("low-%d", i), "ITEM-LOW", qty, "test"); err != nil {
+			t.Fatalf("failed to reserve: %v", err)
+		}
+	}
+
+	var queued int
+	if err := inventoryDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM outbox WHERE topic = $1`, domain.TopicStockLow).Scan(&queued); err != nil {
+		t.Fatalf("failed to count outbox entries: %v", err)
+	}
+	if queued != 1 {
+		t.Fatalf("expected one stock.low event when crossing the threshold, got %d", queued)
+	}
+
+	producer := messaging.NewProducer(brokers, domain.TopicStockLow)
+	defer func() { _ = producer.Close() }()
+
+	relay := messaging.NewOutboxRelay(inventoryDB, producer, time.Second, 10, logger)
+	published, err := relay.Relay(ctx)
+	if err != nil {
+		t.Fatalf("failed to relay outbox: %v", err)
+	}
+	if published != 1 {
+		t.Fatalf("expected 1 published event, got %d", published)
+	}
+
+	if published, err := relay.Relay(ctx); err != nil || published != 0 {
+		t.Fatalf("expected nothing left to relay, got %d (%v)", published, err)
+	}
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	notificationHandler := worker.NewNotificationHandler(emailServer.URL, "", "", http.DefaultClient, logger,
+		worker.WithAlertRecipient("ops@example.com"))
+
+	consumer := messaging.NewConsumer(brokers, domain.TopicStockLow, "low-stock-test", messaging.WithStartOffset(kafka.FirstOffset))
+	defer func() { _ = consumer.Close() }()
+
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	defer stopConsuming()
+	err = consumer.Consume(consumeCtx, func(ctx context.Context, payload []byte) error {
+		defer stopConsuming()
+		return notificationHandler.HandleStockLow(ctx, payload)
+	})
+	if err != nil && consumeCtx.Err() == nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+
+	emails := emailCap.getEmails()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 alert email, got %d", len(emails))
+	}
+	if emails[0]["to"] != "ops@example.com" || !strings.Contains(emails[0]["subject"], "ITEM-LOW") {
+		t.Fatalf("unexpected alert email: %v", emails[0])
+	}
+	if !strings.Contains(emails[0]["body"], "4 available") {
+		t.Fatalf("expected alert to report 4 available units, got: %s", emails[0]["body"])
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	repo := orders.NewOrderRepository(ordersDB)
+	logger := slog.Default()
+	handler := orders.NewHandler(repo, nil, logger)
+
+	for i := 1; i <= 3; i++ {
+		order := &domain.Order{
+			CustomerID: "list-test-customer",
+			Items: []domain.OrderItem{
+				{ItemID: "ITEM-001", Quantity: 1, Price: domain.NewMoney(1000, "USD")},
+			},
+			Total:     domain.NewMoney(1000, "USD"),
+			Status:    domain.OrderStatusPending,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := repo.Create(ctx, order, "test"); err != nil {
+			t.Fatalf("failed to create order %d: %v", i, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandleList(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var orderList []domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&orderList); err != nil {
+		t.Fatalf("failed to decode order list: %v", err)
+	}
+
+	if len(orderList) != 3 {
+		t.Fatalf("expected 3 orders, got %d", len(orderList))
+	}
+
+	for _, order := range orderList {
+		if order.CustomerID != "list-test-customer" {
+			t.Fatalf("unexpected customer_id: %s", order.CustomerID)
+		}
+	}
+}
+
+func TestOrderStatusHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := orders.NewOrderRepository(ordersDB)
+	handler := orders.NewHandler(repo, nil, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", handler.HandleCreate)
+	mux.HandleFunc("POST /orders/{id}/cancel", handler.HandleCancel)
+	mux.HandleFunc("GET /orders/{id}/history", handler.HandleHistory)
+
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"customer_id": "cust-history", "items": [{"item_id": "ITEM-001", "quantity": 1, "price": 100}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", "storefront")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var order domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode order: %v", err)
+	}
+
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	if err != nil {
+		t.Fatalf("failed to parse trace ID: %v", err)
+	}
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	if err != nil {
+		t.Fatalf("failed to parse span ID: %v", err)
+	}
+	tracedCtx := trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	req = httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", strings.NewReader(`{"reason": "customer called support"}`)).WithContext(tracedCtx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", "support-agent")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// Cancelling again changes nothing and must not add an entry.
+	req = httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/orders/"+order.ID+"/history", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var history []domain.StatusChange
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("expected 2 history entries, got %+v", history)
+	}
+
+	created := history[0]
+	if created.FromStatus != "" || created.ToStatus != domain.OrderStatusPending || created.Actor != "storefront" {
+		t.Fatalf("unexpected creation entry: %+v", created)
+	}
+
+	cancelled := history[1]
+	if cancelled.FromStatus != domain.OrderStatusPending || cancelled.ToStatus != domain.OrderStatusCancelled {
+		t.Fatalf("expected pending -> cancelled, got %s -> %s", cancelled.FromStatus, cancelled.ToStatus)
+	}
+	if cancelled.Actor != "support-agent" || cancelled.Reason != "customer called support" {
+		t.Fatalf("expected actor and reason to be recorded, got %+v", cancelled)
+	}
+	if cancelled.TraceID != traceID.String() {
+		t.Fatalf("expected trace ID %s, got %q", traceID, cancelled.TraceID)
+	}
+}
+
+type serverSentEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readEvent reads the next event from an event stream, skipping comments and
+// retry hints.
+func readEvent(t *testing.T, reader *bufio.Reader) serverSentEvent {
+	t.Helper()
+	var event serverSentEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if event.Event != "" {
+				return event
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ": ")
+		switch name {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Event = value
+		case "data":
+			event.Data = value
+		}
+	}
+}
+
+func TestOrderEventsStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	notifier, err := orders.NewStatusNotifier(pg.ConnStr, logger)
+	if err != nil {
+		t.Fatalf("failed to create status notifier: %v", err)
+	}
+	defer func() { _ = notifier.Close() }()
+	go notifier.Run(ctx)
+
+	repo := orders.NewOrderRepository(ordersDB)
+	handler := orders.NewHandler(repo, nil, logger)
+	handler.SetStatusNotifier(notifier)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", handler.HandleCreate)
+	mux.HandleFunc("PATCH /orders/{id}/status", handler.HandleUpdateStatus)
+	mux.HandleFunc("GET /orders/{id}/events", handler.HandleEvents)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"customer_id": "cust-events", "items": [{"item_id": "ITEM-001", "quantity": 1, "price": 100}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var order domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode order: %v", err)
+	}
+
+	openStream := func(lastEventID string) (*bufio.Reader, func()) {
+		t.Helper()
+		streamCtx, stop := context.WithCancel(ctx)
+		req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, server.URL+"/orders/"+order.ID+"/events", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to open event stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body), func() {
+			stop()
+			_ = resp.Body.Close()
+		}
+	}
+
+	stream, closeStream := openStream("")
+	created := readEvent(t, stream)
+	var change domain.StatusChange
+	if err := json.Unmarshal([]byte(created.Data), &change); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if created.Event != "status" || change.ToStatus != domain.OrderStatusPending || created.ID != fmt.Sprint(change.ID) {
+		t.Fatalf("expected the creation entry first, got %+v", created)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/orders/"+order.ID+"/status", strings.NewReader(`{"status": "confirmed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// The notification pushes the change well before the next heartbeat;
+	// the read fails if the stream is closed first.
+	timer := time.AfterFunc(5*time.Second, closeStream)
+	confirmed := readEvent(t, stream)
+	timer.Stop()
+	if !strings.Contains(confirmed.Data, `"to_status":"confirmed"`) {
+		t.Fatalf("expected the confirmed entry, got %+v", confirmed)
+	}
+	closeStream()
+
+	// Resuming after the creation entry replays only the confirmation.
+	stream, closeStream = openStream(created.ID)
+	defer closeStream()
+	if resumed := readEvent(t, stream); resumed.ID != confirmed.ID {
+		t.Fatalf("expected to resume with event %s, got %+v", confirmed.ID, resumed)
+	}
+}
+
+func TestOrderOptimisticConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	ordersRepo := orders.NewOrderRepository(ordersDB)
+	ordersHandler := orders.NewHandler(ordersRepo, nil, logger)
+	ordersMux := http.NewServeMux()
+	ordersMux.HandleFunc("POST /orders", ordersHandler.HandleCreate)
+	ordersMux.HandleFunc("GET /orders/{id}", ordersHandler.HandleGet)
+	ordersMux.HandleFunc("PATCH /orders/{id}/status", ordersHandler.HandleUpdateStatus)
+	ordersMux.HandleFunc("POST /orders/{id}/cancel", ordersHandler.HandleCancel)
+
+	// interfere, when set, runs once before the next status update reaches the
+	// orders service, simulating a concurrent writer.
+	var mu sync.Mutex
+	var interfere func()
+	ordersServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			mu.Lock()
+			f := interfere
+			interfere = nil
+			mu.Unlock()
+			if f != nil {
+				f()
+			}
+		}
+		ordersMux.ServeHTTP(w, r)
+	}))
+	defer ordersServer.Close()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	inventoryMux := http.NewServeMux()
+	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
+	inventoryServer := httptest.NewServer(inventoryMux)
+	defer inventoryServer.Close()
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	notificationHandler := worker.NewNotificationHandler(
+		emailServer.URL,
+		ordersServer.URL,
+		inventoryServer.URL,
+		&http.Client{Timeout: 10 * time.Second},
+		logger,
+	)
+
+	if err := inventoryRepo.CreateItem(ctx, domain.Item{ItemID: "ITEM-OCC", Name: "Contended Widget"}, 10, "", "test"); err != nil {
+		t.Fatalf("failed to create item: %v", err)
+	}
+
+	createOrder := func() domain.Order {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"customer_id": "cust-occ", "items": [{"item_id": "ITEM-OCC", "quantity": 1, "price": 100}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("ETag") != `"1"` {
+			t.Fatalf("expected ETag \"1\", got %q", rec.Header().Get("ETag"))
+		}
+		var order domain.Order
+		if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+			t.Fatalf("failed to decode order: %v", err)
+		}
+		return order
+	}
+
+	createdEvent := func(order domain.Order) []byte {
+		t.Helper()
+		payload, err := json.Marshal(domain.OrderCreatedEvent{
+			OrderID:    order.ID,
+			CustomerID: order.CustomerID,
+			Items:      order.Items,
+			Timestamp:  order.CreatedAt,
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal event: %v", err)
+		}
+		return payload
+	}
+
+	t.Run("only one of several writers holding the same ETag wins", func(t *testing.T) {
+		order := createOrder()
+
+		const writers = 10
+		codes := make(chan int, writers)
+		var wg sync.WaitGroup
+		for i := range writers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var req *http.Request
+				if i%2 == 0 {
+					req = httptest.NewRequest(http.MethodPatch, "/orders/"+order.ID+"/status", strings.NewReader(`{"status": "confirmed"}`))
+				} else {
+					req = httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", nil)
+				}
+				req.Header.Set("If-Match", `"1"`)
+				rec := httptest.NewRecorder()
+				ordersMux.ServeHTTP(rec, req)
+				codes <- rec.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		counts := make(map[int]int)
+		for code := range codes {
+			counts[code]++
+		}
+		if counts[http.StatusOK] != 1 || counts[http.StatusPreconditionFailed] != writers-1 {
+			t.Fatalf("expected one success and %d precondition failures, got %v", writers-1, counts)
+		}
+
+		final, err := ordersRepo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if final.Version != 2 {
+			t.Fatalf("expected version 2, got %d", final.Version)
+		}
+
+		history, err := ordersRepo.History(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get history: %v", err)
+		}
+		if len(history) != 2 || history[1].ToStatus != final.Status {
+			t.Fatalf("expected exactly one recorded transition to %s, got %+v", final.Status, history)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/orders/"+order.ID, nil)
+		rec := httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		if rec.Header().Get("ETag") != `"2"` {
+			t.Fatalf("expected ETag \"2\", got %q", rec.Header().Get("ETag"))
+		}
+	})
+
+	t.Run("an update holding a stale ETag is rejected", func(t *testing.T) {
+		order := createOrder()
+
+		req := httptest.NewRequest(http.MethodPatch, "/orders/"+order.ID+"/status", strings.NewReader(`{"status": "confirmed"}`))
+		rec := httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		// Confirmed orders can still be cancelled, so only the version
+		// stands between this request and the order.
+		req = httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", nil)
+		req.Header.Set("If-Match", `"1"`)
+		rec = httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusPreconditionFailed, rec.Code, rec.Body.String())
+		}
+
+		final, err := ordersRepo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if final.Status != domain.OrderStatusConfirmed || final.Version != 2 {
+			t.Fatalf("expected the order to stay confirmed at version 2, got %s at version %d", final.Status, final.Version)
+		}
+	})
+
+	t.Run("an If-Match list matches any of its versions", func(t *testing.T) {
+		order := createOrder()
+
+		req := httptest.NewRequest(http.MethodPatch, "/orders/"+order.ID+"/status", strings.NewReader(`{"status": "confirmed"}`))
+		req.Header.Set("If-Match", `"7", "1"`)
+		rec := httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("ETag") != `"2"` {
+			t.Fatalf("expected ETag \"2\", got %q", rec.Header().Get("ETag"))
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", nil)
+		req.Header.Add("If-Match", `"1"`)
+		req.Header.Add("If-Match", `"3"`)
+		rec = httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusPreconditionFailed, rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("If-Match compares tags strongly", func(t *testing.T) {
+		order := createOrder()
+
+		tests := []struct {
+			ifMatch string
+			want    int
+		}{
+			{`W/"1"`, http.StatusPreconditionFailed},
+			{`"1", *`, http.StatusBadRequest},
+			{`1`, http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", nil)
+			req.Header.Set("If-Match", tt.ifMatch)
+			rec := httptest.NewRecorder()
+			ordersMux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("If-Match %s: expected status %d, got %d: %s", tt.ifMatch, tt.want, rec.Code, rec.Body.String())
+			}
+		}
+
+		final, err := ordersRepo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if final.Status != domain.OrderStatusPending || final.Version != 1 {
+			t.Fatalf("expected the order to stay pending at version 1, got %s at version %d", final.Status, final.Version)
+		}
+	})
+
+	t.Run("worker retries when the order changes underneath it", func(t *testing.T) {
+		order := createOrder()
+
+		mu.Lock()
+		interfere = func() {
+			_, _, err := ordersRepo.UpdateStatus(ctx, order.ID, orders.StatusChange{
+				Status:      domain.OrderStatusPending,
+				Allocations: []domain.ItemAllocation{{ItemID: "ITEM-OCC", LocationID: "WH-EAST", Quantity: 1}},
+			})
+			if err != nil {
+				t.Errorf("concurrent update failed: %v", err)
+			}
+		}
+		mu.Unlock()
+
+		if err := notificationHandler.Handle(ctx, createdEvent(order)); err != nil {
+			t.Fatalf("worker handler failed: %v", err)
+		}
+
+		final, err := ordersRepo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if final.Status != domain.OrderStatusConfirmed {
+			t.Fatalf("expected the retried update to confirm the order, got %s", final.Status)
+		}
+		if final.Version != 3 {
+			t.Fatalf("expected both updates to bump the version to 3, got %d", final.Version)
+		}
+		if got := final.Items[0].Allocations; len(got) != 1 || got[0].LocationID != "WH-MAIN" {
+			t.Fatalf("expected the worker's allocations to be recorded, got %+v", got)
+		}
+	})
+
+	t.Run("a concurrent cancellation is not overwritten by the worker", func(t *testing.T) {
+		order := createOrder()
+
+		mu.Lock()
+		interfere = func() {
+			req := httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", strings.NewReader(`{"reason": "changed my mind"}`))
+			rec := httptest.NewRecorder()
+			ordersMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("concurrent cancel failed with %d: %s", rec.Code, rec.Body.String())
+			}
+		}
+		mu.Unlock()
+
+		before, err := inventoryRepo.GetStock(ctx, "ITEM-OCC")
+		if err != nil {
+			t.Fatalf("failed to get stock: %v", err)
+		}
+
+		if err := notificationHandler.Handle(ctx, createdEvent(order)); err != nil {
+			t.Fatalf("worker handler failed: %v", err)
+		}
+
+		final, err := ordersRepo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if final.Status != domain.OrderStatusCancelled {
+			t.Fatalf("expected the customer's cancellation to stand, got %s", final.Status)
+		}
+
+		after, err := inventoryRepo.GetStock(ctx, "ITEM-OCC")
+		if err != nil {
+			t.Fatalf("failed to get stock: %v", err)
+		}
+		if after.Available != before.Available || after.Reserved != before.Reserved {
+			t.Fatalf("expected the worker to release its reservation, stock went from %+v to %+v", before, after)
+		}
+	})
+}
+
+func TestCustomerOrders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := orders.NewOrderRepository(ordersDB)
+	handler := orders.NewHandler(repo, nil, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /customers/{customerId}/orders", handler.HandleListByCustomer)
+	mux.HandleFunc("GET /customers/{customerId}/summary", handler.HandleCustomerSummary)
+
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	var created []domain.Order
+	for i, total := range []int64{1000, 2500, 400} {
+		order := &domain.Order{
+			CustomerID: "cust-storefront",
+			Items:      []domain.OrderItem{{ItemID: "ITEM-001", Quantity: 1, Price: domain.NewMoney(total, "USD")}},
+			Total:      domain.NewMoney(total, "USD"),
+			Status:     domain.OrderStatusPending,
+			CreatedAt:  base.Add(time.Duration(i) * time.Hour),
+		}
+		if err := repo.Create(ctx, order, "test"); err != nil {
+			t.Fatalf("failed to create order: %v", err)
+		}
+		created = append(created, *order)
+	}
+
+	other := &domain.Order{
+		CustomerID: "cust-other",
+		Items:      []domain.OrderItem{{ItemID: "ITEM-001", Quantity: 1, Price: domain.NewMoney(9999, "USD")}},
+		Total:      domain.NewMoney(9999, "USD"),
+		Status:     domain.OrderStatusPending,
+		CreatedAt:  base.Add(time.Hour),
+	}
+	if err := repo.Create(ctx, other, "test"); err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+
+	if _, _, err := repo.UpdateStatus(ctx, created[1].ID, orders.StatusChange{Status: domain.OrderStatusCancelled}); err != nil {
+		t.Fatalf("failed to cancel order: %v", err)
+	}
+
+	type page struct {
+		Orders     []domain.Order `json:"orders"`
+		NextOffset *int           `json:"next_offset"`
+	}
+
+	list := func(query string) page {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/customers/cust-storefront/orders"+query, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var p page
+		if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+			t.Fatalf("failed to decode page: %v", err)
+		}
+		return p
+	}
+
+	t.Run("pages through orders newest first", func(t *testing.T) {
+		first := list("?limit=2")
+		if len(first.Orders) != 2 || first.Orders[0].ID != created[2].ID || first.Orders[1].ID != created[1].ID {
+			t.Fatalf("unexpected first page: %+v", first.Orders)
+		}
+		if first.NextOffset == nil || *first.NextOffset != 2 {
+			t.Fatalf("expected next_offset 2, got %v", first.NextOffset)
+		}
+		if len(first.Orders[0].Items) != 1 {
+			t.Fatalf("expected order items to be loaded, got %+v", first.Orders[0].Items)
+		}
+
+		second := list("?limit=2&offset=2")
+		if len(second.Orders) != 1 || second.Orders[0].ID != created[0].ID {
+			t.Fatalf("unexpected second page: %+v", second.Orders)
+		}
+		if second.NextOffset != nil {
+			t.Fatalf("expected no next_offset on the last page, got %d", *second.NextOffset)
+		}
+	})
+
+	t.Run("filters by status", func(t *testing.T) {
+		cancelled := list("?status=cancelled")
+		if len(cancelled.Orders) != 1 || cancelled.Orders[0].ID != created[1].ID {
+			t.Fatalf("expected only the cancelled order, got %+v", cancelled.Orders)
+		}
+
+		open := list("?status=pending,confirmed")
+		if len(open.Orders) != 2 {
+			t.Fatalf("expected 2 pending or confirmed orders, got %d", len(open.Orders))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/customers/cust-storefront/orders?status=lost", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for an unknown status, got %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("summarizes the customer's orders", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/customers/cust-storefront/summary", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var summary domain.CustomerSummary
+		if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+			t.Fatalf("failed to decode summary: %v", err)
+		}
+		if summary.OrderCount != 3 {
+			t.Errorf("expected 3 orders, got %d", summary.OrderCount)
+		}
+		if len(summary.LifetimeValue) != 1 || summary.LifetimeValue[0] != domain.NewMoney(1400, "USD") {
+			t.Errorf("expected lifetime value 1400 USD excluding the cancelled order, got %+v", summary.LifetimeValue)
+		}
+		if summary.LastOrderAt == nil || !summary.LastOrderAt.Equal(created[2].CreatedAt) {
+			t.Errorf("expected last order at %s, got %v", created[2].CreatedAt, summary.LastOrderAt)
+		}
+	})
+
+	t.Run("summarizes a customer without orders", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/customers/cust-new/summary", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var summary domain.CustomerSummary
+		if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+			t.Fatalf("failed to decode summary: %v", err)
+		}
+		if summary.OrderCount != 0 || len(summary.LifetimeValue) != 0 || summary.LastOrderAt != nil {
+			t.Errorf("expected an empty summary, got %+v", summary)
+		}
+	})
+}
+
+func TestOrderCurrencies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	repo := orders.NewOrderRepository(ordersDB)
+	handler := orders.NewHandler(repo, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	create := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.HandleCreate(rec, req)
+		return rec
+	}
+
+	t.Run("prices the order in its items' currency", func(t *testing.T) {
+		rec := create(`{"customer_id": "cust-eu", "currency": "EUR", "items": [{"item_id": "ITEM-001", "quantity": 3, "price": 250}, {"item_id": "ITEM-002", "quantity": 1, "price": 100, "currency": "EUR"}]}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+
+		var raw map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if raw["total"] != float64(850) || raw["currency"] != "EUR" {
+			t.Fatalf("expected total 850 and currency EUR as plain fields, got %v %v", raw["total"], raw["currency"])
+		}
+
+		var created domain.Order
+		if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+			t.Fatalf("failed to decode order: %v", err)
+		}
+
+		fetched, err := repo.GetByID(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("failed to fetch order: %v", err)
+		}
+		if fetched.Total != domain.NewMoney(850, "EUR") {
+			t.Fatalf("expected stored total 850 EUR, got %s", fetched.Total)
+		}
+		for _, item := range fetched.Items {
+			if item.Price.Currency != "EUR" {
+				t.Fatalf("expected item %s to be priced in EUR, got %s", item.ItemID, item.Price.Currency)
+			}
+		}
+	})
+
+	t.Run("rejects items in different currencies", func(t *testing.T) {
+		rec := create(`{"customer_id": "cust-mixed", "items": [{"item_id": "ITEM-001", "quantity": 1, "price": 100, "currency": "EUR"}, {"item_id": "ITEM-002", "quantity": 1, "price": 100, "currency": "GBP"}]}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("rejects an unknown currency code", func(t *testing.T) {
+		rec := create(`{"customer_id": "cust-bad", "currency": "euro", "items": [{"item_id": "ITEM-001", "quantity": 1, "price": 100}]}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("rejects a total that overflows", func(t *testing.T) {
+		rec := create(`{"customer_id": "cust-rich", "items": [{"item_id": "ITEM-001", "quantity": 4, "price": 4611686018427387904}]}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestOrderPricing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	repo := orders.NewOrderRepository(ordersDB)
+	handler := orders.NewHandler(repo, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", handler.HandleCreate)
+	mux.HandleFunc("POST /promo-codes", handler.HandleCreatePromoCode)
+	mux.HandleFunc("GET /promo-codes/{code}", handler.HandleGetPromoCode)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, body := range []string{
+		`{"code": "WIDGET10", "scope": "line", "item_id": "ITEM-A", "percent_off": 10}`,
+		`{"code": "SAVE5", "scope": "order", "amount_off": {"amount": 500, "currency": "USD"}, "max_uses": 1}`,
+		`{"code": "LASTYEAR", "scope": "order", "percent_off": 50, "valid_until": "2020-01-01T00:00:00Z"}`,
+		`{"code": "TENOFF", "scope": "order", "percent_off": 10}`,
+	} {
+		if rec := post("/promo-codes", body); rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := post("/promo-codes", `{"code": "SAVE5", "scope": "order", "percent_off": 5}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d for a duplicate code, got %d", http.StatusConflict, rec.Code)
+	}
+	if rec := post("/promo-codes", `{"code": "BOTH", "scope": "order", "percent_off": 5, "amount_off": {"amount": 100, "currency": "USD"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a code with two discounts, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	items := `"items": [{"item_id": "ITEM-A", "quantity": 2, "price": 1000}, {"item_id": "ITEM-B", "quantity": 1, "price": 3000}]`
+
+	t.Run("applies line discounts, tax and shipping", func(t *testing.T) {
+		recorder.Reset()
+
+		rec := post("/orders", `{"customer_id": "cust-pricing", "promo_code": "WIDGET10", "region": "US-CA", `+items+`}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+
+		var order domain.Order
+		if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+			t.Fatalf("failed to decode order: %v", err)
+		}
+
+		// 5000 subtotal, 10% off the 2000 of ITEM-A, 7.25% tax on 4800 and
+		// the 599 fee since 4800 is under the free shipping threshold.
+		want := map[string][2]int64{
+			"subtotal": {order.Subtotal.Amount, 5000},
+			"discount": {order.Discount.Amount, 200},
+			"tax":      {order.Tax.Amount, 348},
+			"shipping": {order.Shipping.Amount, 599},
+			"total":    {order.Total.Amount, 5747},
+		}
+		for name, v := range want {
+			if v[0] != v[1] {
+				t.Errorf("expected %s %d, got %d", name, v[1], v[0])
+			}
+		}
+
+		stored, err := repo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if stored.Total != order.Total || stored.Tax != order.Tax || stored.PromoCode != "WIDGET10" || stored.Region != "US-CA" {
+			t.Fatalf("stored pricing differs from the response: %+v", stored)
+		}
+		for _, item := range stored.Items {
+			wantDiscount := int64(0)
+			if item.ItemID == "ITEM-A" {
+				wantDiscount = 200
+			}
+			if item.Discount.Amount != wantDiscount {
+				t.Errorf("expected item %s discount %d, got %d", item.ItemID, wantDiscount, item.Discount.Amount)
+			}
+		}
+
+		parents := make(map[string]string)
+		for _, span := range recorder.Ended() {
+			if span.Parent().IsValid() {
+				parents[span.Name()] = span.Parent().SpanID().String()
+			}
+			if span.Name() == "price order" {
+				parents["root"] = span.SpanContext().SpanID().String()
+			}
+		}
+		for _, stage := range []string{"subtotal", "promo code", "line discounts", "order discount", "tax", "shipping", "total"} {
+			if parents["pricing "+stage] != parents["root"] || parents["root"] == "" {
+				t.Errorf("expected a %q span under the price order span", "pricing "+stage)
+			}
+		}
+	})
+
+	t.Run("limits promo code uses", func(t *testing.T) {
+		rec := post("/orders", `{"customer_id": "cust-pricing", "promo_code": "SAVE5", `+items+`}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+
+		var order domain.Order
+		if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+			t.Fatalf("failed to decode order: %v", err)
+		}
+		if order.Discount.Amount != 500 || order.Tax.Amount != 0 || order.Shipping.Amount != 0 || order.Total.Amount != 4500 {
+			t.Fatalf("expected 500 off a 5000 order without tax or shipping, got %+v", order)
+		}
+
+		if rec := post("/orders", `{"customer_id": "cust-pricing", "promo_code": "SAVE5", `+items+`}`); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for a used up code, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+
+		promo, err := repo.GetPromoCode(ctx, "SAVE5")
+		if err != nil {
+			t.Fatalf("failed to get promo code: %v", err)
+		}
+		if promo.Uses != 1 {
+			t.Fatalf("expected 1 use, got %d", promo.Uses)
+		}
+	})
+
+	t.Run("refunds each line's share of the order discount and tax", func(t *testing.T) {
+		rec := post("/orders", `{"customer_id": "cust-pricing", "promo_code": "TENOFF", "region": "US-CA", `+items+`}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+
+		var order domain.Order
+		if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+			t.Fatalf("failed to decode order: %v", err)
+		}
+		// 500 off 5000, 7.25% tax on 4500 and the 599 fee.
+		if order.Discount.Amount != 500 || order.Tax.Amount != 326 || order.Total.Amount != 5425 {
+			t.Fatalf("unexpected pricing: %+v", order)
+		}
+
+		if _, _, err := repo.UpdateStatus(ctx, order.ID, orders.StatusChange{Status: domain.OrderStatusConfirmed}); err != nil {
+			t.Fatalf("failed to confirm order: %v", err)
+		}
+		if _, _, err := repo.CreateShipment(ctx, &domain.Shipment{OrderID: order.ID, Carrier: "UPS", TrackingNumber: "1Z"}, "test"); err != nil {
+			t.Fatalf("failed to ship order: %v", err)
+		}
+
+		ret := &domain.Return{
+			OrderID: order.ID,
+			Items:   []domain.ReturnItem{{ItemID: "ITEM-A", Quantity: 1}, {ItemID: "ITEM-B", Quantity: 1}},
+		}
+		if _, _, err := repo.CreateReturn(ctx, ret); err != nil {
+			t.Fatalf("failed to create return: %v", err)
+		}
+		for _, status := range []domain.ReturnStatus{domain.ReturnStatusReceived, domain.ReturnStatusRefunded} {
+			if _, _, err := repo.UpdateReturnStatus(ctx, order.ID, ret.ID, status); err != nil {
+				t.Fatalf("failed to mark return %s: %v", status, err)
+			}
+		}
+
+		refunded, err := repo.GetReturn(ctx, order.ID, ret.ID)
+		if err != nil {
+			t.Fatalf("failed to get return: %v", err)
+		}
+		// The 4826 paid before shipping, split 2000:3000 between the lines:
+		// half of 1930.4 for one ITEM-A rounds to 965 and 2895.6 for the
+		// ITEM-B rounds to 2896.
+		if refunded.RefundAmount == nil || *refunded.RefundAmount != domain.NewMoney(3861, "USD") {
+			t.Fatalf("expected a refund of 3861 USD, got %v", refunded.RefundAmount)
+		}
+	})
+
+	t.Run("rejects invalid promo codes and regions", func(t *testing.T) {
+		for _, body := range []string{
+			`{"customer_id": "cust-pricing", "promo_code": "LASTYEAR", ` + items + `}`,
+			`{"customer_id": "cust-pricing", "promo_code": "NOPE", ` + items + `}`,
+			`{"customer_id": "cust-pricing", "region": "MARS", ` + items + `}`,
+			`{"customer_id": "cust-pricing", "region": "DE", ` + items + `}`,
+			`{"customer_id": "cust-pricing", "promo_code": "WIDGET10", "items": [{"item_id": "ITEM-B", "quantity": 1, "price": 3000}]}`,
+		} {
+			if rec := post("/orders", body); rec.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d for %s, got %d: %s", http.StatusBadRequest, body, rec.Code, rec.Body.String())
+			}
+		}
+	})
+}
+
+func TestKafkaConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	brokers, cleanup := SetupKafka(ctx, t)
+	defer cleanup()
+
+	if len(brokers) == 0 {
+		t.Fatal("expected at least one broker")
+	}
+
+	t.Logf("kafka brokers: %v", brokers)
+}
+
+type emailCapture struct {
+	mu     sync.Mutex
+	emails []map[string]string
+}
+
+func (e *emailCapture) handler(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	e.emails = append(e.emails, req)
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, `{"status":"sent"}`)
+}
+
+func (e *emailCapture) getEmails() []map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]map[string]string, len(e.emails))
+	copy(result, e.emails)
+	return result
+}
+
+func TestOrderFlowWithSufficientStock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	ordersRepo := orders.NewOrderRepository(ordersDB)
+	ordersHandler := orders.NewHandler(ordersRepo, nil, logger)
+	ordersMux := http.NewServeMux()
+	ordersMux.HandleFunc("POST /orders", ordersHandler.HandleCreate)
+	ordersMux.HandleFunc("GET /orders/{id}", ordersHandler.HandleGet)
+	ordersMux.HandleFunc("PATCH /orders/{id}/status", ordersHandler.HandleUpdateStatus)
+	ordersServer := httptest.NewServer(ordersMux)
+	defer ordersServer.Close()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	inventoryMux := http.NewServeMux()
+	inventoryMux.HandleFunc("GET /stock/{itemId}", inventoryHandler.HandleGetStock)
+	inventoryMux.HandleFunc("POST /stock/{itemId}/reserve", inventoryHandler.HandleReserve)
+	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
+	inventoryServer := httptest.NewServer(inventoryMux)
+	defer inventoryServer.Close()
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	notificationHandler := worker.NewNotificationHandler(
+		emailServer.URL,
+		ordersServer.URL,
+		inventoryServer.URL,
+		httpClient,
+		logger,
+	)
+
+	initialStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	if err != nil {
+		t.Fatalf("failed to get initial stock: %v", err)
+	}
+	initialAvailable := initialStock.Available
+
+	reqBody := `{"customer_id": "cust-123", "items": [{"item_id": "ITEM-001", "quantity": 5, "price": 1000}]}`
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ordersHandler.HandleCreate(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var createdOrder domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&createdOrder); err != nil {
+		t.Fatalf("failed to decode order: %v", err)
+	}
+
+	event := domain.OrderCreatedEvent{
+		OrderID:    createdOrder.ID,
+		CustomerID: createdOrder.CustomerID,
+		Items:      createdOrder.Items,
+		Timestamp:  createdOrder.CreatedAt,
+	}
+	eventPayload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+
+	if err := notificationHandler.Handle(ctx, eventPayload); err != nil {
+		t.Fatalf("worker handler failed: %v", err)
+	}
+
+	finalOrder, err := ordersRepo.GetByID(ctx, createdOrder.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+
+	if finalOrder.Status != domain.OrderStatusConfirmed {
+		t.Fatalf("expected order status %s, got %s", domain.OrderStatusConfirmed, finalOrder.Status)
+	}
+
+	allocations := finalOrder.Items[0].Allocations
+	if len(allocations) != 1 || allocations[0].LocationID != "WH-MAIN" || allocations[0].Quantity != 5 {
+		t.Fatalf("expected the line item to be allocated from WH-MAIN, got %+v", allocations)
+	}
+
+	finalStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	if err != nil {
+		t.Fatalf("failed to get final stock: %v", err)
+	}
+
+	expectedAvailable := initialAvailable - 5
+	if finalStock.Available != expectedAvailable {
+		t.Fatalf("expected available stock %d, got %d", expectedAvailable, finalStock.Available)
+	}
+	if finalStock.Reserved != 5 {
+		t.Fatalf("expected reserved stock 5, got %d", finalStock.Reserved)
+	}
+
+	emails := emailCap.getEmails()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+
+	email := emails[0]
+	if !strings.Contains(email["subject"], "Confirmation") {
+		t.Fatalf("expected confirmation email, got subject: %s", email["subject"])
+	}
+	if !strings.Contains(email["subject"], createdOrder.ID) {
+		t.Fatalf("expected email subject to contain order ID %s, got: %s", createdOrder.ID, email["subject"])
+	}
+}
+
+func TestOrderFlowWithInsufficientStock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	ordersRepo := orders.NewOrderRepository(ordersDB)
+	ordersHandler := orders.NewHandler(ordersRepo, nil, logger)
+	ordersMux := http.NewServeMux()
+	ordersMux.HandleFunc("POST /orders", ordersHandler.HandleCreate)
+	ordersMux.HandleFunc("GET /orders/{id}", ordersHandler.HandleGet)
+	ordersMux.HandleFunc("PATCH /orders/{id}/status", ordersHandler.HandleUpdateStatus)
+	ordersServer := httptest.NewServer(ordersMux)
+	defer ordersServer.Close()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	inventoryMux := http.NewServeMux()
+	inventoryMux.HandleFunc("GET /stock/{itemId}", inventoryHandler.HandleGetStock)
+	inventoryMux.HandleFunc("POST /stock/{itemId}/reserve", inventoryHandler.HandleReserve)
+	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
+	inventoryServer := httptest.NewServer(inventoryMux)
+	defer inventoryServer.Close()
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	notificationHandler := worker.NewNotificationHandler(
+		emailServer.URL,
+		ordersServer.URL,
+		inventoryServer.URL,
+		httpClient,
+		logger,
+	)
+
+	initialStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	if err != nil {
+		t.Fatalf("failed to get initial stock: %v", err)
+	}
+	initialAvailable := initialStock.Available
+	initialReserved := initialStock.Reserved
+
+	reqBody := `{"customer_id": "cust-456", "items": [{"item_id": "ITEM-001", "quantity": 9999, "price": 1000}]}`
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ordersHandler.HandleCreate(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var createdOrder domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&createdOrder); err != nil {
+		t.Fatalf("failed to decode order: %v", err)
+	}
+
+	event := domain.OrderCreatedEvent{
+		OrderID:    createdOrder.ID,
+		CustomerID: createdOrder.CustomerID,
+		Items:      createdOrder.Items,
+		Timestamp:  createdOrder.CreatedAt,
+	}
+	eventPayload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+
+	if err := notificationHandler.Handle(ctx, eventPayload); err != nil {
+		t.Fatalf("worker handler failed: %v", err)
+	}
+
+	finalOrder, err := ordersRepo.GetByID(ctx, createdOrder.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+
+	if finalOrder.Status != domain.OrderStatusCancelled {
+		t.Fatalf("expected order status %s, got %s", domain.OrderStatusCancelled, finalOrder.Status)
+	}
+
+	finalStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	if err != nil {
+		t.Fatalf("failed to get final stock: %v", err)
+	}
+
+	if finalStock.Available != initialAvailable {
+		t.Fatalf("expected available stock unchanged at %d, got %d", initialAvailable, finalStock.Available)
+	}
+	if finalStock.Reserved != initialReserved {
+		t.Fatalf("expected reserved stock unchanged at %d, got %d", initialReserved, finalStock.Reserved)
+	}
+
+	emails := emailCap.getEmails()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+
+	email := emails[0]
+	if !strings.Contains(email["subject"], "Cancelled") {
+		t.Fatalf("expected cancellation email, got subject: %s", email["subject"])
+	}
+	if !strings.Contains(email["body"], "reimbursed") {
+		t.Fatalf("expected email body to mention reimbursement, got: %s", email["body"])
+	}
+
+	history, err := ordersRepo.History(ctx, createdOrder.ID)
+	if err != nil {
+		t.Fatalf("failed to get order history: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 history entries, got %+v", history)
+	}
+	cancellation := history[1]
+	if cancellation.FromStatus != domain.OrderStatusPending || cancellation.ToStatus != domain.OrderStatusCancelled {
+		t.Fatalf("expected pending -> cancelled, got %s -> %s", cancellation.FromStatus, cancellation.ToStatus)
+	}
+	if cancellation.Actor != "worker" || !strings.Contains(cancellation.Reason, "insufficient stock") {
+		t.Fatalf("expected the worker to record the stock shortfall, got %+v", cancellation)
+	}
+}
+
+func TestOrderFlowWithBackorder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	ordersRepo := orders.NewOrderRepository(ordersDB)
+	ordersHandler := orders.NewHandler(ordersRepo, nil, logger)
+	ordersMux := http.NewServeMux()
+	ordersMux.HandleFunc("POST /orders", ordersHandler.HandleCreate)
+	ordersMux.HandleFunc("GET /orders/{id}", ordersHandler.HandleGet)
+	ordersMux.HandleFunc("PATCH /orders/{id}/status", ordersHandler.HandleUpdateStatus)
+	ordersServer := httptest.NewServer(ordersMux)
+	defer ordersServer.Close()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	inventoryMux := http.NewServeMux()
+	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /stock/{itemId}/restock", inventoryHandler.HandleRestock)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
+	inventoryMux.HandleFunc("POST /backorders", inventoryHandler.HandleCreateBackorder)
+	inventoryMux.HandleFunc("POST /backorders/{orderId}/cancel", inventoryHandler.HandleCancelBackorder)
+	inventoryServer := httptest.NewServer(inventoryMux)
+	defer inventoryServer.Close()
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	notificationHandler := worker.NewNotificationHandler(
+		emailServer.URL,
+		ordersServer.URL,
+		inventoryServer.URL,
+		httpClient,
+		logger,
+	)
+
+	if err := inventoryRepo.CreateItem(ctx, domain.Item{ItemID: "ITEM-BO", Name: "Backordered Widget"}, 0, "", "test"); err != nil {
+		t.Fatalf("failed to create item: %v", err)
+	}
+
+	placeOrder := func(customerID string, quantity int, allowBackorder bool) domain.Order {
+		t.Helper()
+		body := fmt.Sprintf(`{"customer_id": %q, "allow_backorder": %t, "items": [{"item_id": "ITEM-BO", "quantity": %d, "price": 500}]}`,
+			customerID, allowBackorder, quantity)
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		ordersHandler.HandleCreate(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+
+		var order domain.Order
+		if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+			t.Fatalf("failed to decode order: %v", err)
+		}
+
+		payload, err := json.Marshal(domain.OrderCreatedEvent{
+			OrderID:        order.ID,
+			CustomerID:     order.CustomerID,
+			Items:          order.Items,
+			AllowBackorder: order.AllowBackorder,
+			Timestamp:      order.CreatedAt,
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal event: %v", err)
+		}
+		if err := notificationHandler.Handle(ctx, payload); err != nil {
+			t.Fatalf("worker handler failed: %v", err)
+		}
+		return order
+	}
+
+	statusOf := func(orderID string) domain.OrderStatus {
+		t.Helper()
+		order, err := ordersRepo.GetByID(ctx, orderID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		return order.Status
+	}
+
+	restock := func(quantity int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/stock/ITEM-BO/restock", strings.NewReader(fmt.Sprintf(`{"quantity": %d}`, quantity)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		inventoryMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("restock: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+
+	// deliverFilled feeds queued backorder_filled events to the worker, in
+	// the order the relay would publish them.
+	deliverFilled := func() int {
+		t.Helper()
+		rows, err := inventoryDB.QueryContext(ctx, `
+			SELECT payload FROM outbox
+			WHERE topic = $1 AND published_at IS NULL
+			ORDER BY id
+		`, domain.TopicStockBackorderFilled)
+		if err != nil {
+			t.Fatalf("failed to read outbox: %v", err)
+		}
+		var payloads [][]byte
+		for rows.Next() {
+			var payload []byte
+			if err := rows.Scan(&payload); err != nil {
+				t.Fatalf("failed to scan outbox: %v", err)
+			}
+			payloads = append(payloads, payload)
+		}
+		_ = rows.Close()
+
+		for _, payload := range payloads {
+			if err := notificationHandler.HandleBackorderFilled(ctx, payload); err != nil {
+				t.Fatalf("worker backorder handler failed: %v", err)
+			}
+		}
+		if _, err := inventoryDB.ExecContext(ctx, `UPDATE outbox SET published_at = NOW() WHERE published_at IS NULL`); err != nil {
+			t.Fatalf("failed to mark outbox published: %v", err)
+		}
+		return len(payloads)
+	}
+
+	first := placeOrder("cust-first", 4, true)
+	second := placeOrder("cust-second", 1, true)
+	rejected := placeOrder("cust-impatient", 1, false)
+
+	if got := statusOf(first.ID); got != domain.OrderStatusBackordered {
+		t.Fatalf("expected first order to be backordered, got %s", got)
+	}
+	if got := statusOf(rejected.ID); got != domain.OrderStatusCancelled {
+		t.Fatalf("expected order without backorder to be cancelled, got %s", got)
+	}
+
+	queue, err := inventoryRepo.ListBackorders(ctx, "ITEM-BO")
+	if err != nil {
+		t.Fatalf("failed to list backorders: %v", err)
+	}
+	if len(queue) != 2 || queue[0].OrderID != first.ID || queue[1].OrderID != second.ID {
+		t.Fatalf("expected both backorders queued in order, got %+v", queue)
+	}
+
+	// Three units would cover the second order, but it must not jump ahead of
+	// the first.
+	restock(3)
+	if n := deliverFilled(); n != 0 {
+		t.Fatalf("expected no backorder to be filled, got %d", n)
+	}
+	if got := statusOf(second.ID); got != domain.OrderStatusBackordered {
+		t.Fatalf("expected second order to stay backordered, got %s", got)
+	}
+
+	restock(2)
+	if n := deliverFilled(); n != 2 {
+		t.Fatalf("expected both backorders to be filled, got %d", n)
+	}
+
+	for _, order := range []domain.Order{first, second} {
+		confirmed, err := ordersRepo.GetByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("failed to get order: %v", err)
+		}
+		if confirmed.Status != domain.OrderStatusConfirmed {
+			t.Fatalf("expected order %s to be confirmed, got %s", order.ID, confirmed.Status)
+		}
+		if len(confirmed.Items[0].Allocations) == 0 {
+			t.Fatalf("expected allocations on confirmed backorder %s", order.ID)
+		}
+	}
+
+	stock, err := inventoryRepo.GetStock(ctx, "ITEM-BO")
+	if err != nil {
+		t.Fatalf("failed to get stock: %v", err)
+	}
+	if stock.Available != 0 || stock.Reserved != 5 {
+		t.Fatalf("expected all restocked units reserved, got %+v", stock)
+	}
+
+	subjects := make([]string, 0)
+	for _, email := range emailCap.getEmails() {
+		subjects = append(subjects, email["subject"])
+	}
+	joined := strings.Join(subjects, "\n")
+	if strings.Count(joined, "Order Backordered") != 2 || strings.Count(joined, "Order Confirmation") != 2 {
+		t.Fatalf("expected two backordered and two confirmation emails, got:\n%s", joined)
+	}
+}
+
+func TestOrderShipment(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	ordersRepo := orders.NewOrderRepository(ordersDB)
+	ordersHandler := orders.NewHandler(ordersRepo, nil, logger)
+	ordersMux := http.NewServeMux()
+	ordersMux.HandleFunc("POST /orders", ordersHandler.HandleCreate)
+	ordersMux.HandleFunc("GET /orders/{id}", ordersHandler.HandleGet)
+	ordersMux.HandleFunc("PATCH /orders/{id}/status", ordersHandler.HandleUpdateStatus)
+	ordersMux.HandleFunc("POST /orders/{id}/cancel", ordersHandler.HandleCancel)
+	ordersMux.HandleFunc("POST /orders/{id}/shipments", ordersHandler.HandleCreateShipment)
+	ordersServer := httptest.NewServer(ordersMux)
+	defer ordersServer.Close()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	inventoryMux := http.NewServeMux()
+	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/commit", inventoryHandler.HandleCommitReservations)
+	inventoryServer := httptest.NewServer(inventoryMux)
+	defer inventoryServer.Close()
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	notificationHandler := worker.NewNotificationHandler(
+		emailServer.URL,
+		ordersServer.URL,
+		inventoryServer.URL,
+		httpClient,
+		logger,
+	)
+
+	if err := inventoryRepo.CreateItem(ctx, domain.Item{ItemID: "ITEM-SHIP-A", Name: "Shipping Widget"}, 10, "", "test"); err != nil {
+		t.Fatalf("failed to create item: %v", err)
+	}
+	if err := inventoryRepo.CreateItem(ctx, domain.Item{ItemID: "ITEM-SHIP-B", Name: "Shipping Gadget"}, 10, "", "test"); err != nil {
+		t.Fatalf("failed to create item: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{
+		"customer_id": "cust-ship",
+		"items": [
+			{"item_id": "ITEM-SHIP-A", "quantity": 3, "price": 1000},
+			{"item_id": "ITEM-SHIP-B", "quantity": 2, "price": 500}
+		]
+	}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ordersHandler.HandleCreate(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var order domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode order: %v", err)
+	}
+
+	ship := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/shipments", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := ship(`{"carrier": "UPS", "tracking_number": "1Z000"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected a pending order not to ship, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	payload, err := json.Marshal(domain.OrderCreatedEvent{
+		OrderID:    order.ID,
+		CustomerID: order.CustomerID,
+		Items:      order.Items,
+		Timestamp:  order.CreatedAt,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	if err := notificationHandler.Handle(ctx, payload); err != nil {
+		t.Fatalf("worker handler failed: %v", err)
+	}
+
+	if rec := ship(`{"carrier": "UPS", "tracking_number": "1Z001", "items": [{"item_id": "ITEM-SHIP-A", "quantity": 4}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected shipping more than ordered to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := ship(`{"carrier": "UPS", "tracking_number": "1Z002", "items": [{"item_id": "ITEM-SHIP-A", "quantity": 3}]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	partial, err := ordersRepo.GetByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+	if partial.Status != domain.OrderStatusConfirmed {
+		t.Fatalf("expected partially shipped order to stay confirmed, got %s", partial.Status)
+	}
+
+	cancelReq := httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/cancel", nil)
+	cancelRec := httptest.NewRecorder()
+	ordersMux.ServeHTTP(cancelRec, cancelReq)
+	if cancelRec.Code != http.StatusConflict {
+		t.Fatalf("expected cancelling a partially shipped order to fail, got %d: %s", cancelRec.Code, cancelRec.Body.String())
+	}
+
+	if rec := ship(`{"carrier": "FedEx", "tracking_number": "FX100"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	shipped, err := ordersRepo.GetByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+	if shipped.Status != domain.OrderStatusShipped {
+		t.Fatalf("expected order to be shipped, got %s", shipped.Status)
+	}
+
+	shipments, err := ordersRepo.ListShipments(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to list shipments: %v", err)
+	}
+	if len(shipments) != 2 || shipments[1].Items[0].ItemID != "ITEM-SHIP-B" || shipments[1].Items[0].Quantity != 2 {
+		t.Fatalf("expected the second shipment to carry the rest of the order, got %+v", shipments)
+	}
+
+	var shippedPayload []byte
+	err = ordersDB.QueryRowContext(ctx, `
+		SELECT payload FROM outbox WHERE topic = $1 AND message_key = $2
+	`, domain.TopicOrderShipped, order.ID).Scan(&shippedPayload)
+	if err != nil {
+		t.Fatalf("failed to read order shipped event: %v", err)
+	}
+
+	var shippedEvent domain.OrderShippedEvent
+	if err := json.Unmarshal(shippedPayload, &shippedEvent); err != nil {
+		t.Fatalf("failed to decode order shipped event: %v", err)
+	}
+	if shippedEvent.CustomerID != order.CustomerID || len(shippedEvent.Shipments) != 2 {
+		t.Fatalf("expected the shipped event to list both shipments, got %+v", shippedEvent)
+	}
+
+	// Delivering the event twice must not commit the stock twice.
+	for range 2 {
+		if err := notificationHandler.HandleOrderShipped(ctx, shippedPayload); err != nil {
+			t.Fatalf("worker shipped handler failed: %v", err)
+		}
+	}
+
+	for itemID, want := range map[string]int{"ITEM-SHIP-A": 7, "ITEM-SHIP-B": 8} {
+		stock, err := inventoryRepo.GetStock(ctx, itemID)
+		if err != nil {
+			t.Fatalf("failed to get stock: %v", err)
+		}
+		if stock.Available != want || stock.Reserved != 0 {
+			t.Fatalf("expected %s to have %d available and none reserved, got %+v", itemID, want, stock)
+		}
+	}
+
+	movements, err := inventoryRepo.ListMovements(ctx, "ITEM-SHIP-A", 0, 10)
+	if err != nil {
+		t.Fatalf("failed to list movements: %v", err)
+	}
+	if movements[0].Reason != inventory.ReasonShip || movements[0].ReservedDelta != -3 || movements[0].AvailableDelta != 0 {
+		t.Fatalf("expected a ship movement committing 3 reserved units, got %+v", movements[0])
+	}
+
+	var shippingEmail map[string]string
+	for _, email := range emailCap.getEmails() {
+		if strings.HasPrefix(email["subject"], "Order Shipped") {
+			shippingEmail = email
+		}
+	}
+	if shippingEmail == nil || !strings.Contains(shippingEmail["body"], "FX100") {
+		t.Fatalf("expected a shipping email with tracking numbers, got %v", emailCap.getEmails())
+	}
+}
+
+func TestReturnsAndRefunds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	pg := SetupPostgres(ctx, t)
+	defer pg.Cleanup()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
+	if err != nil {
+		t.Fatalf("failed to create orders DB: %v", err)
+	}
+	defer func() { _ = ordersDB.Close() }()
+
+	ordersRepo := orders.NewOrderRepository(ordersDB)
+	ordersHandler := orders.NewHandler(ordersRepo, nil, logger)
+	ordersMux := http.NewServeMux()
+	ordersMux.HandleFunc("POST /orders/{id}/returns", ordersHandler.HandleCreateReturn)
+	ordersMux.HandleFunc("POST /orders/{id}/returns/{returnId}/receive", ordersHandler.HandleReceiveReturn)
+	ordersMux.HandleFunc("POST /orders/{id}/returns/{returnId}/refund", ordersHandler.HandleRefundReturn)
+	ordersServer := httptest.NewServer(ordersMux)
+	defer ordersServer.Close()
+
+	inventoryDB, err := DBWithSchema(pg.ConnStr, "inventory")
+	if err != nil {
+		t.Fatalf("failed to create inventory DB: %v", err)
+	}
+	defer func() { _ = inventoryDB.Close() }()
+
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	inventoryMux := http.NewServeMux()
+	inventoryMux.HandleFunc("POST /returns", inventoryHandler.HandleReceiveReturn)
+	inventoryServer := httptest.NewServer(inventoryMux)
+	defer inventoryServer.Close()
+
+	emailCap := &emailCapture{}
+	emailMux := http.NewServeMux()
+	emailMux.HandleFunc("POST /send", emailCap.handler)
+	emailServer := httptest.NewServer(emailMux)
+	defer emailServer.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	notificationHandler := worker.NewNotificationHandler(
+		emailServer.URL,
+		ordersServer.URL,
+		inventoryServer.URL,
+		httpClient,
+		logger,
+	)
+
+	if err := inventoryRepo.CreateItem(ctx, domain.Item{ItemID: "ITEM-RET", Name: "Returnable Widget"}, 5, "", "test"); err != nil {
+		t.Fatalf("failed to create item: %v", err)
 	}
 
-	if updatedStock.Available != 90 {
-		t.Fatalf("expected available stock 90 after reserve, got %d", updatedStock.Available)
+	order := &domain.Order{
+		CustomerID: "cust-return",
+		Items: []domain.OrderItem{
+			{ItemID: "ITEM-RET", Quantity: 3, Price: domain.NewMoney(1000, "USD")},
+		},
+		Total:     domain.NewMoney(3000, "USD"),
+		Status:    domain.OrderStatusConfirmed,
+		CreatedAt: time.Now().UTC(),
 	}
-	if updatedStock.Reserved != 10 {
-		t.Fatalf("expected reserved stock 10 after reserve, got %d", updatedStock.Reserved)
+	if err := ordersRepo.Create(ctx, order, "test"); err != nil {
+		t.Fatalf("failed to create order: %v", err)
 	}
-}
 
-func TestListOrders(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		ordersMux.ServeHTTP(rec, req)
+		return rec
+	}
 
-	pg := SetupPostgres(ctx, t)
-	defer pg.Cleanup()
+	returnBody := `{"reason": "too big", "items": [{"item_id": "ITEM-RET", "quantity": 2}]}`
+	if rec := post("/orders/"+order.ID+"/returns", returnBody); rec.Code != http.StatusConflict {
+		t.Fatalf("expected an unshipped order to refuse returns, got %d: %s", rec.Code, rec.Body.String())
+	}
 
-	ordersDB, err := DBWithSchema(pg.ConnStr, "orders")
-	if err != nil {
-		t.Fatalf("failed to create orders DB: %v", err)
+	if _, _, err := ordersRepo.CreateShipment(ctx, &domain.Shipment{OrderID: order.ID, Carrier: "UPS", TrackingNumber: "1Z"}, "test"); err != nil {
+		t.Fatalf("failed to ship order: %v", err)
 	}
-	defer func() { _ = ordersDB.Close() }()
 
-	repo := orders.NewOrderRepository(ordersDB)
-	logger := slog.Default()
-	handler := orders.NewHandler(repo, nil, logger)
+	rec := post("/orders/"+order.ID+"/returns", returnBody)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
 
-	for i := 1; i <= 3; i++ {
-		order := &domain.Order{
-			CustomerID: "list-test-customer",
-			Items: []domain.OrderItem{
-				{ItemID: "ITEM-001", Quantity: 1, Price: 1000},
-			},
-			Total:     1000,
-			Status:    domain.OrderStatusPending,
-			CreatedAt: time.Now().UTC(),
-		}
-		if err := repo.Create(ctx, order); err != nil {
-			t.Fatalf("failed to create order %d: %v", i, err)
-		}
+	var ret domain.Return
+	if err := json.NewDecoder(rec.Body).Decode(&ret); err != nil {
+		t.Fatalf("failed to decode return: %v", err)
+	}
+	if ret.Status != domain.ReturnStatusRequested {
+		t.Fatalf("expected return to be requested, got %s", ret.Status)
 	}
 
-	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
-	rec := httptest.NewRecorder()
+	if rec := post("/orders/"+order.ID+"/returns", returnBody); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected returning more than was ordered to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
 
-	handler.HandleList(rec, req)
+	if rec := post("/orders/"+order.ID+"/returns/"+ret.ID+"/refund", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("expected refunding a return that was not received to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
 
-	if rec.Code != http.StatusOK {
-		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	// event reads the event the orders service queued when the return
+	// reached status.
+	event := func(status domain.ReturnStatus) []byte {
+		t.Helper()
+		var payload []byte
+		err := ordersDB.QueryRowContext(ctx, `
+			SELECT payload FROM outbox
+			WHERE message_key = $1 AND payload->>'return_id' = $2 AND payload->>'status' = $3
+		`, order.ID, ret.ID, status).Scan(&payload)
+		if err != nil {
+			t.Fatalf("failed to read %s return event: %v", status, err)
+		}
+		return payload
 	}
 
-	var orderList []domain.Order
-	if err := json.NewDecoder(rec.Body).Decode(&orderList); err != nil {
-		t.Fatalf("failed to decode order list: %v", err)
+	if err := notificationHandler.HandleReturnRequested(ctx, event(domain.ReturnStatusRequested)); err != nil {
+		t.Fatalf("worker return requested handler failed: %v", err)
 	}
 
-	if len(orderList) != 3 {
-		t.Fatalf("expected 3 orders, got %d", len(orderList))
+	if rec := post("/orders/"+order.ID+"/returns/"+ret.ID+"/receive", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
 	}
 
-	for _, order := range orderList {
-		if order.CustomerID != "list-test-customer" {
-			t.Fatalf("unexpected customer_id: %s", order.CustomerID)
+	// A redelivered event must not restock the return twice.
+	received := event(domain.ReturnStatusReceived)
+	for range 2 {
+		if err := notificationHandler.HandleReturnReceived(ctx, received); err != nil {
+			t.Fatalf("worker return received handler failed: %v", err)
 		}
 	}
-}
-
-func TestKafkaConnection(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
 
-	brokers, cleanup := SetupKafka(ctx, t)
-	defer cleanup()
+	stock, err := inventoryRepo.GetStock(ctx, "ITEM-RET")
+	if err != nil {
+		t.Fatalf("failed to get stock: %v", err)
+	}
+	if stock.Available != 7 {
+		t.Fatalf("expected returned items back in stock once, got %d available", stock.Available)
+	}
 
-	if len(brokers) == 0 {
-		t.Fatal("expected at least one broker")
+	movements, err := inventoryRepo.ListMovements(ctx, "ITEM-RET", 0, 1)
+	if err != nil {
+		t.Fatalf("failed to list movements: %v", err)
+	}
+	if movements[0].Reason != inventory.ReasonReturn || movements[0].OrderID != order.ID || movements[0].AvailableDelta != 2 {
+		t.Fatalf("expected a return movement for the order, got %+v", movements[0])
 	}
 
-	t.Logf("kafka brokers: %v", brokers)
-}
+	var restocked []byte
+	err = inventoryDB.QueryRowContext(ctx, `
+		SELECT payload FROM outbox WHERE topic = $1
+	`, domain.TopicStockReturnRestocked).Scan(&restocked)
+	if err != nil {
+		t.Fatalf("failed to read return restocked event: %v", err)
+	}
 
-type emailCapture struct {
-	mu     sync.Mutex
-	emails []map[string]string
-}
+	if err := notificationHandler.HandleReturnRestocked(ctx, restocked); err != nil {
+		t.Fatalf("worker return restocked handler failed: %v", err)
+	}
 
-func (e *emailCapture) handler(w http.ResponseWriter, r *http.Request) {
-	var req map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
-		return
+	refunded := event(domain.ReturnStatusRefunded)
+	if err := notificationHandler.HandleReturnRefunded(ctx, refunded); err != nil {
+		t.Fatalf("worker return refunded handler failed: %v", err)
 	}
 
-	e.mu.Lock()
-	e.emails = append(e.emails, req)
-	e.mu.Unlock()
+	updated, err := ordersRepo.GetByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+	if updated.RefundedTotal != domain.NewMoney(2000, "USD") {
+		t.Fatalf("expected refunded total 2000, got %+v", updated.RefundedTotal)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, _ = io.WriteString(w, `{"status":"sent"}`)
-}
+	// Refunding again is a no-op.
+	if err := notificationHandler.HandleReturnRestocked(ctx, restocked); err != nil {
+		t.Fatalf("worker return restocked handler failed on redelivery: %v", err)
+	}
+	updated, err = ordersRepo.GetByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+	if updated.RefundedTotal != domain.NewMoney(2000, "USD") {
+		t.Fatalf("expected refunded total to stay 2000, got %+v", updated.RefundedTotal)
+	}
 
-func (e *emailCapture) getEmails() []map[string]string {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	result := make([]map[string]string, len(e.emails))
-	copy(result, e.emails)
-	return result
+	var subjects []string
+	var refundBody string
+	for _, email := range emailCap.getEmails() {
+		subjects = append(subjects, email["subject"])
+		if strings.HasPrefix(email["subject"], "Refund Issued") {
+			refundBody = email["body"]
+		}
+	}
+	joined := strings.Join(subjects, "\n")
+	for _, want := range []string{"Return Requested", "Return Received", "Refund Issued"} {
+		if !strings.Contains(joined, want) {
+			t.Fatalf("expected a %q email, got:\n%s", want, joined)
+		}
+	}
+	if !strings.Contains(refundBody, "20.00 USD") {
+		t.Fatalf("expected the refund email to state the amount, got %q", refundBody)
+	}
 }
 
-func TestOrderFlowWithSufficientStock(t *testing.T) {
+func TestOrderFlowWithPartialStockRollback(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
 
@@ -278,6 +2871,8 @@ func TestOrderFlowWithSufficientStock(t *testing.T) {
 	inventoryMux.HandleFunc("GET /stock/{itemId}", inventoryHandler.HandleGetStock)
 	inventoryMux.HandleFunc("POST /stock/{itemId}/reserve", inventoryHandler.HandleReserve)
 	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
 	inventoryServer := httptest.NewServer(inventoryMux)
 	defer inventoryServer.Close()
 
@@ -296,13 +2891,22 @@ func TestOrderFlowWithSufficientStock(t *testing.T) {
 		logger,
 	)
 
-	initialStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	initialStock1, err := inventoryRepo.GetStock(ctx, "ITEM-001")
 	if err != nil {
-		t.Fatalf("failed to get initial stock: %v", err)
+		t.Fatalf("failed to get initial stock for ITEM-001: %v", err)
+	}
+	initialStock2, err := inventoryRepo.GetStock(ctx, "ITEM-002")
+	if err != nil {
+		t.Fatalf("failed to get initial stock for ITEM-002: %v", err)
 	}
-	initialAvailable := initialStock.Available
 
-	reqBody := `{"customer_id": "cust-123", "items": [{"item_id": "ITEM-001", "quantity": 5, "price": 1000}]}`
+	reqBody := `{
+		"customer_id": "cust-789",
+		"items": [
+			{"item_id": "ITEM-001", "quantity": 5, "price": 1000},
+			{"item_id": "ITEM-002", "quantity": 9999, "price": 2000}
+		]
+	}`
 	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(reqBody))
 	req.Header.Set("Content-Type", "application/json")
 	rec := httptest.NewRecorder()
@@ -337,38 +2941,39 @@ func TestOrderFlowWithSufficientStock(t *testing.T) {
 		t.Fatalf("failed to get order: %v", err)
 	}
 
-	if finalOrder.Status != domain.OrderStatusConfirmed {
-		t.Fatalf("expected order status %s, got %s", domain.OrderStatusConfirmed, finalOrder.Status)
+	if finalOrder.Status != domain.OrderStatusCancelled {
+		t.Fatalf("expected order status %s, got %s", domain.OrderStatusCancelled, finalOrder.Status)
 	}
 
-	finalStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	finalStock1, err := inventoryRepo.GetStock(ctx, "ITEM-001")
 	if err != nil {
-		t.Fatalf("failed to get final stock: %v", err)
+		t.Fatalf("failed to get final stock for ITEM-001: %v", err)
+	}
+	finalStock2, err := inventoryRepo.GetStock(ctx, "ITEM-002")
+	if err != nil {
+		t.Fatalf("failed to get final stock for ITEM-002: %v", err)
 	}
 
-	expectedAvailable := initialAvailable - 5
-	if finalStock.Available != expectedAvailable {
-		t.Fatalf("expected available stock %d, got %d", expectedAvailable, finalStock.Available)
+	if finalStock1.Available != initialStock1.Available {
+		t.Fatalf("ITEM-001: expected available stock rolled back to %d, got %d", initialStock1.Available, finalStock1.Available)
 	}
-	if finalStock.Reserved != 5 {
-		t.Fatalf("expected reserved stock 5, got %d", finalStock.Reserved)
+	if finalStock1.Reserved != initialStock1.Reserved {
+		t.Fatalf("ITEM-001: expected reserved stock rolled back to %d, got %d", initialStock1.Reserved, finalStock1.Reserved)
 	}
 
-	emails := emailCap.getEmails()
-	if len(emails) != 1 {
-		t.Fatalf("expected 1 email, got %d", len(emails))
+	if finalStock2.Available != initialStock2.Available {
+		t.Fatalf("ITEM-002: expected available stock unchanged at %d, got %d", initialStock2.Available, finalStock2.Available)
 	}
-
-	email := emails[0]
-	if !strings.Contains(email["subject"], "Confirmation") {
-		t.Fatalf("expected confirmation email, got subject: %s", email["subject"])
+	if finalStock2.Reserved != initialStock2.Reserved {
+		t.Fatalf("ITEM-002: expected reserved stock unchanged at %d, got %d", initialStock2.Reserved, finalStock2.Reserved)
 	}
-	if !strings.Contains(email["subject"], createdOrder.ID) {
-		t.Fatalf("expected email subject to contain order ID %s, got: %s", createdOrder.ID, email["subject"])
+	emails := emailCap.getEmails()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 cancellation email, got %d", len(emails))
 	}
 }
 
-func TestOrderFlowWithInsufficientStock(t *testing.T) {
+func TestOrderCancellationReleasesStock(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
 
@@ -389,6 +2994,7 @@ func TestOrderFlowWithInsufficientStock(t *testing.T) {
 	ordersMux.HandleFunc("POST /orders", ordersHandler.HandleCreate)
 	ordersMux.HandleFunc("GET /orders/{id}", ordersHandler.HandleGet)
 	ordersMux.HandleFunc("PATCH /orders/{id}/status", ordersHandler.HandleUpdateStatus)
+	ordersMux.HandleFunc("POST /orders/{id}/cancel", ordersHandler.HandleCancel)
 	ordersServer := httptest.NewServer(ordersMux)
 	defer ordersServer.Close()
 
@@ -404,6 +3010,8 @@ func TestOrderFlowWithInsufficientStock(t *testing.T) {
 	inventoryMux.HandleFunc("GET /stock/{itemId}", inventoryHandler.HandleGetStock)
 	inventoryMux.HandleFunc("POST /stock/{itemId}/reserve", inventoryHandler.HandleReserve)
 	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", inventoryHandler.HandleConfirmReservations)
 	inventoryServer := httptest.NewServer(inventoryMux)
 	defer inventoryServer.Close()
 
@@ -422,18 +3030,16 @@ func TestOrderFlowWithInsufficientStock(t *testing.T) {
 		logger,
 	)
 
-	initialStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	initialStock, err := inventoryRepo.GetStock(ctx, "ITEM-003")
 	if err != nil {
 		t.Fatalf("failed to get initial stock: %v", err)
 	}
-	initialAvailable := initialStock.Available
-	initialReserved := initialStock.Reserved
 
-	reqBody := `{"customer_id": "cust-456", "items": [{"item_id": "ITEM-001", "quantity": 9999, "price": 1000}]}`
+	reqBody := `{"customer_id": "cust-cancel", "items": [{"item_id": "ITEM-003", "quantity": 4, "price": 500}]}`
 	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(reqBody))
 	req.Header.Set("Content-Type", "application/json")
 	rec := httptest.NewRecorder()
-	ordersHandler.HandleCreate(rec, req)
+	ordersMux.ServeHTTP(rec, req)
 
 	if rec.Code != http.StatusCreated {
 		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
@@ -444,57 +3050,88 @@ func TestOrderFlowWithInsufficientStock(t *testing.T) {
 		t.Fatalf("failed to decode order: %v", err)
 	}
 
-	event := domain.OrderCreatedEvent{
+	createdPayload, err := json.Marshal(domain.OrderCreatedEvent{
 		OrderID:    createdOrder.ID,
 		CustomerID: createdOrder.CustomerID,
 		Items:      createdOrder.Items,
 		Timestamp:  createdOrder.CreatedAt,
-	}
-	eventPayload, err := json.Marshal(event)
+	})
 	if err != nil {
 		t.Fatalf("failed to marshal event: %v", err)
 	}
 
-	if err := notificationHandler.Handle(ctx, eventPayload); err != nil {
+	if err := notificationHandler.Handle(ctx, createdPayload); err != nil {
 		t.Fatalf("worker handler failed: %v", err)
 	}
 
-	finalOrder, err := ordersRepo.GetByID(ctx, createdOrder.ID)
+	req = httptest.NewRequest(http.MethodPost, "/orders/"+createdOrder.ID+"/cancel", strings.NewReader(`{"reason": "changed my mind"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	ordersMux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var cancelledOrder domain.Order
+	if err := json.NewDecoder(rec.Body).Decode(&cancelledOrder); err != nil {
+		t.Fatalf("failed to decode order: %v", err)
+	}
+	if cancelledOrder.Status != domain.OrderStatusCancelled {
+		t.Fatalf("expected order status %s, got %s", domain.OrderStatusCancelled, cancelledOrder.Status)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/orders/"+createdOrder.ID+"/status", strings.NewReader(`{"status": "confirmed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	ordersMux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d when confirming a cancelled order, got %d", http.StatusConflict, rec.Code)
+	}
+
+	var cancelledPayload []byte
+	err = ordersDB.QueryRowContext(ctx, `
+		SELECT payload FROM outbox WHERE topic = $1 AND message_key = $2
+	`, domain.TopicOrderCancelled, createdOrder.ID).Scan(&cancelledPayload)
 	if err != nil {
-		t.Fatalf("failed to get order: %v", err)
+		t.Fatalf("failed to read order cancelled event: %v", err)
 	}
 
-	if finalOrder.Status != domain.OrderStatusCancelled {
-		t.Fatalf("expected order status %s, got %s", domain.OrderStatusCancelled, finalOrder.Status)
+	var cancelledEvent domain.OrderCancelledEvent
+	if err := json.Unmarshal(cancelledPayload, &cancelledEvent); err != nil {
+		t.Fatalf("failed to decode order cancelled event: %v", err)
+	}
+	if cancelledEvent.PreviousStatus != domain.OrderStatusConfirmed || cancelledEvent.Reason != "changed my mind" || len(cancelledEvent.Items) != 1 {
+		t.Fatalf("unexpected order cancelled event: %+v", cancelledEvent)
 	}
 
-	finalStock, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	if err := notificationHandler.HandleOrderCancelled(ctx, cancelledPayload); err != nil {
+		t.Fatalf("worker cancellation handler failed: %v", err)
+	}
+
+	finalStock, err := inventoryRepo.GetStock(ctx, "ITEM-003")
 	if err != nil {
 		t.Fatalf("failed to get final stock: %v", err)
 	}
 
-	if finalStock.Available != initialAvailable {
-		t.Fatalf("expected available stock unchanged at %d, got %d", initialAvailable, finalStock.Available)
+	if finalStock.Available != initialStock.Available {
+		t.Fatalf("expected available stock restored to %d, got %d", initialStock.Available, finalStock.Available)
 	}
-	if finalStock.Reserved != initialReserved {
-		t.Fatalf("expected reserved stock unchanged at %d, got %d", initialReserved, finalStock.Reserved)
+	if finalStock.Reserved != initialStock.Reserved {
+		t.Fatalf("expected reserved stock restored to %d, got %d", initialStock.Reserved, finalStock.Reserved)
 	}
 
 	emails := emailCap.getEmails()
-	if len(emails) != 1 {
-		t.Fatalf("expected 1 email, got %d", len(emails))
-	}
-
-	email := emails[0]
-	if !strings.Contains(email["subject"], "Cancelled") {
-		t.Fatalf("expected cancellation email, got subject: %s", email["subject"])
+	if len(emails) != 2 {
+		t.Fatalf("expected confirmation and cancellation emails, got %d", len(emails))
 	}
-	if !strings.Contains(email["body"], "reimbursed") {
-		t.Fatalf("expected email body to mention reimbursement, got: %s", email["body"])
+	if !strings.Contains(emails[1]["subject"], "Cancelled") {
+		t.Fatalf("expected cancellation email, got subject: %s", emails[1]["subject"])
 	}
 }
 
-func TestOrderFlowWithPartialStockRollback(t *testing.T) {
+func TestOrderCancelledWhenReservationExpiresBeforeConfirm(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
 
@@ -524,12 +3161,21 @@ func TestOrderFlowWithPartialStockRollback(t *testing.T) {
 	}
 	defer func() { _ = inventoryDB.Close() }()
 
-	inventoryRepo := inventory.NewInventoryRepository(inventoryDB)
+	inventoryRepo := inventory.NewInventoryRepository(inventoryDB, inventory.WithReservationTTL(50*time.Millisecond))
 	inventoryHandler := inventory.NewHandler(inventoryRepo, logger)
+	sweeper := inventory.NewSweeper(inventoryRepo, time.Minute, 100, logger)
 	inventoryMux := http.NewServeMux()
-	inventoryMux.HandleFunc("GET /stock/{itemId}", inventoryHandler.HandleGetStock)
-	inventoryMux.HandleFunc("POST /stock/{itemId}/reserve", inventoryHandler.HandleReserve)
 	inventoryMux.HandleFunc("POST /stock/{itemId}/release", inventoryHandler.HandleRelease)
+	inventoryMux.HandleFunc("POST /reservations", inventoryHandler.HandleCreateReservation)
+	// The worker is too slow: the sweeper releases the reservation before the
+	// confirmation arrives.
+	inventoryMux.HandleFunc("POST /reservations/{orderId}/confirm", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := sweeper.Sweep(r.Context()); err != nil {
+			t.Errorf("sweep failed: %v", err)
+		}
+		inventoryHandler.HandleConfirmReservations(w, r)
+	})
 	inventoryServer := httptest.NewServer(inventoryMux)
 	defer inventoryServer.Close()
 
@@ -539,35 +3185,24 @@ func TestOrderFlowWithPartialStockRollback(t *testing.T) {
 	emailServer := httptest.NewServer(emailMux)
 	defer emailServer.Close()
 
-	httpClient := &http.Client{Timeout: 10 * time.Second}
 	notificationHandler := worker.NewNotificationHandler(
 		emailServer.URL,
 		ordersServer.URL,
 		inventoryServer.URL,
-		httpClient,
+		&http.Client{Timeout: 10 * time.Second},
 		logger,
 	)
 
-	initialStock1, err := inventoryRepo.GetStock(ctx, "ITEM-001")
-	if err != nil {
-		t.Fatalf("failed to get initial stock for ITEM-001: %v", err)
-	}
-	initialStock2, err := inventoryRepo.GetStock(ctx, "ITEM-002")
+	initialStock, err := inventoryRepo.GetStock(ctx, "ITEM-008")
 	if err != nil {
-		t.Fatalf("failed to get initial stock for ITEM-002: %v", err)
+		t.Fatalf("failed to get initial stock: %v", err)
 	}
 
-	reqBody := `{
-		"customer_id": "cust-789",
-		"items": [
-			{"item_id": "ITEM-001", "quantity": 5, "price": 1000},
-			{"item_id": "ITEM-002", "quantity": 9999, "price": 2000}
-		]
-	}`
+	reqBody := `{"customer_id": "cust-expired", "items": [{"item_id": "ITEM-008", "quantity": 3, "price": 1500}]}`
 	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(reqBody))
 	req.Header.Set("Content-Type", "application/json")
 	rec := httptest.NewRecorder()
-	ordersHandler.HandleCreate(rec, req)
+	ordersMux.ServeHTTP(rec, req)
 
 	if rec.Code != http.StatusCreated {
 		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
@@ -578,54 +3213,45 @@ func TestOrderFlowWithPartialStockRollback(t *testing.T) {
 		t.Fatalf("failed to decode order: %v", err)
 	}
 
-	event := domain.OrderCreatedEvent{
+	payload, err := json.Marshal(domain.OrderCreatedEvent{
 		OrderID:    createdOrder.ID,
 		CustomerID: createdOrder.CustomerID,
 		Items:      createdOrder.Items,
 		Timestamp:  createdOrder.CreatedAt,
-	}
-	eventPayload, err := json.Marshal(event)
+	})
 	if err != nil {
 		t.Fatalf("failed to marshal event: %v", err)
 	}
 
-	if err := notificationHandler.Handle(ctx, eventPayload); err != nil {
+	if err := notificationHandler.Handle(ctx, payload); err != nil {
 		t.Fatalf("worker handler failed: %v", err)
 	}
 
-	finalOrder, err := ordersRepo.GetByID(ctx, createdOrder.ID)
+	order, err := ordersRepo.GetByID(ctx, createdOrder.ID)
 	if err != nil {
 		t.Fatalf("failed to get order: %v", err)
 	}
-
-	if finalOrder.Status != domain.OrderStatusCancelled {
-		t.Fatalf("expected order status %s, got %s", domain.OrderStatusCancelled, finalOrder.Status)
+	if order.Status != domain.OrderStatusCancelled {
+		t.Fatalf("expected an order whose reservation expired to be cancelled, got %s", order.Status)
 	}
 
-	finalStock1, err := inventoryRepo.GetStock(ctx, "ITEM-001")
+	finalStock, err := inventoryRepo.GetStock(ctx, "ITEM-008")
 	if err != nil {
-		t.Fatalf("failed to get final stock for ITEM-001: %v", err)
+		t.Fatalf("failed to get final stock: %v", err)
 	}
-	finalStock2, err := inventoryRepo.GetStock(ctx, "ITEM-002")
-	if err != nil {
-		t.Fatalf("failed to get final stock for ITEM-002: %v", err)
+	if finalStock.Available != initialStock.Available || finalStock.Reserved != initialStock.Reserved {
+		t.Fatalf("expected stock back at %d/%d, got %d/%d", initialStock.Available, initialStock.Reserved, finalStock.Available, finalStock.Reserved)
 	}
 
-	if finalStock1.Available != initialStock1.Available {
-		t.Fatalf("ITEM-001: expected available stock rolled back to %d, got %d", initialStock1.Available, finalStock1.Available)
-	}
-	if finalStock1.Reserved != initialStock1.Reserved {
-		t.Fatalf("ITEM-001: expected reserved stock rolled back to %d, got %d", initialStock1.Reserved, finalStock1.Reserved)
+	// Confirming directly fails the same way.
+	rec = httptest.NewRecorder()
+	inventoryMux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reservations/"+createdOrder.ID+"/confirm", nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d when confirming expired reservations, got %d: %s", http.StatusConflict, rec.Code, rec.Body.String())
 	}
 
-	if finalStock2.Available != initialStock2.Available {
-		t.Fatalf("ITEM-002: expected available stock unchanged at %d, got %d", initialStock2.Available, finalStock2.Available)
-	}
-	if finalStock2.Reserved != initialStock2.Reserved {
-		t.Fatalf("ITEM-002: expected reserved stock unchanged at %d, got %d", initialStock2.Reserved, finalStock2.Reserved)
-	}
 	emails := emailCap.getEmails()
-	if len(emails) != 1 {
-		t.Fatalf("expected 1 cancellation email, got %d", len(emails))
+	if len(emails) != 1 || !strings.Contains(emails[0]["subject"], "Cancelled") {
+		t.Fatalf("expected one cancellation email, got %+v", emails)
 	}
 }